@@ -14,6 +14,151 @@ type DexConfig struct {
 	Topic   string  `json:"topic" yaml:"topic"`
 	Factory string  `json:"factory" yaml:"factory"`
 	Fee     float64 `json:"fee,omitempty" yaml:"fee,omitempty"`
+	// stable池的手续费(只用于SolidlyV2类交易所)
+	StableFee float64 `json:"stable_fee,omitempty" yaml:"stable_fee,omitempty"`
+	// 用于验证池地址的init code hash, 为空时不验证
+	InitCodeHash string `json:"init_code_hash,omitempty" yaml:"init_code_hash,omitempty"`
+	// 使用CREATE2部署池的合约地址, 为空时使用factory(如PancakeV3、Algebra使用单独的PoolDeployer)
+	Deployer string `json:"deployer,omitempty" yaml:"deployer,omitempty"`
+}
+
+type MovingBrickConfig struct {
+	// 最小收益(USD), 为0时使用全局的min_profit_usd
+	MinProfitUSD float64 `json:"min_profit_usd,omitempty" yaml:"min_profit_usd,omitempty"`
+}
+
+type MultiHopConfig struct {
+	// 最小收益(USD), 为0时使用全局的min_profit_usd
+	MinProfitUSD float64 `json:"min_profit_usd,omitempty" yaml:"min_profit_usd,omitempty"`
+	// 套利环的最大长度, 默认3
+	MaxHops int `json:"max_hops,omitempty" yaml:"max_hops,omitempty"`
+	// 环上每一步预估的gas, 默认150000
+	GasPerLeg int64 `json:"gas_per_leg,omitempty" yaml:"gas_per_leg,omitempty"`
+}
+
+// Aave V3清算策略的配置
+type LiquidationConfig struct {
+	// Aave V3 Pool合约地址
+	Pool string `json:"pool" yaml:"pool"`
+	// Aave V3 PoolDataProvider合约地址, 用于查询借款人每种资产的存款与债务, 为空时从Pool的ADDRESSES_PROVIDER查询
+	DataProvider string `json:"data_provider,omitempty" yaml:"data_provider,omitempty"`
+	// Aave V3 价格预言机地址, 为空时从Pool的ADDRESSES_PROVIDER查询
+	Oracle string `json:"oracle,omitempty" yaml:"oracle,omitempty"`
+	// 启动时回溯借款人事件的区块数, 为0时只跟踪启动后的事件
+	Lookback uint64 `json:"lookback,omitempty" yaml:"lookback,omitempty"`
+	// 健康因子低于该值的借款人每批事件都检查, 其他借款人每refresh_blocks个区块检查一次, 默认1.05
+	WatchHealthFactor float64 `json:"watch_health_factor,omitempty" yaml:"watch_health_factor,omitempty"`
+	// 默认20
+	RefreshBlocks uint64 `json:"refresh_blocks,omitempty" yaml:"refresh_blocks,omitempty"`
+	// 清算交易预估的gas, 默认800000
+	Gas int64 `json:"gas,omitempty" yaml:"gas,omitempty"`
+	// 最小收益(USD), 为0时使用全局的min_profit_usd
+	MinProfitUSD float64 `json:"min_profit_usd,omitempty" yaml:"min_profit_usd,omitempty"`
+}
+
+type PreflightConfig struct {
+	// 发送真实交易前是否用eth_call预检
+	Enable bool `json:"enable" yaml:"enable"`
+	// 预检返回E/IIA/IL时数量减半重试的次数
+	Resize int `json:"resize,omitempty" yaml:"resize,omitempty"`
+	// 交易gas limit为预估gas的倍数, 默认1.2
+	GasMargin float64 `json:"gas_margin,omitempty" yaml:"gas_margin,omitempty"`
+}
+
+// 超过截止区块仍未打包的交易的处理
+type StuckTxConfig struct {
+	// 是否发送取消交易, 为假时只标记已丢弃的交易
+	Enable bool `json:"enable" yaml:"enable"`
+	// 超过截止区块多少个区块后处理, 也是两次取消之间等待的区块数, 默认3
+	WaitBlocks uint64 `json:"wait_blocks,omitempty" yaml:"wait_blocks,omitempty"`
+	// 取消交易的费用相对上一次出价的倍数, 最小1.125, 默认1.2
+	FeeBump float64 `json:"fee_bump,omitempty" yaml:"fee_bump,omitempty"`
+	// 最多发送取消交易的次数, 默认3
+	MaxAttempts int `json:"max_attempts,omitempty" yaml:"max_attempts,omitempty"`
+}
+
+// 按利润比例出价的gas策略, 价格单位与gas_price相同
+type GasBidPolicy struct {
+	// 愿意支付给gas的毛利润比例, 为0时使用SuggestGasPrice*gas_times
+	ProfitShare float64 `json:"profit_share" yaml:"profit_share"`
+	// 优先费的下限与上限
+	MinPriorityFee float64 `json:"min_priority_fee" yaml:"min_priority_fee"`
+	MaxPriorityFee float64 `json:"max_priority_fee" yaml:"max_priority_fee"`
+	// EIP1559交易的GasFeeCap为base fee的倍数加优先费, 默认2
+	BaseFeeMultiplier float64 `json:"base_fee_multiplier,omitempty" yaml:"base_fee_multiplier,omitempty"`
+}
+
+type GasBidConfig struct {
+	Default GasBidPolicy `json:"default" yaml:"default"`
+	// 按chain id覆盖默认策略
+	Chains map[string]GasBidPolicy `json:"chains,omitempty" yaml:"chains,omitempty"`
+}
+
+// 获取chain id对应的出价策略
+func (c *GasBidConfig) Policy(chainId string) GasBidPolicy {
+	if p, ok := c.Chains[chainId]; ok {
+		return p
+	}
+	return c.Default
+}
+
+// 风控限制, 为0表示不限制
+type RiskConfig struct {
+	// 全局开关, 为真时不发起任何交易
+	KillSwitch bool `json:"kill_switch" yaml:"kill_switch"`
+	// 每小时最多失败的交易数, 超过后熔断
+	MaxFailedPerHour int `json:"max_failed_per_hour,omitempty" yaml:"max_failed_per_hour,omitempty"`
+	// 每天最多消耗的gas(USD), 超过后熔断
+	MaxGasUSDPerDay float64 `json:"max_gas_usd_per_day,omitempty" yaml:"max_gas_usd_per_day,omitempty"`
+	// 每个池在pool_trade_blocks个区块内最多的交易数
+	MaxPoolTrades   int    `json:"max_pool_trades,omitempty" yaml:"max_pool_trades,omitempty"`
+	PoolTradeBlocks uint64 `json:"pool_trade_blocks,omitempty" yaml:"pool_trade_blocks,omitempty"`
+	// 每笔交易base token的最大数量, 键为base token地址
+	MaxNotional map[string]float64 `json:"max_notional,omitempty" yaml:"max_notional,omitempty"`
+	// 熔断后暂停的分钟数, 为0时暂停到重启
+	PauseMinutes int `json:"pause_minutes,omitempty" yaml:"pause_minutes,omitempty"`
+}
+
+type BorrowConfig struct {
+	// 启动时从价格表自动发现借贷池的交易所名称, 池需要支持合约使用的flash接口
+	Dexs []string `json:"dexs,omitempty" yaml:"dexs,omitempty"`
+	// 自动发现的借贷池中base token的最少数量
+	MinLiquidity map[string]float64 `json:"min_liquidity,omitempty" yaml:"min_liquidity,omitempty"`
+}
+
+type PriceOracleConfig struct {
+	// 剔除偏离加权中位数超过该比例的池, 默认0.1
+	MaxDeviation float64 `json:"max_deviation,omitempty" yaml:"max_deviation,omitempty"`
+	// 交易对价格最多落后的区块数, 为0时不检查
+	MaxAge uint64 `json:"max_age,omitempty" yaml:"max_age,omitempty"`
+}
+
+// 套利合约的库存管理
+type InventoryConfig struct {
+	// 每个base token占总资金的目标比例, 键为base token地址, 为空时不管理库存
+	Targets map[string]float64 `json:"targets,omitempty" yaml:"targets,omitempty"`
+	// 合约中base token的目标总价值(USD)
+	CapitalUSD float64 `json:"capital_usd,omitempty" yaml:"capital_usd,omitempty"`
+	// 偏离目标价值超过该比例时调整, 默认0.2
+	Threshold float64 `json:"threshold,omitempty" yaml:"threshold,omitempty"`
+	// 为真时执行调整与提取, 否则只发送建议
+	Execute bool `json:"execute" yaml:"execute"`
+	// 提取利润的地址, 为空时不提取
+	Treasury string `json:"treasury,omitempty" yaml:"treasury,omitempty"`
+	// 检查间隔(分钟), 默认60, 每笔交易确认成功后也会检查
+	Interval int `json:"interval,omitempty" yaml:"interval,omitempty"`
+	// 调整交易允许的滑点, 默认0.01
+	Slippage float64 `json:"slippage,omitempty" yaml:"slippage,omitempty"`
+}
+
+// 历史区块回测配置
+type BacktestConfig struct {
+	// 回测使用的数据库, 默认为<net_name>listener_backtest, 不能与实时运行的数据库相同
+	Database string `json:"database,omitempty" yaml:"database,omitempty"`
+	// 每次eth_getLogs查询的区块数, 默认100
+	LogRange uint64 `json:"log_range,omitempty" yaml:"log_range,omitempty"`
+	// 套利合约owner地址, 与trader_contract都配置时在事件区块上eth_call验证每笔成交
+	From string `json:"from,omitempty" yaml:"from,omitempty"`
 }
 
 type TGConfig struct {
@@ -45,6 +190,18 @@ type Configuration struct {
 		} `json:"gas_token" yaml:"gas_token"`
 		// 配置要使用的base token, 键为base token的地址，值为可以借贷basetoken的交易池
 		BaseTokens map[string][]string `json:"base_tokens" yaml:"base_tokens"`
+		// 借贷池选择配置
+		Borrow BorrowConfig `json:"borrow,omitempty" yaml:"borrow,omitempty"`
+		// 合约最小利润可以低于预估净利润的比例, 默认0.5, 为1时只要求覆盖gas
+		ProfitTolerance float64 `json:"profit_tolerance,omitempty" yaml:"profit_tolerance,omitempty"`
+		// 启用的策略, 为空时只使用moving_brick, 命令行--strategy优先
+		Enabled []string `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+		// 两个池搬砖策略的配置
+		MovingBrick MovingBrickConfig `json:"moving_brick,omitempty" yaml:"moving_brick,omitempty"`
+		// 多跳套利策略的配置
+		MultiHop MultiHopConfig `json:"multi_hop,omitempty" yaml:"multi_hop,omitempty"`
+		// Aave V3清算策略的配置
+		Liquidation LiquidationConfig `json:"liquidation,omitempty" yaml:"liquidation,omitempty"`
 	} `json:"strategies" yaml:"strategies"`
 	// 事件等待时间，单位毫秒
 	EventWaitingTime uint32  `json:"event_waiting_time" yaml:"event_waiting_time"`
@@ -53,20 +210,38 @@ type Configuration struct {
 	GasTimes float64 `json:"gas_times" yaml:"gas_times"`
 	GasLimit uint64  `json:"gas_limit" yaml:"gas_limit"`
 	EIP1559  bool    `json:"eip1559" yaml:"eip1559"`
+	// gas出价策略
+	GasBid GasBidConfig `json:"gas_bid" yaml:"gas_bid"`
+	// base token价格预言机配置
+	PriceOracle PriceOracleConfig `json:"price_oracle" yaml:"price_oracle"`
+	// 库存管理配置
+	Inventory InventoryConfig `json:"inventory" yaml:"inventory"`
+	// 风控配置
+	Risk RiskConfig `json:"risk" yaml:"risk"`
+	// 交易预检配置
+	Preflight PreflightConfig `json:"preflight" yaml:"preflight"`
+	// 卡住的交易的处理配置
+	StuckTx StuckTxConfig `json:"stuck_tx" yaml:"stuck_tx"`
+	// 回测配置
+	Backtest BacktestConfig `json:"backtest" yaml:"backtest"`
 	// 交易合约地址
 	TraderContract string `json:"trader_contract" yaml:"trader_contract"`
 	//基础token的最小储备量，如ETH
 	BaseMinReserve float64 `json:"base_min_reserve" yaml:"base_min_reserve"`
+	// 计算池深度时允许的价格影响, 默认0.01
+	DepthImpact float64 `json:"depth_impact,omitempty" yaml:"depth_impact,omitempty"`
+	// 计算深度用的tick/bin数据缓存的区块数, 默认100
+	DepthCacheBlocks uint64 `json:"depth_cache_blocks,omitempty" yaml:"depth_cache_blocks,omitempty"`
 	// 对批量请求分组时分组的大小
 	ChunkLength int `json:"chunk_length" yaml:"chunk_length"`
 	// 对请求的池数据分组的大小
 	PoolChunkLength int `json:"pool_chunk_length" yaml:"pool_chunk_length"`
 	// 最大并发数据
 	MaxConcurrent int `json:"max_concurrent" yaml:"max_concurrent"`
+	// 每个区块最多发起的套利交易数, 为0时不限制
+	MaxTradesPerBlock int `json:"max_trades_per_block,omitempty" yaml:"max_trades_per_block,omitempty"`
 	// 最小收益,以USD计算
 	MinProfitUSD float64 `json:"min_profit_usd" yaml:"min_profit_usd"`
-	// 为参与交易的basetoken设置倍数
-	DeltaCoefficient float64 `json:"delta_coefficient" yaml:"delta_coefficient"`
 	// TG消息服务配置
 	TG TGConfig `json:"tg" yaml:"tg"`
 	// 是否开起高度
@@ -24,6 +24,12 @@ const (
 	TABLE_PRICE = "prices"
 	// 存储交易的表名
 	TABLE_TRANSACTION = "transactions"
+	// 存储伪造池的表名
+	TABLE_SPOOFED_POOL = "spoofed_pools"
+	// 存储交易预检结果的表名
+	TABLE_PREFLIGHT = "preflights"
+	// 存储竞争者套利交易的表名
+	TABLE_COMPETITOR = "competitors"
 
 	FieldTag = "Database"
 )
@@ -32,6 +38,8 @@ type Actions struct {
 	DB     *mongo.Database
 	Mctx   context.Context
 	Logger logrus.FieldLogger
+	// 为nil时不缓存价格、不检查过期、不经过中转token
+	Oracle *PriceOracle
 }
 
 func (a Actions) InitDataBase() {
@@ -137,6 +145,14 @@ func (a Actions) SavePairs(pairs []dt.Pair) {
 	}
 }
 
+// 清空交易对价格, 回测开始前使用, 避免读到其他区块的价格
+func (a Actions) ClearPairs() error {
+	ctx, cancel := context.WithCancel(a.Mctx)
+	defer cancel()
+	_, err := a.DB.Collection(TABLE_PRICE).DeleteMany(ctx, bson.M{})
+	return err
+}
+
 func (a Actions) SavePair(pool *dt.Pool, price *big.Float, reserve0, reserve1 *big.Int, blockNumber uint64, fee float64, dexName string) (pair dt.Pair) {
 	ctx, cancel := context.WithCancel(a.Mctx)
 	defer cancel()
@@ -309,6 +325,7 @@ func (a Actions) GetPoolsByTokens2(tokens []string) (pools []dt.Pool) {
 			Address: p.Address,
 			Token0:  dt.Token{Address: p.Token0},
 			Token1:  dt.Token{Address: p.Token1},
+			Params:  p.Params,
 		}
 		if a.GetPoolTokens(&pool) {
 			pools = append(pools, pool)
@@ -325,6 +342,67 @@ func (a Actions) SavePools(pools []interface{}) error {
 	return err
 }
 
+func (a Actions) UpdatePoolParams(addr string, params *dt.PoolParams) {
+	ctx, cancel := context.WithCancel(a.Mctx)
+	defer cancel()
+
+	_, err := a.DB.Collection(TABLE_POOL).UpdateOne(ctx,
+		bson.M{"address": addr},
+		bson.D{{Key: "$set", Value: bson.M{"params": params}}})
+	if err != nil {
+		a.Logger.Error("UpdatePoolParams error:", err)
+	}
+}
+
+func (a Actions) SaveSpoofedPool(pool dt.SpoofedPool) {
+	ctx, cancel := context.WithCancel(a.Mctx)
+	defer cancel()
+
+	_, err := a.DB.Collection(TABLE_SPOOFED_POOL).UpdateOne(ctx,
+		bson.M{"address": pool.Address},
+		bson.M{"$set": pool},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		a.Logger.Error("SaveSpoofedPool error:", err)
+	}
+}
+
+func (a Actions) SavePreflight(preflight dt.Preflight) {
+	ctx, cancel := context.WithCancel(a.Mctx)
+	defer cancel()
+	_, err := a.DB.Collection(TABLE_PREFLIGHT).InsertOne(ctx, preflight)
+	if err != nil {
+		a.Logger.WithField(FieldTag, "SavePreflight").Error(err)
+	}
+}
+
+func (a Actions) SaveCompetitor(competitor dt.Competitor) {
+	ctx, cancel := context.WithCancel(a.Mctx)
+	defer cancel()
+	_, err := a.DB.Collection(TABLE_COMPETITOR).UpdateOne(ctx,
+		bson.M{"tx": competitor.Tx, "our_tx": competitor.OurTx},
+		bson.M{"$set": competitor},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		a.Logger.WithField(FieldTag, "SaveCompetitor").Error(err)
+	}
+}
+
+func (a Actions) GetCompetitors(start time.Time, end time.Time) (competitors []dt.Competitor) {
+	ctx, cancel := context.WithCancel(a.Mctx)
+	defer cancel()
+	cur, err := a.DB.Collection(TABLE_COMPETITOR).Find(ctx, bson.M{"created_at": bson.M{"$gte": start, "$lt": end}})
+	if err != nil {
+		a.Logger.WithField(FieldTag, "GetCompetitors").Error(err)
+		return
+	}
+	err = cur.All(ctx, &competitors)
+	if err != nil {
+		a.Logger.WithField(FieldTag, "GetCompetitors").Error(err)
+	}
+	return
+}
+
 func (a Actions) SaveTokens(docs []interface{}) error {
 	ctx, cancel := context.WithCancel(a.Mctx)
 	defer cancel()
@@ -372,6 +450,41 @@ func (a Actions) GetPairsByTokens(tokens []string) (pairs dt.Pairs) {
 	return
 }
 
+func (a Actions) GetPairsWithTokens(tokens []string) (pairs dt.Pairs) {
+	ctx, cancel := context.WithCancel(a.Mctx)
+	defer cancel()
+
+	filter := bson.M{"$or": bson.A{bson.M{"token0": bson.M{"$in": tokens}}, bson.M{"token1": bson.M{"$in": tokens}}}}
+	cur, err := a.DB.Collection(TABLE_PRICE).Find(ctx, filter)
+	if err != nil {
+		a.Logger.WithField(FieldTag, "GetPairsWithTokens").Error(err)
+		return
+	}
+	err = cur.All(ctx, &pairs)
+	if err != nil {
+		a.Logger.WithField(FieldTag, "GetPairsWithTokens").Error(err)
+		return
+	}
+	return
+}
+
+func (a Actions) GetPairs(pools []string) (pairs dt.Pairs) {
+	ctx, cancel := context.WithCancel(a.Mctx)
+	defer cancel()
+
+	cur, err := a.DB.Collection(TABLE_PRICE).Find(ctx, bson.M{"pool": bson.M{"$in": pools}})
+	if err != nil {
+		a.Logger.WithField(FieldTag, "GetPairs").Error(err)
+		return
+	}
+	err = cur.All(ctx, &pairs)
+	if err != nil {
+		a.Logger.WithField(FieldTag, "GetPairs").Error(err)
+		return
+	}
+	return
+}
+
 func (a Actions) GetTransactions(ok bool, confirm bool) (txs []dt.Transaction) {
 	ctx, cancel := context.WithCancel(a.Mctx)
 	defer cancel()
@@ -418,6 +531,40 @@ func (a Actions) UpdateTransaction(hash string, confirm bool, gasUsed, gasPrice
 	}
 }
 
+func (a Actions) SetCancelTransaction(hash, cancelTx string, bid dt.GasBid, blockNumber uint64) {
+	ctx, cancel := context.WithCancel(a.Mctx)
+	defer cancel()
+
+	_, err := a.DB.Collection(TABLE_TRANSACTION).UpdateOne(ctx,
+		bson.M{"tx": hash},
+		bson.M{
+			"$set": bson.M{"cancel_tx": cancelTx, "cancel_bid": bid, "cancel_block": blockNumber},
+			"$inc": bson.M{"cancel_attempts": 1},
+		})
+	if err != nil {
+		a.Logger.WithField(FieldTag, "SetCancelTransaction").Error(err)
+	}
+}
+
+func (a Actions) CloseTransaction(hash, status string, gasUsed, gasPrice uint64) {
+	ctx, cancel := context.WithCancel(a.Mctx)
+	defer cancel()
+
+	_, err := a.DB.Collection(TABLE_TRANSACTION).UpdateOne(ctx,
+		bson.M{"tx": hash},
+		bson.M{"$set": bson.M{
+			"confirm":   true,
+			"ok":        false,
+			"status":    status,
+			"use_gas":   gasUsed,
+			"gas_price": gasPrice,
+			"error":     status,
+		}})
+	if err != nil {
+		a.Logger.WithField(FieldTag, "CloseTransaction").Error(err)
+	}
+}
+
 func (a Actions) GetToken(addr string) (token dt.Token) {
 	ctx, cancel := context.WithCancel(a.Mctx)
 	defer cancel()
@@ -460,7 +607,7 @@ func (a Actions) GetFailTransacttionCount(buyPool, sellPool string) int {
 
 	var txs []dt.Transaction
 	pools := []string{buyPool, sellPool}
-	filter := bson.M{"buy_pool": bson.M{"$in": pools}, "sell_pool": bson.M{"$in": pools}, "ok": false, "confirm": true}
+	filter := bson.M{"buy_pool": bson.M{"$in": pools}, "sell_pool": bson.M{"$in": pools}, "ok": false, "confirm": true, "status": bson.M{"$exists": false}}
 	cur, err := a.DB.Collection(TABLE_TRANSACTION).Find(ctx, filter)
 	if err != nil {
 		a.Logger.WithField(FieldTag, "GetFailTransacttionCount").Error(err)
@@ -493,24 +640,9 @@ func (a Actions) SearchTransacttion(simulation bool, start time.Time, end time.T
 }
 
 func (a Actions) GetBasePrice(baseToken, quoteToken string) (price float64) {
-	data := a.GetPairsByTokens([]string{baseToken, quoteToken})
-	if len(data) < 1 {
-		return
-	}
-	var total float64
-	// 对齐交易对中的币种
-	data = pie.Each(data, func(p *dt.Pair) {
-		if p.Token0 != baseToken {
-			tmpT := p.Token0
-			p.Token0 = p.Token1
-			p.Token1 = tmpT
-			tmpR := p.Reserve0
-			p.Reserve0 = p.Reserve1
-			p.Reserve1 = tmpR
-			p.Price = 1 / p.Price
-		}
-		total += p.Price
-	})
-	price = total / float64(len(data))
-	return
+	return a.Oracle.Price(a, baseToken, quoteToken)
+}
+
+func (a Actions) SetBlockNumber(blockNumber uint64) {
+	a.Oracle.SetBlockNumber(blockNumber)
 }
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/xiangxn/listener/config"
+	dt "github.com/xiangxn/listener/types"
+)
+
+const (
+	// 默认剔除偏离加权中位数超过10%的池
+	DEFAULT_MAX_DEVIATION = 0.1
+)
+
+// base token价格预言机: 按深度加权, 用加权中位数剔除异常池, 不使用过期的交易对
+// 没有直接交易对时经过Via中的token中转, 结果按区块缓存
+type PriceOracle struct {
+	// 偏离加权中位数超过该比例的池不参与计算, 为0时使用DEFAULT_MAX_DEVIATION
+	MaxDeviation float64
+	// 交易对落后当前区块超过MaxAge个区块时不使用, 为0时不检查
+	MaxAge uint64
+	// 中转token
+	Via []string
+
+	blockNumber uint64
+	cache       map[[2]string]float64
+	sync.Mutex
+}
+
+// 根据配置创建预言机, 使用base token与gas token作为中转token
+func NewPriceOracle(cfg config.Configuration) *PriceOracle {
+	via := append(pie.Keys(cfg.Strategies.BaseTokens), cfg.Strategies.GasToken.Base)
+	return &PriceOracle{
+		MaxDeviation: cfg.PriceOracle.MaxDeviation,
+		MaxAge:       cfg.PriceOracle.MaxAge,
+		Via:          pie.Unique(pie.FilterNot(via, func(t string) bool { return t == "" })),
+	}
+}
+
+// 设置当前区块, 区块变化时清空缓存
+func (o *PriceOracle) SetBlockNumber(blockNumber uint64) {
+	if o == nil {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	if blockNumber != o.blockNumber {
+		o.blockNumber = blockNumber
+		o.cache = nil
+	}
+}
+
+// 1 baseToken = N quoteToken
+func (o *PriceOracle) Price(a Actions, baseToken, quoteToken string) (price float64) {
+	if o == nil {
+		return AggregatePrice(a.GetPairsByTokens([]string{baseToken, quoteToken}), baseToken, 0, 0, DEFAULT_MAX_DEVIATION)
+	}
+	key := [2]string{baseToken, quoteToken}
+	o.Lock()
+	if p, ok := o.cache[key]; ok {
+		o.Unlock()
+		return p
+	}
+	blockNumber := o.blockNumber
+	o.Unlock()
+
+	price = o.direct(a, baseToken, quoteToken, blockNumber)
+	if price <= 0 {
+		// 经过中转token的价格取中位数
+		var routes []float64
+		for _, via := range o.Via {
+			if via == baseToken || via == quoteToken {
+				continue
+			}
+			p1 := o.direct(a, baseToken, via, blockNumber)
+			if p1 <= 0 {
+				continue
+			}
+			if p2 := o.direct(a, via, quoteToken, blockNumber); p2 > 0 {
+				routes = append(routes, p1*p2)
+			}
+		}
+		if len(routes) > 0 {
+			price = pie.Median(routes)
+		}
+	}
+
+	o.Lock()
+	if o.cache == nil {
+		o.cache = make(map[[2]string]float64)
+	}
+	if o.blockNumber == blockNumber {
+		o.cache[key] = price
+	}
+	o.Unlock()
+	return
+}
+
+func (o *PriceOracle) direct(a Actions, baseToken, quoteToken string, blockNumber uint64) float64 {
+	maxDeviation := o.MaxDeviation
+	if maxDeviation <= 0 {
+		maxDeviation = DEFAULT_MAX_DEVIATION
+	}
+	return AggregatePrice(a.GetPairsByTokens([]string{baseToken, quoteToken}), baseToken, blockNumber, o.MaxAge, maxDeviation)
+}
+
+type weightedPrice struct {
+	price  float64
+	weight float64
+}
+
+// 汇总交易对中baseToken的价格: 以baseToken的深度为权重, 先求加权中位数,
+// 剔除偏离中位数超过maxDeviation的池后再求加权平均
+// blockNumber与maxAge都大于0时忽略过期的交易对
+func AggregatePrice(pairs dt.Pairs, baseToken string, blockNumber, maxAge uint64, maxDeviation float64) float64 {
+	var prices []weightedPrice
+	for _, p := range pairs {
+		if blockNumber > 0 && maxAge > 0 && p.BlockNumber+maxAge < blockNumber {
+			continue
+		}
+		if p.Price <= 0 || math.IsInf(p.Price, 0) || math.IsNaN(p.Price) {
+			continue
+		}
+		// 对齐交易对中的币种
+		price, weight, reserve := p.Price, p.Depth0, p.Reserve0
+		if p.Token0 != baseToken {
+			price, weight, reserve = 1/p.Price, p.Depth1, p.Reserve1
+		}
+		if weight <= 0 {
+			weight = reserve
+		}
+		if weight <= 0 {
+			continue
+		}
+		prices = append(prices, weightedPrice{price, weight})
+	}
+	if len(prices) == 0 {
+		return 0
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].price < prices[j].price })
+	var total float64
+	for _, p := range prices {
+		total += p.weight
+	}
+	var median, cum float64
+	for _, p := range prices {
+		cum += p.weight
+		if cum >= total/2 {
+			median = p.price
+			break
+		}
+	}
+	var sum, weights float64
+	for _, p := range prices {
+		if math.Abs(p.price/median-1) > maxDeviation {
+			continue
+		}
+		sum += p.price * p.weight
+		weights += p.weight
+	}
+	if weights <= 0 {
+		return median
+	}
+	return sum / weights
+}
@@ -24,14 +24,28 @@ type Aerodrome struct {
 }
 
 func (d *Aerodrome) GetType() uint8      { return 2 }
-func (d *Aerodrome) PriceCallCount() int { return 4 }
+func (d *Aerodrome) PriceCallCount() int { return 3 }
+
+// Slipstream池的手续费可能由动态手续费模块决定, 只缓存tickSpacing
+func (u *Aerodrome) CreateParamsCall(pool *dt.SimplePool) []*multicall.Call {
+	return createTickSpacingCall(u.Abi, pool)
+}
+
+func (u *Aerodrome) SetParams(calls []*multicall.Call, pool *dt.SimplePool) bool {
+	return setTickSpacing(calls, pool)
+}
+
+func (u *Aerodrome) PoolSalt(pool *dt.SimplePool) ([]byte, bool) {
+	if pool.Params == nil {
+		return nil, false
+	}
+	return saltEncoded(pool, int64(pool.Params.TickSpacing)), true
+}
 
 func (u *Aerodrome) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
 	poolContract := multicall.Contract{ABI: u.Abi, Address: common.HexToAddress(pool.Address)}
 	call := poolContract.NewCall(new(dt.ResBigInt), "fee").Name(pool.Address).AllowFailure()
 	calls = append(calls, call)
-	call = poolContract.NewCall(new(dt.ResBigInt), "tickSpacing").Name(pool.Address).AllowFailure()
-	calls = append(calls, call)
 	call = poolContract.NewCall(new(AerodromeSlot0), "slot0").Name(pool.Address).AllowFailure()
 	calls = append(calls, call)
 	call = poolContract.NewCall(new(dt.ResBigInt), "liquidity").Name(pool.Address).AllowFailure()
@@ -40,21 +54,22 @@ func (u *Aerodrome) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
 }
 
 func (u *Aerodrome) CalcPrice(calls []*multicall.Call, blockNumber uint64, pool *dt.Pool) (pair dt.Pair) {
-	if len(calls) == 0 || calls[0].Failed || calls[1].Failed || calls[2].Failed || calls[3].Failed {
+	if len(calls) == 0 || calls[0].Failed || calls[1].Failed || calls[2].Failed || pool.Params == nil {
 		return
 	}
 
-	u.Fee = tools.PreservePrecision(float64(calls[0].Outputs.(*dt.ResBigInt).Uint64())*1e-6, 6)
-	tickSpacing := int32(calls[1].Outputs.(*dt.ResBigInt).Int64())
-	slot0 := calls[2].Outputs.(*AerodromeSlot0)
-	liquidity := calls[3].Outputs.(*dt.ResBigInt).Int
+	fee := tools.PreservePrecision(float64(calls[0].Outputs.(*dt.ResBigInt).Uint64())*1e-6, 6)
+	tickSpacing := pool.Params.TickSpacing
+	slot0 := calls[1].Outputs.(*AerodromeSlot0)
+	liquidity := calls[2].Outputs.(*dt.ResBigInt).Int
 
 	price := CalcPriceV3(slot0.SqrtPriceX96, pool.Token0.Decimals, pool.Token1.Decimals)
 	// Calculate token0 and token1 reserves
 	token0Reserve, token1Reserve := CalcReserveV3(slot0.Tick, tickSpacing, liquidity, slot0.SqrtPriceX96)
 
-	// u.SavePair(pool, price, token0Reserve, token1Reserve, blockNumber, u.Fee)
-	pair = u.CreatePair(pool, price, token0Reserve, token1Reserve, blockNumber, u.Fee)
+	// u.SavePair(pool, price, token0Reserve, token1Reserve, blockNumber, fee)
+	pair = u.CreatePair(pool, price, token0Reserve, token1Reserve, blockNumber, fee)
+	SetDepthV3(&pair, pool, &dt.ConcentratedState{SqrtPriceX96: slot0.SqrtPriceX96, Tick: int32(slot0.Tick.Int64()), Liquidity: liquidity, TickSpacing: tickSpacing, TickBitmap: true}, DepthImpact(u.monitor))
 	u.monitor.Logger().Debug(pool.Token0.Symbol, "/", pool.Token1.Symbol, " price: ", price, " Pool: ", pool.Address,
 		" blockNumber: ", blockNumber, " reserves: ", token0Reserve, token1Reserve, u.Name)
 	return
@@ -0,0 +1,207 @@
+package dex
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/xiangxn/go-multicall"
+
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// Algebra V1(Thena)与Integral v1.0使用的Swap事件
+const ALGEBRA_SWAP_V1_ABI = `[{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"sender","type":"address"},{"indexed":true,"internalType":"address","name":"recipient","type":"address"},{"indexed":false,"internalType":"int256","name":"amount0","type":"int256"},{"indexed":false,"internalType":"int256","name":"amount1","type":"int256"},{"indexed":false,"internalType":"uint160","name":"price","type":"uint160"},{"indexed":false,"internalType":"uint128","name":"liquidity","type":"uint128"},{"indexed":false,"internalType":"int24","name":"tick","type":"int24"}],"name":"Swap","type":"event"}]`
+
+// Algebra Integral v1.2之后的Swap事件, 多了插件覆盖的手续费与插件手续费
+type AlgebraIntegralEvent struct {
+	Sender      common.Address
+	Recipient   common.Address
+	Amount0     *big.Int
+	Amount1     *big.Int
+	Price       *big.Int
+	Liquidity   *big.Int
+	Tick        *big.Int
+	OverrideFee *big.Int
+	PluginFee   *big.Int
+}
+
+type AlgebraIntegralGlobalState struct {
+	Price        *big.Int
+	Tick         *big.Int
+	LastFee      uint16
+	PluginConfig uint8
+	CommunityFee uint16
+	Unlocked     bool
+}
+
+// Algebra V1.9 按方向收费的globalState(如CamelotV3)
+type AlgebraDirectionalGlobalState struct {
+	Price              *big.Int
+	Tick               *big.Int
+	FeeZto             uint16
+	FeeOtz             uint16
+	TimepointIndex     uint16
+	CommunityFeeToken0 uint8
+	CommunityFeeToken1 uint8
+	Unlocked           bool
+}
+
+type ResUint16 struct {
+	Value uint16
+}
+
+// 插件配置中表示动态手续费的标志位
+const ALGEBRA_DYNAMIC_FEE_FLAG = 128
+
+var algebraSwapV1Abi, _ = multicall.ParseABI(ALGEBRA_SWAP_V1_ABI)
+
+// 解码Algebra的Swap事件, 同时支持V1/Integral v1.0与Integral v1.2+两种格式
+// 旧格式中没有的手续费字段为0
+func DecodeAlgebraSwap(vLog types.Log, integralAbi abi.ABI) (event AlgebraIntegralEvent, err error) {
+	if len(vLog.Topics) == 0 {
+		return event, errors.New("no topics")
+	}
+	if ev, ok := integralAbi.Events[DEFAULT_SWAP_NAME]; ok && vLog.Topics[0] == ev.ID {
+		return TryUnpackSwapEvent[AlgebraIntegralEvent](vLog, integralAbi, DEFAULT_SWAP_NAME)
+	}
+	if vLog.Topics[0] != algebraSwapV1Abi.Events[DEFAULT_SWAP_NAME].ID {
+		return event, errors.New("not an algebra swap event")
+	}
+	old, err := TryUnpackSwapEvent[ThenaEvent](vLog, *algebraSwapV1Abi, DEFAULT_SWAP_NAME)
+	if err != nil {
+		return event, err
+	}
+	event.Sender = old.Sender
+	event.Recipient = old.Recipient
+	event.Amount0 = old.Amount0
+	event.Amount1 = old.Amount1
+	event.Price = old.Price
+	event.Liquidity = old.Liquidity
+	event.Tick = old.Tick
+	event.OverrideFee = big.NewInt(0)
+	event.PluginFee = big.NewInt(0)
+	return
+}
+
+// Algebra Integral(如QuickSwap V3新版、Camelot新池), 手续费由插件决定
+type AlgebraIntegral struct {
+	Dex
+}
+
+func (d *AlgebraIntegral) GetType() uint8      { return 4 }
+func (d *AlgebraIntegral) PriceCallCount() int { return 3 }
+
+// tickSpacing在发现池时缓存, 不在每次更新价格时查询
+func (u *AlgebraIntegral) CreateParamsCall(pool *dt.SimplePool) []*multicall.Call {
+	return createTickSpacingCall(u.Abi, pool)
+}
+
+func (u *AlgebraIntegral) SetParams(calls []*multicall.Call, pool *dt.SimplePool) bool {
+	return setTickSpacing(calls, pool)
+}
+
+// 同一个工厂的池可能来自不同版本, 两种Swap事件都需要订阅
+func (d *AlgebraIntegral) SwapTopics() []common.Hash {
+	return []common.Hash{d.Abi.Events[DEFAULT_SWAP_NAME].ID, algebraSwapV1Abi.Events[DEFAULT_SWAP_NAME].ID}
+}
+
+// 只接受可以按任意一种格式解码并且实际发生了兑换的事件
+func (d *AlgebraIntegral) AcceptSwapLog(vLog types.Log) bool {
+	event, err := DecodeAlgebraSwap(vLog, *d.Abi)
+	return err == nil && event.Amount0.Sign() != 0 && event.Amount1.Sign() != 0
+}
+
+// Algebra池的salt为keccak256(abi.encode(token0, token1))
+func (d *AlgebraIntegral) PoolSalt(pool *dt.SimplePool) ([]byte, bool) {
+	return saltEncoded(pool), true
+}
+
+func (u *AlgebraIntegral) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
+	poolContract := multicall.Contract{ABI: u.Abi, Address: common.HexToAddress(pool.Address)}
+	call := poolContract.NewCall(new(AlgebraIntegralGlobalState), "globalState").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	call = poolContract.NewCall(new(dt.ResBigInt), "liquidity").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	// fee()会向插件查询当前手续费, 插件逻辑复杂时可能失败, 失败时使用globalState中的lastFee
+	call = poolContract.NewCall(new(ResUint16), "fee").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	return
+}
+
+func (u *AlgebraIntegral) CalcPrice(calls []*multicall.Call, blockNumber uint64, pool *dt.Pool) (pair dt.Pair) {
+	if len(calls) == 0 || calls[0].Failed || calls[1].Failed || pool.Params == nil || pool.Params.TickSpacing <= 0 {
+		return
+	}
+	state := calls[0].Outputs.(*AlgebraIntegralGlobalState)
+	tickSpacing := pool.Params.TickSpacing
+	liquidity := calls[1].Outputs.(*dt.ResBigInt).Int
+	fee := state.LastFee
+	if state.PluginConfig&ALGEBRA_DYNAMIC_FEE_FLAG != 0 && !calls[2].Failed {
+		fee = calls[2].Outputs.(*ResUint16).Value
+	}
+	feeRate := tools.PreservePrecision(float64(fee)*1e-6, 6)
+
+	price := CalcPriceV3(state.Price, pool.Token0.Decimals, pool.Token1.Decimals)
+	token0Reserve, token1Reserve := CalcReserveV3(state.Tick, tickSpacing, liquidity, state.Price)
+
+	pair = u.CreatePair(pool, price, token0Reserve, token1Reserve, blockNumber, feeRate)
+	SetDepthV3(&pair, pool, &dt.ConcentratedState{SqrtPriceX96: state.Price, Tick: int32(state.Tick.Int64()), Liquidity: liquidity, TickSpacing: tickSpacing}, DepthImpact(u.monitor))
+	u.monitor.Logger().Debug(pool.Token0.Symbol, "/", pool.Token1.Symbol, " price: ", price, " Pool: ", pool.Address,
+		" blockNumber: ", blockNumber, " reserves: ", token0Reserve, token1Reserve, " fee: ", feeRate, u.Name)
+	return
+}
+
+// Algebra V1.9(CamelotV3), 两个方向的手续费不同
+type CamelotV3 struct {
+	Dex
+}
+
+func (d *CamelotV3) GetType() uint8      { return 4 }
+func (d *CamelotV3) PriceCallCount() int { return 2 }
+
+// tickSpacing在发现池时缓存, 不在每次更新价格时查询
+func (u *CamelotV3) CreateParamsCall(pool *dt.SimplePool) []*multicall.Call {
+	return createTickSpacingCall(u.Abi, pool)
+}
+
+func (u *CamelotV3) SetParams(calls []*multicall.Call, pool *dt.SimplePool) bool {
+	return setTickSpacing(calls, pool)
+}
+
+func (d *CamelotV3) PoolSalt(pool *dt.SimplePool) ([]byte, bool) {
+	return saltEncoded(pool), true
+}
+
+func (u *CamelotV3) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
+	poolContract := multicall.Contract{ABI: u.Abi, Address: common.HexToAddress(pool.Address)}
+	call := poolContract.NewCall(new(AlgebraDirectionalGlobalState), "globalState").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	call = poolContract.NewCall(new(dt.ResBigInt), "liquidity").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	return
+}
+
+func (u *CamelotV3) CalcPrice(calls []*multicall.Call, blockNumber uint64, pool *dt.Pool) (pair dt.Pair) {
+	if len(calls) == 0 || calls[0].Failed || calls[1].Failed || pool.Params == nil || pool.Params.TickSpacing <= 0 {
+		return
+	}
+	state := calls[0].Outputs.(*AlgebraDirectionalGlobalState)
+	tickSpacing := pool.Params.TickSpacing
+	liquidity := calls[1].Outputs.(*dt.ResBigInt).Int
+	feeZto := tools.PreservePrecision(float64(state.FeeZto)*1e-6, 6)
+	feeOtz := tools.PreservePrecision(float64(state.FeeOtz)*1e-6, 6)
+
+	price := CalcPriceV3(state.Price, pool.Token0.Decimals, pool.Token1.Decimals)
+	token0Reserve, token1Reserve := CalcReserveV3(state.Tick, tickSpacing, liquidity, state.Price)
+
+	pair = u.CreatePair(pool, price, token0Reserve, token1Reserve, blockNumber, feeZto)
+	pair.Directional, pair.Fee1 = true, feeOtz
+	SetDepthV3(&pair, pool, &dt.ConcentratedState{SqrtPriceX96: state.Price, Tick: int32(state.Tick.Int64()), Liquidity: liquidity, TickSpacing: tickSpacing}, DepthImpact(u.monitor))
+	u.monitor.Logger().Debug(pool.Token0.Symbol, "/", pool.Token1.Symbol, " price: ", price, " Pool: ", pool.Address,
+		" blockNumber: ", blockNumber, " reserves: ", token0Reserve, token1Reserve, " fee: ", feeZto, feeOtz, u.Name)
+	return
+}
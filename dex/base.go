@@ -90,6 +90,8 @@ type Dex struct {
 	Abi     *abi.ABI
 	monitor dt.IMonitor
 	Fee     float64
+	// stable池的手续费(只用于SolidlyV2)
+	StableFee float64
 }
 
 func (d *Dex) GetName() string       { return d.Name }
@@ -111,11 +113,24 @@ func (d *Dex) CreatePair(pool *dt.Pool, price *big.Float, reserve0, reserve1 *bi
 	pair.Token1 = pool.Token1.Address
 	pair.Fee = fee
 	pair.DexName = d.GetName()
+	impact := DepthImpact(d.monitor)
+	pair.Depth0 = CalcDepthV2(pair.Reserve0, impact)
+	pair.Depth1 = CalcDepthV2(pair.Reserve1, impact)
 	return
 }
 
 func (d *Dex) PriceCallCount() int { return 1 }
 
+func (d *Dex) CreateParamsCall(pool *dt.SimplePool) []*multicall.Call { return nil }
+func (d *Dex) SetParams(calls []*multicall.Call, pool *dt.SimplePool) bool {
+	pool.Params = &dt.PoolParams{}
+	return true
+}
+
+func (d *Dex) PoolSalt(pool *dt.SimplePool) ([]byte, bool) {
+	return saltPacked(pool), true
+}
+
 func (d *Dex) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
 	poolContract := multicall.Contract{ABI: d.Abi, Address: common.HexToAddress(pool.Address)}
 	call := poolContract.NewCall(new(reserves), "getReserves").Name(pool.Address).AllowFailure()
@@ -157,7 +172,7 @@ func FixTokenError(m dt.IMonitor, calls []*multicall.Call, msg string) {
 
 // 交易所类型约束,添加新交易所时需要在这里添加类
 type CDex interface {
-	UniswapV2 | UniswapV3 | SushiSwap | PancakeV3 | PancakeV2 | SolidlyV3 | DefiSwap | ShibaSwap | Thena | ApeSwap | Biswap | MDEX | Aerodrome
+	UniswapV2 | UniswapV3 | SushiSwap | PancakeV3 | PancakeV2 | SolidlyV3 | DefiSwap | ShibaSwap | Thena | ApeSwap | Biswap | MDEX | Aerodrome | SolidlyV2 | AlgebraIntegral | CamelotV3 | LiquidityBook | DODO
 }
 
 func GetDex[T CDex](dexConfig config.DexConfig, monitor dt.IMonitor) *T {
@@ -170,11 +185,12 @@ func GetDex[T CDex](dexConfig config.DexConfig, monitor dt.IMonitor) *T {
 	}
 	return &T{
 		Dex: Dex{
-			Name:    dexConfig.Name,
-			Topic:   common.HexToHash(dexConfig.Topic),
-			Abi:     abiPtr,
-			monitor: monitor,
-			Fee:     dexConfig.Fee,
+			Name:      dexConfig.Name,
+			Topic:     common.HexToHash(dexConfig.Topic),
+			Abi:       abiPtr,
+			monitor:   monitor,
+			Fee:       dexConfig.Fee,
+			StableFee: dexConfig.StableFee,
 		},
 	}
 }
@@ -182,10 +198,19 @@ func GetDex[T CDex](dexConfig config.DexConfig, monitor dt.IMonitor) *T {
 const DEFAULT_SWAP_NAME = "Swap"
 
 func UnpackSwapEvent[T any](vLog types.Log, swapAbi abi.ABI, eventName string) T {
+	event, err := TryUnpackSwapEvent[T](vLog, swapAbi, eventName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return event
+}
+
+// 与UnpackSwapEvent相同, 解码失败时返回错误, 用于过滤订阅到的不属于该交易所的事件
+func TryUnpackSwapEvent[T any](vLog types.Log, swapAbi abi.ABI, eventName string) (T, error) {
 	event := new(T)
 	err := swapAbi.UnpackIntoInterface(event, eventName, vLog.Data)
 	if err != nil {
-		log.Fatal(err)
+		return *event, err
 	}
 
 	var indexed abi.Arguments
@@ -194,11 +219,11 @@ func UnpackSwapEvent[T any](vLog types.Log, swapAbi abi.ABI, eventName string) T
 			indexed = append(indexed, arg)
 		}
 	}
-	err = abi.ParseTopics(event, indexed, vLog.Topics[1:])
-	if err != nil {
-		log.Fatal(err)
+	if len(vLog.Topics) != len(indexed)+1 {
+		return *event, fmt.Errorf("unexpected topics count %d", len(vLog.Topics))
 	}
-	return *event
+	err = abi.ParseTopics(event, indexed, vLog.Topics[1:])
+	return *event, err
 }
 
 // 获取交易对token信息
@@ -310,20 +335,37 @@ func FetchPool(m dt.IMonitor, pools []string, factorys []string) (failPool []str
 	m.Logger().WithFields(logrus.Fields{"T": time.Since(t), "CallCount": len(calls)}).Debug("获取新池")
 	var tokens []string
 	var docs []interface{}
+	var found, valid []dt.SimplePool
+	var retry []string
 	resChunk := pie.Chunk(results, 3)
 	for _, res := range resChunk {
 		address := res[0].Contract.Address.Hex()
 		if res[0].Failed || res[1].Failed || res[2].Failed { // 是否有调用链上合约失败
-			failPool = append(failPool, address)
-			m.Logger().WithField("pool", address).Info("获取池信息失败")
-			m.AddPoolBlacklist(address)
+			retry = append(retry, address)
 			continue
 		}
-		doc := dt.SimplePool{
+		found = append(found, dt.SimplePool{
 			Address: address,
+			Factory: res[0].Outputs.(*dt.ResAddress).Hex(),
 			Token0:  res[1].Outputs.(*dt.ResAddress).Address.Hex(),
 			Token1:  res[2].Outputs.(*dt.ResAddress).Address.Hex(),
-		}
+		})
+	}
+	// 非标准池(如LiquidityBook、DODO)再尝试一次
+	lbDocs, lbFail, lbSpoofed := FetchLBPool(m, retry)
+	found = append(found, lbDocs...)
+	for _, address := range lbSpoofed {
+		failPool = append(failPool, address)
+		m.AddPoolBlacklist(address)
+	}
+	dodoDocs, dodoFail := FetchDODOPool(m, lbFail)
+	found = append(found, dodoDocs...)
+	for _, address := range dodoFail {
+		failPool = append(failPool, address)
+		m.Logger().WithField("pool", address).Info("获取池信息失败")
+		m.AddPoolBlacklist(address)
+	}
+	for _, doc := range found {
 		if pie.Contains(m.GetTokenBlacklist(), doc.Token0) { // token0在黑名单中
 			failPool = append(failPool, doc.Address)
 			m.AddPoolBlacklist(doc.Address)
@@ -333,12 +375,25 @@ func FetchPool(m dt.IMonitor, pools []string, factorys []string) (failPool []str
 			m.AddPoolBlacklist(doc.Address)
 			continue
 		}
-		doc.Factory = res[0].Outputs.(*dt.ResAddress).Hex()
 		if !pie.Contains(factorys, doc.Factory) { // 如果工厂地址不在给定的数组中
 			failPool = append(failPool, doc.Address)
 			m.Logger().WithFields(logrus.Fields{"pool": doc.Address, "factory": doc.Factory}).Info("还未支持的交易市场")
 			continue
 		}
+		valid = append(valid, doc)
+	}
+	valid, paramsFail := FetchPoolParams(m, valid)
+	for _, address := range paramsFail {
+		failPool = append(failPool, address)
+		m.Logger().WithField("pool", address).Info("获取池参数失败")
+	}
+	// 用CREATE2地址验证池是否由声明的工厂创建
+	valid, spoofed := VerifyPools(m, valid)
+	for _, address := range spoofed {
+		failPool = append(failPool, address)
+		m.AddPoolBlacklist(address)
+	}
+	for _, doc := range valid {
 		tokens = append(tokens, doc.Token0, doc.Token1)
 		docs = append(docs, doc)
 	}
@@ -372,6 +427,45 @@ func FetchPool(m dt.IMonitor, pools []string, factorys []string) (failPool []str
 	return
 }
 
+// 批量获取池创建后不会改变的参数(手续费档位、tickSpacing、stable标志等)
+// 返回设置了Params的池以及获取失败的池地址
+func FetchPoolParams(m dt.IMonitor, pools []dt.SimplePool) (result []dt.SimplePool, failPool []string) {
+	var calls []*multicall.Call
+	counts := make([]int, len(pools))
+	for i := range pools {
+		pp := m.GetPoolParams(pools[i].Factory)
+		if pp == nil {
+			continue
+		}
+		cs := pp.CreateParamsCall(&pools[i])
+		counts[i] = len(cs)
+		calls = append(calls, cs...)
+	}
+	var err error
+	if len(calls) > 0 {
+		_, err = tools.ConcurrentMulticall(m.Multicall(), nil, calls, m.Config().ChunkLength, m.Config().MaxConcurrent)
+		if err != nil {
+			m.Logger().Error("FetchPoolParams error: ", err)
+		}
+	}
+	offset := 0
+	for i := range pools {
+		pp := m.GetPoolParams(pools[i].Factory)
+		cs := calls[offset : offset+counts[i]]
+		offset += counts[i]
+		if pp == nil || (counts[i] > 0 && err != nil) {
+			failPool = append(failPool, pools[i].Address)
+			continue
+		}
+		if pp.SetParams(cs, &pools[i]) {
+			result = append(result, pools[i])
+		} else {
+			failPool = append(failPool, pools[i].Address)
+		}
+	}
+	return
+}
+
 // 批量从链上获取token信息,返回获取失败的token地址
 func BatchToken(m dt.IMonitor, tokens []string) (result []string) {
 	ts := CheckTokens(m, tokens)
@@ -520,6 +614,7 @@ func GetFactory(m dt.IMonitor, pool string) *dt.Pool {
 		result.Address = tp.Address
 		result.Token0 = dt.Token{Address: tp.Token0}
 		result.Token1 = dt.Token{Address: tp.Token1}
+		result.Params = tp.Params
 		if GetPoolTokens(m, &result) {
 			return &result
 		}
@@ -0,0 +1,315 @@
+package dex
+
+import (
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/xiangxn/go-multicall"
+
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// 只包含计算深度需要的字段, ticks的前两个返回值在各Uniswap V3分支中都相同
+const TICK_DATA_ABI = `[{"inputs":[{"internalType":"int16","name":"","type":"int16"}],"name":"tickBitmap","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"int24","name":"","type":"int24"}],"name":"ticks","outputs":[{"internalType":"uint128","name":"liquidityGross","type":"uint128"},{"internalType":"int128","name":"liquidityNet","type":"int128"}],"stateMutability":"view","type":"function"}]`
+
+const DEFAULT_DEPTH_IMPACT = 0.01
+
+// 计算深度用的链上数据默认缓存的区块数, 超过后重新获取以反映流动性的增减
+const DEPTH_CACHE_BLOCKS = 100
+
+type TickLiquidity struct {
+	LiquidityGross *big.Int
+	LiquidityNet   *big.Int
+}
+
+var tickDataAbi *abi.ABI
+
+// 配置的价格影响
+func DepthImpact(m dt.IMonitor) float64 {
+	impact := m.Config().DepthImpact
+	if impact <= 0 || impact >= 1 {
+		return DEFAULT_DEPTH_IMPACT
+	}
+	return impact
+}
+
+// 配置的深度数据缓存区块数
+func DepthCacheBlocks(m dt.IMonitor) uint64 {
+	if blocks := m.Config().DepthCacheBlocks; blocks > 0 {
+		return blocks
+	}
+	return DEPTH_CACHE_BLOCKS
+}
+
+// 恒定乘积池在价格影响impact内可卖入的数量: reserve*(1/sqrt(1-impact)-1)
+func CalcDepthV2(reserve, impact float64) float64 {
+	return reserve * (1/math.Sqrt(1-impact) - 1)
+}
+
+// 集中流动性池在价格影响impact内可卖入的token0/token1数量
+// ticks为范围内已初始化tick的liquidityNet, 为nil时只按当前活跃流动性计算
+func CalcDepthV3(state *dt.ConcentratedState, ticks map[int32]*big.Int, impact float64) (depth0, depth1 *big.Int) {
+	sqrtPrice := new(big.Float).SetInt(state.SqrtPriceX96)
+	factor := math.Sqrt(1 - impact)
+	lowerTarget := tools.ToBigInt(new(big.Float).Mul(sqrtPrice, big.NewFloat(factor)))
+	upperTarget := tools.ToBigInt(new(big.Float).Quo(sqrtPrice, big.NewFloat(factor)))
+
+	var ids []int32
+	for id := range ticks {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// 卖出token0, 价格向下移动, 向下跨过tick时减去liquidityNet
+	depth0 = big.NewInt(0)
+	liquidity := new(big.Int).Set(state.Liquidity)
+	current := state.SqrtPriceX96
+	for i := len(ids) - 1; i >= 0; i-- {
+		if ids[i] > state.Tick {
+			continue
+		}
+		boundary := TickToSqrtPriceQ96(int64(ids[i]))
+		if boundary.Cmp(lowerTarget) <= 0 {
+			break
+		}
+		if liquidity.Sign() > 0 {
+			depth0.Add(depth0, CalcAmount0Delta(liquidity, boundary, current, false))
+		}
+		liquidity = new(big.Int).Sub(liquidity, ticks[ids[i]])
+		current = boundary
+	}
+	if liquidity.Sign() > 0 && current.Cmp(lowerTarget) > 0 {
+		depth0.Add(depth0, CalcAmount0Delta(liquidity, lowerTarget, current, false))
+	}
+
+	// 卖出token1, 价格向上移动, 向上跨过tick时加上liquidityNet
+	depth1 = big.NewInt(0)
+	liquidity = new(big.Int).Set(state.Liquidity)
+	current = state.SqrtPriceX96
+	for _, id := range ids {
+		if id <= state.Tick {
+			continue
+		}
+		boundary := TickToSqrtPriceQ96(int64(id))
+		if boundary.Cmp(upperTarget) >= 0 {
+			break
+		}
+		if liquidity.Sign() > 0 {
+			depth1.Add(depth1, CalcAmount1Delta(liquidity, current, boundary, false))
+		}
+		liquidity = new(big.Int).Add(liquidity, ticks[id])
+		current = boundary
+	}
+	if liquidity.Sign() > 0 && current.Cmp(upperTarget) < 0 {
+		depth1.Add(depth1, CalcAmount1Delta(liquidity, current, upperTarget, false))
+	}
+	return
+}
+
+// 按当前活跃流动性设置集中流动性池的深度, 并记录状态用于后面按tick数据重新计算
+// 没有tick数据时假设深度范围内流动性不变
+func SetDepthV3(pair *dt.Pair, pool *dt.Pool, state *dt.ConcentratedState, impact float64) {
+	state.Decimals0 = pool.Token0.Decimals
+	state.Decimals1 = pool.Token1.Decimals
+	pair.State = state
+	pair.Curve = dt.CURVE_CONCENTRATED
+	depth0, depth1 := CalcDepthV3(state, nil, impact)
+	pair.Depth0 = tools.BigIntToFloat64(depth0, pool.Token0.Decimals)
+	pair.Depth1 = tools.BigIntToFloat64(depth1, pool.Token1.Decimals)
+	lower, upper := depthTickRange(state.Tick, impact)
+	pair.Ticks = NewTickCurve(state, nil, lower, upper)
+}
+
+// 按小数位调整后的报价状态, ticks为[lower, upper]内已初始化tick的liquidityNet
+func NewTickCurve(state *dt.ConcentratedState, ticks map[int32]*big.Int, lower, upper int32) *dt.TickCurve {
+	scale := math.Pow(10, (float64(state.Decimals0)-float64(state.Decimals1))/2)
+	unit := math.Pow(10, (float64(state.Decimals0)+float64(state.Decimals1))/2)
+	sqrtPrice := func(x96 *big.Int) float64 {
+		f, _ := new(big.Float).Quo(new(big.Float).SetInt(x96), new(big.Float).SetInt(Q96)).Float64()
+		return f * scale
+	}
+	liquidity := func(l *big.Int) float64 {
+		f, _ := new(big.Float).SetInt(l).Float64()
+		return f / unit
+	}
+	curve := &dt.TickCurve{
+		Tick:      state.Tick,
+		SqrtPrice: sqrtPrice(state.SqrtPriceX96),
+		Liquidity: liquidity(state.Liquidity),
+		Lower:     sqrtPrice(TickToSqrtPriceQ96(int64(lower))),
+		Upper:     sqrtPrice(TickToSqrtPriceQ96(int64(upper))),
+	}
+	for _, id := range pie.Sort(pie.Keys(ticks)) {
+		if id < lower || id > upper {
+			continue
+		}
+		curve.Ticks = append(curve.Ticks, dt.TickCurveStep{Tick: id, SqrtPrice: sqrtPrice(TickToSqrtPriceQ96(int64(id))), LiquidityNet: liquidity(ticks[id])})
+	}
+	return curve
+}
+
+// 价格影响范围覆盖的tick区间
+func depthTickRange(tick int32, impact float64) (lower, upper int32) {
+	delta := int32(math.Ceil(-math.Log(1-impact)/math.Log(1.0001))) + 1
+	return tick - delta, tick + delta
+}
+
+func floorDiv(a, b int32) int32 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// 计算深度用的tick缓存, 按两倍的价格影响范围获取, 当前tick超出缓存范围或缓存过期后重新获取
+type tickCache struct {
+	lower int32
+	upper int32
+	block uint64
+	ticks map[int32]*big.Int
+}
+
+var tickCaches = struct {
+	pools map[string]*tickCache
+	sync.Mutex
+}{pools: make(map[string]*tickCache)}
+
+// 缓存覆盖深度范围并且没有过期时返回缓存
+func cachedTicks(pool string, tick int32, impact float64, blockNumber, cacheBlocks uint64) (*tickCache, bool) {
+	tickCaches.Lock()
+	defer tickCaches.Unlock()
+	c := tickCaches.pools[pool]
+	if c == nil || blockNumber < c.block || blockNumber >= c.block+cacheBlocks {
+		return nil, false
+	}
+	lower, upper := depthTickRange(tick, impact)
+	if lower < c.lower || upper > c.upper {
+		return nil, false
+	}
+	return c, true
+}
+
+// 通过tickBitmap与ticks获取价格影响范围内已初始化的tick, 重新计算集中流动性池的深度
+// tick数据按池缓存, 只对当前tick超出缓存范围或缓存过期的池发起调用
+func CalcTickDepth(m dt.IMonitor, pairs []dt.Pair) {
+	if tickDataAbi == nil {
+		tickDataAbi, _ = multicall.ParseABI(TICK_DATA_ABI)
+	}
+	impact := DepthImpact(m)
+	cacheBlocks := DepthCacheBlocks(m)
+	// 缓存的范围是两倍的价格影响范围
+	cacheImpact := 1 - (1-impact)*(1-impact)
+	type wordRef struct {
+		index int
+		word  int16
+	}
+	var calls []*multicall.Call
+	var refs []wordRef
+	fetch := make(map[int]bool)
+	for i := range pairs {
+		state := pairs[i].State
+		if state == nil || !state.TickBitmap || state.TickSpacing <= 0 {
+			continue
+		}
+		if c, ok := cachedTicks(pairs[i].Pool, state.Tick, impact, pairs[i].BlockNumber, cacheBlocks); ok {
+			setTickDepth(&pairs[i], c, impact)
+			continue
+		}
+		fetch[i] = true
+		lower, upper := depthTickRange(state.Tick, cacheImpact)
+		contract := multicall.Contract{ABI: tickDataAbi, Address: common.HexToAddress(pairs[i].Pool)}
+		for w := floorDiv(lower, state.TickSpacing) >> 8; w <= floorDiv(upper, state.TickSpacing)>>8; w++ {
+			calls = append(calls, contract.NewCall(new(dt.ResBigInt), "tickBitmap", int16(w)).AllowFailure())
+			refs = append(refs, wordRef{index: i, word: int16(w)})
+		}
+	}
+	if len(calls) == 0 {
+		return
+	}
+	_, err := tools.ConcurrentMulticall(m.Multicall(), m.CallOpts(), calls, m.Config().ChunkLength, m.Config().MaxConcurrent)
+	if err != nil {
+		m.Logger().Error("CalcTickDepth error: ", err)
+		return
+	}
+
+	type tickRef struct {
+		index int
+		tick  int32
+	}
+	var tickCalls []*multicall.Call
+	var tickRefs []tickRef
+	for n, c := range calls {
+		if c.Failed {
+			// 有失败的word时不缓存这个池
+			delete(fetch, refs[n].index)
+			continue
+		}
+		bitmap := c.Outputs.(*dt.ResBigInt).Int
+		if bitmap == nil || bitmap.Sign() == 0 {
+			continue
+		}
+		ref := refs[n]
+		state := pairs[ref.index].State
+		lower, upper := depthTickRange(state.Tick, cacheImpact)
+		contract := multicall.Contract{ABI: tickDataAbi, Address: common.HexToAddress(pairs[ref.index].Pool)}
+		for bit := 0; bit < 256; bit++ {
+			if bitmap.Bit(bit) == 0 {
+				continue
+			}
+			tick := (int32(ref.word)*256 + int32(bit)) * state.TickSpacing
+			if tick < lower || tick > upper {
+				continue
+			}
+			tickCalls = append(tickCalls, contract.NewCall(new(TickLiquidity), "ticks", big.NewInt(int64(tick))).AllowFailure())
+			tickRefs = append(tickRefs, tickRef{index: ref.index, tick: tick})
+		}
+	}
+	if len(tickCalls) > 0 {
+		_, err = tools.ConcurrentMulticall(m.Multicall(), m.CallOpts(), tickCalls, m.Config().ChunkLength, m.Config().MaxConcurrent)
+		if err != nil {
+			m.Logger().Error("CalcTickDepth error: ", err)
+			return
+		}
+	}
+	ticks := make(map[int]map[int32]*big.Int)
+	for index := range fetch {
+		ticks[index] = make(map[int32]*big.Int)
+	}
+	for n, c := range tickCalls {
+		ref := tickRefs[n]
+		if c.Failed {
+			delete(fetch, ref.index)
+			continue
+		}
+		if ticks[ref.index] == nil {
+			ticks[ref.index] = make(map[int32]*big.Int)
+		}
+		ticks[ref.index][ref.tick] = c.Outputs.(*TickLiquidity).LiquidityNet
+	}
+	tickCaches.Lock()
+	defer tickCaches.Unlock()
+	for index, ts := range ticks {
+		pair := &pairs[index]
+		lower, upper := depthTickRange(pair.State.Tick, cacheImpact)
+		c := &tickCache{lower: lower, upper: upper, block: pair.BlockNumber, ticks: ts}
+		setTickDepth(pair, c, impact)
+		if fetch[index] {
+			tickCaches.pools[pair.Pool] = c
+		}
+	}
+}
+
+// 用tick数据设置深度与报价用的tick, 报价范围是缓存的范围
+func setTickDepth(pair *dt.Pair, c *tickCache, impact float64) {
+	depth0, depth1 := CalcDepthV3(pair.State, c.ticks, impact)
+	pair.Depth0 = tools.BigIntToFloat64(depth0, pair.State.Decimals0)
+	pair.Depth1 = tools.BigIntToFloat64(depth1, pair.State.Decimals1)
+	pair.Ticks = NewTickCurve(pair.State, c.ticks, c.lower, c.upper)
+}
@@ -0,0 +1,482 @@
+package dex
+
+import (
+	"math"
+	"math/big"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/xiangxn/go-multicall"
+
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// DODO V2 PMM池(DVM/DSP/DPP), base token作为token0, quote token作为token1
+// 价格由预言机价格i、曲线参数K以及base/quote的目标值决定
+type DODO struct {
+	Dex
+}
+
+const DODO_SWAP_NAME = "DODOSwap"
+
+type DODOSwapEvent struct {
+	FromToken  common.Address
+	ToToken    common.Address
+	FromAmount *big.Int
+	ToAmount   *big.Int
+	Trader     common.Address
+	Receiver   common.Address
+}
+
+// getPMMStateForCall的返回值, B0/Q0已由合约调整为当前目标值
+type PMMState struct {
+	I  *big.Int
+	K  *big.Int
+	B  *big.Int
+	Q  *big.Int
+	B0 *big.Int
+	Q0 *big.Int
+	R  *big.Int
+}
+
+type DODOFeeRate struct {
+	LpFeeRate *big.Int
+	MtFeeRate *big.Int
+}
+
+type ResAddresses struct {
+	Addresses []common.Address
+}
+
+// PMM的R状态
+const (
+	DODO_R_ONE       = 0
+	DODO_R_ABOVE_ONE = 1
+	DODO_R_BELOW_ONE = 2
+)
+
+const DODO_POOL_ABI = `[{"inputs":[],"name":"_BASE_TOKEN_","outputs":[{"internalType":"contract IERC20","name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"_QUOTE_TOKEN_","outputs":[{"internalType":"contract IERC20","name":"","type":"address"}],"stateMutability":"view","type":"function"}]`
+
+// DVM/DSP/DPP工厂通过getDODOPool查询已创建的池
+const DODO_FACTORY_ABI = `[{"inputs":[{"internalType":"address","name":"baseToken","type":"address"},{"internalType":"address","name":"quoteToken","type":"address"}],"name":"getDODOPool","outputs":[{"internalType":"address[]","name":"machines","type":"address[]"}],"stateMutability":"view","type":"function"}]`
+
+func (d *DODO) GetType() uint8      { return 8 }
+func (d *DODO) PriceCallCount() int { return 2 }
+
+// 池是clone创建的, 不做CREATE2验证
+func (d *DODO) PoolSalt(pool *dt.SimplePool) ([]byte, bool) { return nil, false }
+
+// 池的兑换事件是DODOSwap, 不是配置中通用的Swap
+func (d *DODO) SwapTopics() []common.Hash {
+	return []common.Hash{d.Abi.Events[DODO_SWAP_NAME].ID}
+}
+
+// 只接受可以解码并且实际发生了兑换的DODOSwap事件
+func (d *DODO) AcceptSwapLog(vLog types.Log) bool {
+	if len(vLog.Topics) == 0 || vLog.Topics[0] != d.Abi.Events[DODO_SWAP_NAME].ID {
+		return false
+	}
+	event, err := TryUnpackSwapEvent[DODOSwapEvent](vLog, *d.Abi, DODO_SWAP_NAME)
+	return err == nil && event.FromAmount.Sign() > 0 && event.ToAmount.Sign() > 0
+}
+
+func (u *DODO) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
+	poolContract := multicall.Contract{ABI: u.Abi, Address: common.HexToAddress(pool.Address)}
+	call := poolContract.NewCall(new(PMMState), "getPMMStateForCall").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	// mtFee可能按交易者收费, 使用交易合约地址查询
+	call = poolContract.NewCall(new(DODOFeeRate), "getUserFeeRate", common.HexToAddress(u.monitor.Config().TraderContract)).Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	return
+}
+
+func (u *DODO) CalcPrice(calls []*multicall.Call, blockNumber uint64, pool *dt.Pool) (pair dt.Pair) {
+	if len(calls) == 0 || calls[0].Failed || calls[1].Failed {
+		return
+	}
+	state := calls[0].Outputs.(*PMMState)
+	feeRate := calls[1].Outputs.(*DODOFeeRate)
+	fee := new(big.Int).Add(feeRate.LpFeeRate, feeRate.MtFeeRate)
+	feeFloat := tools.PreservePrecision(tools.BigIntToFloat64(fee, 18), 6)
+
+	price := CalcPriceDODO(state, pool.Token0.Decimals, pool.Token1.Decimals)
+	pair = u.CreatePair(pool, price, state.B, state.Q, blockNumber, feeFloat)
+	pair.Curve = dt.CURVE_PMM
+	pair.PMM = NewPMMCurve(state, pool.Token0.Decimals, pool.Token1.Decimals)
+	depth0, depth1 := CalcDepthDODO(state, DepthImpact(u.monitor))
+	pair.Depth0 = tools.BigIntToFloat64(depth0, pool.Token0.Decimals)
+	pair.Depth1 = tools.BigIntToFloat64(depth1, pool.Token1.Decimals)
+	u.monitor.Logger().Debug(pool.Token0.Symbol, "/", pool.Token1.Symbol, " price: ", price, " Pool: ", pool.Address,
+		" blockNumber: ", blockNumber, " reserves: ", state.B, state.Q, " R: ", state.R, " fee: ", feeFloat, u.Name)
+	return
+}
+
+// 计算PMM的中间价(统一以token1除以token0表示价格), 与合约getMidPrice一致
+func CalcPriceDODO(state *PMMState, baseDecimals, quoteDecimals uint64) (price *big.Float) {
+	mid := GetMidPriceDODO(state)
+	price = new(big.Float).Quo(new(big.Float).SetInt(mid), new(big.Float).SetInt(e18))
+	decimalsDiff := int64(baseDecimals) - int64(quoteDecimals)
+	adjustmentFactor := new(big.Float)
+	if decimalsDiff >= 0 {
+		adjustmentFactor.SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(decimalsDiff), nil))
+		price.Mul(price, adjustmentFactor)
+	} else {
+		adjustmentFactor.SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(-decimalsDiff), nil))
+		price.Quo(price, adjustmentFactor)
+	}
+	return
+}
+
+// 原始数量表示的中间价(1e18精度)
+func GetMidPriceDODO(state *PMMState) *big.Int {
+	if state.R.Int64() == DODO_R_BELOW_ONE {
+		if state.Q.Sign() == 0 {
+			return big.NewInt(0)
+		}
+		r := dodoDivFloor(new(big.Int).Div(new(big.Int).Mul(state.Q0, state.Q0), state.Q), state.Q)
+		r = new(big.Int).Add(new(big.Int).Sub(e18, state.K), dodoMulFloor(state.K, r))
+		return dodoDivFloor(state.I, r)
+	}
+	if state.B.Sign() == 0 {
+		return big.NewInt(0)
+	}
+	r := dodoDivFloor(new(big.Int).Div(new(big.Int).Mul(state.B0, state.B0), state.B), state.B)
+	r = new(big.Int).Add(new(big.Int).Sub(e18, state.K), dodoMulFloor(state.K, r))
+	return dodoMulFloor(state.I, r)
+}
+
+// 按小数位调整后的PMM曲线参数, 用于策略中报价
+func NewPMMCurve(state *PMMState, baseDecimals, quoteDecimals uint64) *dt.PMMCurve {
+	return &dt.PMMCurve{
+		I:  tools.BigIntToFloat64(state.I, 18) * math.Pow10(int(baseDecimals)-int(quoteDecimals)),
+		K:  tools.BigIntToFloat64(state.K, 18),
+		B:  tools.BigIntToFloat64(state.B, baseDecimals),
+		Q:  tools.BigIntToFloat64(state.Q, quoteDecimals),
+		B0: tools.BigIntToFloat64(state.B0, baseDecimals),
+		Q0: tools.BigIntToFloat64(state.Q0, quoteDecimals),
+		R:  uint8(state.R.Uint64()),
+	}
+}
+
+// 价格影响impact内可卖入的base/quote数量(不含手续费)
+// 用QuerySellBase/QuerySellQuote计算交易后的状态, 二分查找交易后中间价变化不超过impact的最大数量
+func CalcDepthDODO(state *PMMState, impact float64) (depth0, depth1 *big.Int) {
+	mid := GetMidPriceDODO(state)
+	if mid.Sign() == 0 {
+		return big.NewInt(0), big.NewInt(0)
+	}
+	lower := tools.ToBigInt(new(big.Float).Mul(new(big.Float).SetInt(mid), big.NewFloat(1-impact)))
+	upper := tools.ToBigInt(new(big.Float).Quo(new(big.Float).SetInt(mid), big.NewFloat(1-impact)))
+	zero := big.NewInt(0)
+	depth0 = dodoMaxAmount(state.B, func(amount *big.Int) bool {
+		receive := QuerySellBase(state, amount, zero, zero)
+		if receive.Cmp(state.Q) >= 0 {
+			return false
+		}
+		after := *state
+		after.B = new(big.Int).Add(state.B, amount)
+		after.Q = new(big.Int).Sub(state.Q, receive)
+		// 卖出base后只有原来base不足并且没有超过目标值时不变为quote不足
+		after.R = big.NewInt(DODO_R_BELOW_ONE)
+		if state.R.Int64() == DODO_R_ABOVE_ONE {
+			switch after.B.Cmp(state.B0) {
+			case -1:
+				after.R = big.NewInt(DODO_R_ABOVE_ONE)
+			case 0:
+				after.R = big.NewInt(DODO_R_ONE)
+			}
+		}
+		return GetMidPriceDODO(&after).Cmp(lower) >= 0
+	})
+	depth1 = dodoMaxAmount(state.Q, func(amount *big.Int) bool {
+		receive := QuerySellQuote(state, amount, zero, zero)
+		if receive.Cmp(state.B) >= 0 {
+			return false
+		}
+		after := *state
+		after.B = new(big.Int).Sub(state.B, receive)
+		after.Q = new(big.Int).Add(state.Q, amount)
+		after.R = big.NewInt(DODO_R_ABOVE_ONE)
+		if state.R.Int64() == DODO_R_BELOW_ONE {
+			switch after.Q.Cmp(state.Q0) {
+			case -1:
+				after.R = big.NewInt(DODO_R_BELOW_ONE)
+			case 0:
+				after.R = big.NewInt(DODO_R_ONE)
+			}
+		}
+		return GetMidPriceDODO(&after).Cmp(upper) <= 0
+	})
+	return
+}
+
+// 满足ok的最大数量(ok对数量单调), 从start开始倍增确定上界后二分查找, 精度为结果的百万分之一
+func dodoMaxAmount(start *big.Int, ok func(amount *big.Int) bool) *big.Int {
+	lo, hi := big.NewInt(0), new(big.Int).Set(start)
+	if hi.Sign() <= 0 {
+		return lo
+	}
+	for i := 0; i < 64 && ok(hi); i++ {
+		lo.Set(hi)
+		hi.Lsh(hi, 1)
+	}
+	for i := 0; i < 128 && new(big.Int).Sub(hi, lo).Cmp(new(big.Int).Div(lo, big.NewInt(1e6))) > 0; i++ {
+		mid := new(big.Int).Rsh(new(big.Int).Add(lo, hi), 1)
+		if ok(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// 与池合约querySellBase一致, 返回扣除lp与mt手续费后得到的quote数量
+func QuerySellBase(state *PMMState, payBaseAmount, lpFeeRate, mtFeeRate *big.Int) *big.Int {
+	receiveQuote := sellBaseToken(state, payBaseAmount)
+	return deductDODOFee(receiveQuote, lpFeeRate, mtFeeRate)
+}
+
+// 与池合约querySellQuote一致, 返回扣除lp与mt手续费后得到的base数量
+func QuerySellQuote(state *PMMState, payQuoteAmount, lpFeeRate, mtFeeRate *big.Int) *big.Int {
+	receiveBase := sellQuoteToken(state, payQuoteAmount)
+	return deductDODOFee(receiveBase, lpFeeRate, mtFeeRate)
+}
+
+func deductDODOFee(amount, lpFeeRate, mtFeeRate *big.Int) *big.Int {
+	result := new(big.Int).Sub(amount, dodoMulFloor(amount, lpFeeRate))
+	result.Sub(result, dodoMulFloor(amount, mtFeeRate))
+	if result.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	return result
+}
+
+func sellBaseToken(state *PMMState, payBaseAmount *big.Int) (receiveQuoteAmount *big.Int) {
+	switch state.R.Int64() {
+	case DODO_R_ONE:
+		return dodoSolveQuadratic(state.Q0, state.Q0, payBaseAmount, state.I, state.K)
+	case DODO_R_ABOVE_ONE:
+		backToOnePayBase := new(big.Int).Sub(state.B0, state.B)
+		backToOneReceiveQuote := new(big.Int).Sub(state.Q, state.Q0)
+		switch payBaseAmount.Cmp(backToOnePayBase) {
+		case -1:
+			receiveQuoteAmount = dodoGeneralIntegrate(state.B0, new(big.Int).Add(state.B, payBaseAmount), state.B, state.I, state.K)
+			if receiveQuoteAmount.Cmp(backToOneReceiveQuote) > 0 {
+				receiveQuoteAmount = backToOneReceiveQuote
+			}
+			return
+		case 0:
+			return backToOneReceiveQuote
+		default:
+			rest := dodoSolveQuadratic(state.Q0, state.Q0, new(big.Int).Sub(payBaseAmount, backToOnePayBase), state.I, state.K)
+			return rest.Add(rest, backToOneReceiveQuote)
+		}
+	default:
+		return dodoSolveQuadratic(state.Q0, state.Q, payBaseAmount, state.I, state.K)
+	}
+}
+
+func sellQuoteToken(state *PMMState, payQuoteAmount *big.Int) (receiveBaseAmount *big.Int) {
+	reciprocalI := dodoReciprocalFloor(state.I)
+	switch state.R.Int64() {
+	case DODO_R_ONE:
+		return dodoSolveQuadratic(state.B0, state.B0, payQuoteAmount, reciprocalI, state.K)
+	case DODO_R_ABOVE_ONE:
+		return dodoSolveQuadratic(state.B0, state.B, payQuoteAmount, reciprocalI, state.K)
+	default:
+		backToOnePayQuote := new(big.Int).Sub(state.Q0, state.Q)
+		backToOneReceiveBase := new(big.Int).Sub(state.B, state.B0)
+		switch payQuoteAmount.Cmp(backToOnePayQuote) {
+		case -1:
+			receiveBaseAmount = dodoGeneralIntegrate(state.Q0, new(big.Int).Add(state.Q, payQuoteAmount), state.Q, reciprocalI, state.K)
+			if receiveBaseAmount.Cmp(backToOneReceiveBase) > 0 {
+				receiveBaseAmount = backToOneReceiveBase
+			}
+			return
+		case 0:
+			return backToOneReceiveBase
+		default:
+			rest := dodoSolveQuadratic(state.B0, state.B0, new(big.Int).Sub(payQuoteAmount, backToOnePayQuote), reciprocalI, state.K)
+			return rest.Add(rest, backToOneReceiveBase)
+		}
+	}
+}
+
+// DODOMath._GeneralIntegrate
+// res = (1-k)i(V1-V2)+ikV0*V0(1/V2-1/V1)
+func dodoGeneralIntegrate(v0, v1, v2, i, k *big.Int) *big.Int {
+	if v0.Sign() == 0 || v2.Sign() == 0 {
+		return big.NewInt(0)
+	}
+	fairAmount := new(big.Int).Mul(i, new(big.Int).Sub(v1, v2))
+	if k.Sign() == 0 {
+		return fairAmount.Div(fairAmount, e18)
+	}
+	v0v0v1v2 := dodoDivFloor(new(big.Int).Div(new(big.Int).Mul(v0, v0), v1), v2)
+	penalty := dodoMulFloor(k, v0v0v1v2)
+	result := new(big.Int).Add(new(big.Int).Sub(e18, k), penalty)
+	result.Mul(result, fairAmount)
+	return result.Div(result, new(big.Int).Mul(e18, e18))
+}
+
+// DODOMath._SolveQuadraticFunctionForTrade
+// 求解 (1-k)V2^2 + (kV0^2/V1 - iΔ - (1-k)V1)V2 - kV0^2 = 0, 返回V1-V2
+func dodoSolveQuadratic(v0, v1, delta, i, k *big.Int) *big.Int {
+	if v0.Sign() == 0 || v1.Sign() == 0 || delta.Sign() == 0 {
+		return big.NewInt(0)
+	}
+	if k.Sign() == 0 {
+		amount := dodoMulFloor(i, delta)
+		if amount.Cmp(v1) > 0 {
+			return new(big.Int).Set(v1)
+		}
+		return amount
+	}
+	if k.Cmp(e18) == 0 {
+		// k=1时 V2=V1/(1+iΔV1/V0/V0)
+		temp := new(big.Int).Mul(new(big.Int).Mul(i, delta), v1)
+		temp.Div(temp, new(big.Int).Mul(v0, v0))
+		result := new(big.Int).Mul(v1, temp)
+		return result.Div(result, new(big.Int).Add(temp, e18))
+	}
+	part2 := new(big.Int).Mul(new(big.Int).Div(new(big.Int).Mul(k, v0), v1), v0)
+	part2.Add(part2, new(big.Int).Mul(i, delta))
+	oneMinusK := new(big.Int).Sub(e18, k)
+	bAbs := new(big.Int).Mul(oneMinusK, v1)
+	bSig := false
+	if bAbs.Cmp(part2) >= 0 {
+		bAbs.Sub(bAbs, part2)
+	} else {
+		bAbs.Sub(part2, bAbs)
+		bSig = true
+	}
+	bAbs.Div(bAbs, e18)
+
+	squareRoot := dodoMulFloor(new(big.Int).Mul(oneMinusK, big.NewInt(4)), new(big.Int).Mul(dodoMulFloor(k, v0), v0))
+	squareRoot.Add(squareRoot, new(big.Int).Mul(bAbs, bAbs))
+	squareRoot.Sqrt(squareRoot)
+
+	denominator := new(big.Int).Mul(oneMinusK, big.NewInt(2))
+	var numerator *big.Int
+	if bSig {
+		numerator = new(big.Int).Sub(squareRoot, bAbs)
+		if numerator.Sign() <= 0 {
+			return big.NewInt(0)
+		}
+	} else {
+		numerator = new(big.Int).Add(bAbs, squareRoot)
+	}
+	v2 := divRoundUp(new(big.Int).Mul(numerator, e18), denominator)
+	if v2.Cmp(v1) > 0 {
+		return big.NewInt(0)
+	}
+	return v2.Sub(v1, v2)
+}
+
+func dodoMulFloor(a, b *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, b)
+	return r.Div(r, e18)
+}
+
+func dodoDivFloor(a, b *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, e18)
+	return r.Div(r, b)
+}
+
+func dodoReciprocalFloor(a *big.Int) *big.Int {
+	if a.Sign() == 0 {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Div(new(big.Int).Mul(e18, e18), a)
+}
+
+// DODO池没有factory/token0/token1方法, 用_BASE_TOKEN_/_QUOTE_TOKEN_获取池信息
+// 池合约中没有记录工厂地址, 通过已配置的DODO工厂的getDODOPool确认池的归属
+func FetchDODOPool(m dt.IMonitor, pools []string) (docs []dt.SimplePool, failPool []string) {
+	if len(pools) < 1 {
+		return
+	}
+	var factorys []string
+	for _, d := range m.Config().Dexs {
+		if d.Name == "DODO" {
+			factorys = append(factorys, d.Factory)
+		}
+	}
+	if len(factorys) == 0 {
+		failPool = append(failPool, pools...)
+		return
+	}
+	poolAbi, err := multicall.ParseABI(DODO_POOL_ABI)
+	if err != nil {
+		m.Logger().Error("FetchDODOPool error: ", err)
+		failPool = append(failPool, pools...)
+		return
+	}
+	factoryAbi, err := multicall.ParseABI(DODO_FACTORY_ABI)
+	if err != nil {
+		m.Logger().Error("FetchDODOPool error: ", err)
+		failPool = append(failPool, pools...)
+		return
+	}
+	var calls []*multicall.Call
+	for _, pool := range pools {
+		contract := multicall.Contract{ABI: poolAbi, Address: common.HexToAddress(pool)}
+		calls = append(calls, contract.NewCall(new(dt.ResAddress), "_BASE_TOKEN_").AllowFailure())
+		calls = append(calls, contract.NewCall(new(dt.ResAddress), "_QUOTE_TOKEN_").AllowFailure())
+	}
+	results, err := m.Multicall().Call(nil, calls...)
+	if err != nil {
+		m.Logger().Error("FetchDODOPool error: ", err)
+		failPool = append(failPool, pools...)
+		return
+	}
+	var found []dt.SimplePool
+	for i := 0; i+1 < len(results); i += 2 {
+		address := results[i].Contract.Address.Hex()
+		if results[i].Failed || results[i+1].Failed {
+			failPool = append(failPool, address)
+			continue
+		}
+		found = append(found, dt.SimplePool{
+			Address: address,
+			Token0:  results[i].Outputs.(*dt.ResAddress).Hex(),
+			Token1:  results[i+1].Outputs.(*dt.ResAddress).Hex(),
+		})
+	}
+	if len(found) == 0 {
+		return
+	}
+	calls = nil
+	for _, doc := range found {
+		for _, factory := range factorys {
+			contract := multicall.Contract{ABI: factoryAbi, Address: common.HexToAddress(factory)}
+			calls = append(calls, contract.NewCall(new(ResAddresses), "getDODOPool", common.HexToAddress(doc.Token0), common.HexToAddress(doc.Token1)).AllowFailure())
+		}
+	}
+	results, err = m.Multicall().Call(nil, calls...)
+	if err != nil {
+		m.Logger().Error("FetchDODOPool error: ", err)
+		for _, doc := range found {
+			failPool = append(failPool, doc.Address)
+		}
+		return
+	}
+	resChunk := pie.Chunk(results, len(factorys))
+	for i, doc := range found {
+		for j, res := range resChunk[i] {
+			if !res.Failed && pie.Contains(res.Outputs.(*ResAddresses).Addresses, common.HexToAddress(doc.Address)) {
+				doc.Factory = factorys[j]
+				break
+			}
+		}
+		if doc.Factory == "" {
+			failPool = append(failPool, doc.Address)
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	return
+}
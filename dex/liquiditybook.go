@@ -0,0 +1,643 @@
+package dex
+
+import (
+	"math"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"github.com/xiangxn/go-multicall"
+
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// Trader Joe Liquidity Book v2.1
+// 流动性分布在离散的bin中, 每个bin的价格为 (1+binStep/10000)^(id-2^23)
+type LiquidityBook struct {
+	Dex
+}
+
+type LBSwapEvent struct {
+	Sender                common.Address
+	To                    common.Address
+	Id                    *big.Int
+	AmountsIn             [32]byte
+	AmountsOut            [32]byte
+	VolatilityAccumulator *big.Int
+	TotalFees             [32]byte
+	ProtocolFees          [32]byte
+}
+
+type LBStaticFeeParameters struct {
+	BaseFactor               uint16
+	FilterPeriod             uint16
+	DecayPeriod              uint16
+	ReductionFactor          uint16
+	VariableFeeControl       *big.Int
+	ProtocolShare            uint16
+	MaxVolatilityAccumulator *big.Int
+}
+
+type LBVariableFeeParameters struct {
+	VolatilityAccumulator *big.Int
+	VolatilityReference   *big.Int
+	IdReference           *big.Int
+	TimeOfLastUpdate      *big.Int
+}
+
+type LBReserves struct {
+	ReserveX *big.Int
+	ReserveY *big.Int
+}
+
+// bin的储备量
+type LBBin struct {
+	ReserveX *big.Int
+	ReserveY *big.Int
+}
+
+// 计算bin-walk报价需要的池状态
+type LBState struct {
+	ActiveId  uint32
+	BinStep   uint16
+	Static    LBStaticFeeParameters
+	Variable  LBVariableFeeParameters
+	Timestamp uint64
+	Bins      map[uint32]LBBin
+}
+
+const LB_POOL_ABI = `[{"inputs":[{"internalType":"uint24","name":"id","type":"uint24"}],"name":"getBin","outputs":[{"internalType":"uint128","name":"binReserveX","type":"uint128"},{"internalType":"uint128","name":"binReserveY","type":"uint128"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"getBinStep","outputs":[{"internalType":"uint16","name":"","type":"uint16"}],"stateMutability":"pure","type":"function"},{"inputs":[],"name":"getFactory","outputs":[{"internalType":"contract ILBFactory","name":"factory","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"getTokenX","outputs":[{"internalType":"contract IERC20","name":"tokenX","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"getTokenY","outputs":[{"internalType":"contract IERC20","name":"tokenY","type":"address"}],"stateMutability":"view","type":"function"}]`
+
+// LBFactory.getLBPairInformation, 返回的LBPairInformation都是静态类型, 按平铺的输出解码
+const LB_FACTORY_ABI = `[{"inputs":[{"internalType":"contract IERC20","name":"tokenA","type":"address"},{"internalType":"contract IERC20","name":"tokenB","type":"address"},{"internalType":"uint256","name":"binStep","type":"uint256"}],"name":"getLBPairInformation","outputs":[{"internalType":"uint16","name":"binStep","type":"uint16"},{"internalType":"contract ILBPair","name":"LBPair","type":"address"},{"internalType":"bool","name":"createdByOwner","type":"bool"},{"internalType":"bool","name":"ignoredForRouting","type":"bool"}],"stateMutability":"view","type":"function"}]`
+
+type LBPairInformation struct {
+	BinStep uint16
+	LBPair  common.Address
+}
+
+const LB_REAL_ID_SHIFT = 1 << 23
+const LB_BASIS_POINT_MAX = 10000
+
+// 计算深度时活跃bin两侧最多获取的bin数量
+const LB_DEPTH_MAX_BINS = 50
+
+var lbPrecision = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
+var lbPoolAbi *abi.ABI
+
+// 计算深度用的bin缓存: 活跃bin不变时只随价格一起更新活跃bin,
+// 活跃bin移动或缓存超过depth_cache_blocks后由CalcBinDepth重新获取深度范围内的bin
+type lbBinCache struct {
+	activeId  uint32
+	binStep   uint16
+	decimals0 uint64
+	decimals1 uint64
+	block     uint64
+	// 为nil时等待CalcBinDepth获取
+	bins map[uint32]LBBin
+}
+
+// 按monitor分开缓存, 回测与实时运行的monitor读取的区块不同
+var lbBinCaches = struct {
+	monitors map[dt.IMonitor]map[string]*lbBinCache
+	sync.Mutex
+}{monitors: make(map[dt.IMonitor]map[string]*lbBinCache)}
+
+// monitor的bin缓存, 调用时需要持有锁
+func lbPoolCaches(m dt.IMonitor) map[string]*lbBinCache {
+	pools := lbBinCaches.monitors[m]
+	if pools == nil {
+		pools = make(map[string]*lbBinCache)
+		lbBinCaches.monitors[m] = pools
+	}
+	return pools
+}
+
+// 释放monitor的bin缓存, 在monitor停止后调用
+func ReleaseBinCache(m dt.IMonitor) {
+	lbBinCaches.Lock()
+	defer lbBinCaches.Unlock()
+	delete(lbBinCaches.monitors, m)
+}
+
+func (d *LiquidityBook) GetType() uint8      { return 7 }
+func (d *LiquidityBook) PriceCallCount() int { return 6 }
+
+// 池地址由LBFactory按binStep等参数创建, 不做CREATE2验证, 在FetchLBPool中通过工厂的getLBPairInformation验证
+func (d *LiquidityBook) PoolSalt(pool *dt.SimplePool) ([]byte, bool) { return nil, false }
+
+func (d *LiquidityBook) SwapTopics() []common.Hash {
+	return []common.Hash{d.Abi.Events[DEFAULT_SWAP_NAME].ID}
+}
+
+// 只接受可以解码并且输入与输出都不为0的Swap事件
+func (d *LiquidityBook) AcceptSwapLog(vLog types.Log) bool {
+	if len(vLog.Topics) == 0 || vLog.Topics[0] != d.Abi.Events[DEFAULT_SWAP_NAME].ID {
+		return false
+	}
+	event, err := TryUnpackSwapEvent[LBSwapEvent](vLog, *d.Abi, DEFAULT_SWAP_NAME)
+	if err != nil {
+		return false
+	}
+	inX, inY := DecodeLBAmounts(event.AmountsIn)
+	outX, outY := DecodeLBAmounts(event.AmountsOut)
+	return (inX.Sign() > 0 || inY.Sign() > 0) && (outX.Sign() > 0 || outY.Sign() > 0)
+}
+
+func (u *LiquidityBook) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
+	poolContract := multicall.Contract{ABI: u.Abi, Address: common.HexToAddress(pool.Address)}
+	call := poolContract.NewCall(new(dt.ResBigInt), "getActiveId").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	call = poolContract.NewCall(new(dt.ResBigInt), "getBinStep").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	call = poolContract.NewCall(new(LBReserves), "getReserves").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	call = poolContract.NewCall(new(LBStaticFeeParameters), "getStaticFeeParameters").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	call = poolContract.NewCall(new(LBVariableFeeParameters), "getVariableFeeParameters").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	// 上一次的活跃bin, 活跃bin没有移动时不需要再获取其他bin
+	var activeId uint32
+	lbBinCaches.Lock()
+	if c := lbPoolCaches(u.monitor)[pool.Address]; c != nil {
+		activeId = c.activeId
+	}
+	lbBinCaches.Unlock()
+	call = poolContract.NewCall(new(LBBin), "getBin", new(big.Int).SetUint64(uint64(activeId))).Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	return
+}
+
+func (u *LiquidityBook) CalcPrice(calls []*multicall.Call, blockNumber uint64, pool *dt.Pool) (pair dt.Pair) {
+	if len(calls) == 0 || calls[0].Failed || calls[1].Failed || calls[2].Failed || calls[3].Failed || calls[4].Failed {
+		return
+	}
+	activeId := uint32(calls[0].Outputs.(*dt.ResBigInt).Uint64())
+	binStep := uint16(calls[1].Outputs.(*dt.ResBigInt).Uint64())
+	res := calls[2].Outputs.(*LBReserves)
+	static := calls[3].Outputs.(*LBStaticFeeParameters)
+	variable := calls[4].Outputs.(*LBVariableFeeParameters)
+
+	price := CalcPriceLB(activeId, binStep, pool.Token0.Decimals, pool.Token1.Decimals)
+	fee := LBTotalFee(binStep, static, variable.VolatilityAccumulator)
+	feeRate := tools.PreservePrecision(tools.BigIntToFloat64(fee, 18), 6)
+
+	pair = u.CreatePair(pool, price, res.ReserveX, res.ReserveY, blockNumber, feeRate)
+	pair.Curve = dt.CURVE_LIQUIDITY_BOOK
+	pair.LB = NewLBCurve(activeId, binStep, static, variable, pool.Token0.Decimals, pool.Token1.Decimals)
+	// 储备量是所有bin的合计, 深度只计算价格影响范围内的bin, 缓存失效时先置0等待CalcBinDepth
+	pair.Depth0, pair.Depth1 = 0, 0
+	var bin *LBBin
+	if len(calls) > 5 && !calls[5].Failed && calls[5].Inputs[0].(*big.Int).Uint64() == uint64(activeId) {
+		bin = calls[5].Outputs.(*LBBin)
+	}
+	lbCachedDepth(u.monitor, &pair, pool, bin, DepthImpact(u.monitor), DepthCacheBlocks(u.monitor))
+	u.monitor.Logger().Debug(pool.Token0.Symbol, "/", pool.Token1.Symbol, " price: ", price, " Pool: ", pool.Address,
+		" blockNumber: ", blockNumber, " activeId: ", activeId, " reserves: ", res.ReserveX, res.ReserveY, " fee: ", feeRate, u.Name)
+	return
+}
+
+// 活跃bin没有移动并且缓存未过期时用缓存的bin设置深度, 否则记录新的活跃bin等待CalcBinDepth获取
+func lbCachedDepth(m dt.IMonitor, pair *dt.Pair, pool *dt.Pool, bin *LBBin, impact float64, cacheBlocks uint64) {
+	activeId, binStep, blockNumber := pair.LB.ActiveId, pair.LB.BinStep, pair.BlockNumber
+	lbBinCaches.Lock()
+	defer lbBinCaches.Unlock()
+	pools := lbPoolCaches(m)
+	c := pools[pool.Address]
+	if c != nil && c.bins != nil && bin != nil && c.activeId == activeId && c.binStep == binStep &&
+		blockNumber >= c.block && blockNumber < c.block+cacheBlocks {
+		c.bins[activeId] = *bin
+		setLBDepth(pair, c, impact)
+		return
+	}
+	pools[pool.Address] = &lbBinCache{activeId: activeId, binStep: binStep, decimals0: pool.Token0.Decimals, decimals1: pool.Token1.Decimals, block: blockNumber}
+}
+
+// 用缓存的bin设置交易对的深度与报价用的bin, 调用时需要持有锁
+func setLBDepth(pair *dt.Pair, c *lbBinCache, impact float64) {
+	depth0, depth1 := CalcDepthLB(c.activeId, c.binStep, c.bins, impact)
+	pair.Depth0 = tools.BigIntToFloat64(depth0, c.decimals0)
+	pair.Depth1 = tools.BigIntToFloat64(depth1, c.decimals1)
+	if pair.LB == nil {
+		return
+	}
+	pair.LB.Bins = nil
+	for _, id := range pie.Sort(pie.Keys(c.bins)) {
+		bin := c.bins[id]
+		pair.LB.Bins = append(pair.LB.Bins, dt.LBCurveBin{
+			Id:       id,
+			ReserveX: tools.BigIntToFloat64(bin.ReserveX, c.decimals0),
+			ReserveY: tools.BigIntToFloat64(bin.ReserveY, c.decimals1),
+		})
+	}
+}
+
+// 获取活跃bin移动或缓存过期的LB池在价格影响范围内的bin, 重新计算深度
+func CalcBinDepth(m dt.IMonitor, pairs []dt.Pair) {
+	if lbPoolAbi == nil {
+		lbPoolAbi, _ = multicall.ParseABI(LB_POOL_ABI)
+	}
+	impact := DepthImpact(m)
+	type binRef struct {
+		index int
+		id    uint32
+	}
+	var calls []*multicall.Call
+	var refs []binRef
+	// 发起调用时的活跃bin, 期间活跃bin已移动的池不使用获取的结果
+	activeIds := make(map[int]uint32)
+	lbBinCaches.Lock()
+	pools := lbPoolCaches(m)
+	for i := range pairs {
+		c := pools[pairs[i].Pool]
+		if c == nil || c.bins != nil {
+			continue
+		}
+		n := lbDepthBins(c.binStep, impact)
+		contract := multicall.Contract{ABI: lbPoolAbi, Address: common.HexToAddress(pairs[i].Pool)}
+		for id := c.activeId - n; id <= c.activeId+n; id++ {
+			calls = append(calls, contract.NewCall(new(LBBin), "getBin", new(big.Int).SetUint64(uint64(id))).AllowFailure())
+			refs = append(refs, binRef{index: i, id: id})
+		}
+		activeIds[i] = c.activeId
+	}
+	lbBinCaches.Unlock()
+	if len(calls) == 0 {
+		return
+	}
+	_, err := tools.ConcurrentMulticall(m.Multicall(), m.CallOpts(), calls, m.Config().ChunkLength, m.Config().MaxConcurrent)
+	if err != nil {
+		m.Logger().Error("CalcBinDepth error: ", err)
+		return
+	}
+	bins := make(map[int]map[uint32]LBBin)
+	for n, c := range calls {
+		if c.Failed {
+			continue
+		}
+		ref := refs[n]
+		if bins[ref.index] == nil {
+			bins[ref.index] = make(map[uint32]LBBin)
+		}
+		bins[ref.index][ref.id] = *c.Outputs.(*LBBin)
+	}
+	lbBinCaches.Lock()
+	defer lbBinCaches.Unlock()
+	for index, bs := range bins {
+		pair := &pairs[index]
+		c := pools[pair.Pool]
+		if c == nil || c.bins != nil || c.activeId != activeIds[index] {
+			continue
+		}
+		c.bins = bs
+		setLBDepth(pair, c, impact)
+	}
+}
+
+// 价格影响impact内可以到达的bin数量, bin内价格不变, 跨过n个bin后价格变化(1+binStep/10000)^n-1
+func lbDepthBins(binStep uint16, impact float64) uint32 {
+	n := math.Floor(-math.Log(1-impact) / math.Log(1+float64(binStep)/LB_BASIS_POINT_MAX))
+	return uint32(min(n, LB_DEPTH_MAX_BINS))
+}
+
+// 价格影响impact内可卖入的tokenX/tokenY数量(不含手续费)
+// 卖出tokenX时从活跃bin向下消耗tokenY, 卖出tokenY时从活跃bin向上消耗tokenX
+func CalcDepthLB(activeId uint32, binStep uint16, bins map[uint32]LBBin, impact float64) (depth0, depth1 *big.Int) {
+	depth0, depth1 = big.NewInt(0), big.NewInt(0)
+	one := new(big.Int).Lsh(big.NewInt(1), 128)
+	n := lbDepthBins(binStep, impact)
+	for i := uint32(0); i <= n; i++ {
+		if bin, ok := bins[activeId-i]; ok && bin.ReserveY != nil && bin.ReserveY.Sign() > 0 {
+			depth0.Add(depth0, divRoundUp(new(big.Int).Lsh(bin.ReserveY, 128), lbPriceX128(activeId-i, binStep)))
+		}
+		if bin, ok := bins[activeId+i]; ok && bin.ReserveX != nil && bin.ReserveX.Sign() > 0 {
+			depth1.Add(depth1, divRoundUp(new(big.Int).Mul(bin.ReserveX, lbPriceX128(activeId+i, binStep)), one))
+		}
+	}
+	return
+}
+
+// 计算活跃bin的价格(统一以token1除以token0表示价格)
+func CalcPriceLB(activeId uint32, binStep uint16, decimalsX, decimalsY uint64) (price *big.Float) {
+	price = lbPriceFloat(activeId, binStep)
+	decimalsDiff := int64(decimalsX) - int64(decimalsY)
+	adjustmentFactor := new(big.Float)
+	if decimalsDiff >= 0 {
+		adjustmentFactor.SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(decimalsDiff), nil))
+		price.Mul(price, adjustmentFactor)
+	} else {
+		adjustmentFactor.SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(-decimalsDiff), nil))
+		price.Quo(price, adjustmentFactor)
+	}
+	return
+}
+
+// (1+binStep/10000)^(id-2^23), 使用原始数量(未按小数位调整)
+func lbPriceFloat(id uint32, binStep uint16) *big.Float {
+	base := new(big.Float).SetPrec(256).Quo(big.NewFloat(float64(LB_BASIS_POINT_MAX+int(binStep))), big.NewFloat(LB_BASIS_POINT_MAX))
+	exp := int64(id) - LB_REAL_ID_SHIFT
+	neg := exp < 0
+	if neg {
+		exp = -exp
+	}
+	result := new(big.Float).SetPrec(256).SetInt64(1)
+	for exp > 0 {
+		if exp&1 == 1 {
+			result.Mul(result, base)
+		}
+		base = new(big.Float).SetPrec(256).Mul(base, base)
+		exp >>= 1
+	}
+	if neg {
+		result = new(big.Float).SetPrec(256).Quo(big.NewFloat(1), result)
+	}
+	return result
+}
+
+// bin价格的128.128定点数表示
+func lbPriceX128(id uint32, binStep uint16) *big.Int {
+	price := lbPriceFloat(id, binStep)
+	price.Mul(price, new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(1), 128)))
+	return tools.ToBigInt(price)
+}
+
+// 总手续费(1e18精度) = baseFactor*binStep*1e10 + (volatilityAccumulator*binStep)^2*variableFeeControl/100
+func LBTotalFee(binStep uint16, static *LBStaticFeeParameters, volatilityAccumulator *big.Int) *big.Int {
+	baseFee := new(big.Int).Mul(big.NewInt(int64(static.BaseFactor)*int64(binStep)), big.NewInt(1e10))
+	if static.VariableFeeControl == nil || static.VariableFeeControl.Sign() == 0 {
+		return baseFee
+	}
+	prod := new(big.Int).Mul(volatilityAccumulator, big.NewInt(int64(binStep)))
+	variableFee := new(big.Int).Mul(prod, prod)
+	variableFee.Mul(variableFee, static.VariableFeeControl)
+	variableFee.Add(variableFee, big.NewInt(99))
+	variableFee.Div(variableFee, big.NewInt(100))
+	return baseFee.Add(baseFee, variableFee)
+}
+
+// 按小数位调整后的报价状态, bin在计算深度时设置
+func NewLBCurve(activeId uint32, binStep uint16, static *LBStaticFeeParameters, variable *LBVariableFeeParameters, decimals0, decimals1 uint64) *dt.LBCurve {
+	return &dt.LBCurve{
+		ActiveId:                 activeId,
+		BinStep:                  binStep,
+		Decimals0:                decimals0,
+		Decimals1:                decimals1,
+		BaseFactor:               static.BaseFactor,
+		FilterPeriod:             static.FilterPeriod,
+		DecayPeriod:              static.DecayPeriod,
+		ReductionFactor:          static.ReductionFactor,
+		VariableFeeControl:       static.VariableFeeControl.Uint64(),
+		MaxVolatilityAccumulator: static.MaxVolatilityAccumulator.Uint64(),
+		VolatilityAccumulator:    variable.VolatilityAccumulator.Uint64(),
+		VolatilityReference:      variable.VolatilityReference.Uint64(),
+		IdReference:              variable.IdReference.Uint64(),
+		TimeOfLastUpdate:         variable.TimeOfLastUpdate.Uint64(),
+	}
+}
+
+// 用GetAmountOutLB报价卖出amountIn个Token0得到的Token1数量(含手续费), 超出已获取的bin的部分不成交
+// 报价时不知道成交区块的时间, 按没有经过filterPeriod计算, 波动累积值不衰减, 手续费偏保守
+func QuoteLB(c *dt.LBCurve, amountIn float64) float64 {
+	if len(c.Bins) == 0 || amountIn <= 0 {
+		return 0
+	}
+	state := &LBState{
+		ActiveId: c.ActiveId,
+		BinStep:  c.BinStep,
+		Static: LBStaticFeeParameters{
+			BaseFactor:               c.BaseFactor,
+			FilterPeriod:             c.FilterPeriod,
+			DecayPeriod:              c.DecayPeriod,
+			ReductionFactor:          c.ReductionFactor,
+			VariableFeeControl:       new(big.Int).SetUint64(c.VariableFeeControl),
+			MaxVolatilityAccumulator: new(big.Int).SetUint64(c.MaxVolatilityAccumulator),
+		},
+		Variable: LBVariableFeeParameters{
+			VolatilityAccumulator: new(big.Int).SetUint64(c.VolatilityAccumulator),
+			VolatilityReference:   new(big.Int).SetUint64(c.VolatilityReference),
+			IdReference:           new(big.Int).SetUint64(c.IdReference),
+			TimeOfLastUpdate:      new(big.Int).SetUint64(c.TimeOfLastUpdate),
+		},
+		Timestamp: c.TimeOfLastUpdate,
+		Bins:      make(map[uint32]LBBin, len(c.Bins)),
+	}
+	for _, bin := range c.Bins {
+		state.Bins[bin.Id] = LBBin{ReserveX: tools.Float64ToBigInt(bin.ReserveX, c.Decimals0), ReserveY: tools.Float64ToBigInt(bin.ReserveY, c.Decimals1)}
+	}
+	decimalsIn, decimalsOut := c.Decimals0, c.Decimals1
+	if c.Reversed {
+		decimalsIn, decimalsOut = decimalsOut, decimalsIn
+	}
+	amountOut, _ := GetAmountOutLB(state, tools.Float64ToBigInt(amountIn, decimalsIn), !c.Reversed)
+	return tools.BigIntToFloat64(amountOut, decimalsOut)
+}
+
+// 按bin逐个消耗流动性计算输出数量, 返回输出数量与未能成交的输入数量
+// 与LBPair.getSwapOut逻辑一致, 包括跨bin时可变手续费的变化
+func GetAmountOutLB(state *LBState, amountIn *big.Int, swapForY bool) (amountOut, amountInLeft *big.Int) {
+	amountOut = big.NewInt(0)
+	amountInLeft = new(big.Int).Set(amountIn)
+	if state == nil || amountIn.Sign() <= 0 {
+		return
+	}
+	id := state.ActiveId
+	idReference := uint32(state.Variable.IdReference.Uint64())
+	volRef := new(big.Int).Set(state.Variable.VolatilityReference)
+	volAcc := new(big.Int).Set(state.Variable.VolatilityAccumulator)
+	maxVolAcc := state.Static.MaxVolatilityAccumulator
+
+	// 更新参考值
+	dtime := state.Timestamp - state.Variable.TimeOfLastUpdate.Uint64()
+	if dtime >= uint64(state.Static.FilterPeriod) {
+		idReference = id
+		if dtime < uint64(state.Static.DecayPeriod) {
+			volRef = new(big.Int).Div(new(big.Int).Mul(volAcc, big.NewInt(int64(state.Static.ReductionFactor))), big.NewInt(LB_BASIS_POINT_MAX))
+		} else {
+			volRef = big.NewInt(0)
+		}
+	}
+
+	for amountInLeft.Sign() > 0 {
+		bin, ok := state.Bins[id]
+		if !ok { // 超出已获取的bin范围
+			return
+		}
+		reserveOut := bin.ReserveX
+		if swapForY {
+			reserveOut = bin.ReserveY
+		}
+		if reserveOut != nil && reserveOut.Sign() > 0 {
+			// 更新波动累积值
+			deltaId := int64(id) - int64(idReference)
+			if deltaId < 0 {
+				deltaId = -deltaId
+			}
+			volAcc = new(big.Int).Add(volRef, big.NewInt(deltaId*LB_BASIS_POINT_MAX))
+			if maxVolAcc != nil && volAcc.Cmp(maxVolAcc) > 0 {
+				volAcc = new(big.Int).Set(maxVolAcc)
+			}
+			fee := LBTotalFee(state.BinStep, &state.Static, volAcc)
+			price := lbPriceX128(id, state.BinStep)
+
+			var maxAmountIn *big.Int
+			if swapForY {
+				maxAmountIn = divRoundUp(new(big.Int).Lsh(reserveOut, 128), price)
+			} else {
+				maxAmountIn = divRoundUp(new(big.Int).Mul(reserveOut, price), new(big.Int).Lsh(big.NewInt(1), 128))
+			}
+			// fee = amount*fee/(1e18-fee)
+			maxFee := divRoundUp(new(big.Int).Mul(maxAmountIn, fee), new(big.Int).Sub(lbPrecision, fee))
+			maxAmountInWithFees := new(big.Int).Add(maxAmountIn, maxFee)
+
+			if amountInLeft.Cmp(maxAmountInWithFees) >= 0 {
+				amountInLeft.Sub(amountInLeft, maxAmountInWithFees)
+				amountOut.Add(amountOut, reserveOut)
+			} else {
+				feeAmount := divRoundUp(new(big.Int).Mul(amountInLeft, fee), lbPrecision)
+				amountInNoFee := new(big.Int).Sub(amountInLeft, feeAmount)
+				var out *big.Int
+				if swapForY {
+					out = new(big.Int).Rsh(new(big.Int).Mul(amountInNoFee, price), 128)
+				} else {
+					out = new(big.Int).Div(new(big.Int).Lsh(amountInNoFee, 128), price)
+				}
+				if out.Cmp(reserveOut) > 0 {
+					out = new(big.Int).Set(reserveOut)
+				}
+				amountOut.Add(amountOut, out)
+				amountInLeft.SetInt64(0)
+			}
+		}
+		if amountInLeft.Sign() > 0 {
+			if swapForY {
+				id--
+			} else {
+				id++
+			}
+		}
+	}
+	return
+}
+
+// LB池没有factory/token0/token1方法, 用getFactory/getTokenX/getTokenY获取池信息
+// tokenX作为token0, tokenY作为token1
+// 声明的工厂是已配置的LB工厂时, 用工厂的getLBPairInformation确认池的归属, 不一致的池返回在spoofed中
+func FetchLBPool(m dt.IMonitor, pools []string) (docs []dt.SimplePool, failPool []string, spoofed []string) {
+	if len(pools) < 1 {
+		return
+	}
+	lbAbi, err := multicall.ParseABI(LB_POOL_ABI)
+	if err != nil {
+		m.Logger().Error("FetchLBPool error: ", err)
+		failPool = append(failPool, pools...)
+		return
+	}
+	factoryAbi, err := multicall.ParseABI(LB_FACTORY_ABI)
+	if err != nil {
+		m.Logger().Error("FetchLBPool error: ", err)
+		failPool = append(failPool, pools...)
+		return
+	}
+	var calls []*multicall.Call
+	for _, pool := range pools {
+		contract := multicall.Contract{ABI: lbAbi, Address: common.HexToAddress(pool)}
+		calls = append(calls, contract.NewCall(new(dt.ResAddress), "getFactory").AllowFailure())
+		calls = append(calls, contract.NewCall(new(dt.ResAddress), "getTokenX").AllowFailure())
+		calls = append(calls, contract.NewCall(new(dt.ResAddress), "getTokenY").AllowFailure())
+		calls = append(calls, contract.NewCall(new(ResUint16), "getBinStep").AllowFailure())
+	}
+	results, err := m.Multicall().Call(nil, calls...)
+	if err != nil {
+		m.Logger().Error("FetchLBPool error: ", err)
+		failPool = append(failPool, pools...)
+		return
+	}
+	var lbFactorys []string
+	for _, d := range m.Config().Dexs {
+		if d.Name == "LiquidityBook" {
+			lbFactorys = append(lbFactorys, d.Factory)
+		}
+	}
+	var found []dt.SimplePool
+	var binSteps []uint16
+	for _, res := range pie.Chunk(results, 4) {
+		address := res[0].Contract.Address.Hex()
+		if res[0].Failed || res[1].Failed || res[2].Failed || res[3].Failed {
+			failPool = append(failPool, address)
+			continue
+		}
+		doc := dt.SimplePool{
+			Address: address,
+			Factory: res[0].Outputs.(*dt.ResAddress).Hex(),
+			Token0:  res[1].Outputs.(*dt.ResAddress).Hex(),
+			Token1:  res[2].Outputs.(*dt.ResAddress).Hex(),
+		}
+		// 工厂不是已配置的LB工厂时由调用方按不支持的交易市场处理
+		if !pie.Contains(lbFactorys, doc.Factory) {
+			docs = append(docs, doc)
+			continue
+		}
+		found = append(found, doc)
+		binSteps = append(binSteps, res[3].Outputs.(*ResUint16).Value)
+	}
+	if len(found) == 0 {
+		return
+	}
+	calls = nil
+	for i, doc := range found {
+		contract := multicall.Contract{ABI: factoryAbi, Address: common.HexToAddress(doc.Factory)}
+		calls = append(calls, contract.NewCall(new(LBPairInformation), "getLBPairInformation",
+			common.HexToAddress(doc.Token0), common.HexToAddress(doc.Token1), big.NewInt(int64(binSteps[i]))).AllowFailure())
+	}
+	results, err = m.Multicall().Call(nil, calls...)
+	if err != nil {
+		m.Logger().Error("FetchLBPool error: ", err)
+		for _, doc := range found {
+			failPool = append(failPool, doc.Address)
+		}
+		return
+	}
+	for i, doc := range found {
+		var expected common.Address
+		if !results[i].Failed {
+			expected = results[i].Outputs.(*LBPairInformation).LBPair
+		}
+		if expected == common.HexToAddress(doc.Address) {
+			docs = append(docs, doc)
+			continue
+		}
+		spoofed = append(spoofed, doc.Address)
+		m.Logger().WithFields(logrus.Fields{"pool": doc.Address, "factory": doc.Factory, "expected": expected.Hex()}).Warn("伪造的池")
+		m.DB().SaveSpoofedPool(dt.SpoofedPool{
+			Address:   doc.Address,
+			Factory:   doc.Factory,
+			Token0:    doc.Token0,
+			Token1:    doc.Token1,
+			Expected:  expected.Hex(),
+			CreatedAt: time.Now(),
+		})
+	}
+	return
+}
+
+// 把事件中打包的bytes32数量拆分为x(低128位)与y(高128位)
+func DecodeLBAmounts(packed [32]byte) (x, y *big.Int) {
+	y = new(big.Int).SetBytes(packed[:16])
+	x = new(big.Int).SetBytes(packed[16:])
+	return
+}
+
+func divRoundUp(a, b *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+	if r.Sign() > 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	return q
+}
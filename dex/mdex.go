@@ -34,11 +34,11 @@ func (u *MDEX) CalcPrice(calls []*multicall.Call, blockNumber uint64, pool *dt.P
 		return
 	}
 	logger := u.monitor.Logger()
-	u.Fee = tools.PreservePrecision(float64(calls[1].Outputs.(*dt.ResBigInt).Uint64())*1e-4, 6)
+	fee := tools.PreservePrecision(float64(calls[1].Outputs.(*dt.ResBigInt).Uint64())*1e-4, 6)
 	res := calls[0].Outputs.(*reserves)
 	price := CalcPriceV2(res.Reserve0, res.Reserve1, pool.Token0.Decimals, pool.Token1.Decimals)
-	// u.SavePair(pool, price, res.Reserve0, res.Reserve1, blockNumber, u.Fee)
-	pair = u.CreatePair(pool, price, res.Reserve0, res.Reserve1, blockNumber, u.Fee)
+	// u.SavePair(pool, price, res.Reserve0, res.Reserve1, blockNumber, fee)
+	pair = u.CreatePair(pool, price, res.Reserve0, res.Reserve1, blockNumber, fee)
 	logger.Debug(pool.Token0.Symbol, "/", pool.Token1.Symbol, " price: ", price, " Pool: ", pool.Address, " blockNumber: ", blockNumber, " reserves: ", res.Reserve0, res.Reserve1, u.Name)
 	return
 }
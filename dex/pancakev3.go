@@ -1,12 +1,12 @@
 package dex
 
 import (
+	"math"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/xiangxn/go-multicall"
 
-	"github.com/xiangxn/listener/tools"
 	dt "github.com/xiangxn/listener/types"
 )
 
@@ -37,15 +37,26 @@ type PancakeV3 struct {
 }
 
 func (d *PancakeV3) GetType() uint8      { return 3 }
-func (d *PancakeV3) PriceCallCount() int { return 4 }
+func (d *PancakeV3) PriceCallCount() int { return 2 }
+
+func (u *PancakeV3) CreateParamsCall(pool *dt.SimplePool) []*multicall.Call {
+	return createFeeTickSpacingCall(u.Abi, pool)
+}
+
+func (u *PancakeV3) SetParams(calls []*multicall.Call, pool *dt.SimplePool) bool {
+	return setFeeTickSpacing(calls, pool)
+}
+
+func (u *PancakeV3) PoolSalt(pool *dt.SimplePool) ([]byte, bool) {
+	if pool.Params == nil {
+		return nil, false
+	}
+	return saltEncoded(pool, int64(math.Round(pool.Params.Fee*1e6))), true
+}
 
 func (u *PancakeV3) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
 	poolContract := multicall.Contract{ABI: u.Abi, Address: common.HexToAddress(pool.Address)}
-	call := poolContract.NewCall(new(dt.ResBigInt), "fee").Name(pool.Address).AllowFailure()
-	calls = append(calls, call)
-	call = poolContract.NewCall(new(dt.ResBigInt), "tickSpacing").Name(pool.Address).AllowFailure()
-	calls = append(calls, call)
-	call = poolContract.NewCall(new(PancakeSlot0), "slot0").Name(pool.Address).AllowFailure()
+	call := poolContract.NewCall(new(PancakeSlot0), "slot0").Name(pool.Address).AllowFailure()
 	calls = append(calls, call)
 	call = poolContract.NewCall(new(dt.ResBigInt), "liquidity").Name(pool.Address).AllowFailure()
 	calls = append(calls, call)
@@ -56,20 +67,20 @@ func (u *PancakeV3) CalcPrice(calls []*multicall.Call, blockNumber uint64, pool
 	if len(calls) == 0 {
 		return
 	}
-	if calls[0].Failed || calls[1].Failed || calls[2].Failed || calls[3].Failed {
+	if calls[0].Failed || calls[1].Failed || pool.Params == nil {
 		return
 	}
-	u.Fee = tools.PreservePrecision(float64(calls[0].Outputs.(*dt.ResBigInt).Uint64())*1e-6, 6)
-	tickSpacing := int32(calls[1].Outputs.(*dt.ResBigInt).Int64())
-	slot0 := calls[2].Outputs.(*PancakeSlot0)
-	liquidity := calls[3].Outputs.(*dt.ResBigInt).Int
+	tickSpacing := pool.Params.TickSpacing
+	slot0 := calls[0].Outputs.(*PancakeSlot0)
+	liquidity := calls[1].Outputs.(*dt.ResBigInt).Int
 
 	price := CalcPriceV3(slot0.SqrtPriceX96, pool.Token0.Decimals, pool.Token1.Decimals)
 	// Calculate token0 and token1 reserves
 	token0Reserve, token1Reserve := CalcReserveV3(slot0.Tick, tickSpacing, liquidity, slot0.SqrtPriceX96)
 
-	// u.SavePair(pool, price, token0Reserve, token1Reserve, blockNumber, u.Fee)
-	pair = u.CreatePair(pool, price, token0Reserve, token1Reserve, blockNumber, u.Fee)
+	// u.SavePair(pool, price, token0Reserve, token1Reserve, blockNumber, pool.Params.Fee)
+	pair = u.CreatePair(pool, price, token0Reserve, token1Reserve, blockNumber, pool.Params.Fee)
+	SetDepthV3(&pair, pool, &dt.ConcentratedState{SqrtPriceX96: slot0.SqrtPriceX96, Tick: int32(slot0.Tick.Int64()), Liquidity: liquidity, TickSpacing: tickSpacing, TickBitmap: true}, DepthImpact(u.monitor))
 	u.monitor.Logger().Debug(pool.Token0.Symbol, "/", pool.Token1.Symbol, " price: ", price, " Pool: ", pool.Address,
 		" blockNumber: ", blockNumber, " reserves: ", token0Reserve, token1Reserve, u.Name)
 	return
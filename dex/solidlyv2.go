@@ -0,0 +1,205 @@
+package dex
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/xiangxn/go-multicall"
+
+	dt "github.com/xiangxn/listener/types"
+)
+
+// Solidly/Velodrome V2/Aerodrome V2/Thena V1 等经典池
+// stable池使用 x³y+xy³ 曲线, volatile池使用 xy 曲线
+type SolidlyV2 struct {
+	Dex
+}
+
+// Velodrome V2/Aerodrome的工厂按池返回手续费(自定义手续费或stable/volatile默认值), 分母为10000
+const SOLIDLY_FACTORY_FEE_ABI = `[{"inputs":[{"internalType":"address","name":"pool","type":"address"},{"internalType":"bool","name":"_stable","type":"bool"}],"name":"getFee","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"}]`
+
+var solidlyFactoryAbi, _ = multicall.ParseABI(SOLIDLY_FACTORY_FEE_ABI)
+
+type SolidlyMetadata struct {
+	Dec0 *big.Int // 10**decimals0
+	Dec1 *big.Int // 10**decimals1
+	R0   *big.Int
+	R1   *big.Int
+	St   bool
+	T0   common.Address
+	T1   common.Address
+}
+
+var e18 = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
+func (d *SolidlyV2) GetType() uint8      { return 6 }
+func (d *SolidlyV2) PriceCallCount() int { return 1 }
+
+func (u *SolidlyV2) CreateParamsCall(pool *dt.SimplePool) (calls []*multicall.Call) {
+	poolContract := multicall.Contract{ABI: u.Abi, Address: common.HexToAddress(pool.Address)}
+	calls = append(calls, poolContract.NewCall(new(dt.ResBool), "stable").Name(pool.Address).AllowFailure())
+	// 还不知道池的类型, 两种都查询
+	factory := multicall.Contract{ABI: solidlyFactoryAbi, Address: common.HexToAddress(pool.Factory)}
+	for _, stable := range []bool{true, false} {
+		calls = append(calls, factory.NewCall(new(dt.ResBigInt), "getFee", common.HexToAddress(pool.Address), stable).Name(pool.Address).AllowFailure())
+	}
+	return
+}
+
+// 工厂不支持getFee(如Solidly V1分叉)时手续费为0, 计算价格时使用配置的fee/stable_fee
+func (u *SolidlyV2) SetParams(calls []*multicall.Call, pool *dt.SimplePool) bool {
+	if len(calls) < 1 || calls[0].Failed {
+		return false
+	}
+	pool.Params = &dt.PoolParams{Stable: calls[0].Outputs.(*dt.ResBool).Value}
+	index := 2
+	if pool.Params.Stable {
+		index = 1
+	}
+	if len(calls) > index && !calls[index].Failed {
+		if fee := calls[index].Outputs.(*dt.ResBigInt).Int; fee != nil {
+			pool.Params.Fee = float64(fee.Int64()) / 1e4
+		}
+	}
+	return true
+}
+
+func (u *SolidlyV2) PoolSalt(pool *dt.SimplePool) ([]byte, bool) {
+	if pool.Params == nil {
+		return nil, false
+	}
+	stable := []byte{0}
+	if pool.Params.Stable {
+		stable[0] = 1
+	}
+	return crypto.Keccak256(common.HexToAddress(pool.Token0).Bytes(), common.HexToAddress(pool.Token1).Bytes(), stable), true
+}
+
+func (u *SolidlyV2) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
+	poolContract := multicall.Contract{ABI: u.Abi, Address: common.HexToAddress(pool.Address)}
+	call := poolContract.NewCall(new(SolidlyMetadata), "metadata").Name(pool.Address).AllowFailure()
+	calls = append(calls, call)
+	return
+}
+
+func (u *SolidlyV2) CalcPrice(calls []*multicall.Call, blockNumber uint64, pool *dt.Pool) (pair dt.Pair) {
+	if len(calls) == 0 || calls[0].Failed {
+		return
+	}
+	meta := calls[0].Outputs.(*SolidlyMetadata)
+	var price *big.Float
+	fee := u.Fee
+	if meta.St {
+		price = CalcPriceSolidlyStable(meta.R0, meta.R1, pool.Token0.Decimals, pool.Token1.Decimals)
+		fee = u.StableFee
+	} else {
+		price = CalcPriceV2(meta.R0, meta.R1, pool.Token0.Decimals, pool.Token1.Decimals)
+	}
+	if pool.Params != nil && pool.Params.Fee > 0 {
+		fee = pool.Params.Fee
+	}
+	pair = u.CreatePair(pool, price, meta.R0, meta.R1, blockNumber, fee)
+	if meta.St {
+		pair.Curve = dt.CURVE_STABLE
+	}
+	u.monitor.Logger().Debug(pool.Token0.Symbol, "/", pool.Token1.Symbol, " price: ", price, " Pool: ", pool.Address, " blockNumber: ", blockNumber,
+		" reserves: ", meta.R0, meta.R1, " stable: ", meta.St, u.Name)
+	return
+}
+
+// 计算stable池的边际价格(统一以token1除以token0表示价格)
+// 对 x³y+xy³=k 求导: dy/dx = (3x²y+y³)/(x³+3xy²)
+func CalcPriceSolidlyStable(x, y *big.Int, xDecimals, yDecimals uint64) (price *big.Float) {
+	xFloat := new(big.Float).Quo(new(big.Float).SetInt(x), new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), new(big.Int).SetUint64(xDecimals), nil)))
+	yFloat := new(big.Float).Quo(new(big.Float).SetInt(y), new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), new(big.Int).SetUint64(yDecimals), nil)))
+	x2 := new(big.Float).Mul(xFloat, xFloat)
+	y2 := new(big.Float).Mul(yFloat, yFloat)
+	three := big.NewFloat(3)
+	numerator := new(big.Float).Add(new(big.Float).Mul(three, new(big.Float).Mul(x2, yFloat)), new(big.Float).Mul(y2, yFloat))
+	denominator := new(big.Float).Add(new(big.Float).Mul(x2, xFloat), new(big.Float).Mul(three, new(big.Float).Mul(xFloat, y2)))
+	if denominator.Sign() == 0 {
+		return new(big.Float)
+	}
+	price = new(big.Float).Quo(numerator, denominator)
+	return
+}
+
+// 与池合约getAmountOut一致的报价
+// dec0/dec1为10**decimals, fee为小数表示的手续费(如0.0005)
+func GetAmountOutSolidly(amountIn, reserve0, reserve1, dec0, dec1 *big.Int, zeroForOne, stable bool, fee float64) *big.Int {
+	feeBps := big.NewInt(int64(fee*1e4 + 0.5))
+	amountIn = new(big.Int).Sub(amountIn, new(big.Int).Div(new(big.Int).Mul(amountIn, feeBps), big.NewInt(10000)))
+	if amountIn.Sign() <= 0 || reserve0.Sign() == 0 || reserve1.Sign() == 0 {
+		return big.NewInt(0)
+	}
+	if !stable {
+		reserveA, reserveB := reserve0, reserve1
+		if !zeroForOne {
+			reserveA, reserveB = reserve1, reserve0
+		}
+		return new(big.Int).Div(new(big.Int).Mul(amountIn, reserveB), new(big.Int).Add(reserveA, amountIn))
+	}
+	xy := solidlyK(reserve0, reserve1, dec0, dec1)
+	r0 := new(big.Int).Div(new(big.Int).Mul(reserve0, e18), dec0)
+	r1 := new(big.Int).Div(new(big.Int).Mul(reserve1, e18), dec1)
+	reserveA, reserveB, decIn, decOut := r0, r1, dec0, dec1
+	if !zeroForOne {
+		reserveA, reserveB, decIn, decOut = r1, r0, dec1, dec0
+	}
+	amountIn = new(big.Int).Div(new(big.Int).Mul(amountIn, e18), decIn)
+	y := new(big.Int).Sub(reserveB, solidlyGetY(new(big.Int).Add(amountIn, reserveA), xy, reserveB))
+	if y.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	return y.Div(y.Mul(y, decOut), e18)
+}
+
+// x³y+y³x
+func solidlyK(x, y, dec0, dec1 *big.Int) *big.Int {
+	_x := new(big.Int).Div(new(big.Int).Mul(x, e18), dec0)
+	_y := new(big.Int).Div(new(big.Int).Mul(y, e18), dec1)
+	a := new(big.Int).Div(new(big.Int).Mul(_x, _y), e18)
+	b := new(big.Int).Add(new(big.Int).Div(new(big.Int).Mul(_x, _x), e18), new(big.Int).Div(new(big.Int).Mul(_y, _y), e18))
+	return a.Div(a.Mul(a, b), e18)
+}
+
+func solidlyF(x0, y *big.Int) *big.Int {
+	y3 := new(big.Int).Div(new(big.Int).Mul(new(big.Int).Div(new(big.Int).Mul(y, y), e18), y), e18)
+	x3 := new(big.Int).Div(new(big.Int).Mul(new(big.Int).Div(new(big.Int).Mul(x0, x0), e18), x0), e18)
+	a := new(big.Int).Div(new(big.Int).Mul(x0, y3), e18)
+	b := new(big.Int).Div(new(big.Int).Mul(x3, y), e18)
+	return a.Add(a, b)
+}
+
+func solidlyD(x0, y *big.Int) *big.Int {
+	y2 := new(big.Int).Div(new(big.Int).Mul(y, y), e18)
+	a := new(big.Int).Div(new(big.Int).Mul(new(big.Int).Mul(big.NewInt(3), x0), y2), e18)
+	x3 := new(big.Int).Div(new(big.Int).Mul(new(big.Int).Div(new(big.Int).Mul(x0, x0), e18), x0), e18)
+	return a.Add(a, x3)
+}
+
+// 牛顿法求解y, 与合约_get_y一致
+func solidlyGetY(x0, xy, y *big.Int) *big.Int {
+	y = new(big.Int).Set(y)
+	one := big.NewInt(1)
+	for i := 0; i < 255; i++ {
+		yPrev := new(big.Int).Set(y)
+		k := solidlyF(x0, y)
+		d := solidlyD(x0, y)
+		if d.Sign() == 0 {
+			return y
+		}
+		if k.Cmp(xy) < 0 {
+			dy := new(big.Int).Div(new(big.Int).Mul(new(big.Int).Sub(xy, k), e18), d)
+			y.Add(y, dy)
+		} else {
+			dy := new(big.Int).Div(new(big.Int).Mul(new(big.Int).Sub(k, xy), e18), d)
+			y.Sub(y, dy)
+		}
+		if new(big.Int).Abs(new(big.Int).Sub(y, yPrev)).Cmp(one) <= 0 {
+			return y
+		}
+	}
+	return y
+}
@@ -36,14 +36,25 @@ type Thena struct {
 }
 
 func (d *Thena) GetType() uint8      { return 4 }
-func (d *Thena) PriceCallCount() int { return 3 }
+func (d *Thena) PriceCallCount() int { return 2 }
+
+// tickSpacing在发现池时缓存, 不在每次更新价格时查询
+func (u *Thena) CreateParamsCall(pool *dt.SimplePool) []*multicall.Call {
+	return createTickSpacingCall(u.Abi, pool)
+}
+
+func (u *Thena) SetParams(calls []*multicall.Call, pool *dt.SimplePool) bool {
+	return setTickSpacing(calls, pool)
+}
+
+func (d *Thena) PoolSalt(pool *dt.SimplePool) ([]byte, bool) {
+	return saltEncoded(pool), true
+}
 
 func (u *Thena) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
 	poolContract := multicall.Contract{ABI: u.Abi, Address: common.HexToAddress(pool.Address)}
 	call := poolContract.NewCall(new(GlobalState), "globalState").Name(pool.Address).AllowFailure()
 	calls = append(calls, call)
-	call = poolContract.NewCall(new(dt.ResBigInt), "tickSpacing").Name(pool.Address).AllowFailure()
-	calls = append(calls, call)
 	call = poolContract.NewCall(new(dt.ResBigInt), "liquidity").Name(pool.Address).AllowFailure()
 	calls = append(calls, call)
 	return
@@ -53,20 +64,21 @@ func (u *Thena) CalcPrice(calls []*multicall.Call, blockNumber uint64, pool *dt.
 	if len(calls) == 0 {
 		return
 	}
-	if calls[0].Failed || calls[1].Failed || calls[2].Failed {
+	if calls[0].Failed || calls[1].Failed || pool.Params == nil || pool.Params.TickSpacing <= 0 {
 		return
 	}
 	slot0 := calls[0].Outputs.(*GlobalState)
-	u.Fee = tools.PreservePrecision(float64(slot0.Fee)*1e-6, 6)
-	tickSpacing := int32(calls[1].Outputs.(*dt.ResBigInt).Int64())
-	liquidity := calls[2].Outputs.(*dt.ResBigInt).Int
+	fee := tools.PreservePrecision(float64(slot0.Fee)*1e-6, 6)
+	tickSpacing := pool.Params.TickSpacing
+	liquidity := calls[1].Outputs.(*dt.ResBigInt).Int
 
 	price := CalcPriceV3(slot0.Price, pool.Token0.Decimals, pool.Token1.Decimals)
 	// Calculate token0 and token1 reserves
 	token0Reserve, token1Reserve := CalcReserveV3(slot0.Tick, tickSpacing, liquidity, slot0.Price)
 
-	// u.SavePair(pool, price, token0Reserve, token1Reserve, blockNumber, u.Fee)
-	pair = u.CreatePair(pool, price, token0Reserve, token1Reserve, blockNumber, u.Fee)
+	// u.SavePair(pool, price, token0Reserve, token1Reserve, blockNumber, fee)
+	pair = u.CreatePair(pool, price, token0Reserve, token1Reserve, blockNumber, fee)
+	SetDepthV3(&pair, pool, &dt.ConcentratedState{SqrtPriceX96: slot0.Price, Tick: int32(slot0.Tick.Int64()), Liquidity: liquidity, TickSpacing: tickSpacing, TickBitmap: false}, DepthImpact(u.monitor))
 	u.monitor.Logger().Debug(pool.Token0.Symbol, "/", pool.Token1.Symbol, " price: ", price, " Pool: ", pool.Address,
 		" blockNumber: ", blockNumber, " reserves: ", token0Reserve, token1Reserve, u.Name)
 	return
@@ -5,6 +5,7 @@ import (
 	"math"
 	"math/big"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/xiangxn/go-multicall"
 
@@ -43,15 +44,26 @@ const MAX_TICK = 887272
 var Q96 = new(big.Int).Lsh(big.NewInt(1), 96)
 
 func (d *UniswapV3) GetType() uint8      { return 2 }
-func (d *UniswapV3) PriceCallCount() int { return 4 }
+func (d *UniswapV3) PriceCallCount() int { return 2 }
+
+func (u *UniswapV3) CreateParamsCall(pool *dt.SimplePool) []*multicall.Call {
+	return createFeeTickSpacingCall(u.Abi, pool)
+}
+
+func (u *UniswapV3) SetParams(calls []*multicall.Call, pool *dt.SimplePool) bool {
+	return setFeeTickSpacing(calls, pool)
+}
+
+func (u *UniswapV3) PoolSalt(pool *dt.SimplePool) ([]byte, bool) {
+	if pool.Params == nil {
+		return nil, false
+	}
+	return saltEncoded(pool, int64(math.Round(pool.Params.Fee*1e6))), true
+}
 
 func (u *UniswapV3) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
 	poolContract := multicall.Contract{ABI: u.Abi, Address: common.HexToAddress(pool.Address)}
-	call := poolContract.NewCall(new(dt.ResBigInt), "fee").Name(pool.Address).AllowFailure()
-	calls = append(calls, call)
-	call = poolContract.NewCall(new(dt.ResBigInt), "tickSpacing").Name(pool.Address).AllowFailure()
-	calls = append(calls, call)
-	call = poolContract.NewCall(new(Slot0), "slot0").Name(pool.Address).AllowFailure()
+	call := poolContract.NewCall(new(Slot0), "slot0").Name(pool.Address).AllowFailure()
 	calls = append(calls, call)
 	call = poolContract.NewCall(new(dt.ResBigInt), "liquidity").Name(pool.Address).AllowFailure()
 	calls = append(calls, call)
@@ -59,26 +71,60 @@ func (u *UniswapV3) CreatePriceCall(pool *dt.Pool) (calls []*multicall.Call) {
 }
 
 func (u *UniswapV3) CalcPrice(calls []*multicall.Call, blockNumber uint64, pool *dt.Pool) (pair dt.Pair) {
-	if len(calls) == 0 || calls[0].Failed || calls[1].Failed || calls[2].Failed || calls[3].Failed {
+	if len(calls) == 0 || calls[0].Failed || calls[1].Failed || pool.Params == nil {
 		return
 	}
 
-	slot0 := calls[2].Outputs.(*Slot0)
-	liquidity := calls[3].Outputs.(*dt.ResBigInt).Int
-	u.Fee = tools.PreservePrecision(float64(calls[0].Outputs.(*dt.ResBigInt).Uint64())*1e-6, 6)
-	tickSpacing := int32(calls[1].Outputs.(*dt.ResBigInt).Int64())
+	slot0 := calls[0].Outputs.(*Slot0)
+	liquidity := calls[1].Outputs.(*dt.ResBigInt).Int
+	tickSpacing := pool.Params.TickSpacing
 	price := CalcPriceV3(slot0.SqrtPriceX96, pool.Token0.Decimals, pool.Token1.Decimals)
 
 	// Calculate token0 and token1 reserves
 	token0Reserve, token1Reserve := CalcReserveV3(slot0.Tick, tickSpacing, liquidity, slot0.SqrtPriceX96)
 
-	// u.SavePair(pool, price, token0Reserve, token1Reserve, blockNumber, u.Fee)
-	pair = u.CreatePair(pool, price, token0Reserve, token1Reserve, blockNumber, u.Fee)
+	// u.SavePair(pool, price, token0Reserve, token1Reserve, blockNumber, pool.Params.Fee)
+	pair = u.CreatePair(pool, price, token0Reserve, token1Reserve, blockNumber, pool.Params.Fee)
+	SetDepthV3(&pair, pool, &dt.ConcentratedState{SqrtPriceX96: slot0.SqrtPriceX96, Tick: int32(slot0.Tick.Int64()), Liquidity: liquidity, TickSpacing: tickSpacing, TickBitmap: true}, DepthImpact(u.monitor))
 	u.monitor.Logger().Debug(pool.Token0.Symbol, "/", pool.Token1.Symbol, " price: ", price, " Pool: ", pool.Address,
 		" blockNumber: ", blockNumber, " reserves: ", token0Reserve, token1Reserve, u.Name)
 	return
 }
 
+// 创建查询固定手续费档位与tickSpacing的Call
+func createFeeTickSpacingCall(poolAbi *abi.ABI, pool *dt.SimplePool) (calls []*multicall.Call) {
+	poolContract := multicall.Contract{ABI: poolAbi, Address: common.HexToAddress(pool.Address)}
+	calls = append(calls, poolContract.NewCall(new(dt.ResBigInt), "fee").Name(pool.Address).AllowFailure())
+	calls = append(calls, poolContract.NewCall(new(dt.ResBigInt), "tickSpacing").Name(pool.Address).AllowFailure())
+	return
+}
+
+func setFeeTickSpacing(calls []*multicall.Call, pool *dt.SimplePool) bool {
+	if len(calls) < 2 || calls[0].Failed || calls[1].Failed {
+		return false
+	}
+	pool.Params = &dt.PoolParams{
+		Fee:         tools.PreservePrecision(float64(calls[0].Outputs.(*dt.ResBigInt).Uint64())*1e-6, 6),
+		TickSpacing: int32(calls[1].Outputs.(*dt.ResBigInt).Int64()),
+	}
+	return true
+}
+
+// 创建只查询tickSpacing的Call(用于手续费可变的池)
+func createTickSpacingCall(poolAbi *abi.ABI, pool *dt.SimplePool) (calls []*multicall.Call) {
+	poolContract := multicall.Contract{ABI: poolAbi, Address: common.HexToAddress(pool.Address)}
+	calls = append(calls, poolContract.NewCall(new(dt.ResBigInt), "tickSpacing").Name(pool.Address).AllowFailure())
+	return
+}
+
+func setTickSpacing(calls []*multicall.Call, pool *dt.SimplePool) bool {
+	if len(calls) < 1 || calls[0].Failed {
+		return false
+	}
+	pool.Params = &dt.PoolParams{TickSpacing: int32(calls[0].Outputs.(*dt.ResBigInt).Int64())}
+	return true
+}
+
 func CalcReserveV3(tick *big.Int, tickSpacing int32, liquidity, sqrtPriceX96 *big.Int) (token0Reserve, token1Reserve *big.Int) {
 	tickLower, tickUpper := GetLowerUpperTick(int32(tick.Int64()), tickSpacing)
 	priceLower := TickToSqrtPriceQ96(tickLower.Int64())
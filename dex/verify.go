@@ -0,0 +1,76 @@
+package dex
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/xiangxn/listener/config"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// UniswapV2类: keccak256(abi.encodePacked(token0, token1))
+func saltPacked(pool *dt.SimplePool) []byte {
+	return crypto.Keccak256(common.HexToAddress(pool.Token0).Bytes(), common.HexToAddress(pool.Token1).Bytes())
+}
+
+// keccak256(abi.encode(token0, token1, value...)), value为uint24/int24等数值
+func saltEncoded(pool *dt.SimplePool, values ...int64) []byte {
+	data := append(common.LeftPadBytes(common.HexToAddress(pool.Token0).Bytes(), 32), common.LeftPadBytes(common.HexToAddress(pool.Token1).Bytes(), 32)...)
+	for _, v := range values {
+		data = append(data, common.LeftPadBytes(big.NewInt(v).Bytes(), 32)...)
+	}
+	return crypto.Keccak256(data)
+}
+
+// 根据CREATE2规则计算池地址
+func ComputePoolAddress(deployer common.Address, salt []byte, initCodeHash common.Hash) common.Address {
+	return crypto.CreateAddress2(deployer, common.BytesToHash(salt), initCodeHash.Bytes())
+}
+
+// 验证池地址是否由声明的工厂创建, 返回通过验证的池与伪造的池地址
+// 没有配置init code hash或交易所不支持验证的池直接通过
+func VerifyPools(m dt.IMonitor, pools []dt.SimplePool) (result []dt.SimplePool, spoofed []string) {
+	for _, pool := range pools {
+		var dexConfig *config.DexConfig
+		for i, d := range m.Config().Dexs {
+			if d.Factory == pool.Factory && d.InitCodeHash != "" {
+				dexConfig = &m.Config().Dexs[i]
+				break
+			}
+		}
+		pp := m.GetPoolParams(pool.Factory)
+		if dexConfig == nil || pp == nil {
+			result = append(result, pool)
+			continue
+		}
+		salt, ok := pp.PoolSalt(&pool)
+		if !ok {
+			result = append(result, pool)
+			continue
+		}
+		deployer := dexConfig.Deployer
+		if deployer == "" {
+			deployer = dexConfig.Factory
+		}
+		expected := ComputePoolAddress(common.HexToAddress(deployer), salt, common.HexToHash(dexConfig.InitCodeHash))
+		if expected == common.HexToAddress(pool.Address) {
+			result = append(result, pool)
+			continue
+		}
+		spoofed = append(spoofed, pool.Address)
+		m.Logger().WithFields(logrus.Fields{"pool": pool.Address, "factory": pool.Factory, "expected": expected.Hex()}).Warn("伪造的池")
+		m.DB().SaveSpoofedPool(dt.SpoofedPool{
+			Address:   pool.Address,
+			Factory:   pool.Factory,
+			Token0:    pool.Token0,
+			Token1:    pool.Token1,
+			Expected:  expected.Hex(),
+			CreatedAt: time.Now(),
+		})
+	}
+	return
+}
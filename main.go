@@ -4,10 +4,15 @@ import (
 	"crypto/sha256"
 	"encoding/base32"
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/araddon/dateparse"
+	"github.com/elliotchance/pie/v2"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -37,9 +42,52 @@ func main() {
 		Use:   "arb",
 		Short: "Arbitrage command",
 		Run: func(cmd *cobra.Command, args []string) {
-			arbitrage(conf)
+			names, _ := cmd.Flags().GetStringSlice("strategy")
+			arbitrage(conf, names)
 		},
 	}
+	arbCmd.Flags().StringSliceP("strategy", "s", nil, "Strategies to run, overrides strategies.enabled in the configuration (available: "+strings.Join(strategies.Names(), ", ")+")")
+
+	var backtestCmd = &cobra.Command{
+		Use:   "backtest",
+		Short: "Replay historical blocks and report hypothetical arbitrage P&L without sending transactions",
+		Run: func(cmd *cobra.Command, args []string) {
+			from, _ := cmd.Flags().GetUint64("from")
+			to, _ := cmd.Flags().GetUint64("to")
+			names, _ := cmd.Flags().GetStringSlice("strategy")
+			backtest(conf, from, to, names)
+		},
+	}
+	backtestCmd.Flags().Uint64P("from", "f", 0, "First block of the backtest")
+	backtestCmd.Flags().Uint64P("to", "t", 0, "Last block of the backtest (requires an archive node)")
+	backtestCmd.Flags().StringSliceP("strategy", "s", nil, "Strategies to backtest, overrides strategies.enabled in the configuration (available: "+strings.Join(strategies.Names(), ", ")+")")
+	backtestCmd.MarkFlagRequired("from")
+	backtestCmd.MarkFlagRequired("to")
+
+	var tuneCmd = &cobra.Command{
+		Use:   "tune",
+		Short: "Search strategy parameters over a backtested block range",
+		Run: func(cmd *cobra.Command, args []string) {
+			from, _ := cmd.Flags().GetUint64("from")
+			to, _ := cmd.Flags().GetUint64("to")
+			names, _ := cmd.Flags().GetStringSlice("strategy")
+			params, _ := cmd.Flags().GetStringArray("param")
+			samples, _ := cmd.Flags().GetInt("samples")
+			seed, _ := cmd.Flags().GetInt64("seed")
+			out, _ := cmd.Flags().GetString("out")
+			tune(conf, from, to, names, params, samples, seed, out)
+		},
+	}
+	tuneCmd.Flags().Uint64P("from", "f", 0, "First block of the backtest")
+	tuneCmd.Flags().Uint64P("to", "t", 0, "Last block of the backtest (requires an archive node)")
+	tuneCmd.Flags().StringSliceP("strategy", "s", nil, "Strategies to backtest, overrides strategies.enabled in the configuration (available: "+strings.Join(strategies.Names(), ", ")+")")
+	tuneCmd.Flags().StringArrayP("param", "p", nil, "Parameter to search, name=v1,v2,... or name=min:max for random search (available: "+strings.Join(monitor.TuneParamNames(), ", ")+")")
+	tuneCmd.Flags().IntP("samples", "n", 0, "Number of random samples, 0 searches the full grid")
+	tuneCmd.Flags().Int64("seed", 0, "Random seed, 0 uses the current time")
+	tuneCmd.Flags().StringP("out", "o", "tune", "Output file name without extension, writes <out>.csv and <out>.json")
+	tuneCmd.MarkFlagRequired("from")
+	tuneCmd.MarkFlagRequired("to")
+	tuneCmd.MarkFlagRequired("param")
 
 	var statsCmd = &cobra.Command{
 		Use:   "stats",
@@ -57,6 +105,22 @@ func main() {
 	statsCmd.Flags().StringP("end", "E", "", "End date of statistics")
 	statsCmd.Flags().BoolP("simulate", "M", false, "When true, only simulated transactions are counted; when false, only real transactions are counted")
 
+	var competitorsCmd = &cobra.Command{
+		Use:   "competitors",
+		Short: "Find other arbitrage transactions on the pools of our transactions and list top competitors",
+		Run: func(cmd *cobra.Command, args []string) {
+			day, _ := cmd.Flags().GetInt("day")
+			start, _ := cmd.Flags().GetString("start")
+			end, _ := cmd.Flags().GetString("end")
+			top, _ := cmd.Flags().GetInt("top")
+			competitorsFun(conf, day, start, end, top)
+		},
+	}
+	competitorsCmd.Flags().IntP("day", "D", 1, "Analyze transactions of the last few days")
+	competitorsCmd.Flags().StringP("start", "S", "", "The analysis start date")
+	competitorsCmd.Flags().StringP("end", "E", "", "End date of analysis")
+	competitorsCmd.Flags().IntP("top", "T", 5, "Number of competitors listed per pool pair")
+
 	var decryptCmd = &cobra.Command{
 		Use:   "crypto",
 		Short: "Crypto command",
@@ -74,7 +138,10 @@ func main() {
 	decryptCmd.Flags().BoolP("encrypt", "E", false, "Encrypt the characters specified by the parameter")
 
 	rootCmd.AddCommand(arbCmd)
+	rootCmd.AddCommand(backtestCmd)
+	rootCmd.AddCommand(tuneCmd)
 	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(competitorsCmd)
 	rootCmd.AddCommand(decryptCmd)
 	rootCmd.Execute()
 }
@@ -131,7 +198,32 @@ func statsFun(conf config.Configuration, day int, start, end string, simulate bo
 	}
 }
 
-func arbitrage(conf config.Configuration) {
+func competitorsFun(conf config.Configuration, day int, start, end string, top int) {
+	sts := stats.New(conf)
+	if start != "" && end != "" {
+		sData, err := dateparse.ParseAny(start)
+		if err != nil {
+			panic(err)
+		}
+		eData, err := dateparse.ParseAny(end)
+		if err != nil {
+			panic(err)
+		}
+		sts.Competitors(sData, eData, top)
+	} else {
+		eData := time.Now()
+		sData := eData.AddDate(0, 0, -day)
+		sts.Competitors(sData, eData, top)
+	}
+}
+
+func arbitrage(conf config.Configuration, names []string) {
+	handler, err := strategies.New(&conf, names)
+	if err != nil {
+		fmt.Println("Error creating strategy:", err)
+		return
+	}
+
 	fmt.Print("Enter password: ")
 	passwordBytes, err := term.ReadPassword(int(syscall.Stdin))
 	fmt.Println()
@@ -154,7 +246,7 @@ func arbitrage(conf config.Configuration) {
 
 	opt := &dt.Options{
 		Cfg:     conf,
-		Handler: &strategies.MovingBrick{},
+		Handler: handler,
 		Logger:  l,
 		Cipher:  sha256.Sum256([]byte(password)),
 	}
@@ -166,3 +258,98 @@ func arbitrage(conf config.Configuration) {
 	monitor.Run()
 	monitor.Cancel()
 }
+
+func backtest(conf config.Configuration, from, to uint64, names []string) {
+	handler, err := strategies.New(&conf, names)
+	if err != nil {
+		fmt.Println("Error creating strategy:", err)
+		return
+	}
+
+	l := logrus.New()
+	l.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	if conf.Debug {
+		l.Level = logrus.DebugLevel
+	}
+
+	opt := &dt.Options{
+		Cfg:     conf,
+		Handler: handler,
+		Logger:  l,
+	}
+	report, err := monitor.Backtest(opt, from, to)
+	if report != nil {
+		fmt.Print(report)
+	}
+	if err != nil {
+		fmt.Println("Error running backtest:", err)
+	}
+}
+
+func tune(conf config.Configuration, from, to uint64, names []string, args []string, samples int, seed int64, out string) {
+	var params []monitor.TuneParam
+	for _, arg := range args {
+		p, err := monitor.ParseTuneParam(arg)
+		if err != nil {
+			fmt.Println("Error parsing parameter:", err)
+			return
+		}
+		if pie.Contains(pie.Map(params, func(tp monitor.TuneParam) string { return tp.Name }), p.Name) {
+			fmt.Println("Error parsing parameter: duplicate parameter", p.Name)
+			return
+		}
+		params = append(params, p)
+	}
+	var sets [][]float64
+	if samples > 0 {
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		sets = monitor.TuneRandom(params, samples, rand.New(rand.NewSource(seed)))
+	} else {
+		var err error
+		if sets, err = monitor.TuneGrid(params); err != nil {
+			fmt.Println("Error creating grid:", err)
+			return
+		}
+	}
+
+	handler, err := strategies.New(&conf, names)
+	if err != nil {
+		fmt.Println("Error creating strategy:", err)
+		return
+	}
+
+	l := logrus.New()
+	l.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	if conf.Debug {
+		l.Level = logrus.DebugLevel
+	}
+
+	opt := &dt.Options{
+		Cfg:     conf,
+		Handler: handler,
+		Logger:  l,
+	}
+	results, err := monitor.Tune(opt, from, to, params, sets)
+	if err != nil {
+		fmt.Println("Error running tune:", err)
+	}
+	if len(results) == 0 {
+		return
+	}
+	monitor.WriteTuneCSV(os.Stdout, params, results)
+	writeFile := func(name string, write func(w io.Writer) error) {
+		f, err := os.Create(name)
+		if err != nil {
+			fmt.Println("Error creating file:", err)
+			return
+		}
+		defer f.Close()
+		if err := write(f); err != nil {
+			fmt.Println("Error writing file:", err)
+		}
+	}
+	writeFile(out+".csv", func(w io.Writer) error { return monitor.WriteTuneCSV(w, params, results) })
+	writeFile(out+".json", func(w io.Writer) error { return monitor.WriteTuneJSON(w, results) })
+}
@@ -0,0 +1,467 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/xiangxn/listener/config"
+	"github.com/xiangxn/listener/database"
+	"github.com/xiangxn/listener/dex"
+	si "github.com/xiangxn/listener/simulation"
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
+)
+
+const DEFAULT_BACKTEST_LOG_RANGE = 100
+
+// 回测中假设成交的套利
+type BacktestFill struct {
+	BlockNumber uint64
+	Strategy    string
+	BuyPool     string
+	SellPool    string
+	// 多跳套利经过的池
+	Path      []string
+	BaseToken string
+	Amount    float64
+	// 扣除gas后的净利润, 失败时为gas成本的负数
+	ProfitUSD float64
+	GasUSD    float64
+	// 在区块上eth_call交易的revert原因, 为空表示成功或未验证
+	Error string
+}
+
+// 每个策略的回测统计
+type BacktestSummary struct {
+	Opportunities int
+	Fills         int
+	Failed        int
+	GasUSD        float64
+	ProfitUSD     float64
+}
+
+// 回测的盈亏报告
+type BacktestReport struct {
+	FromBlock uint64
+	ToBlock   uint64
+	// 有事件的区块数
+	Blocks int
+	// 预处理后的事件数
+	Events int
+	// 计算出的套利机会数(包括冲突丢弃的)
+	Opportunities int
+	// 与利润更高的套利冲突或超出区块交易上限而丢弃的数量
+	Dropped int
+	// 按event_waiting_time等待后已经是下一个区块而放弃的区块数
+	Missed int
+	Fills  []BacktestFill
+	// 是否用eth_call验证了成交, 需要配置trader_contract与backtest.from
+	Verified   bool
+	Failed     int
+	GasUSD     float64
+	ProfitUSD  float64
+	Strategies map[string]*BacktestSummary
+}
+
+func NewBacktestReport(from, to uint64) *BacktestReport {
+	return &BacktestReport{FromBlock: from, ToBlock: to, Strategies: make(map[string]*BacktestSummary)}
+}
+
+func (r *BacktestReport) summary(strategy string) *BacktestSummary {
+	s, ok := r.Strategies[strategy]
+	if !ok {
+		s = &BacktestSummary{}
+		r.Strategies[strategy] = s
+	}
+	return s
+}
+
+// 记录一个区块的结果, selected与dropped为Schedule的结果
+// errs为selected中每个套利验证时的revert原因(为空表示成功), 没有验证时为nil; gasTokenUSD为该区块gas token的USD价格
+func (r *BacktestReport) AddBlock(blockNumber uint64, events int, selected, dropped []*dt.Arbitrage, errs []string, gasTokenUSD float64) {
+	r.Blocks++
+	r.Events += events
+	r.Opportunities += len(selected) + len(dropped)
+	r.Dropped += len(dropped)
+	for _, a := range dropped {
+		r.summary(a.Strategy).Opportunities++
+	}
+	for i, a := range selected {
+		fill := BacktestFill{
+			BlockNumber: blockNumber,
+			Strategy:    a.Strategy,
+			BuyPool:     a.BuyPool.Pool,
+			SellPool:    a.SellPool.Pool,
+			BaseToken:   a.BaseToken,
+			Amount:      a.Amount,
+			ProfitUSD:   a.ProfitUSD,
+			GasUSD:      float64(a.Gas) * a.GasPrice * gasTokenUSD,
+		}
+		for _, leg := range a.Legs {
+			fill.Path = append(fill.Path, leg.Pool)
+		}
+		s := r.summary(a.Strategy)
+		if i < len(errs) && errs[i] != "" {
+			// 失败的交易没有利润, 按消耗全部预估gas计算
+			fill.Error = errs[i]
+			fill.ProfitUSD = -fill.GasUSD
+			r.Failed++
+			s.Failed++
+		}
+		r.Fills = append(r.Fills, fill)
+		r.GasUSD += fill.GasUSD
+		r.ProfitUSD += fill.ProfitUSD
+		s.Opportunities++
+		s.Fills++
+		s.GasUSD += fill.GasUSD
+		s.ProfitUSD += fill.ProfitUSD
+	}
+}
+
+// 验证失败的成交比例, 没有成交时为0
+func (r *BacktestReport) FailureRate() float64 {
+	if len(r.Fills) == 0 {
+		return 0
+	}
+	return float64(r.Failed) / float64(len(r.Fills))
+}
+
+func (r *BacktestReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Backtest blocks %d-%d\n", r.FromBlock, r.ToBlock)
+	fmt.Fprintf(&b, "Blocks with events: %d, missed: %d, events: %d, opportunities: %d, dropped: %d, fills: %d\n",
+		r.Blocks, r.Missed, r.Events, r.Opportunities, r.Dropped, len(r.Fills))
+	if r.Verified {
+		fmt.Fprintf(&b, "Failed: %d (%.2f%%)\n", r.Failed, r.FailureRate()*100)
+	} else {
+		fmt.Fprintf(&b, "Fills were not verified, set trader_contract and backtest.from to eth_call them\n")
+	}
+	fmt.Fprintf(&b, "Gas(USD): %.4f, Gross profit(USD): %.4f, Net profit(USD): %.4f\n", r.GasUSD, r.ProfitUSD+r.GasUSD, r.ProfitUSD)
+	names := make([]string, 0, len(r.Strategies))
+	for name := range r.Strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := r.Strategies[name]
+		fmt.Fprintf(&b, "  [%s] opportunities: %d, fills: %d, failed: %d, gas(USD): %.4f, net profit(USD): %.4f\n",
+			name, s.Opportunities, s.Fills, s.Failed, s.GasUSD, s.ProfitUSD)
+	}
+	for _, f := range r.Fills {
+		pools := fmt.Sprintf("%s -> %s", f.BuyPool, f.SellPool)
+		if len(f.Path) > 0 {
+			pools = strings.Join(f.Path, " -> ")
+		}
+		status := ""
+		if f.Error != "" {
+			status = ", reverted: " + f.Error
+		}
+		fmt.Fprintf(&b, "  #%d [%s] %s amount: %.6f %s, gas(USD): %.4f, net profit(USD): %.4f%s\n",
+			f.BlockNumber, f.Strategy, pools, f.Amount, f.BaseToken, f.GasUSD, f.ProfitUSD, status)
+	}
+	return b.String()
+}
+
+// 事件区块回测需要的数据, 价格在第一次运行时记录, 之后的运行直接重放
+type backtestBlock struct {
+	number     uint64
+	events     int
+	eventPools []dt.SimplePool
+	// 订阅了其他事件的策略(如清算)在该区块匹配的事件
+	logs     []types.Log
+	recorded bool
+	// 获取价格时的区块, 为0表示获取失败
+	priceBlock uint64
+	pairs      []dt.Pair
+	baseFee    *big.Int
+	balances   map[string]float64
+	gasPrice   float64
+	// 到下一个区块的毫秒数, 为0表示还没获取
+	interval int64
+}
+
+// 在同一段历史区块上多次回测(如参数搜索), 事件只获取一次, 价格只从归档节点读取一次
+type Backtester struct {
+	m      *monitor
+	from   uint64
+	to     uint64
+	blocks []*backtestBlock
+	swaps  []dt.SwapParams
+}
+
+// 创建回测器: 获取[from, to]区块的swap事件并预处理(拉取池与token信息)
+// 使用独立的数据库, 不能与实时运行的数据库相同
+func NewBacktester(opt *dt.Options, from, to uint64) (*Backtester, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid block range %d-%d", from, to)
+	}
+	dbName := opt.Cfg.Backtest.Database
+	if dbName == "" {
+		dbName = fmt.Sprintf("%slistener_backtest", opt.Cfg.NetName)
+	}
+	if dbName == fmt.Sprintf("%slistener", opt.Cfg.NetName) {
+		return nil, fmt.Errorf("backtest database %s is the live database", dbName)
+	}
+	// 在初始化base token与借贷池之前清空, 避免读到上次回测的价格
+	db := database.Actions{DB: database.GetClient(opt.Cfg).Database(dbName), Mctx: context.Background(), Logger: opt.Logger}
+	if err := db.ClearPairs(); err != nil {
+		return nil, err
+	}
+	m, err := newMonitor(opt, dbName)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backtester{m: m, from: from, to: to}
+	m.backtestSwap = func(params dt.SwapParams) { b.swaps = append(b.swaps, params) }
+
+	logRange := opt.Cfg.Backtest.LogRange
+	if logRange == 0 {
+		logRange = DEFAULT_BACKTEST_LOG_RANGE
+	}
+	query := m.swapQuery()
+	for start := from; start <= to; start += logRange {
+		end := min(start+logRange-1, to)
+		query.FromBlock = new(big.Int).SetUint64(start)
+		query.ToBlock = new(big.Int).SetUint64(end)
+		logs, err := m.httpClient.FilterLogs(m.ctx, query)
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("FilterLogs %d-%d: %w", start, end, err)
+		}
+		blocks := make(map[uint64]*backtestBlock)
+		for _, blockLogs := range groupLogsByBlock(logs) {
+			events := m.preprocessEvent(blockLogs)
+			events, eventPools := m.filterLog(events)
+			if len(eventPools) == 0 {
+				continue
+			}
+			blocks[blockLogs[0].BlockNumber] = &backtestBlock{number: blockLogs[0].BlockNumber, events: len(events), eventPools: eventPools}
+		}
+		if err := b.fetchHandlerLogs(blocks, start, end); err != nil {
+			b.Close()
+			return nil, err
+		}
+		for _, number := range pie.Sort(pie.Keys(blocks)) {
+			b.blocks = append(b.blocks, blocks[number])
+		}
+		m.logger.Info(fmt.Sprintf("回测获取事件: %d/%d, 有事件的区块: %d", end, to, len(b.blocks)))
+	}
+	return b, nil
+}
+
+// 获取订阅了其他事件的策略在[start, end]区块的事件, 没有交易池事件的区块也加入回测
+func (b *Backtester) fetchHandlerLogs(blocks map[uint64]*backtestBlock, start, end uint64) error {
+	m := b.m
+	addresses, topics := m.logFilter()
+	if len(addresses) == 0 {
+		return nil
+	}
+	query := ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(start),
+		ToBlock:   new(big.Int).SetUint64(end),
+		Addresses: addresses,
+		Topics:    [][]common.Hash{topics},
+	}
+	logs, err := m.httpClient.FilterLogs(m.ctx, query)
+	if err != nil {
+		return fmt.Errorf("FilterLogs %d-%d: %w", start, end, err)
+	}
+	for _, vLog := range logs {
+		if vLog.Removed {
+			continue
+		}
+		blk, ok := blocks[vLog.BlockNumber]
+		if !ok {
+			blk = &backtestBlock{number: vLog.BlockNumber}
+			blocks[vLog.BlockNumber] = blk
+		}
+		blk.logs = append(blk.logs, vLog)
+	}
+	return nil
+}
+
+func (b *Backtester) Close() {
+	b.m.cancel()
+	dex.ReleaseBinCache(b.m)
+	database.Close()
+}
+
+// 使用cfg运行一次回测, cfg只能修改策略相关的参数(池与base token需要与创建回测器时一致)
+func (b *Backtester) Run(cfg config.Configuration) (*BacktestReport, error) {
+	m := b.m
+	m.cfg = cfg
+	if err := m.database.(database.Actions).ClearPairs(); err != nil {
+		return nil, err
+	}
+	m.baseBalance = make(map[string]float64)
+	report := NewBacktestReport(b.from, b.to)
+	report.Verified = cfg.TraderContract != "" && cfg.Backtest.From != ""
+	for i, blk := range b.blocks {
+		b.runBlock(report, blk)
+		if (i+1)%100 == 0 {
+			m.logger.Info(fmt.Sprintf("回测进度: %d/%d, 机会: %d, 成交: %d, 净利润(USD): %.4f", i+1, len(b.blocks), report.Opportunities, len(report.Fills), report.ProfitUSD))
+		}
+	}
+	m.callOpts = nil
+	return report, nil
+}
+
+// 回测: 重放[from, to]区块的swap事件, 在每个事件区块通过归档节点读取价格并计算套利, 不发送任何交易
+func Backtest(opt *dt.Options, from, to uint64) (*BacktestReport, error) {
+	b, err := NewBacktester(opt, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	return b.Run(opt.Cfg)
+}
+
+// 按区块分组, 同一区块中同一个池只保留最后一次事件(与实时运行的cacheEvent一致)
+func groupLogsByBlock(logs []types.Log) (blocks [][]types.Log) {
+	sort.SliceStable(logs, func(i, j int) bool {
+		if logs[i].BlockNumber != logs[j].BlockNumber {
+			return logs[i].BlockNumber < logs[j].BlockNumber
+		}
+		return logs[i].Index < logs[j].Index
+	})
+	var current []types.Log
+	index := make(map[common.Address]int)
+	for _, vLog := range logs {
+		if vLog.Removed {
+			continue
+		}
+		if len(current) > 0 && current[0].BlockNumber != vLog.BlockNumber {
+			blocks = append(blocks, current)
+			current = nil
+			index = make(map[common.Address]int)
+		}
+		if i, ok := index[vLog.Address]; ok {
+			current[i] = vLog
+			continue
+		}
+		index[vLog.Address] = len(current)
+		current = append(current, vLog)
+	}
+	if len(current) > 0 {
+		blocks = append(blocks, current)
+	}
+	return
+}
+
+// 在事件所在区块计算套利, 按实时运行的规则选出成交的套利并记录到报告
+func (b *Backtester) runBlock(report *BacktestReport, blk *backtestBlock) {
+	m := b.m
+	m.callOpts = &bind.CallOpts{Context: m.ctx, BlockNumber: new(big.Int).SetUint64(blk.number)}
+	if !blk.recorded {
+		b.record(blk)
+	} else {
+		m.database.SetBlockNumber(blk.priceBlock)
+		m.database.SavePairs(blk.pairs)
+		m.Lock()
+		m.baseFee = blk.baseFee
+		maps.Copy(m.baseBalance, blk.balances)
+		m.Unlock()
+	}
+	m.gasPrice = blk.gasPrice
+	// 与实时运行一致, 订阅了其他事件的策略的套利与交易池事件的套利一起调度
+	var arbitrages []*dt.Arbitrage
+	if lh, ok := m.handler.(dt.LogHandler); ok {
+		arbitrages = lh.HandleLogs(m, blk.logs, blk.number, m.gasPrice*m.cfg.GasTimes)
+	}
+	if b.priced(report, blk) {
+		arbitrages = append(arbitrages, m.calcArbitrages(blk.eventPools, blk.priceBlock)...)
+	}
+	selected, dropped := Schedule(arbitrages, m.cfg.MaxTradesPerBlock)
+	var errs []string
+	if report.Verified {
+		errs = b.verify(blk.number, selected)
+	}
+	conf := m.cfg.Strategies.GasToken
+	gasTokenUSD := m.database.GetBasePrice(conf.Base, conf.Quote)
+	report.AddBlock(blk.number, blk.events, selected, dropped, errs, gasTokenUSD)
+}
+
+// 交易池事件的价格是否可用于计算套利
+func (b *Backtester) priced(report *BacktestReport, blk *backtestBlock) bool {
+	if len(blk.eventPools) == 0 || blk.priceBlock == 0 || blk.priceBlock > blk.number {
+		return false
+	}
+	// 实时运行时等待event_waiting_time后才获取价格, 已经到下一个区块时会放弃这些事件
+	if b.m.cfg.EventWaitingTime > 0 {
+		if interval := b.interval(blk); interval > 0 && int64(b.m.cfg.EventWaitingTime) >= interval {
+			report.Missed++
+			return false
+		}
+	}
+	return true
+}
+
+// 从归档节点读取区块的价格与gas price并记录
+func (b *Backtester) record(blk *backtestBlock) {
+	m := b.m
+	blk.gasPrice = m.cfg.GasPrice
+	header, err := m.httpClient.HeaderByNumber(m.ctx, new(big.Int).SetUint64(blk.number))
+	if err != nil {
+		m.logger.Error("获取区块头失败:", err)
+	} else if header.BaseFee != nil {
+		blk.gasPrice = tools.BigIntToFloat64(header.BaseFee, 18) + m.cfg.GasBid.Policy(m.chainId.String()).MinPriorityFee
+	}
+	if len(blk.eventPools) > 0 {
+		blk.priceBlock, blk.pairs = m.fetchPrice(blk.eventPools)
+	}
+	m.RLock()
+	blk.baseFee = m.baseFee
+	blk.balances = maps.Clone(m.baseBalance)
+	m.RUnlock()
+	blk.recorded = true
+}
+
+// 事件区块到下一个区块的毫秒数, 获取失败时返回0
+func (b *Backtester) interval(blk *backtestBlock) int64 {
+	if blk.interval > 0 {
+		return blk.interval
+	}
+	m := b.m
+	header, err := m.httpClient.HeaderByNumber(m.ctx, new(big.Int).SetUint64(blk.number))
+	if err != nil {
+		return 0
+	}
+	next, err := m.httpClient.HeaderByNumber(m.ctx, new(big.Int).SetUint64(blk.number+1))
+	if err != nil {
+		return 0
+	}
+	blk.interval = int64(next.Time-header.Time) * 1000
+	return blk.interval
+}
+
+// 让策略生成交易参数, 在事件区块上eth_call套利合约, 返回每个套利的revert原因
+func (b *Backtester) verify(blockNumber uint64, selected []*dt.Arbitrage) (errs []string) {
+	m := b.m
+	from := common.HexToAddress(m.cfg.Backtest.From)
+	to := common.HexToAddress(m.cfg.TraderContract)
+	bn := new(big.Int).SetUint64(blockNumber)
+	errs = make([]string, len(selected))
+	for i, a := range selected {
+		b.swaps = b.swaps[:0]
+		m.handler.Do(m, a)
+		if len(b.swaps) == 0 {
+			continue
+		}
+		params := m.fillSwapTypes(b.swaps[0])
+		data := packSwapData(params, m.handler.GetBaseDecimals(params.BaseToken))
+		_, err := m.httpClient.CallContract(m.ctx, ethereum.CallMsg{From: from, To: &to, Data: data}, bn)
+		if err != nil {
+			errs[i] = si.RevertReason(err)
+		}
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package monitor
+
+import (
+	"fmt"
+
+	"github.com/xiangxn/listener/config"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// 按利润比例计算gas出价
+// profitUSD为按estGasPrice扣除gas后的净利润, gasTokenUSD为gas token的USD价格
+// 策略未配置利润比例或缺少数据时使用suggested(SuggestGasPrice*gas_times)
+// 提高到最低优先费后gas成本超过毛利润时标记为Unprofitable
+func BidGas(policy config.GasBidPolicy, baseFee, suggested, profitUSD, estGasPrice float64, gas int64, gasTokenUSD float64) (bid dt.GasBid) {
+	bid.BaseFee = baseFee
+	if policy.ProfitShare <= 0 || gas <= 0 || gasTokenUSD <= 0 {
+		bid.GasPrice = suggested
+		bid.FeeCap = suggested
+		bid.PriorityFee = max(suggested-baseFee, 0)
+		bid.Reason = fmt.Sprintf("suggested %.4f gwei", suggested*1e9)
+		return
+	}
+	grossUSD := profitUSD + float64(gas)*estGasPrice*gasTokenUSD
+	grossPerGas := grossUSD / gasTokenUSD / float64(gas)
+	budget := policy.ProfitShare * grossPerGas
+	bid.PriorityFee = budget - baseFee
+	bid.Reason = fmt.Sprintf("%.0f%% of %.4f USD gross profit, %.4f gwei/gas", policy.ProfitShare*100, grossUSD, budget*1e9)
+	if bid.PriorityFee < policy.MinPriorityFee {
+		bid.PriorityFee = policy.MinPriorityFee
+		bid.Reason += ", raised to min priority fee"
+		if baseFee+bid.PriorityFee > grossPerGas {
+			bid.Unprofitable = true
+			bid.Reason += ", exceeds gross profit"
+		}
+	}
+	if policy.MaxPriorityFee > 0 && bid.PriorityFee > policy.MaxPriorityFee {
+		bid.PriorityFee = policy.MaxPriorityFee
+		bid.Reason += ", capped at max priority fee"
+	}
+	multiplier := policy.BaseFeeMultiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	bid.GasPrice = baseFee + bid.PriorityFee
+	bid.FeeCap = baseFee*multiplier + bid.PriorityFee
+	return
+}
+
+// 根据当前链的出价策略计算交易的gas出价
+func (m *monitor) bidGas(params dt.SwapParams) dt.GasBid {
+	baseFee := m.getBaseFee()
+	conf := m.cfg.Strategies.GasToken
+	gasTokenUSD := m.database.GetBasePrice(conf.Base, conf.Quote)
+	policy := m.cfg.GasBid.Policy(m.chainId.String())
+	return BidGas(policy, baseFee, params.GasPrice, params.ProfitUSD, params.GasPrice, params.Gas, gasTokenUSD)
+}
@@ -17,6 +17,7 @@ import (
 
 	"github.com/elliotchance/pie/v2"
 	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -57,8 +58,82 @@ func createQuery(configEvents []config.DexConfig) ethereum.FilterQuery {
 	return query
 }
 
+// 订阅交易所事件的查询, 包括交易所额外的Swap事件格式
+func (m *monitor) swapQuery() ethereum.FilterQuery {
+	query := createQuery(m.cfg.Dexs)
+	for _, d := range m.dexs {
+		if f, ok := d.(SwapLogFilter); ok {
+			query.Topics[0] = append(query.Topics[0], f.SwapTopics()...)
+		}
+	}
+	query.Topics[0] = pie.Unique(query.Topics[0])
+	return query
+}
+
+// 按配置创建交易所, 不支持的交易所返回nil
+// 添加新交易所时需要在这里添加对应的类型
+func NewDex(d config.DexConfig, m dt.IMonitor) IDex {
+	switch d.Name {
+	case "UniswapV2":
+		return dex.GetDex[dex.UniswapV2](d, m)
+	case "UniswapV3":
+		return dex.GetDex[dex.UniswapV3](d, m)
+	case "SushiSwap":
+		return dex.GetDex[dex.SushiSwap](d, m)
+	case "SushiSwapV3":
+		return dex.GetDex[dex.UniswapV3](d, m)
+	case "PancakeV3":
+		return dex.GetDex[dex.PancakeV3](d, m)
+	case "PancakeV2":
+		return dex.GetDex[dex.PancakeV2](d, m)
+	case "SolidlyV3":
+		return dex.GetDex[dex.SolidlyV3](d, m)
+	case "DefiSwap":
+		return dex.GetDex[dex.DefiSwap](d, m)
+	case "ShibaSwap":
+		return dex.GetDex[dex.ShibaSwap](d, m)
+	case "Thena":
+		return dex.GetDex[dex.Thena](d, m)
+	case "ApeSwap":
+		return dex.GetDex[dex.ApeSwap](d, m)
+	case "Biswap":
+		return dex.GetDex[dex.Biswap](d, m)
+	case "MDEX":
+		return dex.GetDex[dex.MDEX](d, m)
+	case "Aerodrome":
+		return dex.GetDex[dex.Aerodrome](d, m)
+	case "SolidlyV2":
+		return dex.GetDex[dex.SolidlyV2](d, m)
+	case "AlgebraIntegral":
+		return dex.GetDex[dex.AlgebraIntegral](d, m)
+	case "CamelotV3":
+		return dex.GetDex[dex.CamelotV3](d, m)
+	case "LiquidityBook":
+		return dex.GetDex[dex.LiquidityBook](d, m)
+	case "DODO":
+		return dex.GetDex[dex.DODO](d, m)
+	}
+	return nil
+}
+
+// 配置的交易所的全部Swap事件topic, 包括交易所额外的Swap事件格式
+func SwapTopics(dexs []config.DexConfig) (topics []common.Hash) {
+	for _, d := range dexs {
+		topics = append(topics, common.HexToHash(d.Topic))
+		if f, ok := NewDex(d, nil).(SwapLogFilter); ok {
+			topics = append(topics, f.SwapTopics()...)
+		}
+	}
+	return pie.Unique(topics)
+}
+
 // New 初始化eth 监控器
 func New(opt *dt.Options) (dt.IMonitor, error) {
+	return newMonitor(opt, fmt.Sprintf("%slistener", opt.Cfg.NetName))
+}
+
+// 使用指定的数据库创建监控器
+func newMonitor(opt *dt.Options, dbName string) (*monitor, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	// client, err := ethclient.DialContext(ctx, opt.Cfg.Rpcs.Ws)
 	// if err != nil {
@@ -83,11 +158,15 @@ func New(opt *dt.Options) (dt.IMonitor, error) {
 		baseBalance:        make(map[string]float64),
 		gasPrice:           opt.Cfg.GasPrice, // default: 2GWei
 		database: database.Actions{
-			DB:     database.GetClient(opt.Cfg).Database(fmt.Sprintf("%slistener", opt.Cfg.NetName)),
+			DB:     database.GetClient(opt.Cfg).Database(dbName),
 			Mctx:   ctx,
 			Logger: opt.Logger,
+			Oracle: database.NewPriceOracle(opt.Cfg),
 		},
-		cipher: opt.Cipher,
+		cipher:      opt.Cipher,
+		risk:        NewRiskManager(opt.Cfg.Risk),
+		nonces:      NewNonceManager(httpClient.PendingNonceAt),
+		inventoryCh: make(chan struct{}, 1),
 	}
 	// opt.Cipher = [32]byte{}
 	// 获取chain id
@@ -123,37 +202,9 @@ func New(opt *dt.Options) (dt.IMonitor, error) {
 		m.logger.Infof("Failed to read file '%s'.", tefn)
 	}
 	m.tokenErc20a = pie.Unique(m.tokenErc20a)
-	// 添加新交易所时需要在这里添加对应的类型
 	for _, d := range m.cfg.Dexs {
-		switch d.Name {
-		case "UniswapV2":
-			m.dexs[d.Factory] = dex.GetDex[dex.UniswapV2](d, m)
-		case "UniswapV3":
-			m.dexs[d.Factory] = dex.GetDex[dex.UniswapV3](d, m)
-		case "SushiSwap":
-			m.dexs[d.Factory] = dex.GetDex[dex.SushiSwap](d, m)
-		case "SushiSwapV3":
-			m.dexs[d.Factory] = dex.GetDex[dex.UniswapV3](d, m)
-		case "PancakeV3":
-			m.dexs[d.Factory] = dex.GetDex[dex.PancakeV3](d, m)
-		case "PancakeV2":
-			m.dexs[d.Factory] = dex.GetDex[dex.PancakeV2](d, m)
-		case "SolidlyV3":
-			m.dexs[d.Factory] = dex.GetDex[dex.SolidlyV3](d, m)
-		case "DefiSwap":
-			m.dexs[d.Factory] = dex.GetDex[dex.DefiSwap](d, m)
-		case "ShibaSwap":
-			m.dexs[d.Factory] = dex.GetDex[dex.ShibaSwap](d, m)
-		case "Thena":
-			m.dexs[d.Factory] = dex.GetDex[dex.Thena](d, m)
-		case "ApeSwap":
-			m.dexs[d.Factory] = dex.GetDex[dex.ApeSwap](d, m)
-		case "Biswap":
-			m.dexs[d.Factory] = dex.GetDex[dex.Biswap](d, m)
-		case "MDEX":
-			m.dexs[d.Factory] = dex.GetDex[dex.MDEX](d, m)
-		case "Aerodrome":
-			m.dexs[d.Factory] = dex.GetDex[dex.Aerodrome](d, m)
+		if idex := NewDex(d, m); idex != nil {
+			m.dexs[d.Factory] = idex
 		}
 	}
 	m.InitBaseTokens()
@@ -176,11 +227,31 @@ func (m *monitor) clearCacheEvent() {
 func (m *monitor) cacheEvent(vLog types.Log) {
 	m.logger.WithField(FieldTag, "New Event").Debug(vLog.BlockNumber, vLog.Address, vLog.TxIndex, vLog.Index)
 	if !vLog.Removed && (m.currentBlockNumber == 0 || m.currentBlockNumber == vLog.BlockNumber) {
-		m.cacheEvents[vLog.Address] = vLog
+		if m.isHandlerLog(vLog) {
+			m.handlerLogs = append(m.handlerLogs, vLog)
+		} else {
+			m.cacheEvents[vLog.Address] = vLog
+		}
 	}
 	m.currentBlockNumber = vLog.BlockNumber
 }
 
+// 策略额外订阅的事件, 策略没有实现dt.LogHandler时为空
+func (m *monitor) logFilter() (addresses []common.Address, topics []common.Hash) {
+	if lh, ok := m.handler.(dt.LogHandler); ok {
+		return lh.LogFilter()
+	}
+	return
+}
+
+func (m *monitor) isHandlerLog(vLog types.Log) bool {
+	if len(vLog.Topics) == 0 {
+		return false
+	}
+	addresses, topics := m.logFilter()
+	return pie.Contains(addresses, vLog.Address) && pie.Contains(topics, vLog.Topics[0])
+}
+
 // 预处理事件(包括拉取池信息与token信息)
 func (m *monitor) preprocessEvent(logs []types.Log) []types.Log {
 	//过滤掉池黑名单中的地址
@@ -195,7 +266,7 @@ func (m *monitor) preprocessEvent(logs []types.Log) []types.Log {
 func (m *monitor) checkEvent() {
 	// fmt.Println("000")
 	elength := len(m.cacheEvents)
-	if elength == 0 {
+	if elength == 0 && len(m.handlerLogs) == 0 {
 		// m.logger.Info("Waiting for an event...")
 		return
 	}
@@ -204,8 +275,10 @@ func (m *monitor) checkEvent() {
 	for _, vLog := range m.cacheEvents {
 		events = append(events, vLog)
 	}
+	handlerLogs, blockNumber := m.handlerLogs, m.currentBlockNumber
 	// 清理缓存
 	m.clearCacheEvent()
+	m.handlerLogs = nil
 	m.currentBlockNumber = 0
 
 	// 预处理事件
@@ -231,6 +304,24 @@ func (m *monitor) checkEvent() {
 	wg.Wait()
 	m.logger.Info("本次预处理共", len(events), "个事件, 共用时: ", time.Since(t), fmt.Sprintf(", 最新GasPrice: %.18f", m.gasPrice))
 
+	// 每批事件都交给订阅了其他事件的策略, 即使本批中没有它订阅的事件
+	// 它返回的套利(如清算)与交易池事件的套利一起调度
+	var logArbitrages []*dt.Arbitrage
+	if lh, ok := m.handler.(dt.LogHandler); ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logArbitrages = lh.HandleLogs(m, handlerLogs, blockNumber, m.gasPrice*m.cfg.GasTimes)
+		}()
+	}
+
+	arbitrages := m.calcEvents(events)
+	wg.Wait()
+	m.doArbitrages(append(arbitrages, logArbitrages...))
+}
+
+// 获取事件相关池的价格并计算套利, events需要已经预处理
+func (m *monitor) calcEvents(events []types.Log) (arbitrages []*dt.Arbitrage) {
 	var eventPools []dt.SimplePool
 	events, eventPools = m.filterLog(events)
 	if len(eventPools) < 1 {
@@ -239,25 +330,54 @@ func (m *monitor) checkEvent() {
 	m.logger.Info(fmt.Sprintf("有%d个事件需要计算套利。。。", len(events)))
 	// 获取事件相关所有池的价格
 	eventBlockNumber := events[0].BlockNumber
-	t = time.Now()
-	blockNumber := m.fetchPrice(eventPools)
+	t := time.Now()
+	blockNumber, _ := m.fetchPrice(eventPools)
 	m.logger.Info(fmt.Sprintf("获取事件相关交易对价格[%d]个, 共用时: %s", len(eventPools), time.Since(t)))
 	if blockNumber > eventBlockNumber || blockNumber == 0 {
 		return
 	}
+	return m.calcArbitrages(eventPools, blockNumber)
+}
 
+// 根据已更新的价格并发计算事件的套利
+func (m *monitor) calcArbitrages(eventPools []dt.SimplePool, blockNumber uint64) (arbitrages []*dt.Arbitrage) {
 	// 处理事件数据, 根据并发限制数来处理
+	var wg sync.WaitGroup
+	var mu sync.Mutex
 	ch := make(chan struct{}, m.cfg.MaxConcurrent)
 	for _, e := range eventPools {
 		ch <- struct{}{}
+		wg.Add(1)
 		go func(event dt.SimplePool, bn uint64) {
-			m.processEvent(event, bn)
+			defer wg.Done()
+			if found := m.processEvent(event, bn); len(found) > 0 {
+				mu.Lock()
+				arbitrages = append(arbitrages, found...)
+				mu.Unlock()
+			}
 			<-ch
 		}(e, blockNumber)
 	}
+	wg.Wait()
+	return
+}
+
+// 对同一区块的套利去除冲突后执行
+func (m *monitor) doArbitrages(arbitrages []*dt.Arbitrage) {
+	selected, dropped := Schedule(arbitrages, m.cfg.MaxTradesPerBlock)
+	for _, a := range dropped {
+		m.logger.WithFields(logrus.Fields{
+			"BuyPool":     a.BuyPool.Pool,
+			"SellPool":    a.SellPool.Pool,
+			"Profit(USD)": a.ProfitUSD,
+		}).Debug("套利与利润更高的交易冲突或超出区块交易上限, 已丢弃")
+	}
+	for _, a := range selected {
+		go m.handler.Do(m, a)
+	}
 }
 
-func (m *monitor) fetchPrice(eventPools []dt.SimplePool) (blockNumber uint64) {
+func (m *monitor) fetchPrice(eventPools []dt.SimplePool) (blockNumber uint64, pairs []dt.Pair) {
 	var tokens []string
 	// t := time.Now()
 	for _, ep := range eventPools {
@@ -266,7 +386,7 @@ func (m *monitor) fetchPrice(eventPools []dt.SimplePool) (blockNumber uint64) {
 	tokens = pie.Unique(tokens) // 去重
 	pools := m.database.GetPoolsByTokens(tokens)
 	// m.logger.Info(fmt.Sprintf("更新价格, 共用时: %s", time.Since(t)))
-	blockNumber = m.UpdatePrice(pools)
+	blockNumber, pairs = m.updatePrice(pools)
 	return
 }
 
@@ -289,11 +409,21 @@ func (m *monitor) filterLog(events []types.Log) (resEvents []types.Log, resPools
 			m.AddPoolBlacklist(pool.Address)
 			continue
 		}
-		resPools = append(resPools, pool)
+		filter, _ := m.dexs[pool.Factory].(SwapLogFilter)
+		accepted := false
 		for _, event := range events {
-			if pool.Address == event.Address.Hex() {
-				resEvents = append(resEvents, event)
+			if pool.Address != event.Address.Hex() {
+				continue
 			}
+			// 解码事件, 过滤掉不是Swap或没有实际兑换的事件
+			if filter != nil && !filter.AcceptSwapLog(event) {
+				continue
+			}
+			resEvents = append(resEvents, event)
+			accepted = true
+		}
+		if accepted {
+			resPools = append(resPools, pool)
 		}
 	}
 	return
@@ -308,6 +438,14 @@ func (m *monitor) GetListenFactory() []string {
 	return ls
 }
 
+// 根据工厂地址获取池参数接口
+func (m *monitor) GetPoolParams(factory string) dt.IPoolParams {
+	if d, ok := m.dexs[factory]; ok {
+		return d
+	}
+	return nil
+}
+
 // 根据交易对地址获取交易所接口
 func (m *monitor) GetDex(poolAddr string) (IDex, *dt.Pool) {
 	pool := dex.GetFactory(m, poolAddr)
@@ -317,16 +455,23 @@ func (m *monitor) GetDex(poolAddr string) (IDex, *dt.Pool) {
 	return m.dexs[pool.Factory], pool
 }
 
-// 根据策略处理事件
-func (m *monitor) processEvent(event dt.SimplePool, bn uint64) {
-	arbitrage, ok := m.handler.CalcArbitrage(m, event, bn, m.gasPrice*m.cfg.GasTimes)
-	if ok {
-		m.handler.Do(m, arbitrage)
+// 计算事件的套利, 同时运行多个策略时可能有多个套利
+func (m *monitor) processEvent(event dt.SimplePool, bn uint64) []*dt.Arbitrage {
+	gasPrice := m.gasPrice * m.cfg.GasTimes
+	if h, ok := m.handler.(dt.ArbitragesHandler); ok {
+		return h.CalcArbitrages(m, event, bn, gasPrice)
 	}
+	if arbitrage, ok := m.handler.CalcArbitrage(m, event, bn, gasPrice); ok {
+		return []*dt.Arbitrage{arbitrage}
+	}
+	return nil
 }
 
 func (m *monitor) subscribeEvents(ctx context.Context) error {
-	query := createQuery(m.cfg.Dexs)
+	query := m.swapQuery()
+	if _, topics := m.logFilter(); len(topics) > 0 {
+		query.Topics[0] = pie.Unique(append(query.Topics[0], topics...))
+	}
 	logs := make(chan types.Log)
 	sub, err := m.cli.SubscribeFilterLogs(ctx, query, logs)
 	if err != nil {
@@ -362,6 +507,10 @@ func (m *monitor) subscribeEvents(ctx context.Context) error {
 func (m *monitor) ConfirmingTransaction() {
 	for {
 		txs := m.DB().GetTransactions(true, false)
+		var blockNumber uint64
+		if len(txs) > 0 {
+			blockNumber, _ = m.httpClient.BlockNumber(m.ctx)
+		}
 		var wg sync.WaitGroup
 		concurrent := make(chan struct{}, m.Config().MaxConcurrent)
 		for _, tx := range txs {
@@ -375,11 +524,14 @@ func (m *monitor) ConfirmingTransaction() {
 					if receipt.Status == 1 {
 						//实际运行时不再计算单笔收益。可以不定期查询余额与失败的消耗计算总收益
 						mo.DB().UpdateTransaction(txr.Tx, true, receipt.GasUsed, receipt.EffectiveGasPrice.Uint64(), income, true, "")
+						mo.notifyInventory()
 					} else {
 						_, revertMsg := si.GetRevert(m.ctx, mo.httpClient, receipt, nil)
 						mo.DB().UpdateTransaction(txr.Tx, true, receipt.GasUsed, receipt.EffectiveGasPrice.Uint64(), income, false, revertMsg)
 						m.checkFailTx(txr.BuyPool, txr.SellPool, revertMsg)
 					}
+				} else if blockNumber > 0 {
+					mo.checkStuckTx(txr, blockNumber)
 				}
 				<-concurrent
 			}(m, tx)
@@ -397,6 +549,8 @@ func (m *monitor) Run() {
 	defer cancel()
 	// 确认交易状态
 	go m.ConfirmingTransaction()
+	// 管理合约库存
+	go m.ManageInventory()
 	// Listen for stop signal in a separate goroutine
 	go func() {
 		<-stopChan
@@ -496,6 +650,10 @@ func (m *monitor) DB() dt.IActions {
 func (m *monitor) Multicall() *multicall.Caller {
 	return m.multicall
 }
+func (m *monitor) CallOpts() *bind.CallOpts {
+	return m.callOpts
+}
+
 func (m *monitor) Config() *config.Configuration {
 	return &m.cfg
 }
@@ -534,6 +692,9 @@ func (m *monitor) GetERC20A() []string {
 
 // 往TG发送消息
 func (m *monitor) SendToTG(msg string) {
+	if m.backtestSwap != nil { // 回测时不发送消息
+		return
+	}
 	telegramAPI := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", m.cfg.TG.Token)
 	body := dt.TelegramRequestBody{
 		ChatID: m.cfg.TG.ChatID,
@@ -567,6 +728,13 @@ func (m *monitor) SendToTG(msg string) {
 }
 
 func (m *monitor) UpdatePrice(pools []dt.Pool) (blockNumber uint64) {
+	blockNumber, _ = m.updatePrice(pools)
+	return
+}
+
+// 更新价格并返回保存的交易对
+func (m *monitor) updatePrice(pools []dt.Pool) (blockNumber uint64, pairs []dt.Pair) {
+	pools = m.fillPoolParams(pools)
 	mcContract, err := multicall.NewContract(dex.BlockNumberABI, multicall.DefaultAddress)
 	if err != nil {
 		m.logger.Error("UpdatePrice 0:", err)
@@ -584,20 +752,11 @@ func (m *monitor) UpdatePrice(pools []dt.Pool) (blockNumber uint64) {
 		}
 		startIndex += length
 	}
-	for _, p := range pools {
-		idex := m.dexs[p.Factory]
-		if idex == nil {
-			continue
-		}
-		call := idex.CreatePriceCall(&p)
-		if len(call) > 0 {
-			calls = append(calls, call...)
-		}
-	}
+	calls = append(calls, m.createPriceCalls(pools)...)
 
 	t := time.Now()
 	// results, err := m.multicall.Call(nil, calls...)
-	results, err := tools.ConcurrentMulticall(m.multicall, calls, m.Config().ChunkLength, m.Config().MaxConcurrent)
+	results, err := tools.ConcurrentMulticall(m.multicall, m.callOpts, calls, m.Config().ChunkLength, m.Config().MaxConcurrent)
 	m.logger.Info(fmt.Sprintf("UpdatePrice Multicall调用, 共%d个Call, 共用时%s", len(calls), time.Since(t)))
 	if err != nil {
 		m.logger.Error("UpdatePrice 1:", err)
@@ -605,18 +764,71 @@ func (m *monitor) UpdatePrice(pools []dt.Pool) (blockNumber uint64) {
 	}
 	// t = time.Now()
 	blockNumber = calls[0].Outputs.(*dt.ResBigInt).Int.Uint64()
+	m.database.SetBlockNumber(blockNumber)
+	// 策略会并发读取baseFee与余额
+	m.Lock()
 	m.baseFee = calls[1].Outputs.(*dt.ResBigInt).Int
 	if startIndex > 2 {
 		bts := m.handler.GetBaseTokens()
 		for i, bt := range bts {
-			balance := calls[i+1].Outputs.(*dt.ResBigInt).Int
+			c := calls[i+2]
+			if c.Failed {
+				continue
+			}
+			balance := c.Outputs.(*dt.ResBigInt).Int
 			m.baseBalance[bt.Address] = tools.BigIntToFloat64(balance, bt.Decimals)
 		}
 	}
+	m.Unlock()
+
+	pairs = m.calcPairs(results[startIndex:], pools, blockNumber)
+	m.database.SavePairs(pairs)
+	// m.logger.Info(fmt.Sprintf("UpdatePrice 计算存储, 共用时%s", time.Since(t)))
+	return
+}
 
+// 只查询池的价格, 不保存交易对, 也不更新区块高度、baseFee与余额, 可以在策略中并发调用
+func (m *monitor) QueryPairs(pools []dt.Pool) (pairs []dt.Pair) {
+	pools = m.fillPoolParams(pools)
+	calls := m.createPriceCalls(pools)
+	if len(calls) == 0 {
+		return
+	}
+	mcContract, err := multicall.NewContract(dex.BlockNumberABI, multicall.DefaultAddress)
+	if err != nil {
+		m.logger.WithField(FieldTag, "QueryPairs").Error(err)
+		return
+	}
+	calls = append([]*multicall.Call{mcContract.NewCall(new(dt.ResBigInt), "getBlockNumber").AllowFailure()}, calls...)
+	results, err := tools.ConcurrentMulticall(m.multicall, m.callOpts, calls, m.Config().ChunkLength, m.Config().MaxConcurrent)
+	if err != nil {
+		m.logger.WithField(FieldTag, "QueryPairs").Error(err)
+		return
+	}
+	if calls[0].Failed {
+		return
+	}
+	return m.calcPairs(results[1:], pools, calls[0].Outputs.(*dt.ResBigInt).Int.Uint64())
+}
+
+func (m *monitor) createPriceCalls(pools []dt.Pool) (calls []*multicall.Call) {
+	for _, p := range pools {
+		idex := m.dexs[p.Factory]
+		if idex == nil {
+			continue
+		}
+		call := idex.CreatePriceCall(&p)
+		if len(call) > 0 {
+			calls = append(calls, call...)
+		}
+	}
+	return
+}
+
+// 按价格调用的结果计算交易对的价格与深度
+func (m *monitor) calcPairs(resCalls []*multicall.Call, pools []dt.Pool, blockNumber uint64) (pairs []dt.Pair) {
 	var wg sync.WaitGroup
 	taskChan := make(chan dt.Pair)
-	resCalls := results[startIndex:]
 	for i := 0; i < len(resCalls); {
 		c := resCalls[i]
 		pIndex := pie.FindFirstUsing(pools, func(v dt.Pool) bool { return v.Address == c.CallName })
@@ -635,20 +847,50 @@ func (m *monitor) UpdatePrice(pools []dt.Pool) (blockNumber uint64) {
 		wg.Wait()
 		close(taskChan)
 	}()
-	var pairs []dt.Pair
 	for pair := range taskChan {
 		pairs = append(pairs, pair)
 	}
-	m.database.SavePairs(pairs)
-	// m.logger.Info(fmt.Sprintf("UpdatePrice 计算存储, 共用时%s", time.Since(t)))
+	// 按tick数据重新计算集中流动性池的深度
+	dex.CalcTickDepth(m, pairs)
+	// 按bin数据重新计算LiquidityBook池的深度
+	dex.CalcBinDepth(m, pairs)
 	return
 }
 
+// 补全旧数据中还没有缓存参数的池, 获取失败的池不参与本次价格更新
+func (m *monitor) fillPoolParams(pools []dt.Pool) []dt.Pool {
+	var missing []dt.SimplePool
+	for _, p := range pools {
+		if p.Params == nil {
+			missing = append(missing, dt.SimplePool{Factory: p.Factory, Token0: p.Token0.Address, Token1: p.Token1.Address, Address: p.Address})
+		}
+	}
+	if len(missing) == 0 {
+		return pools
+	}
+	filled, failPool := dex.FetchPoolParams(m, missing)
+	for _, sp := range filled {
+		m.database.UpdatePoolParams(sp.Address, sp.Params)
+		for i := range pools {
+			if pools[i].Address == sp.Address {
+				pools[i].Params = sp.Params
+			}
+		}
+	}
+	if len(failPool) > 0 {
+		m.logger.WithField(FieldTag, "fillPoolParams").Warn(fmt.Sprintf("%d个池获取参数失败", len(failPool)))
+		pools = pie.Filter(pools, func(p dt.Pool) bool { return p.Params != nil })
+	}
+	return pools
+}
+
 func (m *monitor) GetUseGas(buyPool, sellPool *dt.Pair, amount float64) int64 {
 	minGas, maxGas := m.database.GetGas(buyPool.Pool, sellPool.Pool)
 	if minGas == 0 || maxGas == 0 {
 		return 300000 //如果数据库中不存在数据，就以最高gas消耗来计算
 	}
+	m.RLock()
+	defer m.RUnlock()
 	if amount <= m.baseBalance[sellPool.Token0] {
 		return minGas
 	} else {
@@ -656,6 +898,22 @@ func (m *monitor) GetUseGas(buyPool, sellPool *dt.Pair, amount float64) int64 {
 	}
 }
 
+func (m *monitor) GetBaseBalance(baseToken string) float64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.baseBalance[baseToken]
+}
+
+// 最近一次更新价格时的baseFee
+func (m *monitor) getBaseFee() float64 {
+	m.RLock()
+	defer m.RUnlock()
+	if m.baseFee == nil {
+		return 0
+	}
+	return tools.BigIntToFloat64(m.baseFee, 18)
+}
+
 func (m *monitor) Swap(client *ethclient.Client, params dt.SwapParams, traderContract string, simulation bool, cost float64, baseDec uint64) (signedTx *types.Transaction) {
 	if traderContract == "" { //如果不配置套利合约就不执行调用
 		m.logger.Info("No arbitrage contract is configured.")
@@ -670,14 +928,7 @@ func (m *monitor) Swap(client *ethclient.Client, params dt.SwapParams, traderCon
 	// fmt.Println("params.borrowPool:", params.Borrow)
 	// fmt.Println("params.baseToken:", params.BaseToken)
 
-	if params.BuyType == 0 {
-		idex, _ := m.GetDex(params.BuyPool)
-		params.BuyType = idex.GetType()
-	}
-	if params.SellType == 0 {
-		idex, _ := m.GetDex(params.SellPool)
-		params.SellType = idex.GetType()
-	}
+	params = m.fillSwapTypes(params)
 
 	privateKey := si.GetPrivateKey(m.GetPrivateKey())
 	fromAddress := si.GetAddress(privateKey)
@@ -685,32 +936,34 @@ func (m *monitor) Swap(client *ethclient.Client, params dt.SwapParams, traderCon
 	ctx, cancel := context.WithCancel(m.ctx)
 	defer cancel()
 
-	nonce, err := client.PendingNonceAt(ctx, fromAddress)
+	data := packSwapData(params, baseDec)
+	gasLimit := m.gasLimit(params)
+	if !simulation && m.cfg.Preflight.Enable {
+		var ok bool
+		if params, data, gasLimit, ok = m.preflight(ctx, client, fromAddress, traderContract, params, baseDec); !ok {
+			return
+		}
+	}
+	// 预检可能减小数量并重新报价利润, 之后再出价
+	bid := m.bidGas(params)
+	if bid.Unprofitable {
+		m.Logger().WithFields(logrus.Fields{"BuyPool": params.BuyPool, "SellPool": params.SellPool, "Reason": bid.Reason}).Info("gas出价超过利润, 放弃交易")
+		return
+	}
+	gasPrice := tools.Float64ToBigInt(bid.GasPrice, 18)
+
+	// 模拟时每次都是新的anvil分叉, 直接从链上获取nonce
+	var nonce uint64
+	var err error
+	if simulation {
+		nonce, err = client.PendingNonceAt(ctx, fromAddress)
+	} else {
+		nonce, err = m.nonces.Next(ctx, fromAddress)
+	}
 	if err != nil {
 		m.Logger().WithField(FieldTag, "Swap1").Error(err)
 		return
 	}
-	gasPrice := tools.Float64ToBigInt(params.GasPrice, 18)
-
-	hash := crypto.Keccak256Hash([]byte("swap()")).Hex()
-	methodID := hash[:10]
-	amount := tools.Float64ToBigInt(params.Amount, baseDec)
-
-	tmp := new(big.Int).Lsh(big.NewInt(int64(params.Deadline)), 72)
-	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.Position)), 64))
-	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.BuyType)), 48))
-	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.SellType)), 32))
-	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.BuyFee)), 16))
-	tmp = tmp.Or(tmp, big.NewInt(int64(params.SellFee)))
-
-	var data []byte
-	data = append(data, hexutil.MustDecode(methodID)...)
-	data = append(data, common.LeftPadBytes(common.HexToAddress(params.BuyPool).Bytes(), 32)...)
-	data = append(data, common.LeftPadBytes(common.HexToAddress(params.SellPool).Bytes(), 32)...)
-	data = append(data, common.LeftPadBytes(common.HexToAddress(params.BaseToken).Bytes(), 32)...)
-	data = append(data, common.LeftPadBytes(common.HexToAddress(params.Borrow).Bytes(), 32)...)
-	data = append(data, common.LeftPadBytes(amount.Bytes(), 32)...)
-	data = append(data, common.LeftPadBytes(tmp.Bytes(), 32)...)
 
 	// fmt.Printf("data: %x", data)
 	var tx *types.Transaction
@@ -718,25 +971,27 @@ func (m *monitor) Swap(client *ethclient.Client, params dt.SwapParams, traderCon
 	// var err error
 	if m.cfg.EIP1559 {
 		to := common.HexToAddress(traderContract)
-		maxPriorityFeePerGas := new(big.Int).Sub(gasPrice, m.baseFee)
 		tx = types.NewTx(&types.DynamicFeeTx{
 			ChainID:   m.chainId,
 			Nonce:     nonce,
-			GasFeeCap: gasPrice,
-			GasTipCap: maxPriorityFeePerGas,
-			Gas:       m.cfg.GasLimit * uint64(m.cfg.GasTimes),
+			GasFeeCap: tools.Float64ToBigInt(bid.FeeCap, 18),
+			GasTipCap: tools.Float64ToBigInt(bid.PriorityFee, 18),
+			Gas:       gasLimit,
 			To:        &to,
 			Value:     big.NewInt(0),
 			Data:      data,
 		})
 		signedTx, err = types.SignTx(tx, types.NewLondonSigner(m.chainId), privateKey)
 	} else {
-		tx = types.NewTransaction(nonce, common.HexToAddress(traderContract), big.NewInt(0), m.cfg.GasLimit*uint64(m.cfg.GasTimes), gasPrice, data)
+		tx = types.NewTransaction(nonce, common.HexToAddress(traderContract), big.NewInt(0), gasLimit, gasPrice, data)
 		signedTx, err = types.SignTx(tx, types.NewEIP155Signer(m.chainId), privateKey)
 	}
 
 	if err != nil {
 		m.Logger().WithField(FieldTag, "Swap3").Error(err)
+		if !simulation {
+			m.nonces.Done(fromAddress, nonce, err)
+		}
 		return
 	}
 
@@ -753,6 +1008,7 @@ func (m *monitor) Swap(client *ethclient.Client, params dt.SwapParams, traderCon
 		default:
 			err = client.SendTransaction(ctx, signedTx)
 		}
+		m.nonces.Done(fromAddress, nonce, err)
 	}
 	errMsg := ""
 
@@ -766,6 +1022,14 @@ func (m *monitor) Swap(client *ethclient.Client, params dt.SwapParams, traderCon
 		errMsg = err.Error()
 	}
 
+	var path []string
+	for _, leg := range params.Path {
+		path = append(path, leg.Pool)
+	}
+	var borrower string
+	if params.Liquidation != nil {
+		borrower = params.Liquidation.User
+	}
 	m.database.SaveTransaction(dt.Transaction{
 		Tx:         signedTx.Hash().Hex(),
 		Ok:         ok,
@@ -777,11 +1041,146 @@ func (m *monitor) Swap(client *ethclient.Client, params dt.SwapParams, traderCon
 		BaseToken:  params.BaseToken,
 		CreatedAt:  time.Now(),
 		EventBlock: params.BlockNumber,
+		Path:       path,
+		Bid:        &bid,
 		Error:      errMsg,
+		Borrower:   borrower,
+		From:       fromAddress.Hex(),
+		Nonce:      nonce,
+		Deadline:   params.Deadline,
 	})
 	return
 }
 
+// 交易的gas上限, 清算和多跳交易按策略预估的gas计算
+func (m *monitor) gasLimit(params dt.SwapParams) uint64 {
+	limit := m.cfg.GasLimit
+	if params.Liquidation != nil || len(params.Path) > 0 {
+		limit = max(limit, uint64(params.Gas))
+	}
+	return limit * uint64(m.cfg.GasTimes)
+}
+
+// 补全交易参数中池的类型
+func (m *monitor) fillSwapTypes(params dt.SwapParams) dt.SwapParams {
+	if params.Liquidation != nil {
+		if params.SellType == 0 {
+			idex, _ := m.GetDex(params.SellPool)
+			params.SellType = idex.GetType()
+		}
+	} else if len(params.Path) > 0 {
+		path := make([]dt.SwapLeg, len(params.Path))
+		copy(path, params.Path)
+		for i := range path {
+			if path[i].Type == 0 {
+				idex, _ := m.GetDex(path[i].Pool)
+				path[i].Type = idex.GetType()
+			}
+		}
+		params.Path = path
+	} else {
+		if params.BuyType == 0 {
+			idex, _ := m.GetDex(params.BuyPool)
+			params.BuyType = idex.GetType()
+		}
+		if params.SellType == 0 {
+			idex, _ := m.GetDex(params.SellPool)
+			params.SellType = idex.GetType()
+		}
+	}
+	return params
+}
+
+// 打包合约调用数据
+func packSwapData(params dt.SwapParams, baseDec uint64) []byte {
+	amount := tools.Float64ToBigInt(params.Amount, baseDec)
+	minProfit := tools.Float64ToBigInt(max(params.MinProfit, 0), baseDec)
+	if params.Liquidation != nil {
+		return PackLiquidate(params, amount, minProfit)
+	}
+	if len(params.Path) > 0 {
+		return PackSwapPath(params, amount, minProfit)
+	}
+	return PackSwap(params, amount, minProfit)
+}
+
+// 打包两个池套利的swap()调用数据
+// 参数字: 136位起为最小利润, 72位起为过期块号, 64位起为借贷位置, 之后依次为买卖池类型与手续费
+func PackSwap(params dt.SwapParams, amount, minProfit *big.Int) (data []byte) {
+	hash := crypto.Keccak256Hash([]byte("swap()")).Hex()
+	methodID := hash[:10]
+
+	tmp := new(big.Int).Lsh(minProfit, 136)
+	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.Deadline)), 72))
+	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.Position)), 64))
+	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.BuyType)), 48))
+	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.SellType)), 32))
+	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.BuyFee)), 16))
+	tmp = tmp.Or(tmp, big.NewInt(int64(params.SellFee)))
+
+	data = append(data, hexutil.MustDecode(methodID)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.BuyPool).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.SellPool).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.BaseToken).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.Borrow).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(amount.Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(tmp.Bytes(), 32)...)
+	return
+}
+
+// 打包多跳套利的swapPath()调用数据
+// 参数字: 136位起为最小利润, 72位起为过期块号, 64位起为借贷位置, 低8位为步数
+// 每一步占32字节: 低160位为池地址, 160位起16位为池类型, 176位起16位为手续费
+func PackSwapPath(params dt.SwapParams, amount, minProfit *big.Int) (data []byte) {
+	hash := crypto.Keccak256Hash([]byte("swapPath()")).Hex()
+	methodID := hash[:10]
+
+	tmp := new(big.Int).Lsh(minProfit, 136)
+	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.Deadline)), 72))
+	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.Position)), 64))
+	tmp = tmp.Or(tmp, big.NewInt(int64(len(params.Path))))
+
+	data = append(data, hexutil.MustDecode(methodID)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.BaseToken).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.Borrow).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(amount.Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(tmp.Bytes(), 32)...)
+	for _, leg := range params.Path {
+		word := new(big.Int).SetBytes(common.HexToAddress(leg.Pool).Bytes())
+		word = word.Or(word, new(big.Int).Lsh(big.NewInt(int64(leg.Type)), 160))
+		word = word.Or(word, new(big.Int).Lsh(big.NewInt(int64(leg.Fee)), 176))
+		data = append(data, common.LeftPadBytes(word.Bytes(), 32)...)
+	}
+	return
+}
+
+// 打包清算的liquidate()调用数据
+// 依次为Aave Pool、借款人、抵押品、债务token、借贷池、偿还的债务数量, 卖出抵押品的池(格式与多跳的每一步相同)
+// 最后一个参数字: 136位起为最小利润, 72位起为过期块号, 64位起为借贷位置
+func PackLiquidate(params dt.SwapParams, amount, minProfit *big.Int) (data []byte) {
+	hash := crypto.Keccak256Hash([]byte("liquidate()")).Hex()
+	methodID := hash[:10]
+
+	tmp := new(big.Int).Lsh(minProfit, 136)
+	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.Deadline)), 72))
+	tmp = tmp.Or(tmp, new(big.Int).Lsh(big.NewInt(int64(params.Position)), 64))
+
+	sellLeg := new(big.Int).SetBytes(common.HexToAddress(params.SellPool).Bytes())
+	sellLeg = sellLeg.Or(sellLeg, new(big.Int).Lsh(big.NewInt(int64(params.SellType)), 160))
+	sellLeg = sellLeg.Or(sellLeg, new(big.Int).Lsh(big.NewInt(int64(params.SellFee)), 176))
+
+	data = append(data, hexutil.MustDecode(methodID)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.Liquidation.AavePool).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.Liquidation.User).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.Liquidation.Collateral).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.BaseToken).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(params.Borrow).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(amount.Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(sellLeg.Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(tmp.Bytes(), 32)...)
+	return
+}
+
 func (m *monitor) sendPrivateTransaction(ctx context.Context, signedTx *types.Transaction, maxBlock uint64, url string) error {
 	data, err := signedTx.MarshalBinary()
 	if err != nil {
@@ -820,6 +1219,9 @@ func (m *monitor) checkFailTx(buyPool, sellPool, errMsg string) {
 	if errMsg == "D" || errMsg == "execution reverted: D" || errMsg == "" { //只是调用过期的不处理
 		return
 	}
+	if buyPool == "" { // 清算交易没有买入池, 不把token加入黑名单
+		return
+	}
 	baseCount := 1
 	if errMsg == "E" || errMsg == "execution reverted: E" { //只是套利失败的,需要两次失败才加入黑名单
 		baseCount = 2
@@ -838,6 +1240,13 @@ func (m *monitor) checkFailTx(buyPool, sellPool, errMsg string) {
 }
 
 func (m *monitor) DoSwap(params dt.SwapParams) {
+	if m.backtestSwap != nil { // 回测时只记录交易参数
+		m.backtestSwap(params)
+		return
+	}
+	if !m.checkRisk(params) {
+		return
+	}
 	if m.cfg.Simulation.Enable { //模拟交易
 		ctx, cancel := context.WithCancel(m.ctx)
 		richAddress := m.cfg.Simulation.Funds
@@ -883,7 +1292,7 @@ func (m *monitor) DoSwap(params dt.SwapParams) {
 	} else { //真实交易
 		// 真实交易时不再记录每笔成本
 		dec := m.handler.GetBaseDecimals(params.BaseToken)
-		cost := m.baseBalance[params.BaseToken]
+		cost := m.GetBaseBalance(params.BaseToken)
 		m.Swap(m.httpClient, params, m.cfg.TraderContract, false, cost, dec)
 	}
 }
@@ -898,5 +1307,8 @@ func (m *monitor) caclIncome(client *ethclient.Client, traderContract string, co
 }
 
 func (m *monitor) TestEvent(eventPool dt.SimplePool, blockNumber uint64) {
-	m.processEvent(eventPool, blockNumber)
+	selected, _ := Schedule(m.processEvent(eventPool, blockNumber), 0)
+	for _, arbitrage := range selected {
+		m.handler.Do(m, arbitrage)
+	}
 }
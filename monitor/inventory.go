@@ -0,0 +1,285 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/sirupsen/logrus"
+	"github.com/xiangxn/listener/dex"
+	si "github.com/xiangxn/listener/simulation"
+	"github.com/xiangxn/listener/strategies"
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// 合约中一种base token的持仓
+type Holding struct {
+	Token     string
+	Balance   float64
+	PriceUSD  float64
+	TargetUSD float64
+}
+
+func (h *Holding) ValueUSD() float64 { return h.Balance * h.PriceUSD }
+
+// 把价值AmountUSD的From换成To
+type Rebalance struct {
+	From      string
+	To        string
+	AmountUSD float64
+}
+
+// 把价值AmountUSD的Token提取到treasury
+type Sweep struct {
+	Token     string
+	AmountUSD float64
+}
+
+// 根据目标价值计算库存调整: 先用超出目标的token补足低于目标的token, 剩余超出的部分提取
+// 只有偏离目标价值超过threshold比例的token才参与调整
+func PlanInventory(holdings []Holding, threshold float64) (rebalances []Rebalance, sweeps []Sweep) {
+	surplus := make([]float64, len(holdings))
+	for i := range holdings {
+		surplus[i] = holdings[i].ValueUSD() - holdings[i].TargetUSD
+	}
+	drifted := func(i int, sign float64) bool {
+		return surplus[i]*sign > threshold*holdings[i].TargetUSD && surplus[i]*sign > 0
+	}
+	for {
+		from, to := -1, -1
+		for i := range holdings {
+			if drifted(i, 1) && (from < 0 || surplus[i] > surplus[from]) {
+				from = i
+			}
+			if drifted(i, -1) && (to < 0 || surplus[i] < surplus[to]) {
+				to = i
+			}
+		}
+		if from < 0 || to < 0 {
+			break
+		}
+		amount := min(surplus[from], -surplus[to])
+		rebalances = append(rebalances, Rebalance{From: holdings[from].Token, To: holdings[to].Token, AmountUSD: amount})
+		surplus[from] -= amount
+		surplus[to] += amount
+	}
+	for i := range holdings {
+		if drifted(i, 1) {
+			sweeps = append(sweeps, Sweep{Token: holdings[i].Token, AmountUSD: surplus[i]})
+		}
+	}
+	return
+}
+
+// 通知库存管理检查持仓
+func (m *monitor) notifyInventory() {
+	select {
+	case m.inventoryCh <- struct{}{}:
+	default:
+	}
+}
+
+// 定时或在交易确认后检查合约持仓, 偏离目标时调整或提取利润
+func (m *monitor) ManageInventory() {
+	conf := m.cfg.Inventory
+	if len(conf.Targets) == 0 || m.cfg.TraderContract == "" {
+		return
+	}
+	interval := time.Duration(conf.Interval) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.inventoryCh:
+		}
+		m.checkInventory()
+	}
+}
+
+func (m *monitor) holdings() (holdings []Holding) {
+	conf := m.cfg.Inventory
+	quote := m.cfg.Strategies.GasToken.Quote
+	for token, weight := range conf.Targets {
+		price := 1.0
+		if token != quote {
+			price = m.database.GetBasePrice(token, quote)
+		}
+		if price <= 0 {
+			m.logger.Warn("库存管理: 无法获取价格 ", token)
+			return nil
+		}
+		holdings = append(holdings, Holding{
+			Token:     token,
+			Balance:   m.GetBaseBalance(token),
+			PriceUSD:  price,
+			TargetUSD: conf.CapitalUSD * weight,
+		})
+	}
+	sort.Slice(holdings, func(i, j int) bool { return holdings[i].Token < holdings[j].Token })
+	return
+}
+
+func (m *monitor) checkInventory() {
+	conf := m.cfg.Inventory
+	holdings := m.holdings()
+	if len(holdings) == 0 {
+		return
+	}
+	threshold := conf.Threshold
+	if threshold <= 0 {
+		threshold = 0.2
+	}
+	rebalances, sweeps := PlanInventory(holdings, threshold)
+	if conf.Treasury == "" {
+		sweeps = nil
+	}
+	if len(rebalances) == 0 && len(sweeps) == 0 {
+		return
+	}
+	byToken := make(map[string]Holding)
+	for _, h := range holdings {
+		byToken[h.Token] = h
+	}
+	for _, r := range rebalances {
+		amount := r.AmountUSD / byToken[r.From].PriceUSD
+		msg := fmt.Sprintf("库存调整: %f %s -> %s (%.2f USD)", amount, r.From, r.To, r.AmountUSD)
+		if !conf.Execute {
+			go m.SendToTG("建议" + msg)
+			continue
+		}
+		if err := m.rebalance(r.From, r.To, amount); err != nil {
+			m.logger.WithField(FieldTag, "rebalance").Error(err)
+			go m.SendToTG(msg + " 失败: " + err.Error())
+			continue
+		}
+		go m.SendToTG(msg)
+	}
+	for _, s := range sweeps {
+		amount := s.AmountUSD / byToken[s.Token].PriceUSD
+		msg := fmt.Sprintf("提取利润: %f %s (%.2f USD) -> %s", amount, s.Token, s.AmountUSD, conf.Treasury)
+		if !conf.Execute {
+			go m.SendToTG("建议" + msg)
+			continue
+		}
+		if err := m.sweep(s.Token, amount); err != nil {
+			m.logger.WithField(FieldTag, "sweep").Error(err)
+			go m.SendToTG(msg + " 失败: " + err.Error())
+			continue
+		}
+		go m.SendToTG(msg)
+	}
+}
+
+// 在深度最大的池中通过合约的rebalance()把from换成to
+func (m *monitor) rebalance(from, to string, amount float64) error {
+	var best *dt.Pair
+	for _, p := range m.database.GetPairsByTokens([]string{from, to}) {
+		if pie.Contains(m.poolBlacklist, p.Pool) {
+			continue
+		}
+		pair := *p
+		if pair.Token0 != from {
+			strategies.FlipPair(&pair)
+		}
+		if best == nil || pair.Depth0 > best.Depth0 {
+			best = &pair
+		}
+	}
+	if best == nil || best.Price <= 0 || best.Depth0 <= 0 {
+		return errors.New("no pool for " + from + "/" + to)
+	}
+	idex, _ := m.GetDex(best.Pool)
+	if idex == nil {
+		return errors.New("unsupported pool " + best.Pool)
+	}
+	// 数量不超过深度, 最小输出按池的曲线报价后扣除滑点
+	amount = min(amount, best.Depth0)
+	slippage := m.cfg.Inventory.Slippage
+	if slippage <= 0 {
+		slippage = 0.01
+	}
+	out := strategies.QuoteLeg(best, amount, dex.DepthImpact(m))
+	if out <= 0 {
+		return errors.New("no quote for " + best.Pool)
+	}
+	minOut := out * (1 - slippage)
+
+	hash := crypto.Keccak256Hash([]byte("rebalance(address,uint16,uint16,address,uint256,uint256)")).Bytes()
+	var data []byte
+	data = append(data, hash[:4]...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(best.Pool).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(big.NewInt(int64(idex.GetType())).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(big.NewInt(int64(best.Fee*1e4)).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(from).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(tools.Float64ToBigInt(amount, m.handler.GetBaseDecimals(from)).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(tools.Float64ToBigInt(minOut, m.handler.GetBaseDecimals(to)).Bytes(), 32)...)
+	_, err := m.sendOwnerTx(m.cfg.TraderContract, data)
+	return err
+}
+
+// 用合约的withdraw(token,to,amount)把amount直接从合约转到treasury
+func (m *monitor) sweep(token string, amount float64) error {
+	profit := tools.Float64ToBigInt(min(amount, m.GetBaseBalance(token)), m.handler.GetBaseDecimals(token))
+	hash := crypto.Keccak256Hash([]byte("withdraw(address,address,uint256)")).Bytes()
+	var data []byte
+	data = append(data, hash[:4]...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(token).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(m.cfg.Inventory.Treasury).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(profit.Bytes(), 32)...)
+	_, err := m.sendOwnerTx(m.cfg.TraderContract, data)
+	return err
+}
+
+// 用机器人账户发送交易并等待确认
+func (m *monitor) sendOwnerTx(to string, data []byte) (*types.Receipt, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, 2*time.Minute)
+	defer cancel()
+	privateKey := si.GetPrivateKey(m.GetPrivateKey())
+	from := si.GetAddress(privateKey)
+	toAddr := common.HexToAddress(to)
+	gas, err := m.httpClient.EstimateGas(ctx, ethereum.CallMsg{From: from, To: &toAddr, Data: data})
+	if err != nil {
+		return nil, errors.New(si.RevertReason(err))
+	}
+	// 与套利交易使用同一个地址, 从nonce管理器分配
+	nonce, err := m.nonces.Next(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	gasPrice := tools.Float64ToBigInt(m.gasPrice*m.cfg.GasTimes, 18)
+	tx := types.NewTransaction(nonce, toAddr, big.NewInt(0), gas*6/5, gasPrice, data)
+	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(m.chainId), privateKey)
+	if err == nil {
+		err = m.httpClient.SendTransaction(ctx, signedTx)
+	}
+	m.nonces.Done(from, nonce, err)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := bind.WaitMined(ctx, m.httpClient, signedTx)
+	if err != nil {
+		return nil, err
+	}
+	if receipt.Status != 1 {
+		_, errMsg := si.GetRevert(ctx, m.httpClient, receipt, signedTx)
+		return receipt, errors.New("reverted: " + errMsg)
+	}
+	m.logger.WithFields(logrus.Fields{"To": to, "Tx": signedTx.Hash().Hex()}).Info("库存管理交易已确认")
+	return receipt, nil
+}
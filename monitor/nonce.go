@@ -0,0 +1,105 @@
+package monitor
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// 节点返回这些错误时说明本地nonce与链上不一致, 需要重新同步
+var nonceErrors = []string{
+	"nonce too low",
+	"nonce too high",
+	"already known",
+	"replacement transaction underpriced",
+	"invalid nonce",
+}
+
+type signerNonce struct {
+	synced bool
+	next   uint64
+	// 已分配但发送失败的nonce, 下次分配时优先复用
+	gaps []uint64
+}
+
+// 为每个签名地址在本地分配nonce, 并发发送交易时不会取到相同的nonce
+type NonceManager struct {
+	fetch   func(ctx context.Context, account common.Address) (uint64, error)
+	signers map[common.Address]*signerNonce
+	sync.Mutex
+}
+
+// fetch用于从链上同步nonce, 一般是client.PendingNonceAt
+func NewNonceManager(fetch func(ctx context.Context, account common.Address) (uint64, error)) *NonceManager {
+	return &NonceManager{fetch: fetch, signers: make(map[common.Address]*signerNonce)}
+}
+
+// 分配一个nonce, 第一次使用或需要重新同步时从链上获取
+// 每次分配都必须用Done报告发送结果
+func (n *NonceManager) Next(ctx context.Context, account common.Address) (uint64, error) {
+	n.Lock()
+	defer n.Unlock()
+	s := n.signers[account]
+	if s == nil {
+		s = &signerNonce{}
+		n.signers[account] = s
+	}
+	if !s.synced {
+		nonce, err := n.fetch(ctx, account)
+		if err != nil {
+			return 0, err
+		}
+		s.synced, s.next, s.gaps = true, nonce, nil
+	}
+	if len(s.gaps) > 0 {
+		nonce := s.gaps[0]
+		s.gaps = s.gaps[1:]
+		return nonce, nil
+	}
+	nonce := s.next
+	s.next++
+	return nonce, nil
+}
+
+// 报告nonce的发送结果: 成功时不处理; nonce相关的错误时下次分配前重新同步;
+// 其他错误说明交易没有进入交易池, 记录为空缺留给下一笔交易使用
+func (n *NonceManager) Done(account common.Address, nonce uint64, err error) {
+	if err == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	s := n.signers[account]
+	if s == nil || !s.synced {
+		return
+	}
+	if IsNonceError(err) {
+		s.synced = false
+		return
+	}
+	if nonce+1 == s.next {
+		// 最后分配的nonce直接回退
+		s.next--
+		return
+	}
+	if nonce < s.next && !pie.Contains(s.gaps, nonce) {
+		s.gaps = pie.Sort(append(s.gaps, nonce))
+	}
+}
+
+// 下次分配前从链上重新同步, 如私有交易没有被打包导致nonce没有被使用时
+func (n *NonceManager) Resync(account common.Address) {
+	n.Lock()
+	defer n.Unlock()
+	if s := n.signers[account]; s != nil {
+		s.synced = false
+	}
+}
+
+func IsNonceError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return pie.Any(nonceErrors, func(e string) bool { return strings.Contains(msg, e) })
+}
@@ -0,0 +1,156 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"github.com/xiangxn/listener/config"
+	si "github.com/xiangxn/listener/simulation"
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
+)
+
+const (
+	STUCK_WAIT_BLOCKS  = 3
+	STUCK_FEE_BUMP     = 1.2
+	STUCK_MIN_FEE_BUMP = 1.125 // 节点替换交易要求费用至少提高10%
+	STUCK_MAX_ATTEMPTS = 3
+	CANCEL_GAS         = 21000
+)
+
+func stuckTxConfig(cfg config.StuckTxConfig) config.StuckTxConfig {
+	if cfg.WaitBlocks == 0 {
+		cfg.WaitBlocks = STUCK_WAIT_BLOCKS
+	}
+	if cfg.FeeBump == 0 {
+		cfg.FeeBump = STUCK_FEE_BUMP
+	}
+	cfg.FeeBump = max(cfg.FeeBump, STUCK_MIN_FEE_BUMP)
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = STUCK_MAX_ATTEMPTS
+	}
+	return cfg
+}
+
+// 取消交易的出价: 上一次出价乘以bump, 并且不低于当前的建议价格
+func CancelBid(prev, current dt.GasBid, bump float64) (bid dt.GasBid) {
+	bid.BaseFee = current.BaseFee
+	bid.GasPrice = max(prev.GasPrice*bump, current.GasPrice)
+	bid.PriorityFee = max(prev.PriorityFee*bump, current.PriorityFee)
+	bid.FeeCap = max(prev.FeeCap*bump, current.FeeCap, bid.PriorityFee)
+	bid.Reason = fmt.Sprintf("cancel, bump %.3f", bump)
+	return
+}
+
+// 是否需要处理超过截止区块仍未打包的交易, 已发送取消交易时等待wait_blocks后再处理
+func StuckDue(tx dt.Transaction, blockNumber uint64, cfg config.StuckTxConfig) bool {
+	cfg = stuckTxConfig(cfg)
+	if tx.Deadline == 0 || tx.From == "" || blockNumber <= tx.Deadline+cfg.WaitBlocks {
+		return false
+	}
+	return tx.CancelTx == "" || blockNumber > tx.CancelBlock+cfg.WaitBlocks
+}
+
+// 处理超过截止区块仍未打包的交易:
+// nonce已被使用时根据取消交易的收据标记为已取消或已丢弃;
+// 原交易与取消交易都不在交易池中时(如私有交易没有被打包)标记为已丢弃并重新同步nonce;
+// 否则发送同nonce的取消交易
+func (m *monitor) checkStuckTx(txr dt.Transaction, blockNumber uint64) {
+	cfg := stuckTxConfig(m.cfg.StuckTx)
+	if !StuckDue(txr, blockNumber, cfg) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(m.ctx, time.Minute)
+	defer cancel()
+	logger := m.logger.WithFields(logrus.Fields{"Tx": txr.Tx, "Nonce": txr.Nonce})
+	from := common.HexToAddress(txr.From)
+	hash := common.HexToHash(txr.Tx)
+
+	nonce, err := m.httpClient.NonceAt(ctx, from, nil)
+	if err != nil {
+		logger.WithField(FieldTag, "checkStuckTx").Error(err)
+		return
+	}
+	if nonce > txr.Nonce {
+		// 原交易刚好在这期间被打包时留给下一轮确认
+		if receipt, err := m.httpClient.TransactionReceipt(ctx, hash); err == nil && receipt != nil {
+			return
+		}
+		if txr.CancelTx != "" {
+			if receipt, err := m.httpClient.TransactionReceipt(ctx, common.HexToHash(txr.CancelTx)); err == nil && receipt != nil {
+				m.DB().CloseTransaction(txr.Tx, dt.TX_STATUS_CANCELLED, receipt.GasUsed, receipt.EffectiveGasPrice.Uint64())
+				logger.Info("卡住的交易已取消")
+				return
+			}
+		}
+		m.DB().CloseTransaction(txr.Tx, dt.TX_STATUS_DROPPED, 0, 0)
+		logger.Info("交易的nonce已被其他交易使用")
+		return
+	}
+	_, _, err = m.httpClient.TransactionByHash(ctx, hash)
+	if err == ethereum.NotFound && txr.CancelTx != "" {
+		_, _, err = m.httpClient.TransactionByHash(ctx, common.HexToHash(txr.CancelTx))
+	}
+	if err == ethereum.NotFound {
+		m.nonces.Resync(from)
+		m.DB().CloseTransaction(txr.Tx, dt.TX_STATUS_DROPPED, 0, 0)
+		logger.Info("交易已不在交易池中")
+		return
+	}
+	if !cfg.Enable || txr.CancelAttempts >= cfg.MaxAttempts {
+		return
+	}
+	m.cancelTx(ctx, txr, cfg.FeeBump, blockNumber)
+}
+
+// 发送同nonce的0值转账给自己, 替换卡住的交易
+func (m *monitor) cancelTx(ctx context.Context, txr dt.Transaction, bump float64, blockNumber uint64) {
+	logger := m.logger.WithFields(logrus.Fields{"Tx": txr.Tx, "Nonce": txr.Nonce})
+	privateKey := si.GetPrivateKey(m.GetPrivateKey())
+	from := si.GetAddress(privateKey)
+	if from.Hex() != txr.From {
+		logger.Warn("交易的发送地址与当前私钥不一致, 不能取消")
+		return
+	}
+	current := BidGas(config.GasBidPolicy{}, m.getBaseFee(), m.gasPrice*m.cfg.GasTimes, 0, 0, 0, 0)
+	prev := current
+	if txr.CancelBid != nil {
+		prev = *txr.CancelBid
+	} else if txr.Bid != nil {
+		prev = *txr.Bid
+	}
+	bid := CancelBid(prev, current, bump)
+
+	var tx *types.Transaction
+	if m.cfg.EIP1559 {
+		tx = types.NewTx(&types.DynamicFeeTx{
+			ChainID:   m.chainId,
+			Nonce:     txr.Nonce,
+			GasFeeCap: tools.Float64ToBigInt(bid.FeeCap, 18),
+			GasTipCap: tools.Float64ToBigInt(bid.PriorityFee, 18),
+			Gas:       CANCEL_GAS,
+			To:        &from,
+			Value:     big.NewInt(0),
+		})
+	} else {
+		tx = types.NewTransaction(txr.Nonce, from, big.NewInt(0), CANCEL_GAS, tools.Float64ToBigInt(bid.GasPrice, 18), nil)
+	}
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(m.chainId), privateKey)
+	if err != nil {
+		logger.WithField(FieldTag, "cancelTx").Error(err)
+		return
+	}
+	// 取消交易需要进入公开交易池才能替换原交易
+	if err = m.httpClient.SendTransaction(ctx, signedTx); err != nil {
+		logger.WithField(FieldTag, "cancelTx").Error(err)
+		return
+	}
+	m.DB().SetCancelTransaction(txr.Tx, signedTx.Hash().Hex(), bid, blockNumber)
+	logger.WithFields(logrus.Fields{"CancelTx": signedTx.Hash().Hex(), "Attempt": txr.CancelAttempts + 1}).Info("已发送取消交易")
+}
@@ -0,0 +1,99 @@
+package monitor
+
+import (
+	"context"
+	"time"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/sirupsen/logrus"
+	"github.com/xiangxn/listener/config"
+	si "github.com/xiangxn/listener/simulation"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// 预检返回这些错误时减小数量可能成功
+var resizableReverts = []string{"E", "IIA", "IL"}
+
+// 预检用到的链上调用, *ethclient.Client实现了这个接口
+type PreflightClient interface {
+	PendingCallContract(ctx context.Context, msg ethereum.CallMsg) ([]byte, error)
+	EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error)
+}
+
+func (m *monitor) preflight(ctx context.Context, client *ethclient.Client, from common.Address, traderContract string, params dt.SwapParams, baseDec uint64) (dt.SwapParams, []byte, uint64, bool) {
+	return Preflight(ctx, client, from, common.HexToAddress(traderContract), params, baseDec, m.cfg.Preflight, m.gasLimit(params), m.savePreflight)
+}
+
+// 发送前在pending区块上eth_call调用数据并预估gas, 每次调用的结果交给save记录
+// revert为E/IIA/IL时数量减半并重新报价利润与最小利润后重试, 重新报价后没有利润、
+// 不能重新报价、其他错误或gas超过上限maxGas时放弃交易
+// 返回可能被减小数量的params、调用数据与gas limit
+func Preflight(ctx context.Context, client PreflightClient, from, to common.Address, params dt.SwapParams, baseDec uint64, conf config.PreflightConfig, maxGas uint64, save func(dt.Preflight)) (dt.SwapParams, []byte, uint64, bool) {
+	margin := conf.GasMargin
+	if margin <= 0 {
+		margin = 1.2
+	}
+	for i := 0; ; i++ {
+		data := packSwapData(params, baseDec)
+		msg := ethereum.CallMsg{From: from, To: &to, Data: data}
+		record := dt.Preflight{
+			BuyPool:    params.BuyPool,
+			SellPool:   params.SellPool,
+			Path:       pie.Map(params.Path, func(leg dt.SwapLeg) string { return leg.Pool }),
+			BaseToken:  params.BaseToken,
+			Amount:     params.Amount,
+			EventBlock: params.BlockNumber,
+			CreatedAt:  time.Now(),
+		}
+		_, err := client.PendingCallContract(ctx, msg)
+		var gas uint64
+		if err == nil {
+			gas, err = client.EstimateGas(ctx, msg)
+		}
+		if err != nil {
+			record.Error = si.RevertReason(err)
+			if pie.Contains(resizableReverts, record.Error) && i < conf.Resize && params.Requote != nil {
+				amount := params.Amount / 2
+				if profitUSD, minProfit := params.Requote(amount); profitUSD > 0 {
+					record.Decision = dt.PREFLIGHT_RESIZE
+					save(record)
+					params.Amount, params.ProfitUSD, params.MinProfit = amount, profitUSD, minProfit
+					continue
+				}
+			}
+			record.Decision = dt.PREFLIGHT_ABORT
+			save(record)
+			return params, nil, 0, false
+		}
+		record.Gas = gas
+		gasLimit := uint64(float64(gas) * margin)
+		if gasLimit > maxGas {
+			record.Decision = dt.PREFLIGHT_ABORT
+			record.Error = "gas"
+			save(record)
+			return params, nil, 0, false
+		}
+		record.Decision = dt.PREFLIGHT_SEND
+		save(record)
+		return params, data, gasLimit, true
+	}
+}
+
+func (m *monitor) savePreflight(record dt.Preflight) {
+	errMsg := record.Error
+	if msg, ok := si.RevertMessages[errMsg]; ok {
+		errMsg += "(" + msg + ")"
+	}
+	m.logger.WithFields(logrus.Fields{
+		"BuyPool":  record.BuyPool,
+		"SellPool": record.SellPool,
+		"Amount":   record.Amount,
+		"Decision": record.Decision,
+		"Gas":      record.Gas,
+		"Error":    errMsg,
+	}).Info("交易预检")
+	m.database.SavePreflight(record)
+}
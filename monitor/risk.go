@@ -0,0 +1,113 @@
+package monitor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/xiangxn/listener/config"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// 在DoSwap前检查风控限制, 失败次数或gas消耗超限时熔断暂停执行
+type RiskManager struct {
+	cfg         config.RiskConfig
+	paused      bool
+	pausedUntil time.Time
+	// 每个池发起交易的区块
+	poolTrades map[string][]uint64
+	sync.Mutex
+}
+
+func NewRiskManager(cfg config.RiskConfig) *RiskManager {
+	return &RiskManager{cfg: cfg, poolTrades: make(map[string][]uint64)}
+}
+
+// 检查交易是否可以执行, 允许时返回空的reason并记录交易的池
+// recent为最近一天的交易, gasTokenUSD为gas token的USD价格; trip为真表示本次触发了熔断
+func (r *RiskManager) Allow(params dt.SwapParams, recent []dt.Transaction, gasTokenUSD float64, now time.Time) (reason string, trip bool) {
+	r.Lock()
+	defer r.Unlock()
+	if r.cfg.KillSwitch {
+		return "kill switch", false
+	}
+	if r.paused {
+		if r.cfg.PauseMinutes <= 0 || now.Before(r.pausedUntil) {
+			return "paused", false
+		}
+		r.paused = false
+	}
+	if limit := r.cfg.MaxNotional[params.BaseToken]; limit > 0 && params.Amount > limit {
+		return fmt.Sprintf("amount %f exceeds max notional %f", params.Amount, limit), false
+	}
+	pools := []string{params.BuyPool, params.SellPool}
+	for _, leg := range params.Path {
+		pools = append(pools, leg.Pool)
+	}
+	// 清算交易没有买入池
+	pools = pie.Unique(pie.FilterNot(pools, func(pool string) bool { return pool == "" }))
+	if r.cfg.MaxPoolTrades > 0 {
+		for _, pool := range pools {
+			count := len(pie.Filter(r.poolTrades[pool], func(bn uint64) bool { return bn+r.cfg.PoolTradeBlocks > params.BlockNumber }))
+			if count >= r.cfg.MaxPoolTrades {
+				return fmt.Sprintf("pool %s traded %d times in %d blocks", pool, count, r.cfg.PoolTradeBlocks), false
+			}
+		}
+	}
+	if r.cfg.MaxFailedPerHour > 0 {
+		failed := len(pie.Filter(recent, func(tx dt.Transaction) bool {
+			return tx.Confirm && !tx.Ok && tx.Status == "" && tx.CreatedAt.After(now.Add(-time.Hour))
+		}))
+		if failed >= r.cfg.MaxFailedPerHour {
+			return r.trip(now, fmt.Sprintf("%d failed transactions in the last hour", failed))
+		}
+	}
+	if r.cfg.MaxGasUSDPerDay > 0 {
+		var gasUSD float64
+		for _, tx := range recent {
+			if tx.CreatedAt.After(now.Add(-24 * time.Hour)) {
+				gasUSD += float64(tx.UseGas) * float64(tx.GasPrice) / 1e18 * gasTokenUSD
+			}
+		}
+		if gasUSD >= r.cfg.MaxGasUSDPerDay {
+			return r.trip(now, fmt.Sprintf("gas spend %.2f USD in the last day", gasUSD))
+		}
+	}
+	for _, pool := range pools {
+		trades := pie.Filter(r.poolTrades[pool], func(bn uint64) bool { return bn+r.cfg.PoolTradeBlocks > params.BlockNumber })
+		r.poolTrades[pool] = append(trades, params.BlockNumber)
+	}
+	return "", false
+}
+
+func (r *RiskManager) trip(now time.Time, reason string) (string, bool) {
+	r.paused = true
+	r.pausedUntil = now.Add(time.Duration(r.cfg.PauseMinutes) * time.Minute)
+	return reason, true
+}
+
+// 发起交易前检查风控, 触发熔断时发送TG提醒
+func (m *monitor) checkRisk(params dt.SwapParams) bool {
+	now := time.Now()
+	var recent []dt.Transaction
+	var gasTokenUSD float64
+	if m.cfg.Risk.MaxFailedPerHour > 0 || m.cfg.Risk.MaxGasUSDPerDay > 0 {
+		recent = m.database.SearchTransacttion(m.cfg.Simulation.Enable, now.Add(-24*time.Hour), now)
+		conf := m.cfg.Strategies.GasToken
+		gasTokenUSD = m.database.GetBasePrice(conf.Base, conf.Quote)
+	}
+	reason, trip := m.risk.Allow(params, recent, gasTokenUSD, now)
+	if reason == "" {
+		return true
+	}
+	m.logger.WithField("Reason", reason).Warn("风控拒绝交易: ", params.BuyPool, " ", params.SellPool)
+	if trip {
+		msg := fmt.Sprintf("风控熔断, 暂停交易: %s", reason)
+		if m.cfg.Risk.PauseMinutes > 0 {
+			msg += fmt.Sprintf(", %d分钟后恢复", m.cfg.Risk.PauseMinutes)
+		}
+		go m.SendToTG(msg)
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package monitor
+
+import (
+	"sort"
+
+	"github.com/elliotchance/pie/v2"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// 套利交易会占用的池(交易池与借贷池)
+func arbitragePools(a *dt.Arbitrage) (pools []string) {
+	pools = append(pools, a.BuyPool.Pool, a.SellPool.Pool)
+	for _, leg := range a.Legs {
+		pools = append(pools, leg.Pool)
+	}
+	if a.Borrow != "" {
+		pools = append(pools, a.Borrow)
+	}
+	return pie.Unique(pie.FilterNot(pools, func(p string) bool { return p == "" }))
+}
+
+// 同一区块的套利按USD利润从高到低排序, 丢弃与排名更高的套利使用相同池(包括借贷池)的套利
+// maxTrades大于0时最多选出maxTrades个
+func Schedule(arbitrages []*dt.Arbitrage, maxTrades int) (selected, dropped []*dt.Arbitrage) {
+	sorted := make([]*dt.Arbitrage, len(arbitrages))
+	copy(sorted, arbitrages)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ProfitUSD > sorted[j].ProfitUSD })
+	used := map[string]bool{}
+	for _, a := range sorted {
+		pools := arbitragePools(a)
+		if (maxTrades > 0 && len(selected) >= maxTrades) || pie.Any(pools, func(p string) bool { return used[p] }) {
+			dropped = append(dropped, a)
+			continue
+		}
+		for _, p := range pools {
+			used[p] = true
+		}
+		selected = append(selected, a)
+	}
+	return
+}
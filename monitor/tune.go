@@ -0,0 +1,244 @@
+package monitor
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/xiangxn/listener/config"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// 可以搜索的参数
+var tuneSetters = map[string]func(cfg *config.Configuration, v float64){
+	// 同时清除策略中的覆盖值, 否则搜索不起作用
+	"min_profit_usd": func(cfg *config.Configuration, v float64) {
+		cfg.MinProfitUSD = v
+		cfg.Strategies.MovingBrick.MinProfitUSD = 0
+		cfg.Strategies.MultiHop.MinProfitUSD = 0
+		cfg.Strategies.Liquidation.MinProfitUSD = 0
+	},
+	"base_min_reserve":   func(cfg *config.Configuration, v float64) { cfg.BaseMinReserve = v },
+	"gas_times":          func(cfg *config.Configuration, v float64) { cfg.GasTimes = v },
+	"event_waiting_time": func(cfg *config.Configuration, v float64) { cfg.EventWaitingTime = uint32(v) },
+}
+
+// 已经不存在的参数
+var removedTuneParams = map[string]string{
+	"delta_coefficient": "delta_coefficient was replaced by the trade size solver",
+}
+
+// 可以搜索的参数名称
+func TuneParamNames() []string {
+	names := pie.Keys(tuneSetters)
+	sort.Strings(names)
+	return names
+}
+
+// 搜索的参数, Values不为空时从中取值, 否则在[Min, Max]中随机取值(只能用于随机搜索)
+type TuneParam struct {
+	Name   string
+	Values []float64
+	Min    float64
+	Max    float64
+}
+
+// 解析参数: name=v1,v2,v3 或 name=min:max
+func ParseTuneParam(s string) (p TuneParam, err error) {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || value == "" {
+		return p, fmt.Errorf("invalid parameter %q, expected name=v1,v2 or name=min:max", s)
+	}
+	p.Name = strings.TrimSpace(name)
+	if reason, ok := removedTuneParams[p.Name]; ok {
+		return p, fmt.Errorf("%s", reason)
+	}
+	if _, ok := tuneSetters[p.Name]; !ok {
+		return p, fmt.Errorf("unknown parameter %q, available: %s", p.Name, strings.Join(TuneParamNames(), ", "))
+	}
+	parse := func(v string) (float64, error) {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("parameter %s: %w", p.Name, err)
+		}
+		if f < 0 {
+			return 0, fmt.Errorf("parameter %s: negative value %v", p.Name, f)
+		}
+		return f, nil
+	}
+	if lo, hi, ok := strings.Cut(value, ":"); ok {
+		if p.Min, err = parse(lo); err != nil {
+			return
+		}
+		if p.Max, err = parse(hi); err != nil {
+			return
+		}
+		if p.Min > p.Max {
+			return p, fmt.Errorf("parameter %s: min %v is greater than max %v", p.Name, p.Min, p.Max)
+		}
+		return
+	}
+	for _, v := range strings.Split(value, ",") {
+		f, err := parse(v)
+		if err != nil {
+			return p, err
+		}
+		if !pie.Contains(p.Values, f) {
+			p.Values = append(p.Values, f)
+		}
+	}
+	return
+}
+
+// 网格搜索: 所有参数取值的组合
+func TuneGrid(params []TuneParam) ([][]float64, error) {
+	sets := [][]float64{{}}
+	for _, p := range params {
+		if len(p.Values) == 0 {
+			return nil, fmt.Errorf("parameter %s is a range, use random search or give a list of values", p.Name)
+		}
+		var next [][]float64
+		for _, set := range sets {
+			for _, v := range p.Values {
+				next = append(next, append(append([]float64{}, set...), v))
+			}
+		}
+		sets = next
+	}
+	return sets, nil
+}
+
+// 随机搜索: 生成samples组参数
+func TuneRandom(params []TuneParam, samples int, rng *rand.Rand) [][]float64 {
+	sets := make([][]float64, samples)
+	for i := range sets {
+		set := make([]float64, len(params))
+		for j, p := range params {
+			if len(p.Values) > 0 {
+				set[j] = p.Values[rng.Intn(len(p.Values))]
+			} else {
+				set[j] = p.Min + rng.Float64()*(p.Max-p.Min)
+			}
+		}
+		sets[i] = set
+	}
+	return sets
+}
+
+// 把一组参数应用到配置的副本
+func ApplyTuneParams(cfg config.Configuration, params []TuneParam, values []float64) config.Configuration {
+	for i, p := range params {
+		tuneSetters[p.Name](&cfg, values[i])
+	}
+	return cfg
+}
+
+// 一组参数的回测结果
+type TuneResult struct {
+	Rank          int                `json:"rank"`
+	Params        map[string]float64 `json:"params"`
+	NetProfitUSD  float64            `json:"net_profit_usd"`
+	GasUSD        float64            `json:"gas_usd"`
+	Trades        int                `json:"trades"`
+	Failed        int                `json:"failed"`
+	FailureRate   float64            `json:"failure_rate"`
+	Verified      bool               `json:"verified"`
+	Opportunities int                `json:"opportunities"`
+	Missed        int                `json:"missed"`
+}
+
+func NewTuneResult(params []TuneParam, values []float64, r *BacktestReport) TuneResult {
+	result := TuneResult{
+		Params:        make(map[string]float64),
+		NetProfitUSD:  r.ProfitUSD,
+		GasUSD:        r.GasUSD,
+		Trades:        len(r.Fills),
+		Failed:        r.Failed,
+		FailureRate:   r.FailureRate(),
+		Verified:      r.Verified,
+		Opportunities: r.Opportunities,
+		Missed:        r.Missed,
+	}
+	for i, p := range params {
+		result.Params[p.Name] = values[i]
+	}
+	return result
+}
+
+// 按净利润从高到低排名, 相同时失败率低的在前
+func RankTuneResults(results []TuneResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].NetProfitUSD != results[j].NetProfitUSD {
+			return results[i].NetProfitUSD > results[j].NetProfitUSD
+		}
+		return results[i].FailureRate < results[j].FailureRate
+	})
+	for i := range results {
+		results[i].Rank = i + 1
+	}
+}
+
+// 在同一段历史区块上依次回测每组参数, 返回排名后的结果
+func Tune(opt *dt.Options, from, to uint64, params []TuneParam, sets [][]float64) ([]TuneResult, error) {
+	b, err := NewBacktester(opt, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	var results []TuneResult
+	for i, values := range sets {
+		cfg := ApplyTuneParams(opt.Cfg, params, values)
+		report, err := b.Run(cfg)
+		if err != nil {
+			return results, err
+		}
+		result := NewTuneResult(params, values, report)
+		b.m.logger.Info(fmt.Sprintf("参数搜索[%d/%d] %v: 净利润(USD): %.4f, 成交: %d, 失败: %d", i+1, len(sets), result.Params, result.NetProfitUSD, result.Trades, result.Failed))
+		results = append(results, result)
+	}
+	RankTuneResults(results)
+	return results, nil
+}
+
+// 以CSV输出结果, 每个参数一列; 没有验证成交时失败率为空
+func WriteTuneCSV(w io.Writer, params []TuneParam, results []TuneResult) error {
+	cw := csv.NewWriter(w)
+	header := []string{"rank"}
+	for _, p := range params {
+		header = append(header, p.Name)
+	}
+	header = append(header, "net_profit_usd", "gas_usd", "trades", "failed", "failure_rate", "opportunities", "missed")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	format := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	for _, r := range results {
+		row := []string{strconv.Itoa(r.Rank)}
+		for _, p := range params {
+			row = append(row, format(r.Params[p.Name]))
+		}
+		failed, rate := "", ""
+		if r.Verified {
+			failed, rate = strconv.Itoa(r.Failed), format(r.FailureRate)
+		}
+		row = append(row, format(r.NetProfitUSD), format(r.GasUSD), strconv.Itoa(r.Trades), failed, rate, strconv.Itoa(r.Opportunities), strconv.Itoa(r.Missed))
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// 以JSON输出结果
+func WriteTuneJSON(w io.Writer, results []TuneResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
@@ -6,6 +6,7 @@ import (
 	"sync"
 
 	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
@@ -16,6 +17,7 @@ import (
 )
 
 type IDex interface {
+	dt.IPoolParams
 	GetName() string
 	GetTopic() common.Hash
 	GetAbi() *abi.ABI
@@ -30,10 +32,16 @@ type IDex interface {
 	CalcPrice(calls []*multicall.Call, blockNumber uint64, pool *dt.Pool) dt.Pair
 
 	PriceCallCount() int
-	// 获取传给合约的交易池类型,1是UniswapV3,2是UniswapV2
+	// 获取传给合约的交易池类型,1是UniswapV2,2是UniswapV3,3是PancakeV3,4是Algebra,5是SolidlyV3,6是SolidlyV2,7是LiquidityBook,8是DODO
 	GetType() uint8
 }
 
+// 同一个交易所有多种Swap事件格式时实现, 订阅全部格式并过滤无法解码的事件
+type SwapLogFilter interface {
+	SwapTopics() []common.Hash
+	AcceptSwapLog(vLog types.Log) bool
+}
+
 type monitor struct {
 	ctx                context.Context
 	cancel             context.CancelFunc
@@ -58,5 +66,14 @@ type monitor struct {
 	gasPrice           float64
 	baseBalance        map[string]float64
 	cipher             [32]byte
+	risk               *RiskManager
+	nonces             *NonceManager
+	inventoryCh        chan struct{}
+	// 策略额外订阅的事件(见dt.LogHandler), 同一个合约的事件都需要保留
+	handlerLogs []types.Log
+	// 回测时读取历史区块的调用参数, 实时运行时为nil
+	callOpts *bind.CallOpts
+	// 回测时接收策略发起的交易参数, 不为nil时DoSwap不发送交易
+	backtestSwap func(dt.SwapParams)
 	sync.RWMutex
 }
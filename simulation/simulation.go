@@ -291,16 +291,37 @@ func GetRevert(ctx context.Context, client *ethclient.Client, receipt *types.Rec
 	}
 	result, err := client.CallContract(ctx, ethereum.CallMsg{To: stx.To(), Data: stx.Data()}, receipt.BlockNumber)
 	if err != nil {
-		const errHead = "execution reverted: revert: "
-		const errHead2 = "execution reverted: "
-		errMsg = err.Error()
-		if strings.Contains(errMsg, errHead) {
-			em, _ := strings.CutPrefix(errMsg, errHead)
-			errMsg = em
-		} else if strings.Contains(errMsg, errHead2) {
-			em, _ := strings.CutPrefix(errMsg, errHead2)
-			errMsg = em
-		}
+		errMsg = RevertReason(err)
+	}
+	return
+}
+
+// 套利合约的错误码(见trader/design.md)
+var RevertMessages = map[string]string{
+	"D":   "交易过期",
+	"E":   "套利失败",
+	"S":   "池没有流动性",
+	"IIA": "INSUFFICIENT_INPUT_AMOUNT",
+	"IL":  "INSUFFICIENT_LIQUIDITY",
+	"EP":  "非借贷池回调",
+	"EB":  "获取余额失败",
+	"P":   "多跳交易没有回到base token",
+	"R":   "库存调整得到的数量少于最小数量",
+	"L":   "清算没有得到抵押品",
+	"SA":  "授权失败",
+}
+
+// 从调用错误中取出revert原因
+func RevertReason(err error) (errMsg string) {
+	const errHead = "execution reverted: revert: "
+	const errHead2 = "execution reverted: "
+	errMsg = err.Error()
+	if strings.Contains(errMsg, errHead) {
+		em, _ := strings.CutPrefix(errMsg, errHead)
+		errMsg = em
+	} else if strings.Contains(errMsg, errHead2) {
+		em, _ := strings.CutPrefix(errMsg, errHead2)
+		errMsg = em
 	}
 	return
 }
@@ -0,0 +1,285 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/xiangxn/listener/monitor"
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// ERC20 Transfer(address,address,uint256)
+const TRANSFER_TOPIC = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+
+// 最多检查我们的交易事件区块之后的区块数
+const MAX_COMPETITOR_BLOCKS = 3
+
+// 根据交易日志判断是否是套利: 至少两次swap, 受益地址在所有token上都没有净支出并且至少一个token有净收入
+// 返回发生swap的池、获得利润的token(有多个时取最先出现的)与数量
+func ClassifyArbitrage(logs []*types.Log, swapTopics []common.Hash, beneficiaries []common.Address) (pools []string, token string, profit *big.Int, ok bool) {
+	transferTopic := common.HexToHash(TRANSFER_TOPIC)
+	flows := make(map[string]*big.Int)
+	var tokens []string
+	swaps := 0
+	for _, l := range logs {
+		if len(l.Topics) == 0 {
+			continue
+		}
+		if pie.Contains(swapTopics, l.Topics[0]) {
+			swaps++
+			pools = append(pools, l.Address.Hex())
+			continue
+		}
+		if l.Topics[0] != transferTopic || len(l.Topics) != 3 || len(l.Data) != 32 {
+			continue
+		}
+		from := common.BytesToAddress(l.Topics[1].Bytes())
+		to := common.BytesToAddress(l.Topics[2].Bytes())
+		in, out := pie.Contains(beneficiaries, to), pie.Contains(beneficiaries, from)
+		if in == out {
+			continue
+		}
+		t := l.Address.Hex()
+		if _, exists := flows[t]; !exists {
+			flows[t] = new(big.Int)
+			tokens = append(tokens, t)
+		}
+		value := new(big.Int).SetBytes(l.Data)
+		if in {
+			flows[t].Add(flows[t], value)
+		} else {
+			flows[t].Sub(flows[t], value)
+		}
+	}
+	pools = pie.Unique(pools)
+	if swaps < 2 {
+		return pools, "", nil, false
+	}
+	for _, t := range tokens {
+		if flows[t].Sign() < 0 {
+			return pools, "", nil, false
+		}
+		if token == "" && flows[t].Sign() > 0 {
+			token, profit = t, flows[t]
+		}
+	}
+	return pools, token, profit, token != ""
+}
+
+// 交易的池组合, 多跳时为路径
+func pairKey(tx dt.Transaction) string {
+	if len(tx.Path) > 0 {
+		return strings.Join(tx.Path, "/")
+	}
+	return tx.BuyPool + "/" + tx.SellPool
+}
+
+type competitorBlock struct {
+	block    *types.Block
+	receipts []*types.Receipt
+}
+
+// 分析[start, end)内我们已确认的真实交易, 找出同一组池上的其他套利交易并保存
+func (s *Stats) AnalyzeCompetitors(start, end time.Time) (competitors []dt.Competitor, err error) {
+	client, err := ethclient.Dial(s.Conf.Rpcs.Http)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	ctx := context.Background()
+	swapTopics := monitor.SwapTopics(s.Conf.Dexs)
+	trader := common.HexToAddress(s.Conf.TraderContract)
+	blocks := make(map[uint64]*competitorBlock)
+	getBlock := func(bn uint64) (*competitorBlock, error) {
+		if b, ok := blocks[bn]; ok {
+			return b, nil
+		}
+		block, err := client.BlockByNumber(ctx, new(big.Int).SetUint64(bn))
+		if err != nil {
+			return nil, err
+		}
+		receipts, err := client.BlockReceipts(ctx, rpc.BlockNumberOrHashWithNumber(rpc.BlockNumber(bn)))
+		if err != nil {
+			return nil, err
+		}
+		b := &competitorBlock{block: block, receipts: receipts}
+		blocks[bn] = b
+		return b, nil
+	}
+
+	txs := pie.Filter(s.DB.SearchTransacttion(false, start, end), func(tx dt.Transaction) bool { return tx.Confirm && tx.Status == "" })
+	for _, tx := range txs {
+		ourPools := pie.FilterNot(append([]string{tx.BuyPool, tx.SellPool}, tx.Path...), func(p string) bool { return p == "" })
+		landing, ourIndex := tx.EventBlock+1, -1
+		receipt, err := client.TransactionReceipt(ctx, common.HexToHash(tx.Tx))
+		if err == nil {
+			landing, ourIndex = receipt.BlockNumber.Uint64(), int(receipt.TransactionIndex)
+		}
+		first := tx.EventBlock + 1
+		if tx.EventBlock == 0 {
+			first = landing
+		}
+		for bn := first; bn <= min(landing, tx.EventBlock+MAX_COMPETITOR_BLOCKS); bn++ {
+			b, err := getBlock(bn)
+			if err != nil {
+				fmt.Printf("获取区块%d失败: %s\n", bn, err)
+				break
+			}
+			baseFee := b.block.BaseFee()
+			for i, r := range b.receipts {
+				if r.Status != types.ReceiptStatusSuccessful || i >= len(b.block.Transactions()) {
+					continue
+				}
+				other := b.block.Transactions()[i]
+				if other.Hash().Hex() == tx.Tx || other.To() == nil || *other.To() == trader {
+					continue
+				}
+				from, err := types.Sender(types.LatestSignerForChainID(other.ChainId()), other)
+				if err != nil {
+					continue
+				}
+				pools, token, profit, ok := ClassifyArbitrage(r.Logs, swapTopics, []common.Address{from, *other.To()})
+				if !ok || !pie.Any(pools, func(p string) bool { return pie.Contains(ourPools, p) }) {
+					continue
+				}
+				c := dt.Competitor{
+					Tx:          other.Hash().Hex(),
+					BlockNumber: bn,
+					Position:    r.TransactionIndex,
+					From:        from.Hex(),
+					To:          other.To().Hex(),
+					Pools:       pools,
+					PairKey:     pairKey(tx),
+					Token:       token,
+					GasUsed:     r.GasUsed,
+					OurTx:       tx.Tx,
+					OurPosition: -1,
+					OurError:    tx.Error,
+					CreatedAt:   tx.CreatedAt,
+				}
+				if r.EffectiveGasPrice != nil {
+					c.GasPrice = r.EffectiveGasPrice.Uint64()
+					if baseFee != nil && r.EffectiveGasPrice.Cmp(baseFee) > 0 {
+						c.PriorityFee = new(big.Int).Sub(r.EffectiveGasPrice, baseFee).Uint64()
+					}
+				}
+				if bn == landing {
+					c.OurPosition = ourIndex
+				}
+				if t := s.DB.GetToken(token); t.Address != "" {
+					c.Profit = tools.BigIntToFloat64(profit, t.Decimals)
+					c.ProfitUSD = s.toUSD(token, c.Profit)
+				}
+				s.DB.SaveCompetitor(c)
+				competitors = append(competitors, c)
+			}
+		}
+	}
+	return competitors, nil
+}
+
+// 把token数量换算成USD, 没有价格时返回0
+func (s *Stats) toUSD(token string, amount float64) float64 {
+	conf := s.Conf.Strategies.GasToken
+	if token == conf.Quote || s.isUSD(token) {
+		return amount
+	}
+	return amount * s.DB.GetBasePrice(token, conf.Quote)
+}
+
+// 一个竞争者在某个池组合上的统计
+type CompetitorSummary struct {
+	From      string
+	Trades    int
+	ProfitUSD float64
+	// 平均gas price与优先费(gwei)
+	AvgGasPrice    float64
+	AvgPriorityFee float64
+	// 平均位置, 以及与我们同一区块并且排在我们前面的次数
+	AvgPosition float64
+	AheadOfUs   int
+}
+
+// 一个池组合上的竞争者
+type PairCompetitors struct {
+	PairKey     string
+	Competitors []CompetitorSummary
+}
+
+// 按池组合统计竞争者, 每个池组合按交易数与利润排序后保留前top个, 池组合按竞争交易总数排序
+func CompetitorReport(records []dt.Competitor, top int) (report []PairCompetitors) {
+	byPair := pie.GroupBy(records, func(c dt.Competitor) string { return c.PairKey })
+	total := make(map[string]int)
+	for key, cs := range byPair {
+		var summaries []CompetitorSummary
+		for from, list := range pie.GroupBy(cs, func(c dt.Competitor) string { return c.From }) {
+			sum := CompetitorSummary{From: from, Trades: len(list)}
+			for _, c := range list {
+				sum.ProfitUSD += c.ProfitUSD
+				sum.AvgGasPrice += float64(c.GasPrice) / 1e9
+				sum.AvgPriorityFee += float64(c.PriorityFee) / 1e9
+				sum.AvgPosition += float64(c.Position)
+				if c.OurPosition >= 0 && int(c.Position) < c.OurPosition {
+					sum.AheadOfUs++
+				}
+			}
+			n := float64(len(list))
+			sum.AvgGasPrice /= n
+			sum.AvgPriorityFee /= n
+			sum.AvgPosition /= n
+			summaries = append(summaries, sum)
+		}
+		sort.Slice(summaries, func(i, j int) bool {
+			if summaries[i].Trades != summaries[j].Trades {
+				return summaries[i].Trades > summaries[j].Trades
+			}
+			if summaries[i].ProfitUSD != summaries[j].ProfitUSD {
+				return summaries[i].ProfitUSD > summaries[j].ProfitUSD
+			}
+			return summaries[i].From < summaries[j].From
+		})
+		if top > 0 && len(summaries) > top {
+			summaries = summaries[:top]
+		}
+		total[key] = len(cs)
+		report = append(report, PairCompetitors{PairKey: key, Competitors: summaries})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if total[report[i].PairKey] != total[report[j].PairKey] {
+			return total[report[i].PairKey] > total[report[j].PairKey]
+		}
+		return report[i].PairKey < report[j].PairKey
+	})
+	return
+}
+
+// 分析并打印[start, end)内的竞争者
+func (s *Stats) Competitors(start, end time.Time, top int) {
+	if _, err := s.AnalyzeCompetitors(start, end); err != nil {
+		fmt.Println("分析竞争者失败:", err)
+	}
+	report := CompetitorReport(s.DB.GetCompetitors(start, end), top)
+	if len(report) < 1 {
+		fmt.Println("还没有数据!")
+		return
+	}
+	fmt.Println("\n================竞争者================")
+	fmt.Printf("时间从[%s]到[%s]\n", start.Format(time.DateTime), end.Format(time.DateTime))
+	for _, p := range report {
+		fmt.Printf("%s\n", p.PairKey)
+		for _, c := range p.Competitors {
+			fmt.Printf("\t%s 交易数: %d, 利润(USD): %.4f, 平均GasPrice: %.4f gwei, 平均优先费: %.4f gwei, 平均位置: %.1f, 排在我们前面: %d\n",
+				c.From, c.Trades, c.ProfitUSD, c.AvgGasPrice, c.AvgPriorityFee, c.AvgPosition, c.AheadOfUs)
+		}
+	}
+}
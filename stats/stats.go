@@ -32,6 +32,7 @@ func New(conf config.Configuration) (stats *Stats) {
 			DB:     database.GetClient(conf).Database(fmt.Sprintf("%slistener", conf.NetName)),
 			Mctx:   context.Background(),
 			Logger: l,
+			Oracle: database.NewPriceOracle(conf),
 		},
 	}
 	stats.init()
@@ -63,9 +64,16 @@ func (s *Stats) SearchTransacttion(simulation bool, start time.Time, end time.Ti
 	failure := 0
 	confirmed := 0
 	unconfirmed := 0
+	// 超过截止区块没有被打包的交易, 不计入失败
+	cancelled := 0
+	dropped := 0
 	for _, tx := range txs {
 		if tx.BaseToken != "" {
-			if tx.Confirm {
+			if tx.Status == dt.TX_STATUS_CANCELLED {
+				cancelled += 1
+			} else if tx.Status == dt.TX_STATUS_DROPPED {
+				dropped += 1
+			} else if tx.Confirm {
 				if tx.Ok {
 					coins[tx.BaseToken] += tx.Income
 					success += 1
@@ -108,4 +116,6 @@ func (s *Stats) SearchTransacttion(simulation bool, start time.Time, end time.Ti
 	fmt.Printf("失败数量: %d\n", failure)
 	fmt.Printf("已确认数量: %d\n", confirmed)
 	fmt.Printf("未确认数量: %d\n", unconfirmed)
+	fmt.Printf("取消数量: %d\n", cancelled)
+	fmt.Printf("丢弃数量: %d\n", dropped)
 }
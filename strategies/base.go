@@ -1,6 +1,7 @@
 package strategies
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sort"
@@ -10,9 +11,14 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/sirupsen/logrus"
 	"github.com/xiangxn/go-multicall"
+	"github.com/xiangxn/listener/config"
+	"github.com/xiangxn/listener/dex"
 	dt "github.com/xiangxn/listener/types"
 )
 
+// 合约最小利润默认可以低于预估净利润的比例
+const DEFAULT_PROFIT_TOLERANCE = 0.5
+
 type MovingBrick struct {
 	baseTokens  map[string]dt.Token
 	borrowPools map[string][]dt.SimplePool
@@ -52,6 +58,7 @@ func (m *MovingBrick) InitBaseTokens(monitor dt.IMonitor) {
 	for _, bt := range baseTokens {
 		bps := conf.BaseTokens[bt]
 		m.borrowPools[bt] = monitor.DB().GetSimplePools(bps)
+		m.discoverBorrowPools(monitor, bt)
 	}
 }
 
@@ -59,22 +66,6 @@ func (m *MovingBrick) GetBaseTokens() []dt.Token {
 	return pie.Values(m.baseTokens)
 }
 
-func (m *MovingBrick) getBorrowPool(buyPool, sellPool *dt.Pair, baseToken string) (borrow string, position uint8) {
-	borrowPools := m.borrowPools[baseToken]
-	for _, bp := range borrowPools {
-		if bp.Address != buyPool.Pool && bp.Address != sellPool.Pool {
-			borrow = bp.Address
-			if baseToken == bp.Token0 {
-				position = 0
-			} else {
-				position = 1
-			}
-			return
-		}
-	}
-	return borrowPools[0].Address, 0
-}
-
 func (m *MovingBrick) isUSD(token string) bool {
 	return strings.Contains(m.baseTokens[token].Symbol, "USD")
 }
@@ -103,106 +94,229 @@ func (m *MovingBrick) CalcArbitrage(monitor dt.IMonitor, event dt.SimplePool, bl
 	// 对齐交易对中的币种
 	data = pie.Each(data, func(p *dt.Pair) {
 		if p.Token0 != baseToken {
-			tmpT := p.Token0
-			p.Token0 = p.Token1
-			p.Token1 = tmpT
-			tmpR := p.Reserve0
-			p.Reserve0 = p.Reserve1
-			p.Reserve1 = tmpR
-			p.Price = 1 / p.Price
+			FlipPair(p)
 		}
 	})
-	// 过滤掉流动性不足的池
+	// 过滤掉流动性不足的池(按深度换算的储备量, 集中流动性池的Reserve0只是当前区间的数量)
+	impact := dex.DepthImpact(monitor)
 	data = pie.Filter(data, func(d *dt.Pair) bool {
-		return d.Reserve0 >= monitor.Config().BaseMinReserve
+		return d.DepthReserve0(impact) >= monitor.Config().BaseMinReserve
 	})
 	if len(data) < 2 {
 		return nil, false
 	}
-	// tmps := pie.Map(data, func(d *dt.Pair) float64 { return d.Price })
-	// fmt.Println("data0: ", tmps)
 	sort.Sort(&data)
-	// tmps = pie.Map(data, func(d *dt.Pair) float64 { return d.Price })
-	// fmt.Println("data0: ", tmps)
-
-	var buyPool, sellPool *dt.Pair
-	buyPool = data[0]
-	sellPool = data[len(data)-1]
-	amount, profit, avgPrice := m.calcArbitrage(monitor, sellPool, buyPool)
-	if profit > 0 {
-		var profitUSD float64
-		conf := monitor.Config().Strategies.GasToken
-		gasUSDPrice := monitor.DB().GetBasePrice(conf.Base, conf.Quote)
-		gas := monitor.GetUseGas(buyPool, sellPool, amount)
-		gasUSD := float64(gas) * gasPrice * gasUSDPrice
-		borrow, position := m.getBorrowPool(buyPool, sellPool, baseToken)
-
-		if baseToken == conf.Base {
-			profitUSD = profit / avgPrice * gasUSDPrice // avgPrice表示: 1 base = N quote
-		} else if m.isUSD(baseToken) {
-			profitUSD = profit / avgPrice
-		} else {
-			// 报价basetoken相对于USD的价格
-			basePrice := monitor.DB().GetBasePrice(baseToken, conf.Quote) // basePrice表示: 1 base = N quote
-			profitUSD = profit / avgPrice * basePrice
-		}
-		profitUSD -= gasUSD
-		if profitUSD < monitor.Config().MinProfitUSD {
-			return nil, false
+
+	// 评估所有买入/卖出池的组合, 按扣除gas后的USD利润排序
+	conf := monitor.Config().Strategies.GasToken
+	gasUSDPrice := monitor.DB().GetBasePrice(conf.Base, conf.Quote)
+	var candidates []*dt.Arbitrage
+	for i, buyPool := range data {
+		for _, sellPool := range data[i+1:] {
+			if sellPool.Price <= buyPool.Price {
+				continue
+			}
+			amount, profit := m.calcArbitrage(monitor, sellPool, buyPool)
+			if profit <= 0 {
+				continue
+			}
+			borrow, ok := m.selectBorrow(monitor, baseToken, amount, []string{buyPool.Pool, sellPool.Pool})
+			if !ok {
+				monitor.Logger().Debug(fmt.Sprintf("没有可用的借贷池: %s buy: %s, sell: %s", buyPool.Symbol, buyPool.Pool, sellPool.Pool))
+				continue
+			}
+			// 扣除闪电贷手续费
+			profit -= amount * borrow.Fee
+			if profit <= 0 {
+				continue
+			}
+			gas := monitor.GetUseGas(buyPool, sellPool, amount)
+			gasUSD := float64(gas) * gasPrice * gasUSDPrice
+			profitUSD := m.toUSD(monitor, baseToken, profit, gasUSDPrice) - gasUSD
+			if profitUSD < m.minProfitUSD(monitor) {
+				continue
+			}
+			candidates = append(candidates, &dt.Arbitrage{
+				BlockNumber: blockNumber,
+				Amount:      amount,
+				BuyPool:     *buyPool,
+				SellPool:    *sellPool,
+				ProfitUSD:   profitUSD,
+				GasPrice:    gasPrice,
+				Gas:         gas,
+				Borrow:      borrow.Pool,
+				Position:    borrow.Position,
+				BaseToken:   baseToken,
+				BorrowFee:   borrow.Fee,
+				Strategy:    STRATEGY_MOVING_BRICK,
+			})
 		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ProfitUSD > candidates[j].ProfitUSD })
 
+	arbitrage = candidates[0]
+	monitor.Logger().WithFields(logrus.Fields{
+		"Profit(USD)": arbitrage.ProfitUSD,
+		"Amount":      arbitrage.Amount,
+		"Symbol":      arbitrage.BuyPool.Symbol,
+		"PriceBuy":    arbitrage.BuyPool.Price,
+		"PriceSell":   arbitrage.SellPool.Price,
+	}).Info("发现可套利交易")
+	for _, alt := range candidates[1:] {
 		monitor.Logger().WithFields(logrus.Fields{
-			"Profit":      profit,
-			"Profit(USD)": profitUSD,
-			"Amount":      amount,
-			"Symbol":      buyPool.Symbol,
-			"PriceBuy":    buyPool.Price,
-			"PriceSell":   sellPool.Price,
-		}).Info("发现可套利交易")
-
-		arbitrage = new(dt.Arbitrage)
-		arbitrage.BlockNumber = blockNumber
-		arbitrage.Amount = amount
-		arbitrage.BuyPool = *buyPool
-		arbitrage.SellPool = *sellPool
-		arbitrage.ProfitUSD = profitUSD
-		arbitrage.GasPrice = gasPrice
-		arbitrage.Borrow = borrow
-		arbitrage.Position = position
-		arbitrage.BaseToken = baseToken
-
-		return arbitrage, true
-	} else {
-		return nil, false
+			"Profit(USD)": alt.ProfitUSD,
+			"Amount":      alt.Amount,
+			"BuyPool":     alt.BuyPool.Pool,
+			"SellPool":    alt.SellPool.Pool,
+		}).Debug("其他套利组合")
+	}
+	return arbitrage, true
+}
+
+func (m *MovingBrick) minProfitUSD(monitor dt.IMonitor) float64 {
+	if p := monitor.Config().Strategies.MovingBrick.MinProfitUSD; p > 0 {
+		return p
+	}
+	return monitor.Config().MinProfitUSD
+}
+
+// 检查策略需要的配置
+func (m *MovingBrick) Validate(cfg *config.Configuration) error {
+	conf := cfg.Strategies
+	if len(conf.BaseTokens) == 0 {
+		return errors.New("strategies.base_tokens is empty")
+	}
+	for bt, pools := range conf.BaseTokens {
+		if len(pools) == 0 && len(conf.Borrow.Dexs) == 0 {
+			return fmt.Errorf("strategies.base_tokens: no borrow pool for %s", bt)
+		}
 	}
+	if conf.GasToken.Base == "" || conf.GasToken.Quote == "" {
+		return errors.New("strategies.gas_token is not configured")
+	}
+	if conf.MovingBrick.MinProfitUSD < 0 {
+		return errors.New("strategies.moving_brick.min_profit_usd must not be negative")
+	}
+	// 库存的余额与小数位只对base token可用
+	for token := range cfg.Inventory.Targets {
+		if _, ok := conf.BaseTokens[token]; !ok {
+			return fmt.Errorf("inventory.targets: %s is not a base token", token)
+		}
+	}
+	return nil
 }
 
-// 搬平两个池的价格(价格用base/quote表示,即:1ETH=3000U,价格是3000,其中base是ETH,quote是USD)
-// 在a池卖出(basetoken), 在b池买入
-// 计算中包括了手续费, 如果profit大于0则可以套利
-// 返回的profit表示quoteToken的数量
-func (m *MovingBrick) calcArbitrage(monitor dt.IMonitor, aPool, bPool *dt.Pair) (deltaSell, profit, targetPrice float64) {
-	// 计算目标价格
-	targetPrice = (aPool.Price + bPool.Price) / 2
-	// 取储备小的一个值
-	minReserve := min(aPool.Reserve0, bPool.Reserve0)
-	// 计算卖出数量(以池子小的一个池来计算)
-	deltaSell = (aPool.Price - targetPrice) * minReserve / targetPrice / 2
+// 把baseToken数量换算成USD, gasUSDPrice为gas token的USD价格
+func (m *MovingBrick) toUSD(monitor dt.IMonitor, baseToken string, amount, gasUSDPrice float64) float64 {
+	conf := monitor.Config().Strategies.GasToken
+	if baseToken == conf.Base {
+		return amount * gasUSDPrice
+	} else if m.isUSD(baseToken) {
+		return amount
+	}
+	// 报价basetoken相对于USD的价格
+	basePrice := monitor.DB().GetBasePrice(baseToken, conf.Quote) // basePrice表示: 1 base = N quote
+	return amount * basePrice
+}
 
-	if deltaSell <= 0 || deltaSell*2 >= minReserve { //流动性太低(如用于交易的base token超过流动性的一半)
-		profit = -1
-		return
+// 合约要求的最小利润(baseToken数量): gas成本加上按容忍度扣减后的预估USD净利润
+func (m *MovingBrick) minProfit(monitor dt.IMonitor, arbitrage *dt.Arbitrage) float64 {
+	tolerance := monitor.Config().Strategies.ProfitTolerance
+	if tolerance <= 0 {
+		tolerance = DEFAULT_PROFIT_TOLERANCE
 	}
-	deltaSell = deltaSell + deltaSell*monitor.Config().DeltaCoefficient //DeltaCoefficient 默认为0.4,手动系数,因为计算出来的值会偏小
+	conf := monitor.Config().Strategies.GasToken
+	gasUSDPrice := monitor.DB().GetBasePrice(conf.Base, conf.Quote)
+	unitUSD := m.toUSD(monitor, arbitrage.BaseToken, 1, gasUSDPrice)
+	if unitUSD <= 0 {
+		return 0
+	}
+	gasUSD := float64(arbitrage.Gas) * arbitrage.GasPrice * gasUSDPrice
+	return (gasUSD + max(arbitrage.ProfitUSD, 0)*(1-min(tolerance, 1))) / unitUSD
+}
 
-	// 卖出(卖出baseToken,获得quoteToken)
-	proceeds := ((aPool.Price + targetPrice) / 2) * deltaSell * (1.0 - aPool.Fee)
-	// 买入(卖出quoteToken,获得baseToken)
-	cost := ((bPool.Price + targetPrice) / 2) * deltaSell * (1.0 + bPool.Fee)
+// 按新的数量重新报价套利路径, 返回扣除gas后的USD净利润与对应的最小利润
+func (m *MovingBrick) requote(monitor dt.IMonitor, arbitrage dt.Arbitrage, legs []dt.Pair) func(amount float64) (float64, float64) {
+	return func(amount float64) (float64, float64) {
+		conf := monitor.Config().Strategies.GasToken
+		gasUSDPrice := monitor.DB().GetBasePrice(conf.Base, conf.Quote)
+		profit := QuoteRoute(legs, amount, dex.DepthImpact(monitor)) - amount*(1+arbitrage.BorrowFee)
+		gasUSD := float64(arbitrage.Gas) * arbitrage.GasPrice * gasUSDPrice
+		arbitrage.Amount = amount
+		arbitrage.ProfitUSD = m.toUSD(monitor, arbitrage.BaseToken, profit, gasUSDPrice) - gasUSD
+		return arbitrage.ProfitUSD, m.minProfit(monitor, &arbitrage)
+	}
+}
 
-	// 利润(利润的数量是表示的quoteToken的数量)
-	profit = proceeds - cost
-	info := fmt.Sprintf("%s cost: %f, proceeds: %f, profit: %f, deltaSell: %f,pa: %f, pb: %f, fa: %f, fb: %f\n", bPool.Symbol, cost, proceeds, profit, deltaSell, aPool.Price, bPool.Price, aPool.Fee, bPool.Fee)
+// 价格区块早于blockNumber的交易对只查询最新价格(不保存), 本区块已更新的交易对直接使用, 查询失败的交易对被去掉
+func refreshPairs(monitor dt.IMonitor, pairs dt.Pairs, blockNumber uint64) (fresh dt.Pairs) {
+	stale := make(map[string]bool)
+	var tokens []string
+	for _, p := range pairs {
+		if p.BlockNumber < blockNumber {
+			stale[p.Pool] = true
+			tokens = append(tokens, p.Token0, p.Token1)
+		}
+	}
+	if len(stale) == 0 {
+		return pairs
+	}
+	pools := pie.Filter(monitor.DB().GetPoolsByTokens(pie.Unique(tokens)), func(p dt.Pool) bool { return stale[p.Address] })
+	queried := make(map[string]dt.Pair)
+	for _, p := range monitor.QueryPairs(pools) {
+		queried[p.Pool] = p
+	}
+	for _, p := range pairs {
+		if !stale[p.Pool] {
+			fresh = append(fresh, p)
+		} else if q, ok := queried[p.Pool]; ok {
+			fresh = append(fresh, &q)
+		}
+	}
+	return
+}
+
+// 交换交易对中的币种, 价格、储备、深度、方向手续费与PMM、LiquidityBook、集中流动性的卖出方向一起交换
+func FlipPair(p *dt.Pair) {
+	p.Token0, p.Token1 = p.Token1, p.Token0
+	p.Reserve0, p.Reserve1 = p.Reserve1, p.Reserve0
+	p.Price = 1 / p.Price
+	if p.Directional {
+		p.Fee, p.Fee1 = p.Fee1, p.Fee
+	}
+	p.Depth0, p.Depth1 = p.Depth1, p.Depth0
+	if p.PMM != nil {
+		pmm := *p.PMM
+		pmm.Reversed = !pmm.Reversed
+		p.PMM = &pmm
+	}
+	if p.LB != nil {
+		lb := *p.LB
+		lb.Reversed = !lb.Reversed
+		p.LB = &lb
+	}
+	if p.Ticks != nil {
+		ticks := *p.Ticks
+		ticks.Reversed = !ticks.Reversed
+		p.Ticks = &ticks
+	}
+}
+
+// 在a池卖出baseToken, 在b池买回baseToken(价格用base/quote表示,即:1ETH=3000U,价格是3000,其中base是ETH,quote是USD)
+// 计算中包括了手续费, 返回的profit表示baseToken的数量, 大于0则可以套利
+func (m *MovingBrick) calcArbitrage(monitor dt.IMonitor, aPool, bPool *dt.Pair) (amount, profit float64) {
+	buy := *bPool
+	FlipPair(&buy)
+	legs := []dt.Pair{*aPool, buy}
+	maxAmount := m.maxTradeAmount(monitor, aPool.Token0, []string{aPool.Pool, bPool.Pool})
+	amount, profit = m.sizeRoute(monitor, legs, maxAmount)
+	if amount <= 0 {
+		return 0, -1
+	}
+	info := fmt.Sprintf("%s amount: %f, profit: %f, pa: %f, pb: %f, fa: %f, fb: %f\n", bPool.Symbol, amount, profit, aPool.Price, bPool.Price, aPool.Fee, bPool.Fee)
 	monitor.Logger().Debug(info)
 	return
 }
@@ -219,12 +333,18 @@ func (m *MovingBrick) Do(monitor dt.IMonitor, arbitrage *dt.Arbitrage) {
 		Amount:      arbitrage.Amount,
 		BlockNumber: arbitrage.BlockNumber,
 		Deadline:    arbitrage.BlockNumber + 1,
-		BuyFee:      uint16(arbitrage.BuyPool.Fee * 1e4),
+		BuyFee:      uint16(arbitrage.BuyPool.ReverseFee() * 1e4),
 		SellFee:     uint16(arbitrage.SellPool.Fee * 1e4),
 		GasPrice:    arbitrage.GasPrice,
 		Borrow:      arbitrage.Borrow,
 		BaseToken:   arbitrage.BaseToken,
 		Position:    arbitrage.Position,
+		ProfitUSD:   arbitrage.ProfitUSD,
+		Gas:         arbitrage.Gas,
+		MinProfit:   m.minProfit(monitor, arbitrage),
 	}
+	buy := arbitrage.BuyPool
+	FlipPair(&buy)
+	params.Requote = m.requote(monitor, *arbitrage, []dt.Pair{arbitrage.SellPool, buy})
 	monitor.DoSwap(params)
 }
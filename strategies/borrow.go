@@ -0,0 +1,146 @@
+package strategies
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/xiangxn/listener/config"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// 可用于闪电贷的池
+type BorrowCandidate struct {
+	Pool     string
+	Position uint8   // baseToken在池中的位置, 0是token0, 1是token1
+	Fee      float64 // 闪电贷手续费(与池的交易手续费相同)
+	// 池中baseToken的数量, 价格表中没有数据时为-1
+	Liquidity float64
+}
+
+// 从价格表中发现配置的交易所中包含baseToken的池, 加入借贷池
+func (m *MovingBrick) discoverBorrowPools(monitor dt.IMonitor, baseToken string) {
+	conf := monitor.Config().Strategies.Borrow
+	if len(conf.Dexs) == 0 {
+		return
+	}
+	known := pie.Map(m.borrowPools[baseToken], func(p dt.SimplePool) string { return p.Address })
+	var found []string
+	for _, p := range monitor.DB().GetPairsWithTokens([]string{baseToken}) {
+		if !pie.Contains(conf.Dexs, p.DexName) || pie.Contains(known, p.Pool) || pie.Contains(monitor.GetPoolBlacklist(), p.Pool) {
+			continue
+		}
+		if pie.Contains(monitor.GetTokenBlacklist(), p.Token0) || pie.Contains(monitor.GetTokenBlacklist(), p.Token1) {
+			continue
+		}
+		if c, ok := newBorrowCandidate(p, baseToken); !ok || c.Liquidity < conf.MinLiquidity[baseToken] {
+			continue
+		}
+		found = append(found, p.Pool)
+	}
+	if len(found) == 0 {
+		return
+	}
+	m.borrowPools[baseToken] = append(m.borrowPools[baseToken], monitor.DB().GetSimplePools(found)...)
+	monitor.Logger().Info(fmt.Sprintf("发现%s的借贷池%d个", baseToken, len(found)))
+}
+
+func newBorrowCandidate(p *dt.Pair, baseToken string) (c BorrowCandidate, ok bool) {
+	c = BorrowCandidate{Pool: p.Pool, Fee: p.Fee}
+	switch baseToken {
+	case p.Token0:
+		c.Liquidity = p.Reserve0
+	case p.Token1:
+		c.Position = 1
+		c.Liquidity = p.Reserve1
+	default:
+		return c, false
+	}
+	return c, true
+}
+
+// 不参与交易的借贷池, 按手续费从低到高、流动性从高到低排序
+func (m *MovingBrick) borrowCandidates(monitor dt.IMonitor, baseToken string, exclude []string) (candidates []BorrowCandidate) {
+	pools := pie.FilterNot(m.borrowPools[baseToken], func(p dt.SimplePool) bool { return pie.Contains(exclude, p.Address) })
+	if len(pools) == 0 {
+		return
+	}
+	pairs := monitor.DB().GetPairs(pie.Map(pools, func(p dt.SimplePool) string { return p.Address }))
+	for _, bp := range pools {
+		i := pie.FindFirstUsing(pairs, func(p *dt.Pair) bool { return p.Pool == bp.Address })
+		if i < 0 {
+			// 价格表中没有数据时只能按配置使用
+			var position uint8
+			if baseToken != bp.Token0 {
+				position = 1
+			}
+			fee := BorrowPoolFee(bp, monitor.Config().Dexs)
+			candidates = append(candidates, BorrowCandidate{Pool: bp.Address, Position: position, Fee: fee, Liquidity: -1})
+			continue
+		}
+		if c, ok := newBorrowCandidate(pairs[i], baseToken); ok {
+			candidates = append(candidates, c)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Fee != candidates[j].Fee {
+			return candidates[i].Fee < candidates[j].Fee
+		}
+		return candidates[i].Liquidity > candidates[j].Liquidity
+	})
+	return
+}
+
+// 价格表中没有数据时借贷池的手续费: 优先使用池参数中的手续费, 否则使用池所属交易所配置的手续费
+func BorrowPoolFee(bp dt.SimplePool, dexs []config.DexConfig) float64 {
+	if bp.Params != nil && bp.Params.Fee > 0 {
+		return bp.Params.Fee
+	}
+	for _, d := range dexs {
+		if d.Factory != bp.Factory {
+			continue
+		}
+		if bp.Params != nil && bp.Params.Stable && d.StableFee > 0 {
+			return d.StableFee
+		}
+		return d.Fee
+	}
+	return 0
+}
+
+// 选择能借出amount的手续费最低的借贷池, 都不满足时使用没有价格数据的借贷池
+func SelectBorrowPool(candidates []BorrowCandidate, amount float64) (BorrowCandidate, bool) {
+	for _, c := range candidates {
+		if c.Liquidity >= amount {
+			return c, true
+		}
+	}
+	for _, c := range candidates {
+		if c.Liquidity < 0 {
+			return c, true
+		}
+	}
+	return BorrowCandidate{}, false
+}
+
+// 借贷池中最多能借出的baseToken数量
+func maxBorrowLiquidity(candidates []BorrowCandidate) float64 {
+	var liquidity float64
+	for _, c := range candidates {
+		liquidity = max(liquidity, c.Liquidity)
+	}
+	return liquidity
+}
+
+// 为需要的数量选择借贷池, 余额足够时不借贷(fee为0)
+func (m *MovingBrick) selectBorrow(monitor dt.IMonitor, baseToken string, amount float64, exclude []string) (c BorrowCandidate, ok bool) {
+	candidates := m.borrowCandidates(monitor, baseToken, exclude)
+	if amount <= monitor.GetBaseBalance(baseToken) {
+		if len(candidates) > 0 {
+			c = candidates[0]
+		}
+		c.Fee = 0
+		return c, true
+	}
+	return SelectBorrowPool(candidates, amount)
+}
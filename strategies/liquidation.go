@@ -0,0 +1,600 @@
+package strategies
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/sirupsen/logrus"
+	"github.com/xiangxn/go-multicall"
+	"github.com/xiangxn/listener/config"
+	"github.com/xiangxn/listener/dex"
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// Aave V3 Pool中改变仓位的事件
+var (
+	AaveSupplyTopic      = crypto.Keccak256Hash([]byte("Supply(address,address,address,uint256,uint16)"))
+	AaveWithdrawTopic    = crypto.Keccak256Hash([]byte("Withdraw(address,address,address,uint256)"))
+	AaveBorrowTopic      = crypto.Keccak256Hash([]byte("Borrow(address,address,address,uint256,uint8,uint256,uint16)"))
+	AaveRepayTopic       = crypto.Keccak256Hash([]byte("Repay(address,address,address,uint256,bool)"))
+	AaveLiquidationTopic = crypto.Keccak256Hash([]byte("LiquidationCall(address,address,address,uint256,uint256,address,bool)"))
+)
+
+const (
+	// 健康因子低于该值时可以清算全部债务, 否则最多清算一半(Aave V3的CLOSE_FACTOR_HF_THRESHOLD)
+	AAVE_CLOSE_FACTOR_HF_THRESHOLD = 0.95
+	AAVE_DEFAULT_CLOSE_FACTOR      = 0.5
+
+	DEFAULT_WATCH_HEALTH_FACTOR = 1.05
+	DEFAULT_REFRESH_BLOCKS      = 20
+	DEFAULT_LIQUIDATION_GAS     = 800000
+	// 回溯借款人事件时每次eth_getLogs查询的区块数
+	AAVE_LOG_RANGE = 2000
+)
+
+const AAVE_POOL_ABI = `[{"inputs":[],"name":"ADDRESSES_PROVIDER","outputs":[{"internalType":"contract IPoolAddressesProvider","name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"getReservesList","outputs":[{"internalType":"address[]","name":"","type":"address[]"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"address","name":"user","type":"address"}],"name":"getUserAccountData","outputs":[{"internalType":"uint256","name":"totalCollateralBase","type":"uint256"},{"internalType":"uint256","name":"totalDebtBase","type":"uint256"},{"internalType":"uint256","name":"availableBorrowsBase","type":"uint256"},{"internalType":"uint256","name":"currentLiquidationThreshold","type":"uint256"},{"internalType":"uint256","name":"ltv","type":"uint256"},{"internalType":"uint256","name":"healthFactor","type":"uint256"}],"stateMutability":"view","type":"function"}]`
+
+const AAVE_ADDRESSES_PROVIDER_ABI = `[{"inputs":[],"name":"getPoolDataProvider","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"getPriceOracle","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"}]`
+
+const AAVE_DATA_PROVIDER_ABI = `[{"inputs":[{"internalType":"address","name":"asset","type":"address"},{"internalType":"address","name":"user","type":"address"}],"name":"getUserReserveData","outputs":[{"internalType":"uint256","name":"currentATokenBalance","type":"uint256"},{"internalType":"uint256","name":"currentStableDebt","type":"uint256"},{"internalType":"uint256","name":"currentVariableDebt","type":"uint256"},{"internalType":"uint256","name":"principalStableDebt","type":"uint256"},{"internalType":"uint256","name":"scaledVariableDebt","type":"uint256"},{"internalType":"uint256","name":"stableBorrowRate","type":"uint256"},{"internalType":"uint256","name":"liquidityRate","type":"uint256"},{"internalType":"uint40","name":"stableRateLastUpdated","type":"uint40"},{"internalType":"bool","name":"usageAsCollateralEnabled","type":"bool"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"address","name":"asset","type":"address"}],"name":"getReserveConfigurationData","outputs":[{"internalType":"uint256","name":"decimals","type":"uint256"},{"internalType":"uint256","name":"ltv","type":"uint256"},{"internalType":"uint256","name":"liquidationThreshold","type":"uint256"},{"internalType":"uint256","name":"liquidationBonus","type":"uint256"},{"internalType":"uint256","name":"reserveFactor","type":"uint256"},{"internalType":"bool","name":"usageAsCollateralEnabled","type":"bool"},{"internalType":"bool","name":"borrowingEnabled","type":"bool"},{"internalType":"bool","name":"stableBorrowRateEnabled","type":"bool"},{"internalType":"bool","name":"isActive","type":"bool"},{"internalType":"bool","name":"isFrozen","type":"bool"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"address","name":"asset","type":"address"}],"name":"getLiquidationProtocolFee","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"}]`
+
+const AAVE_ORACLE_ABI = `[{"inputs":[{"internalType":"address","name":"asset","type":"address"}],"name":"getAssetPrice","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"}]`
+
+type aaveAccountData struct {
+	TotalCollateralBase         *big.Int
+	TotalDebtBase               *big.Int
+	AvailableBorrowsBase        *big.Int
+	CurrentLiquidationThreshold *big.Int
+	Ltv                         *big.Int
+	HealthFactor                *big.Int
+}
+
+type aaveUserReserveData struct {
+	CurrentATokenBalance     *big.Int
+	CurrentStableDebt        *big.Int
+	CurrentVariableDebt      *big.Int
+	PrincipalStableDebt      *big.Int
+	ScaledVariableDebt       *big.Int
+	StableBorrowRate         *big.Int
+	LiquidityRate            *big.Int
+	StableRateLastUpdated    *big.Int
+	UsageAsCollateralEnabled bool
+}
+
+// 只取需要的前几个返回值
+type aaveReserveConfig struct {
+	Decimals             *big.Int
+	Ltv                  *big.Int
+	LiquidationThreshold *big.Int
+	LiquidationBonus     *big.Int
+}
+
+type aaveAddresses struct {
+	Assets []common.Address
+}
+
+// 从Aave V3 Pool的事件中取出仓位发生变化的借款人, 不是仓位相关的事件时返回false
+func ParseAaveLog(l types.Log) (user string, ok bool) {
+	if len(l.Topics) < 3 {
+		return "", false
+	}
+	switch l.Topics[0] {
+	case AaveSupplyTopic, AaveWithdrawTopic, AaveBorrowTopic, AaveRepayTopic:
+		return common.BytesToAddress(l.Topics[2].Bytes()).Hex(), true
+	case AaveLiquidationTopic:
+		if len(l.Topics) < 4 {
+			return "", false
+		}
+		return common.BytesToAddress(l.Topics[3].Bytes()).Hex(), true
+	}
+	return "", false
+}
+
+// 跟踪的借款人
+type AavePosition struct {
+	User string
+	// 最近一次查询的健康因子, 有新事件或还没有查询时为0
+	HealthFactor float64
+	HasDebt      bool
+	CheckedBlock uint64
+}
+
+// 是否需要在blockNumber重新查询健康因子: 有新事件、接近清算线或超过refresh个区块没有查询
+// 没有债务的借款人只在有新事件时查询
+func (p *AavePosition) Due(blockNumber uint64, watch float64, refresh uint64) bool {
+	if p.HealthFactor == 0 {
+		return true
+	}
+	return p.HasDebt && (p.HealthFactor < watch || p.CheckedBlock+refresh <= blockNumber)
+}
+
+// 借款人在一种资产上的仓位与资产的清算参数
+type AaveReserve struct {
+	Asset    string
+	Decimals uint64
+	// 预言机价格(Aave的基础货币)
+	Price float64
+	// 清算奖励, 如1.05表示得到价值105%的抵押品
+	Bonus float64
+	// 协议从清算奖励中收取的比例
+	ProtocolFee float64
+	// 可以被清算的抵押品数量(未启用抵押时为0)
+	Collateral float64
+	Debt       float64
+}
+
+// 计算清算debt债务、得到collateral抵押品时偿还的债务数量与得到的抵押品数量
+// 健康因子不低于0.95时最多偿还一半债务, 抵押品不足时按抵押品数量减少偿还的债务
+func LiquidationAmounts(healthFactor float64, debt, collateral AaveReserve) (debtToCover, seized float64) {
+	if debt.Price <= 0 || collateral.Price <= 0 || collateral.Bonus <= 0 {
+		return 0, 0
+	}
+	closeFactor := AAVE_DEFAULT_CLOSE_FACTOR
+	if healthFactor < AAVE_CLOSE_FACTOR_HF_THRESHOLD {
+		closeFactor = 1
+	}
+	debtToCover = debt.Debt * closeFactor
+	base := debtToCover * debt.Price / collateral.Price
+	total := base * collateral.Bonus
+	if total > collateral.Collateral {
+		total = collateral.Collateral
+		base = total / collateral.Bonus
+		debtToCover = base * collateral.Price / debt.Price
+	}
+	seized = total - (total-base)*collateral.ProtocolFee
+	return
+}
+
+// 一次清算机会
+type liquidationCandidate struct {
+	User        string
+	Debt        AaveReserve
+	Collateral  AaveReserve
+	DebtToCover float64
+	Seized      float64
+	SellPool    *dt.Pair
+	Borrow      BorrowCandidate
+	Gas         int64
+	ProfitUSD   float64
+}
+
+// Aave V3清算: 根据借贷事件跟踪借款人, 每批事件用multicall批量检查健康因子,
+// 健康因子低于1时用闪电贷偿还债务, 并在最优的池中把得到的抵押品卖回债务token
+// 债务token需要是base token(使用base token的借贷池与价格)
+type Liquidation struct {
+	MovingBrick
+	pool         common.Address
+	dataProvider common.Address
+	oracle       common.Address
+	// Aave中所有的资产
+	assets []string
+	// 资产的清算参数, 查询一次后缓存
+	configs     map[string]AaveReserve
+	positions   map[string]*AavePosition
+	initialized bool
+	// 上一批还在处理时跳过新的批次
+	running atomic.Bool
+}
+
+var _ dt.EventHandler = &Liquidation{}
+var _ dt.LogHandler = &Liquidation{}
+
+func (l *Liquidation) InitBaseTokens(monitor dt.IMonitor) {
+	l.MovingBrick.InitBaseTokens(monitor)
+	l.pool = common.HexToAddress(monitor.Config().Strategies.Liquidation.Pool)
+	if l.configs == nil {
+		l.configs = make(map[string]AaveReserve)
+	}
+	if l.positions == nil {
+		l.positions = make(map[string]*AavePosition)
+	}
+}
+
+func (l *Liquidation) Validate(cfg *config.Configuration) error {
+	if err := l.MovingBrick.Validate(cfg); err != nil {
+		return err
+	}
+	conf := cfg.Strategies.Liquidation
+	if !common.IsHexAddress(conf.Pool) {
+		return errors.New("strategies.liquidation.pool is not configured")
+	}
+	if conf.WatchHealthFactor != 0 && conf.WatchHealthFactor < 1 {
+		return errors.New("strategies.liquidation.watch_health_factor must be at least 1")
+	}
+	if conf.MinProfitUSD < 0 {
+		return errors.New("strategies.liquidation.min_profit_usd must not be negative")
+	}
+	return nil
+}
+
+// 清算不由交易池事件触发
+func (l *Liquidation) CalcArbitrage(monitor dt.IMonitor, event dt.SimplePool, blockNumber uint64, gasPrice float64) (arbitrage *dt.Arbitrage, ok bool) {
+	return nil, false
+}
+
+func (l *Liquidation) Do(monitor dt.IMonitor, arbitrage *dt.Arbitrage) {
+	monitor.Logger().Debug("Do: ", arbitrage)
+	go monitor.SendToTG(fmt.Sprintf("清算: %s, Debt: %s, Collateral: %s, Amount: %.6f, Estimated: %.4f, Block: %d, SellPool: %s",
+		arbitrage.Liquidation.User, arbitrage.BaseToken, arbitrage.Liquidation.Collateral, arbitrage.Amount, arbitrage.ProfitUSD,
+		arbitrage.BlockNumber, arbitrage.SellPool.Pool))
+
+	params := dt.SwapParams{
+		SellPool:    arbitrage.SellPool.Pool,
+		SellFee:     uint16(arbitrage.SellPool.Fee * 1e4),
+		Amount:      arbitrage.Amount,
+		BlockNumber: arbitrage.BlockNumber,
+		Deadline:    arbitrage.BlockNumber + 1,
+		GasPrice:    arbitrage.GasPrice,
+		Borrow:      arbitrage.Borrow,
+		Position:    arbitrage.Position,
+		BaseToken:   arbitrage.BaseToken,
+		ProfitUSD:   arbitrage.ProfitUSD,
+		Gas:         arbitrage.Gas,
+		MinProfit:   l.minProfit(monitor, arbitrage),
+		Liquidation: arbitrage.Liquidation,
+	}
+	monitor.DoSwap(params)
+}
+
+func (l *Liquidation) LogFilter() (addresses []common.Address, topics []common.Hash) {
+	return []common.Address{l.pool}, []common.Hash{AaveSupplyTopic, AaveWithdrawTopic, AaveBorrowTopic, AaveRepayTopic, AaveLiquidationTopic}
+}
+
+func (l *Liquidation) HandleLogs(monitor dt.IMonitor, logs []types.Log, blockNumber uint64, gasPrice float64) (arbitrages []*dt.Arbitrage) {
+	if !l.running.CompareAndSwap(false, true) {
+		monitor.Logger().Debug("上一批清算检查还没有完成")
+		return nil
+	}
+	defer l.running.Store(false)
+	if !l.initialized {
+		if err := l.init(monitor, blockNumber); err != nil {
+			monitor.Logger().Error("初始化清算策略失败: ", err)
+			return nil
+		}
+	}
+	l.track(logs)
+
+	conf := monitor.Config().Strategies.Liquidation
+	watch, refresh := conf.WatchHealthFactor, conf.RefreshBlocks
+	if watch <= 0 {
+		watch = DEFAULT_WATCH_HEALTH_FACTOR
+	}
+	if refresh == 0 {
+		refresh = DEFAULT_REFRESH_BLOCKS
+	}
+	var users []string
+	for user, p := range l.positions {
+		if p.Due(blockNumber, watch, refresh) {
+			users = append(users, user)
+		}
+	}
+	prices := make(map[string]dt.Pairs)
+	for _, user := range l.checkHealth(monitor, users, blockNumber) {
+		if c, ok := l.evaluate(monitor, user, blockNumber, gasPrice, prices); ok {
+			arbitrages = append(arbitrages, l.arbitrage(monitor, c, blockNumber, gasPrice))
+		}
+	}
+	return
+}
+
+// 查询数据提供者与预言机地址、资产列表, 并回溯借款人事件
+func (l *Liquidation) init(monitor dt.IMonitor, blockNumber uint64) error {
+	conf := monitor.Config().Strategies.Liquidation
+	pool, err := multicall.NewContract(AAVE_POOL_ABI, conf.Pool)
+	if err != nil {
+		return err
+	}
+	calls, err := monitor.Multicall().Call(monitor.CallOpts(),
+		pool.NewCall(new(dt.ResAddress), "ADDRESSES_PROVIDER"),
+		pool.NewCall(new(aaveAddresses), "getReservesList"),
+	)
+	if err != nil {
+		return err
+	}
+	provider := calls[0].Outputs.(*dt.ResAddress).Address
+	l.assets = pie.Map(calls[1].Outputs.(*aaveAddresses).Assets, func(a common.Address) string { return a.Hex() })
+	l.dataProvider, l.oracle = common.HexToAddress(conf.DataProvider), common.HexToAddress(conf.Oracle)
+	if conf.DataProvider == "" || conf.Oracle == "" {
+		p, err := multicall.NewContract(AAVE_ADDRESSES_PROVIDER_ABI, provider.Hex())
+		if err != nil {
+			return err
+		}
+		calls, err = monitor.Multicall().Call(monitor.CallOpts(),
+			p.NewCall(new(dt.ResAddress), "getPoolDataProvider"),
+			p.NewCall(new(dt.ResAddress), "getPriceOracle"),
+		)
+		if err != nil {
+			return err
+		}
+		if conf.DataProvider == "" {
+			l.dataProvider = calls[0].Outputs.(*dt.ResAddress).Address
+		}
+		if conf.Oracle == "" {
+			l.oracle = calls[1].Outputs.(*dt.ResAddress).Address
+		}
+	}
+	if conf.Lookback > 0 {
+		l.backfill(monitor, blockNumber-min(conf.Lookback, blockNumber), blockNumber)
+	}
+	l.initialized = true
+	monitor.Logger().WithFields(logrus.Fields{
+		"Assets":       len(l.assets),
+		"Borrowers":    len(l.positions),
+		"DataProvider": l.dataProvider.Hex(),
+		"Oracle":       l.oracle.Hex(),
+	}).Info("清算策略已初始化")
+	return nil
+}
+
+// 回溯[from, to]内的借贷事件
+func (l *Liquidation) backfill(monitor dt.IMonitor, from, to uint64) {
+	addresses, topics := l.LogFilter()
+	for start := from; start <= to; start += AAVE_LOG_RANGE {
+		query := ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(start),
+			ToBlock:   new(big.Int).SetUint64(min(start+AAVE_LOG_RANGE-1, to)),
+			Addresses: addresses,
+			Topics:    [][]common.Hash{topics},
+		}
+		logs, err := monitor.GetHttpClient().FilterLogs(monitor.GetContext(), query)
+		if err != nil {
+			monitor.Logger().Error(fmt.Sprintf("回溯借贷事件[%d, %d]失败: %s", start, query.ToBlock, err))
+			return
+		}
+		l.track(logs)
+	}
+}
+
+// 记录事件中仓位发生变化的借款人, 下一次检查时重新查询
+func (l *Liquidation) track(logs []types.Log) {
+	for _, lg := range logs {
+		if lg.Removed || lg.Address != l.pool {
+			continue
+		}
+		user, ok := ParseAaveLog(lg)
+		if !ok {
+			continue
+		}
+		if p, exists := l.positions[user]; exists {
+			p.HealthFactor = 0
+		} else {
+			l.positions[user] = &AavePosition{User: user}
+		}
+	}
+}
+
+// 批量查询健康因子, 返回可以清算的借款人
+func (l *Liquidation) checkHealth(monitor dt.IMonitor, users []string, blockNumber uint64) (liquidatable []string) {
+	if len(users) == 0 {
+		return
+	}
+	pool, err := multicall.NewContract(AAVE_POOL_ABI, l.pool.Hex())
+	if err != nil {
+		monitor.Logger().Error("checkHealth: ", err)
+		return
+	}
+	calls := pie.Map(users, func(user string) *multicall.Call {
+		return pool.NewCall(new(aaveAccountData), "getUserAccountData", common.HexToAddress(user)).Name(user).AllowFailure()
+	})
+	cfg := monitor.Config()
+	if _, err := tools.ConcurrentMulticall(monitor.Multicall(), monitor.CallOpts(), calls, cfg.ChunkLength, cfg.MaxConcurrent); err != nil {
+		monitor.Logger().Error("查询健康因子失败: ", err)
+	}
+	for i, call := range calls {
+		res := call.Outputs.(*aaveAccountData)
+		if call.Failed || res.HealthFactor == nil || res.TotalDebtBase == nil {
+			continue
+		}
+		p := l.positions[users[i]]
+		p.HasDebt = res.TotalDebtBase.Sign() > 0
+		p.HealthFactor = tools.BigIntToFloat64(res.HealthFactor, 18)
+		p.CheckedBlock = blockNumber
+		if p.HasDebt && p.HealthFactor < 1 {
+			liquidatable = append(liquidatable, users[i])
+		}
+	}
+	monitor.Logger().Debug(fmt.Sprintf("检查了%d个借款人的健康因子, 可以清算: %d", len(users), len(liquidatable)))
+	return
+}
+
+// 查询借款人在每种资产上的仓位, 没有缓存的资产同时查询清算参数
+func (l *Liquidation) userReserves(monitor dt.IMonitor, user string) (reserves []AaveReserve, err error) {
+	provider, err := multicall.NewContract(AAVE_DATA_PROVIDER_ABI, l.dataProvider.Hex())
+	if err != nil {
+		return
+	}
+	oracle, err := multicall.NewContract(AAVE_ORACLE_ABI, l.oracle.Hex())
+	if err != nil {
+		return
+	}
+	missing := pie.FilterNot(l.assets, func(a string) bool { _, ok := l.configs[a]; return ok })
+	var calls []*multicall.Call
+	for _, a := range missing {
+		asset := common.HexToAddress(a)
+		calls = append(calls,
+			provider.NewCall(new(aaveReserveConfig), "getReserveConfigurationData", asset).AllowFailure(),
+			provider.NewCall(new(dt.ResBigInt), "getLiquidationProtocolFee", asset).AllowFailure(),
+		)
+	}
+	for _, a := range l.assets {
+		asset := common.HexToAddress(a)
+		calls = append(calls,
+			provider.NewCall(new(aaveUserReserveData), "getUserReserveData", asset, common.HexToAddress(user)).AllowFailure(),
+			oracle.NewCall(new(dt.ResBigInt), "getAssetPrice", asset).AllowFailure(),
+		)
+	}
+	if _, err = monitor.Multicall().Call(monitor.CallOpts(), calls...); err != nil {
+		return
+	}
+	for i, a := range missing {
+		cc, fc := calls[i*2], calls[i*2+1]
+		if cc.Failed || fc.Failed {
+			continue
+		}
+		c := cc.Outputs.(*aaveReserveConfig)
+		l.configs[a] = AaveReserve{
+			Asset:       a,
+			Decimals:    c.Decimals.Uint64(),
+			Bonus:       float64(c.LiquidationBonus.Uint64()) / 1e4,
+			ProtocolFee: float64(fc.Outputs.(*dt.ResBigInt).Uint64()) / 1e4,
+		}
+	}
+	calls = calls[len(missing)*2:]
+	for i, a := range l.assets {
+		rc, pc := calls[i*2], calls[i*2+1]
+		r, ok := l.configs[a]
+		if !ok || rc.Failed || pc.Failed {
+			continue
+		}
+		data := rc.Outputs.(*aaveUserReserveData)
+		debt := new(big.Int).Add(data.CurrentStableDebt, data.CurrentVariableDebt)
+		if data.UsageAsCollateralEnabled {
+			r.Collateral = tools.BigIntToFloat64(data.CurrentATokenBalance, r.Decimals)
+		}
+		r.Debt = tools.BigIntToFloat64(debt, r.Decimals)
+		r.Price = tools.BigIntToFloat64(pc.Outputs.(*dt.ResBigInt).Int, 0)
+		if r.Collateral > 0 || r.Debt > 0 {
+			reserves = append(reserves, r)
+		}
+	}
+	return
+}
+
+// 在抵押品与债务token的池中找出卖出amount个抵押品得到最多债务token的池
+// prices缓存本批次已查询过的交易对, 同一对token只查询一次价格
+func (l *Liquidation) bestSellPool(monitor dt.IMonitor, collateral, debt string, amount float64, blockNumber uint64, prices map[string]dt.Pairs) (pool *dt.Pair, out float64) {
+	key := min(collateral, debt) + max(collateral, debt)
+	pairs, ok := prices[key]
+	if !ok {
+		pairs = refreshPairs(monitor, monitor.DB().GetPairsByTokens([]string{collateral, debt}), blockNumber)
+		prices[key] = pairs
+	}
+	impact := dex.DepthImpact(monitor)
+	for _, pair := range pairs {
+		p := new(dt.Pair)
+		*p = *pair
+		if pie.Contains(monitor.GetPoolBlacklist(), p.Pool) {
+			continue
+		}
+		if p.Token0 != collateral {
+			FlipPair(p)
+		}
+		// 超过深度时报价不准确
+		if amount > RouteMaxAmount([]dt.Pair{*p}) {
+			continue
+		}
+		if o := QuoteLeg(p, amount, impact); o > out {
+			pool, out = p, o
+		}
+	}
+	return
+}
+
+// 在借款人所有的债务与抵押品组合中选择USD利润最大的清算
+func (l *Liquidation) evaluate(monitor dt.IMonitor, user string, blockNumber uint64, gasPrice float64, prices map[string]dt.Pairs) (best *liquidationCandidate, ok bool) {
+	reserves, err := l.userReserves(monitor, user)
+	if err != nil {
+		monitor.Logger().Error("查询借款人仓位失败: ", err)
+		return nil, false
+	}
+	hf := l.positions[user].HealthFactor
+	conf := monitor.Config().Strategies.GasToken
+	gasUSDPrice := monitor.DB().GetBasePrice(conf.Base, conf.Quote)
+	gas := l.gas(monitor)
+	for _, debt := range reserves {
+		if debt.Debt <= 0 {
+			continue
+		}
+		if _, ok := l.baseTokens[debt.Asset]; !ok {
+			monitor.Logger().Debug(fmt.Sprintf("债务token不是base token, 不能清算: %s %s", user, debt.Asset))
+			continue
+		}
+		for _, collateral := range reserves {
+			if collateral.Collateral <= 0 || collateral.Asset == debt.Asset || pie.Contains(monitor.GetTokenBlacklist(), collateral.Asset) {
+				continue
+			}
+			debtToCover, seized := LiquidationAmounts(hf, debt, collateral)
+			if debtToCover <= 0 {
+				continue
+			}
+			pool, out := l.bestSellPool(monitor, collateral.Asset, debt.Asset, seized, blockNumber, prices)
+			if pool == nil {
+				continue
+			}
+			borrow, ok := l.selectBorrow(monitor, debt.Asset, debtToCover, []string{pool.Pool})
+			if !ok {
+				continue
+			}
+			profit := out - debtToCover*(1+borrow.Fee)
+			profitUSD := l.toUSD(monitor, debt.Asset, profit, gasUSDPrice) - float64(gas)*gasPrice*gasUSDPrice
+			if profitUSD < l.minProfitUSD(monitor) || (best != nil && profitUSD <= best.ProfitUSD) {
+				continue
+			}
+			best = &liquidationCandidate{
+				User:        user,
+				Debt:        debt,
+				Collateral:  collateral,
+				DebtToCover: debtToCover,
+				Seized:      seized,
+				SellPool:    pool,
+				Borrow:      borrow,
+				Gas:         gas,
+				ProfitUSD:   profitUSD,
+			}
+		}
+	}
+	return best, best != nil
+}
+
+func (l *Liquidation) gas(monitor dt.IMonitor) int64 {
+	if gas := monitor.Config().Strategies.Liquidation.Gas; gas > 0 {
+		return gas
+	}
+	return DEFAULT_LIQUIDATION_GAS
+}
+
+func (l *Liquidation) minProfitUSD(monitor dt.IMonitor) float64 {
+	if p := monitor.Config().Strategies.Liquidation.MinProfitUSD; p > 0 {
+		return p
+	}
+	return monitor.Config().MinProfitUSD
+}
+
+// 清算仓位转为套利, 与交易池事件的套利一起调度, 避免同一区块的交易使用同一个卖出池或借款池
+func (l *Liquidation) arbitrage(monitor dt.IMonitor, c *liquidationCandidate, blockNumber uint64, gasPrice float64) *dt.Arbitrage {
+	monitor.Logger().WithFields(logrus.Fields{
+		"User":        c.User,
+		"Debt":        c.Debt.Asset,
+		"Collateral":  c.Collateral.Asset,
+		"DebtToCover": c.DebtToCover,
+		"Seized":      c.Seized,
+		"SellPool":    c.SellPool.Pool,
+		"Profit(USD)": c.ProfitUSD,
+	}).Info("发现可清算仓位")
+	return &dt.Arbitrage{
+		SellPool:    *c.SellPool,
+		Amount:      c.DebtToCover,
+		ProfitUSD:   c.ProfitUSD,
+		BlockNumber: blockNumber,
+		GasPrice:    gasPrice,
+		Borrow:      c.Borrow.Pool,
+		Position:    c.Borrow.Position,
+		BaseToken:   c.Debt.Asset,
+		BorrowFee:   c.Borrow.Fee,
+		Strategy:    STRATEGY_LIQUIDATION,
+		Gas:         c.Gas,
+		Liquidation: &dt.LiquidationParams{
+			AavePool:   monitor.Config().Strategies.Liquidation.Pool,
+			User:       c.User,
+			Collateral: c.Collateral.Asset,
+		},
+	}
+}
@@ -0,0 +1,339 @@
+package strategies
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/xiangxn/listener/config"
+	dt "github.com/xiangxn/listener/types"
+)
+
+const DEFAULT_MAX_HOPS = 3
+
+// 图只包含事件token相邻的token, 超过4跳的环不能保证被找到
+const MAX_HOPS_LIMIT = 4
+
+// 每一步的默认gas与闪电贷额外的gas
+const (
+	DEFAULT_GAS_PER_LEG = 150000
+	FLASH_BORROW_GAS    = 100000
+)
+
+// 多跳(三角)套利: 用价格表构建token图, 搜索经过事件池且以base token开始和结束的环
+type MultiHop struct {
+	MovingBrick
+}
+
+var _ dt.EventHandler = &MultiHop{}
+
+// 图中的有向边, pair已对齐为卖出Token0买入Token1
+type graphEdge struct {
+	pair   dt.Pair
+	weight float64 // -log(价格*(1-手续费))
+}
+
+// 按方向分别对齐交易对, 生成两条有向边
+func newGraphEdges(p *dt.Pair) (edges []*graphEdge) {
+	if p.Price <= 0 || p.Depth0 <= 0 || p.Depth1 <= 0 {
+		return
+	}
+	forward := *p
+	forward.State = nil
+	reverse := forward
+	FlipPair(&reverse)
+	for _, e := range []dt.Pair{forward, reverse} {
+		rate := e.Price * (1 - e.Fee)
+		if rate <= 0 {
+			continue
+		}
+		edges = append(edges, &graphEdge{pair: e, weight: -math.Log(rate)})
+	}
+	return
+}
+
+// 套利环, Legs从baseToken开始依次交易
+type Cycle struct {
+	Legs []dt.Pair
+	// 所有边权重之和, 小于0表示扣除手续费后的汇率乘积大于1
+	Weight float64
+}
+
+// 环上所有交易的汇率乘积(已扣除手续费)
+func (c *Cycle) Rate() float64 { return math.Exp(-c.Weight) }
+
+// 是否为简单环: 每个池只使用一次, 除起点外token不重复
+func (c *Cycle) valid() bool {
+	var pools, tokens []string
+	for _, leg := range c.Legs {
+		if pie.Contains(pools, leg.Pool) || pie.Contains(tokens, leg.Token0) {
+			return false
+		}
+		pools = append(pools, leg.Pool)
+		tokens = append(tokens, leg.Token0)
+	}
+	return len(c.Legs) > 0 && c.Legs[len(c.Legs)-1].Token1 == c.Legs[0].Token0
+}
+
+// 在交易对中搜索经过event池、从baseToken开始并回到baseToken的最优环(边数不超过maxHops)
+// 正向从baseToken、反向到baseToken各做一次按边数分层的Bellman-Ford, 再用event池的边连接两段
+func BestCycle(pairs dt.Pairs, event dt.SimplePool, baseToken string, maxHops int) *Cycle {
+	var edges, eventEdges []*graphEdge
+	for _, p := range pairs {
+		es := newGraphEdges(p)
+		if p.Pool == event.Address {
+			eventEdges = append(eventEdges, es...)
+		} else {
+			edges = append(edges, es...)
+		}
+	}
+	if len(eventEdges) == 0 {
+		return nil
+	}
+	// dist[k][token]: 从baseToken经过k条边到token的最小权重, prev记录到达token的边
+	dist := []map[string]float64{{baseToken: 0}}
+	prev := []map[string]*graphEdge{{}}
+	// rdist[k][token]: 从token经过k条边到baseToken的最小权重, next记录离开token的边
+	rdist := []map[string]float64{{baseToken: 0}}
+	next := []map[string]*graphEdge{{}}
+	for k := 1; k < maxHops; k++ {
+		dist = append(dist, map[string]float64{})
+		prev = append(prev, map[string]*graphEdge{})
+		rdist = append(rdist, map[string]float64{})
+		next = append(next, map[string]*graphEdge{})
+		for _, e := range edges {
+			if d, ok := dist[k-1][e.pair.Token0]; ok {
+				if old, ok := dist[k][e.pair.Token1]; !ok || d+e.weight < old {
+					dist[k][e.pair.Token1] = d + e.weight
+					prev[k][e.pair.Token1] = e
+				}
+			}
+			if d, ok := rdist[k-1][e.pair.Token1]; ok {
+				if old, ok := rdist[k][e.pair.Token0]; !ok || d+e.weight < old {
+					rdist[k][e.pair.Token0] = d + e.weight
+					next[k][e.pair.Token0] = e
+				}
+			}
+		}
+	}
+
+	var best *Cycle
+	for _, ee := range eventEdges {
+		for a := 0; a < maxHops; a++ {
+			da, ok := dist[a][ee.pair.Token0]
+			if !ok {
+				continue
+			}
+			for b := 0; a+b < maxHops; b++ {
+				db, ok := rdist[b][ee.pair.Token1]
+				if !ok || a+b < 2 { // 两个池的套利由MovingBrick处理
+					continue
+				}
+				weight := da + ee.weight + db
+				if weight >= 0 || (best != nil && weight >= best.Weight) {
+					continue
+				}
+				legs := make([]dt.Pair, 0, a+b+1)
+				token := ee.pair.Token0
+				for k := a; k > 0; k-- {
+					e := prev[k][token]
+					legs = append([]dt.Pair{e.pair}, legs...)
+					token = e.pair.Token0
+				}
+				legs = append(legs, ee.pair)
+				token = ee.pair.Token1
+				for k := b; k > 0; k-- {
+					e := next[k][token]
+					legs = append(legs, e.pair)
+					token = e.pair.Token1
+				}
+				cycle := &Cycle{Legs: legs, Weight: weight}
+				if cycle.valid() {
+					best = cycle
+				}
+			}
+		}
+	}
+	return best
+}
+
+func (c *Cycle) pools() (pools []string) {
+	for _, leg := range c.Legs {
+		pools = append(pools, leg.Pool)
+	}
+	return
+}
+
+func (c *Cycle) String() string {
+	symbols := pie.Map(c.Legs, func(p dt.Pair) string { return p.Symbol })
+	return strings.Join(symbols, " -> ")
+}
+
+// 用本区块的价格重新对齐环上的每一步, 本区块没有更新过价格的池只查询价格
+func (h *MultiHop) refreshCycle(monitor dt.IMonitor, cycle *Cycle, blockNumber uint64) *Cycle {
+	pairs := refreshPairs(monitor, pie.Map(cycle.Legs, func(p dt.Pair) *dt.Pair { return &p }), blockNumber)
+	fresh := &Cycle{}
+	for _, leg := range cycle.Legs {
+		i := pie.FindFirstUsing(pairs, func(p *dt.Pair) bool { return p.Pool == leg.Pool })
+		if i < 0 {
+			return nil
+		}
+		p := *pairs[i]
+		if p.Token0 != leg.Token0 {
+			FlipPair(&p)
+		}
+		if p.Price <= 0 || p.Depth0 <= 0 || p.Depth1 <= 0 {
+			return nil
+		}
+		fresh.Legs = append(fresh.Legs, p)
+		fresh.Weight -= math.Log(p.Price * (1 - p.Fee))
+	}
+	return fresh
+}
+
+func (h *MultiHop) maxHops(monitor dt.IMonitor) int {
+	hops := monitor.Config().Strategies.MultiHop.MaxHops
+	if hops <= 0 {
+		return DEFAULT_MAX_HOPS
+	}
+	return min(hops, MAX_HOPS_LIMIT)
+}
+
+// 多跳套利预估的gas: 按步数计算, 余额不足需要闪电贷时加上借贷的gas
+func (h *MultiHop) gas(monitor dt.IMonitor, legs int, borrow bool) int64 {
+	perLeg := monitor.Config().Strategies.MultiHop.GasPerLeg
+	if perLeg <= 0 {
+		perLeg = DEFAULT_GAS_PER_LEG
+	}
+	gas := int64(legs) * perLeg
+	if borrow {
+		gas += FLASH_BORROW_GAS
+	}
+	return gas
+}
+
+func (h *MultiHop) minProfitUSD(monitor dt.IMonitor) float64 {
+	if p := monitor.Config().Strategies.MultiHop.MinProfitUSD; p > 0 {
+		return p
+	}
+	return monitor.Config().MinProfitUSD
+}
+
+func (h *MultiHop) Validate(cfg *config.Configuration) error {
+	if err := h.MovingBrick.Validate(cfg); err != nil {
+		return err
+	}
+	conf := cfg.Strategies.MultiHop
+	if conf.MaxHops != 0 && (conf.MaxHops < 3 || conf.MaxHops > MAX_HOPS_LIMIT) {
+		return fmt.Errorf("strategies.multi_hop.max_hops must be between 3 and %d", MAX_HOPS_LIMIT)
+	}
+	if conf.MinProfitUSD < 0 {
+		return errors.New("strategies.multi_hop.min_profit_usd must not be negative")
+	}
+	if conf.GasPerLeg < 0 {
+		return errors.New("strategies.multi_hop.gas_per_leg must not be negative")
+	}
+	return nil
+}
+
+func (h *MultiHop) CalcArbitrage(monitor dt.IMonitor, event dt.SimplePool, blockNumber uint64, gasPrice float64) (arbitrage *dt.Arbitrage, ok bool) {
+	// 图只包含与事件token相邻的token和base token之间的交易对
+	tokens := []string{event.Token0, event.Token1}
+	for _, p := range monitor.DB().GetPairsWithTokens(tokens) {
+		tokens = append(tokens, p.Token0, p.Token1)
+	}
+	tokens = pie.Unique(append(tokens, pie.Keys(h.baseTokens)...))
+	tokens = pie.FilterNot(tokens, func(t string) bool { return pie.Contains(monitor.GetTokenBlacklist(), t) })
+	pairs := monitor.DB().GetPairsByTokens(tokens)
+	if len(pairs) < 3 {
+		return nil, false
+	}
+
+	conf := monitor.Config().Strategies.GasToken
+	gasUSDPrice := monitor.DB().GetBasePrice(conf.Base, conf.Quote)
+	maxHops := h.maxHops(monitor)
+	for baseToken := range h.baseTokens {
+		cycle := BestCycle(pairs, event, baseToken, maxHops)
+		if cycle == nil {
+			continue
+		}
+		monitor.Logger().Debug(fmt.Sprintf("发现候选环: %s, rate: %f", cycle, cycle.Rate()))
+		cycle = h.refreshCycle(monitor, cycle, blockNumber)
+		if cycle == nil || cycle.Weight >= 0 {
+			continue
+		}
+		amount, profit := h.sizeRoute(monitor, cycle.Legs, h.maxTradeAmount(monitor, baseToken, cycle.pools()))
+		if profit <= 0 {
+			continue
+		}
+		borrow, ok := h.selectBorrow(monitor, baseToken, amount, cycle.pools())
+		if !ok {
+			continue
+		}
+		// 扣除闪电贷手续费
+		if profit -= amount * borrow.Fee; profit <= 0 {
+			continue
+		}
+		first, last := &cycle.Legs[0], &cycle.Legs[len(cycle.Legs)-1]
+		gas := h.gas(monitor, len(cycle.Legs), amount > monitor.GetBaseBalance(baseToken))
+		gasUSD := float64(gas) * gasPrice * gasUSDPrice
+		profitUSD := h.toUSD(monitor, baseToken, profit, gasUSDPrice) - gasUSD
+		if profitUSD < h.minProfitUSD(monitor) || (arbitrage != nil && profitUSD <= arbitrage.ProfitUSD) {
+			continue
+		}
+
+		monitor.Logger().WithFields(logrus.Fields{
+			"Profit":      profit,
+			"Profit(USD)": profitUSD,
+			"Amount":      amount,
+			"Path":        cycle.String(),
+		}).Info("发现可多跳套利交易")
+
+		arbitrage = &dt.Arbitrage{
+			BuyPool:     *last,
+			SellPool:    *first,
+			Amount:      amount,
+			ProfitUSD:   profitUSD,
+			BlockNumber: blockNumber,
+			GasPrice:    gasPrice,
+			Gas:         gas,
+			Borrow:      borrow.Pool,
+			Position:    borrow.Position,
+			BaseToken:   baseToken,
+			BorrowFee:   borrow.Fee,
+			Legs:        cycle.Legs,
+			Strategy:    STRATEGY_MULTI_HOP,
+		}
+	}
+	return arbitrage, arbitrage != nil
+}
+
+func (h *MultiHop) Do(monitor dt.IMonitor, arbitrage *dt.Arbitrage) {
+	monitor.Logger().Debug("Do: ", arbitrage)
+	cycle := Cycle{Legs: arbitrage.Legs}
+	go monitor.SendToTG(fmt.Sprintf("%s: Amount: %.6f, Estimated: %.4f, Block: %d, Pools: %s",
+		cycle.String(), arbitrage.Amount, arbitrage.ProfitUSD, arbitrage.BlockNumber, strings.Join(cycle.pools(), ",")))
+
+	params := dt.SwapParams{
+		BuyPool:     arbitrage.BuyPool.Pool,
+		SellPool:    arbitrage.SellPool.Pool,
+		Amount:      arbitrage.Amount,
+		BlockNumber: arbitrage.BlockNumber,
+		Deadline:    arbitrage.BlockNumber + 1,
+		GasPrice:    arbitrage.GasPrice,
+		Borrow:      arbitrage.Borrow,
+		BaseToken:   arbitrage.BaseToken,
+		Position:    arbitrage.Position,
+		ProfitUSD:   arbitrage.ProfitUSD,
+		Gas:         arbitrage.Gas,
+		MinProfit:   h.minProfit(monitor, arbitrage),
+		Requote:     h.requote(monitor, *arbitrage, arbitrage.Legs),
+	}
+	for _, leg := range arbitrage.Legs {
+		params.Path = append(params.Path, dt.SwapLeg{Pool: leg.Pool, Fee: uint16(leg.Fee * 1e4)})
+	}
+	monitor.DoSwap(params)
+}
@@ -0,0 +1,166 @@
+package strategies
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/xiangxn/go-multicall"
+	"github.com/xiangxn/listener/config"
+	dt "github.com/xiangxn/listener/types"
+)
+
+const (
+	STRATEGY_MOVING_BRICK = "moving_brick"
+	STRATEGY_MULTI_HOP    = "multi_hop"
+	STRATEGY_LIQUIDATION  = "aave_liquidation"
+)
+
+// 策略需要实现的接口
+type Strategy interface {
+	dt.EventHandler
+	// 检查策略需要的配置
+	Validate(cfg *config.Configuration) error
+}
+
+var registry = map[string]func() Strategy{
+	STRATEGY_MOVING_BRICK: func() Strategy { return &MovingBrick{} },
+	STRATEGY_MULTI_HOP:    func() Strategy { return &MultiHop{} },
+	STRATEGY_LIQUIDATION:  func() Strategy { return &Liquidation{} },
+}
+
+// 注册策略, 名称重复时覆盖
+func Register(name string, create func() Strategy) {
+	registry[name] = create
+}
+
+// 已注册的策略名称
+func Names() []string {
+	names := pie.Keys(registry)
+	sort.Strings(names)
+	return names
+}
+
+// 根据名称创建策略, 多个策略时合并为一个EventHandler
+// names为空时使用配置中的strategies.enabled, 都为空时使用moving_brick
+func New(cfg *config.Configuration, names []string) (dt.EventHandler, error) {
+	if len(names) == 0 {
+		names = cfg.Strategies.Enabled
+	}
+	if len(names) == 0 {
+		names = []string{STRATEGY_MOVING_BRICK}
+	}
+	names = pie.Unique(names)
+	var handlers []Strategy
+	for _, name := range names {
+		create, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown strategy %q, available: %s", name, strings.Join(Names(), ", "))
+		}
+		h := create()
+		if err := h.Validate(cfg); err != nil {
+			return nil, fmt.Errorf("strategy %s: %w", name, err)
+		}
+		handlers = append(handlers, h)
+	}
+	if len(handlers) == 1 {
+		return handlers[0], nil
+	}
+	return &Combined{names: names, handlers: handlers}, nil
+}
+
+// 在同一个事件流上同时运行多个策略, 每个策略的套利都交给调度去除冲突
+// base token相关的方法都使用第一个策略(所有策略共用strategies.base_tokens配置)
+type Combined struct {
+	names    []string
+	handlers []Strategy
+}
+
+var _ dt.EventHandler = &Combined{}
+var _ dt.LogHandler = &Combined{}
+var _ dt.ArbitragesHandler = &Combined{}
+
+func (c *Combined) InitBaseTokens(monitor dt.IMonitor) {
+	for _, h := range c.handlers {
+		h.InitBaseTokens(monitor)
+	}
+}
+
+func (c *Combined) CreateBalanceCalls(tokenABI string, account common.Address) []*multicall.Call {
+	return c.handlers[0].CreateBalanceCalls(tokenABI, account)
+}
+
+func (c *Combined) GetBaseTokens() []dt.Token {
+	return c.handlers[0].GetBaseTokens()
+}
+
+func (c *Combined) GetBaseToken(token0, token1 string) string {
+	return c.handlers[0].GetBaseToken(token0, token1)
+}
+
+func (c *Combined) GetBaseDecimals(baseToken string) uint64 {
+	return c.handlers[0].GetBaseDecimals(baseToken)
+}
+
+// 返回USD利润最大的套利
+func (c *Combined) CalcArbitrage(monitor dt.IMonitor, event dt.SimplePool, blockNumber uint64, gasPrice float64) (arbitrage *dt.Arbitrage, ok bool) {
+	found := c.CalcArbitrages(monitor, event, blockNumber, gasPrice)
+	if len(found) == 0 {
+		return nil, false
+	}
+	return found[0], true
+}
+
+// 返回每个策略的套利(按USD利润从高到低), 使用相同池的套利由调度去除
+func (c *Combined) CalcArbitrages(monitor dt.IMonitor, event dt.SimplePool, blockNumber uint64, gasPrice float64) (found []*dt.Arbitrage) {
+	for i, h := range c.handlers {
+		if a, ok := h.CalcArbitrage(monitor, event, blockNumber, gasPrice); ok {
+			a.Strategy = c.names[i]
+			found = append(found, a)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].ProfitUSD > found[j].ProfitUSD })
+	return
+}
+
+func (c *Combined) Do(monitor dt.IMonitor, arbitrage *dt.Arbitrage) {
+	i := pie.FindFirstUsing(c.names, func(name string) bool { return name == arbitrage.Strategy })
+	if i < 0 {
+		i = 0
+	}
+	c.handlers[i].Do(monitor, arbitrage)
+}
+
+// 合并实现了dt.LogHandler的策略订阅的事件
+func (c *Combined) LogFilter() (addresses []common.Address, topics []common.Hash) {
+	for _, h := range c.handlers {
+		if lh, ok := h.(dt.LogHandler); ok {
+			a, t := lh.LogFilter()
+			addresses = append(addresses, a...)
+			topics = append(topics, t...)
+		}
+	}
+	return
+}
+
+// 把事件分给订阅了它的策略
+func (c *Combined) HandleLogs(monitor dt.IMonitor, logs []types.Log, blockNumber uint64, gasPrice float64) (arbitrages []*dt.Arbitrage) {
+	for i, h := range c.handlers {
+		lh, ok := h.(dt.LogHandler)
+		if !ok {
+			continue
+		}
+		addresses, topics := lh.LogFilter()
+		matched := pie.Filter(logs, func(l types.Log) bool {
+			return len(l.Topics) > 0 && pie.Contains(addresses, l.Address) && pie.Contains(topics, l.Topics[0])
+		})
+		for _, a := range lh.HandleLogs(monitor, matched, blockNumber, gasPrice) {
+			a.Strategy = c.names[i]
+			arbitrages = append(arbitrages, a)
+		}
+	}
+	return
+}
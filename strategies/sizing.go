@@ -0,0 +1,324 @@
+package strategies
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/elliotchance/pie/v2"
+	"github.com/xiangxn/listener/dex"
+	dt "github.com/xiangxn/listener/types"
+)
+
+// 调试日志中利润曲线的采样点(相对最优数量的比例)
+var curveSamples = []float64{0.25, 0.5, 0.75, 0.9, 1, 1.1, 1.25, 1.5, 2}
+
+// 在交易对中卖出amountIn个Token0得到的Token1数量(交易对已对齐)
+func QuoteLeg(p *dt.Pair, amountIn, impact float64) float64 {
+	if amountIn <= 0 || p.Price <= 0 {
+		return 0
+	}
+	amountInWithFee := amountIn * (1 - p.Fee)
+	switch p.Curve {
+	case dt.CURVE_STABLE:
+		return quoteStable(p.Reserve0, p.Reserve1, amountInWithFee)
+	case dt.CURVE_PMM:
+		// DODO从输出中扣除手续费
+		if p.PMM == nil {
+			return 0
+		}
+		return quotePMM(p.PMM, amountIn) * (1 - p.Fee)
+	case dt.CURVE_LIQUIDITY_BOOK:
+		// 按bin报价, 手续费随跨过的bin变化, 在报价中计算
+		if p.LB == nil {
+			return 0
+		}
+		return dex.QuoteLB(p.LB, amountIn)
+	case dt.CURVE_CONCENTRATED:
+		if p.Ticks != nil {
+			amountOut, _ := quoteTicks(p.Ticks, amountInWithFee)
+			return amountOut
+		}
+		// 没有tick数据时, 在深度范围内与虚拟储备量的恒定乘积一致
+		reserveIn := p.DepthReserve0(impact)
+		if reserveIn <= 0 {
+			return 0
+		}
+		reserveOut := reserveIn * p.Price
+		return reserveOut * amountInWithFee / (reserveIn + amountInWithFee)
+	default:
+		if p.Reserve0 <= 0 || p.Reserve1 <= 0 {
+			return 0
+		}
+		return p.Reserve1 * amountInWithFee / (p.Reserve0 + amountInWithFee)
+	}
+}
+
+// stable池x³y+xy³=k的报价, 用牛顿法求新的y
+func quoteStable(reserveIn, reserveOut, amountIn float64) float64 {
+	if reserveIn <= 0 || reserveOut <= 0 {
+		return 0
+	}
+	k := reserveIn*reserveIn*reserveIn*reserveOut + reserveIn*reserveOut*reserveOut*reserveOut
+	x := reserveIn + amountIn
+	y := reserveOut
+	for i := 0; i < 255; i++ {
+		dy := (x*x*x*y + x*y*y*y - k) / (x*x*x + 3*x*y*y)
+		y -= dy
+		if math.Abs(dy) <= y*1e-12 {
+			break
+		}
+	}
+	if y <= 0 || y >= reserveOut {
+		return 0
+	}
+	return reserveOut - y
+}
+
+// 按tick逐段报价, 与池合约的swap一致: 段内流动性不变, 跨过tick时按liquidityNet调整流动性
+// 超出已知tick范围的部分不成交, amountUsed为成交的输入数量
+func quoteTicks(c *dt.TickCurve, amountIn float64) (amountOut, amountUsed float64) {
+	s, l := c.SqrtPrice, c.Liquidity
+	// 第一个大于当前tick的tick, 向上跨过时加上liquidityNet, 向下跨过它前面的tick时减去liquidityNet
+	i := sort.Search(len(c.Ticks), func(i int) bool { return c.Ticks[i].Tick > c.Tick })
+	if c.Reversed {
+		// 卖出token1, 价格向上移动
+		for ; amountIn > 0; i++ {
+			next := c.Upper
+			if i < len(c.Ticks) {
+				next = min(c.Ticks[i].SqrtPrice, c.Upper)
+			}
+			if l > 0 {
+				step := l * (next - s)
+				if amountIn < step {
+					target := s + amountIn/l
+					return amountOut + amountIn/(s*target), amountUsed + amountIn
+				}
+				amountIn -= step
+				amountUsed += step
+				amountOut += step / (s * next)
+			}
+			if i >= len(c.Ticks) || next >= c.Upper {
+				break
+			}
+			s, l = next, l+c.Ticks[i].LiquidityNet
+		}
+		return
+	}
+	// 卖出token0, 价格向下移动
+	for i--; amountIn > 0; i-- {
+		next := c.Lower
+		if i >= 0 {
+			next = max(c.Ticks[i].SqrtPrice, c.Lower)
+		}
+		if l > 0 {
+			step := l * (1/next - 1/s)
+			if amountIn < step {
+				target := l * s / (l + amountIn*s)
+				return amountOut + amountIn*s*target, amountUsed + amountIn
+			}
+			amountIn -= step
+			amountUsed += step
+			amountOut += l * (s - next)
+		}
+		if i < 0 || next <= c.Lower {
+			break
+		}
+		s, l = next, l-c.Ticks[i].LiquidityNet
+	}
+	return
+}
+
+// PMM曲线的报价, 与池合约的sellBaseToken/sellQuoteToken一致
+func quotePMM(c *dt.PMMCurve, amountIn float64) float64 {
+	if c.Reversed {
+		return pmmSellQuote(c, amountIn)
+	}
+	return pmmSellBase(c, amountIn)
+}
+
+func pmmSellBase(c *dt.PMMCurve, pay float64) float64 {
+	switch c.R {
+	case dex.DODO_R_ONE:
+		return pmmSolveQuadratic(c.Q0, c.Q0, pay, c.I, c.K)
+	case dex.DODO_R_ABOVE_ONE:
+		backToOnePayBase, backToOneReceiveQuote := c.B0-c.B, c.Q-c.Q0
+		if pay < backToOnePayBase {
+			return min(pmmGeneralIntegrate(c.B0, c.B+pay, c.B, c.I, c.K), backToOneReceiveQuote)
+		}
+		return backToOneReceiveQuote + pmmSolveQuadratic(c.Q0, c.Q0, pay-backToOnePayBase, c.I, c.K)
+	default:
+		return pmmSolveQuadratic(c.Q0, c.Q, pay, c.I, c.K)
+	}
+}
+
+func pmmSellQuote(c *dt.PMMCurve, pay float64) float64 {
+	if c.I <= 0 {
+		return 0
+	}
+	i := 1 / c.I
+	switch c.R {
+	case dex.DODO_R_ONE:
+		return pmmSolveQuadratic(c.B0, c.B0, pay, i, c.K)
+	case dex.DODO_R_ABOVE_ONE:
+		return pmmSolveQuadratic(c.B0, c.B, pay, i, c.K)
+	default:
+		backToOnePayQuote, backToOneReceiveBase := c.Q0-c.Q, c.B-c.B0
+		if pay < backToOnePayQuote {
+			return min(pmmGeneralIntegrate(c.Q0, c.Q+pay, c.Q, i, c.K), backToOneReceiveBase)
+		}
+		return backToOneReceiveBase + pmmSolveQuadratic(c.B0, c.B0, pay-backToOnePayQuote, i, c.K)
+	}
+}
+
+// (1-k)i(V1-V2)+ikV0²(1/V2-1/V1)
+func pmmGeneralIntegrate(v0, v1, v2, i, k float64) float64 {
+	if v0 <= 0 || v2 <= 0 {
+		return 0
+	}
+	return i * (v1 - v2) * (1 - k + k*v0*v0/v1/v2)
+}
+
+// 求解(1-k)V2²+(kV0²/V1-iΔ-(1-k)V1)V2-kV0²=0, 返回V1-V2
+func pmmSolveQuadratic(v0, v1, delta, i, k float64) float64 {
+	if v0 <= 0 || v1 <= 0 || delta <= 0 {
+		return 0
+	}
+	if k == 0 {
+		return min(i*delta, v1)
+	}
+	if k == 1 {
+		temp := i * delta * v1 / (v0 * v0)
+		return v1 * temp / (1 + temp)
+	}
+	b := (1-k)*v1 - k*v0*v0/v1 - i*delta
+	root := math.Sqrt(b*b + 4*(1-k)*k*v0*v0)
+	var v2 float64
+	if b >= 0 {
+		v2 = (b + root) / (2 * (1 - k))
+	} else {
+		// 避免b为负时相减损失精度
+		v2 = 2 * k * v0 * v0 / (root - b)
+	}
+	return max(v1-v2, 0)
+}
+
+// 依次报价路径上的每一步
+func QuoteRoute(legs []dt.Pair, amountIn, impact float64) float64 {
+	amount := amountIn
+	for i := range legs {
+		amount = QuoteLeg(&legs[i], amount, impact)
+	}
+	return amount
+}
+
+// 报价准确的最大投入数量: 有tick数据的集中流动性池不超过已知tick范围, 其他集中流动性、PMM与LiquidityBook池受深度限制, stable池不超过储备量的一半
+func RouteMaxAmount(legs []dt.Pair) float64 {
+	maxAmount := math.Inf(1)
+	rate := 1.0
+	for _, leg := range legs {
+		switch leg.Curve {
+		case dt.CURVE_CONCENTRATED:
+			if leg.Ticks != nil {
+				_, used := quoteTicks(leg.Ticks, math.Inf(1))
+				maxAmount = min(maxAmount, used/(1-leg.Fee)/rate)
+			} else {
+				maxAmount = min(maxAmount, leg.Depth0/rate)
+			}
+		case dt.CURVE_PMM, dt.CURVE_LIQUIDITY_BOOK:
+			maxAmount = min(maxAmount, leg.Depth0/rate)
+		case dt.CURVE_STABLE:
+			maxAmount = min(maxAmount, leg.Reserve0/2/rate)
+		}
+		rate *= leg.Price * (1 - leg.Fee)
+	}
+	return maxAmount
+}
+
+// 在[0, maxAmount]内求利润(QuoteRoute(amount)-amount)最大的投入数量, maxAmount同时受RouteMaxAmount限制
+// 只有恒定乘积与没有tick数据的集中流动性池时用闭式解, 其他情况按各池的报价用黄金分割搜索
+func OptimalAmount(legs []dt.Pair, impact, maxAmount float64) (amount, profit float64) {
+	maxAmount = min(maxAmount, RouteMaxAmount(legs))
+	if len(legs) == 0 || maxAmount <= 0 {
+		return 0, 0
+	}
+	if pie.All(legs, func(p dt.Pair) bool {
+		return p.Curve == dt.CURVE_CONSTANT_PRODUCT || (p.Curve == dt.CURVE_CONCENTRATED && p.Ticks == nil)
+	}) {
+		amount = min(max(optimalConstantProduct(legs, impact), 0), maxAmount)
+	} else {
+		amount = goldenSection(func(x float64) float64 { return QuoteRoute(legs, x, impact) - x }, 0, maxAmount)
+	}
+	return amount, QuoteRoute(legs, amount, impact) - amount
+}
+
+// 恒定乘积路径可以合并为 out = N*a/(D+M*a), 令导数N*D/(D+M*a)²=1得 a = (sqrt(N*D)-D)/M
+func optimalConstantProduct(legs []dt.Pair, impact float64) float64 {
+	n, d, m := 1.0, 1.0, 0.0
+	for i := range legs {
+		reserveIn, reserveOut := legs[i].Reserve0, legs[i].Reserve1
+		if legs[i].Curve == dt.CURVE_CONCENTRATED {
+			reserveIn = legs[i].DepthReserve0(impact)
+			reserveOut = reserveIn * legs[i].Price
+		}
+		if reserveIn <= 0 || reserveOut <= 0 {
+			return 0
+		}
+		gamma := 1 - legs[i].Fee
+		// 上一步输出 x = n*a/(d+m*a), 本步输出 reserveOut*g*x/(reserveIn+g*x)
+		n, d, m = n*gamma*reserveOut, d*reserveIn, m*reserveIn+gamma*n
+	}
+	if m <= 0 || n <= d {
+		return 0
+	}
+	return (math.Sqrt(n*d) - d) / m
+}
+
+// 单峰函数在[lo, hi]上的最大值位置
+func goldenSection(f func(float64) float64, lo, hi float64) float64 {
+	g := (math.Sqrt(5) - 1) / 2
+	x1, x2 := hi-g*(hi-lo), lo+g*(hi-lo)
+	f1, f2 := f(x1), f(x2)
+	for i := 0; i < 100 && hi-lo > hi*1e-9; i++ {
+		if f1 < f2 {
+			lo, x1, f1 = x1, x2, f2
+			x2 = lo + g*(hi-lo)
+			f2 = f(x2)
+		} else {
+			hi, x2, f2 = x2, x1, f1
+			x1 = hi - g*(hi-lo)
+			f1 = f(x1)
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// 可用于交易的baseToken数量: 合约余额与借贷池中baseToken数量的较大值
+func (m *MovingBrick) maxTradeAmount(monitor dt.IMonitor, baseToken string, exclude []string) float64 {
+	return max(monitor.GetBaseBalance(baseToken), maxBorrowLiquidity(m.borrowCandidates(monitor, baseToken, exclude)))
+}
+
+// 计算路径的最优投入数量, 并在调试日志中输出利润曲线
+func (m *MovingBrick) sizeRoute(monitor dt.IMonitor, legs []dt.Pair, maxAmount float64) (amount, profit float64) {
+	impact := dex.DepthImpact(monitor)
+	amount, profit = OptimalAmount(legs, impact, maxAmount)
+	maxAmount = min(maxAmount, RouteMaxAmount(legs))
+	if amount <= 0 || !monitor.Config().Debug {
+		return
+	}
+	var curve []string
+	for _, s := range curveSamples {
+		x := amount * s
+		if x > maxAmount {
+			break
+		}
+		h := x * 1e-6
+		marginal := (QuoteRoute(legs, x+h, impact) - QuoteRoute(legs, x-h, impact)) / (2 * h)
+		curve = append(curve, fmt.Sprintf("%.6f:%.6f(%.4f)", x, QuoteRoute(legs, x, impact)-x, marginal-1))
+	}
+	symbols := pie.Map(legs, func(p dt.Pair) string { return p.Symbol })
+	monitor.Logger().Debug(fmt.Sprintf("%s 最优数量: %f, 利润: %f, 上限: %f, 利润曲线(数量:利润(边际利润)): %s",
+		strings.Join(symbols, " -> "), amount, profit, maxAmount, strings.Join(curve, " ")))
+	return
+}
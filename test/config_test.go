@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/xiangxn/listener/config"
+	"github.com/xiangxn/listener/strategies"
 	"gopkg.in/yaml.v3"
 )
 
@@ -32,3 +33,42 @@ func TestConfig(t *testing.T) {
 		return
 	}
 }
+
+// go test ^TestStrategyRegistry$ github.com/xiangxn/listener/test
+func TestStrategyRegistry(t *testing.T) {
+	conf := config.Configuration{}
+	conf.Strategies.BaseTokens = map[string][]string{"0xbb4CdB9CBd36B01bD1cBaEBF2De08d9173bc095c": {"0x0f338Ec12d3f7C3D77A4B9fcC1f95F3FB6AD0EA6"}}
+	conf.Strategies.GasToken.Base = "0xbb4CdB9CBd36B01bD1cBaEBF2De08d9173bc095c"
+	conf.Strategies.GasToken.Quote = "0x55d398326f99059fF775485246999027B3197955"
+
+	handler, err := strategies.New(&conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := handler.(*strategies.MovingBrick); !ok {
+		t.Fatalf("default strategy: %T", handler)
+	}
+	handler, err = strategies.New(&conf, []string{"moving_brick", "multi_hop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := handler.(*strategies.Combined); !ok {
+		t.Fatalf("combined strategy: %T", handler)
+	}
+	if _, err = strategies.New(&conf, []string{"unknown"}); err == nil {
+		t.Fatal("unknown strategy should fail")
+	}
+	conf.Strategies.MultiHop.MaxHops = 2
+	if _, err = strategies.New(&conf, []string{"multi_hop"}); err == nil {
+		t.Fatal("max_hops 2 should fail")
+	}
+	if _, err = strategies.New(&conf, []string{"aave_liquidation"}); err == nil {
+		t.Fatal("aave_liquidation without pool should fail")
+	}
+	// 库存目标只能是base token
+	conf.Strategies.MultiHop.MaxHops = 0
+	conf.Inventory.Targets = map[string]float64{conf.Strategies.GasToken.Quote: 1}
+	if _, err = strategies.New(&conf, nil); err == nil {
+		t.Fatal("inventory target that is not a base token should fail")
+	}
+}
@@ -3,11 +3,22 @@ package main
 import (
 	"context"
 	"fmt"
+	"math"
+	"math/big"
+	"slices"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/sirupsen/logrus"
+	"github.com/xiangxn/go-multicall"
 	"github.com/xiangxn/listener/config"
 	"github.com/xiangxn/listener/database"
+	"github.com/xiangxn/listener/dex"
+	"github.com/xiangxn/listener/monitor"
+	"github.com/xiangxn/listener/stats"
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
 )
 
 // go test -v -run ^TestDB$ github.com/xiangxn/listener/test
@@ -41,3 +52,105 @@ func TestGetPoolsByTokens(t *testing.T) {
 	data := DB.GetPoolsByTokens([]string{"0x2Bf83D080d8Bc4715984e75E5b3D149805d11751", "0x55d398326f99059fF775485246999027B3197955"})
 	fmt.Println(len(data), data)
 }
+
+// go test -v -run ^TestAggregatePrice$ github.com/xiangxn/listener/test
+func TestAggregatePrice(t *testing.T) {
+	pair := func(pool, token0, token1 string, price, depth0, depth1 float64, bn uint64) *dt.Pair {
+		return &dt.Pair{Pool: pool, Token0: token0, Token1: token1, Price: price, Depth0: depth0, Depth1: depth1, BlockNumber: bn}
+	}
+	pairs := dt.Pairs{
+		pair("P1", "B", "Q", 600, 100, 60000, 100),
+		pair("P2", "Q", "B", 1.0/602, 30000, 50, 100), // 反向的池
+		pair("P3", "B", "Q", 900, 1, 900, 100),        // 流动性很小的异常池
+		pair("P4", "B", "Q", 100, 500, 50000, 10),     // 过期的池
+	}
+	price := database.AggregatePrice(pairs, "B", 100, 50, 0.1)
+	want := (600*100 + 602*50) / 150.0
+	if math.Abs(price-want) > 1e-9 {
+		t.Fatalf("price: %f, want %f", price, want)
+	}
+	// 不检查过期时过期池的深度最大, 加权中位数落在过期池
+	if price = database.AggregatePrice(pairs, "B", 0, 0, 0.1); price != 100 {
+		t.Fatalf("price without staleness check: %f", price)
+	}
+	if price = database.AggregatePrice(nil, "B", 100, 50, 0.1); price != 0 {
+		t.Fatalf("empty price: %f", price)
+	}
+}
+
+// go test -v -run ^TestClassifyArbitrage$ github.com/xiangxn/listener/test
+func TestClassifyArbitrage(t *testing.T) {
+	swapTopic := common.HexToHash("0xd78ad95fa46c994b6551d0da85fc275fe613ce37657fb8d5e3d130840159d822")
+	bot := common.HexToAddress("0xb0")
+	poolA, poolB := common.HexToAddress("0xa1"), common.HexToAddress("0xa2")
+	weth, usdt := common.HexToAddress("0xe1"), common.HexToAddress("0xe2")
+	transfer := func(token, from, to common.Address, value int64) *types.Log {
+		return &types.Log{
+			Address: token,
+			Topics:  []common.Hash{common.HexToHash(stats.TRANSFER_TOPIC), common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())},
+			Data:    common.LeftPadBytes(big.NewInt(value).Bytes(), 32),
+		}
+	}
+	swap := func(pool common.Address) *types.Log {
+		return &types.Log{Address: pool, Topics: []common.Hash{swapTopic}}
+	}
+	// weth -> usdt -> weth, 多得到2 weth
+	logs := []*types.Log{
+		transfer(weth, bot, poolA, 100), transfer(usdt, poolA, bot, 3000), swap(poolA),
+		transfer(usdt, bot, poolB, 3000), transfer(weth, poolB, bot, 102), swap(poolB),
+	}
+	pools, token, profit, ok := stats.ClassifyArbitrage(logs, []common.Hash{swapTopic}, []common.Address{bot})
+	if !ok || len(pools) != 2 || token != weth.Hex() || profit.Int64() != 2 {
+		t.Fatal(pools, token, profit, ok)
+	}
+	// 普通兑换: 支出了weth
+	_, _, _, ok = stats.ClassifyArbitrage(logs[:3], []common.Hash{swapTopic}, []common.Address{bot})
+	if ok {
+		t.Fatal("single swap is not an arbitrage")
+	}
+	logs[4] = transfer(weth, poolB, bot, 99)
+	if _, _, _, ok = stats.ClassifyArbitrage(logs, []common.Hash{swapTopic}, []common.Address{bot}); ok {
+		t.Fatal("losing round trip is not an arbitrage")
+	}
+}
+
+// go test -v -run ^TestSwapTopics$ github.com/xiangxn/listener/test
+func TestSwapTopics(t *testing.T) {
+	v2Topic := common.HexToHash("0xd78ad95fa46c994b6551d0da85fc275fe613ce37657fb8d5e3d130840159d822")
+	integralTopic := tools.ReadABI("AlgebraIntegral").Events["Swap"].ID
+	v1Abi, _ := multicall.ParseABI(dex.ALGEBRA_SWAP_V1_ABI)
+	topics := monitor.SwapTopics([]config.DexConfig{
+		{Name: "UniswapV2", Topic: v2Topic.Hex(), Factory: "0x01"},
+		{Name: "PancakeV2", Topic: v2Topic.Hex(), Factory: "0x02"},
+		{Name: "AlgebraIntegral", Topic: integralTopic.Hex(), Factory: "0x03"},
+	})
+	// 包括Algebra Integral的V1格式Swap事件
+	if len(topics) != 3 || !slices.Contains(topics, v2Topic) || !slices.Contains(topics, integralTopic) || !slices.Contains(topics, v1Abi.Events["Swap"].ID) {
+		t.Fatalf("swap topics: %v", topics)
+	}
+}
+
+// go test -v -run ^TestCompetitorReport$ github.com/xiangxn/listener/test
+func TestCompetitorReport(t *testing.T) {
+	records := []dt.Competitor{
+		{PairKey: "P1/P2", From: "A", Position: 1, OurPosition: 3, GasPrice: 3e9, ProfitUSD: 10},
+		{PairKey: "P1/P2", From: "A", Position: 5, OurPosition: 3, GasPrice: 1e9, ProfitUSD: 2},
+		{PairKey: "P1/P2", From: "B", Position: 0, OurPosition: -1, GasPrice: 5e9, ProfitUSD: 50},
+		{PairKey: "P1/P2", From: "C", Position: 2, OurPosition: -1, GasPrice: 5e9, ProfitUSD: 1},
+		{PairKey: "P3/P4", From: "B", Position: 0, OurPosition: 1, GasPrice: 5e9, ProfitUSD: 5},
+	}
+	report := stats.CompetitorReport(records, 2)
+	if len(report) != 2 || report[0].PairKey != "P1/P2" || len(report[0].Competitors) != 2 {
+		t.Fatalf("%+v", report)
+	}
+	a, b := report[0].Competitors[0], report[0].Competitors[1]
+	if a.From != "A" || a.Trades != 2 || a.AheadOfUs != 1 || a.AvgGasPrice != 2 || a.AvgPosition != 3 || a.ProfitUSD != 12 {
+		t.Fatalf("%+v", a)
+	}
+	if b.From != "B" || b.AheadOfUs != 0 {
+		t.Fatalf("%+v", b)
+	}
+	if c := report[1].Competitors[0]; c.From != "B" || c.AheadOfUs != 1 {
+		t.Fatalf("%+v", c)
+	}
+}
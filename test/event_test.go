@@ -1,9 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
 	"math/big"
+	"math/rand"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 	"github.com/xiangxn/listener/config"
@@ -42,3 +52,328 @@ func TestEvent(t *testing.T) {
 	eventPool := monitor.DB().GetSimplePool("0x4f55423de1049d3CBfDC72f8A40f8A6f554f92aa")
 	monitor.TestEvent(eventPool, BlockNumber)
 }
+
+// go test -v -run ^TestSchedule$ github.com/xiangxn/listener/test
+func TestSchedule(t *testing.T) {
+	arb := func(buy, sell, borrow string, profit float64) *dt.Arbitrage {
+		return &dt.Arbitrage{BuyPool: dt.Pair{Pool: buy}, SellPool: dt.Pair{Pool: sell}, Borrow: borrow, ProfitUSD: profit}
+	}
+	a := arb("P1", "P2", "B1", 10)
+	b := arb("P2", "P3", "B2", 20) // 与a共用P2
+	c := arb("P4", "P5", "B2", 5)  // 与b共用借贷池
+	d := arb("P6", "P7", "B3", 1)
+	e := arb("P8", "P9", "", 3)
+
+	selected, dropped := monitor.Schedule([]*dt.Arbitrage{a, b, c, d, e}, 0)
+	if len(selected) != 3 || selected[0] != b || selected[1] != e || selected[2] != d {
+		t.Fatalf("selected: %v", selected)
+	}
+	if len(dropped) != 2 {
+		t.Fatalf("dropped: %v", dropped)
+	}
+
+	selected, _ = monitor.Schedule([]*dt.Arbitrage{a, b, c, d, e}, 2)
+	if len(selected) != 2 || selected[0] != b || selected[1] != e {
+		t.Fatalf("selected with cap: %v", selected)
+	}
+
+	// 清算只有卖出池, 与套利共用卖出池时同样去除冲突
+	liq := func(sell, borrow string, profit float64) *dt.Arbitrage {
+		return &dt.Arbitrage{SellPool: dt.Pair{Pool: sell}, Borrow: borrow, ProfitUSD: profit, Liquidation: &dt.LiquidationParams{User: "U"}}
+	}
+	f := liq("P3", "B4", 15) // 与b共用P3
+	g := liq("P10", "B5", 2)
+	h := liq("P11", "B6", 4)
+	selected, dropped = monitor.Schedule([]*dt.Arbitrage{b, f, g, h}, 0)
+	if len(selected) != 3 || selected[0] != b || selected[1] != h || selected[2] != g || len(dropped) != 1 || dropped[0] != f {
+		t.Fatalf("selected with liquidations: %v, dropped: %v", selected, dropped)
+	}
+}
+
+// 预检的模拟调用, 依次返回reverts中的revert原因, 用完后调用成功
+type fakePreflightClient struct {
+	reverts []string
+	gas     uint64
+}
+
+func (c *fakePreflightClient) PendingCallContract(ctx context.Context, msg ethereum.CallMsg) ([]byte, error) {
+	if len(c.reverts) > 0 {
+		reason := c.reverts[0]
+		c.reverts = c.reverts[1:]
+		return nil, errors.New("execution reverted: " + reason)
+	}
+	return nil, nil
+}
+
+func (c *fakePreflightClient) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	return c.gas, nil
+}
+
+// go test -v -run ^TestPreflight$ github.com/xiangxn/listener/test
+func TestPreflight(t *testing.T) {
+	conf := config.PreflightConfig{Enable: true, Resize: 2}
+	run := func(client *fakePreflightClient, params dt.SwapParams) (dt.SwapParams, uint64, bool, []dt.Preflight) {
+		var records []dt.Preflight
+		params, data, gasLimit, ok := monitor.Preflight(context.Background(), client, common.Address{}, common.Address{}, params, 18, conf, 600000, func(r dt.Preflight) {
+			records = append(records, r)
+		})
+		if ok && len(data) == 0 {
+			t.Fatal("missing call data")
+		}
+		return params, gasLimit, ok, records
+	}
+	// 数量不小于0.5时有利润, 最小利润为数量的10%
+	params := dt.SwapParams{BaseToken: "0x01", Amount: 1, ProfitUSD: 20, MinProfit: 0.1, Requote: func(amount float64) (float64, float64) {
+		if amount < 0.5 {
+			return 0, 0
+		}
+		return amount * 10, amount * 0.1
+	}}
+
+	// 减半后成功, 利润与最小利润按新的数量重新报价
+	got, gasLimit, ok, records := run(&fakePreflightClient{reverts: []string{"E"}, gas: 100000}, params)
+	if !ok || got.Amount != 0.5 || got.ProfitUSD != 5 || got.MinProfit != 0.05 || gasLimit != 120000 {
+		t.Fatalf("resize then send: %+v gas=%d ok=%v", got, gasLimit, ok)
+	}
+	if len(records) != 2 || records[0].Decision != dt.PREFLIGHT_RESIZE || records[0].Error != "E" || records[1].Decision != dt.PREFLIGHT_SEND || records[1].Amount != 0.5 {
+		t.Fatalf("resize then send records: %+v", records)
+	}
+
+	// 第二次减半后没有利润, 放弃交易
+	_, _, ok, records = run(&fakePreflightClient{reverts: []string{"IIA", "E"}, gas: 100000}, params)
+	if ok || len(records) != 2 || records[0].Decision != dt.PREFLIGHT_RESIZE || records[1].Decision != dt.PREFLIGHT_ABORT || records[1].Error != "E" {
+		t.Fatalf("resize then unprofitable: ok=%v %+v", ok, records)
+	}
+
+	// 其他错误不减小数量
+	_, _, ok, records = run(&fakePreflightClient{reverts: []string{"BAL"}, gas: 100000}, params)
+	if ok || len(records) != 1 || records[0].Decision != dt.PREFLIGHT_ABORT {
+		t.Fatalf("other revert: ok=%v %+v", ok, records)
+	}
+
+	// gas乘以余量后超过上限时放弃交易
+	_, _, ok, records = run(&fakePreflightClient{gas: 550000}, params)
+	if ok || len(records) != 1 || records[0].Decision != dt.PREFLIGHT_ABORT || records[0].Error != "gas" || records[0].Gas != 550000 {
+		t.Fatalf("gas over cap: ok=%v %+v", ok, records)
+	}
+}
+
+// go test -v -run ^TestBidGas$ github.com/xiangxn/listener/test
+func TestBidGas(t *testing.T) {
+	policy := config.GasBidPolicy{ProfitShare: 0.5, MinPriorityFee: 1e-9, MaxPriorityFee: 50e-9}
+	// 毛利润 = 9 + 100000*1e-9*1000 = 9.1 USD, 出价 0.5*9.1/1000/100000 = 45.5 gwei
+	bid := monitor.BidGas(policy, 10e-9, 1e-9, 9, 1e-9, 100000, 1000)
+	if math.Abs(bid.PriorityFee-35.5e-9) > 1e-15 || math.Abs(bid.GasPrice-45.5e-9) > 1e-15 || math.Abs(bid.FeeCap-55.5e-9) > 1e-15 {
+		t.Fatalf("bid: %+v", bid)
+	}
+	if bid.Unprofitable {
+		t.Fatalf("profitable bid: %+v", bid)
+	}
+	// 利润小时使用最低优先费, 毛利润 0.1 USD 只够 1 gwei/gas, 低于 baseFee+最低优先费
+	bid = monitor.BidGas(policy, 10e-9, 1e-9, 0, 1e-9, 100000, 1000)
+	if bid.PriorityFee != policy.MinPriorityFee || !bid.Unprofitable {
+		t.Fatalf("min bid: %+v", bid)
+	}
+	// 提高到最低优先费后仍在毛利润之内
+	bid = monitor.BidGas(policy, 0.5e-9, 1e-9, 0.1, 1e-9, 100000, 1000)
+	if bid.PriorityFee != policy.MinPriorityFee || bid.Unprofitable {
+		t.Fatalf("raised bid: %+v", bid)
+	}
+	// 利润大时不超过最高优先费
+	bid = monitor.BidGas(policy, 10e-9, 1e-9, 1000, 1e-9, 100000, 1000)
+	if bid.PriorityFee != policy.MaxPriorityFee {
+		t.Fatalf("max bid: %+v", bid)
+	}
+	// 没有配置利润比例时使用建议价格
+	bid = monitor.BidGas(config.GasBidPolicy{}, 10e-9, 12e-9, 9, 1e-9, 100000, 1000)
+	if bid.GasPrice != 12e-9 || math.Abs(bid.PriorityFee-2e-9) > 1e-15 {
+		t.Fatalf("suggested bid: %+v", bid)
+	}
+}
+
+// go test -v -run ^TestRiskManager$ github.com/xiangxn/listener/test
+func TestRiskManager(t *testing.T) {
+	now := time.Now()
+	r := monitor.NewRiskManager(config.RiskConfig{
+		MaxFailedPerHour: 2,
+		MaxPoolTrades:    1,
+		PoolTradeBlocks:  10,
+		MaxNotional:      map[string]float64{"B": 5},
+		PauseMinutes:     30,
+	})
+	params := dt.SwapParams{BuyPool: "P1", SellPool: "P2", BaseToken: "B", Amount: 1, BlockNumber: 100}
+	if reason, _ := r.Allow(params, nil, 0, now); reason != "" {
+		t.Fatal(reason)
+	}
+	// 同一个池在10个区块内只能交易一次
+	params.BlockNumber = 105
+	if reason, trip := r.Allow(params, nil, 0, now); reason == "" || trip {
+		t.Fatal("pool trade limit")
+	}
+	params.BlockNumber = 110
+	if reason, _ := r.Allow(params, nil, 0, now); reason != "" {
+		t.Fatal(reason)
+	}
+	params.Amount = 6
+	if reason, _ := r.Allow(params, nil, 0, now); reason == "" {
+		t.Fatal("max notional")
+	}
+	// 失败次数超限后熔断, 暂停结束前拒绝所有交易
+	failed := []dt.Transaction{{Confirm: true, CreatedAt: now.Add(-time.Minute)}, {Confirm: true, CreatedAt: now.Add(-2 * time.Minute)}}
+	params = dt.SwapParams{BuyPool: "P3", SellPool: "P4", BaseToken: "B", Amount: 1, BlockNumber: 200}
+	if _, trip := r.Allow(params, failed, 0, now); !trip {
+		t.Fatal("failed transactions should trip")
+	}
+	if reason, _ := r.Allow(params, nil, 0, now.Add(10*time.Minute)); reason != "paused" {
+		t.Fatal("should be paused")
+	}
+	if reason, _ := r.Allow(params, nil, 0, now.Add(31*time.Minute)); reason != "" {
+		t.Fatal(reason)
+	}
+}
+
+// go test -v -run ^TestStuckTx$ github.com/xiangxn/listener/test
+func TestStuckTx(t *testing.T) {
+	cfg := config.StuckTxConfig{Enable: true, WaitBlocks: 2}
+	tx := dt.Transaction{From: "0x36F18e8B735592dE9A32A417e482e106eAa0C77A", Deadline: 100}
+	if monitor.StuckDue(tx, 102, cfg) || !monitor.StuckDue(tx, 103, cfg) {
+		t.Fatal("should wait 2 blocks after deadline")
+	}
+	// 已发送取消交易时等待取消交易被打包
+	tx.CancelTx, tx.CancelBlock = "0x01", 103
+	if monitor.StuckDue(tx, 105, cfg) || !monitor.StuckDue(tx, 106, cfg) {
+		t.Fatal("should wait 2 blocks after cancel")
+	}
+	if monitor.StuckDue(dt.Transaction{From: tx.From}, 1000, cfg) {
+		t.Fatal("transaction without deadline")
+	}
+
+	// 在上一次出价上提高, 不低于当前建议价格
+	prev := dt.GasBid{GasPrice: 10e-9, PriorityFee: 2e-9, FeeCap: 20e-9}
+	current := dt.GasBid{BaseFee: 9e-9, GasPrice: 11e-9, PriorityFee: 3e-9, FeeCap: 12e-9}
+	bid := monitor.CancelBid(prev, current, 1.2)
+	if math.Abs(bid.GasPrice-12e-9) > 1e-18 || bid.PriorityFee != 3e-9 || math.Abs(bid.FeeCap-24e-9) > 1e-18 || bid.BaseFee != 9e-9 {
+		t.Fatalf("cancel bid: %+v", bid)
+	}
+
+	// 取消与丢弃的交易不计入失败次数
+	r := monitor.NewRiskManager(config.RiskConfig{MaxFailedPerHour: 1})
+	now := time.Now()
+	closed := []dt.Transaction{
+		{Confirm: true, Status: dt.TX_STATUS_CANCELLED, CreatedAt: now},
+		{Confirm: true, Status: dt.TX_STATUS_DROPPED, CreatedAt: now},
+	}
+	if reason, _ := r.Allow(dt.SwapParams{BuyPool: "P1", SellPool: "P2", BlockNumber: 1}, closed, 0, now); reason != "" {
+		t.Fatal(reason)
+	}
+}
+
+// go test -v -run ^TestPlanInventory$ github.com/xiangxn/listener/test
+func TestPlanInventory(t *testing.T) {
+	holdings := []monitor.Holding{
+		{Token: "A", Balance: 3, PriceUSD: 500, TargetUSD: 1000},  // 多500
+		{Token: "B", Balance: 200, PriceUSD: 1, TargetUSD: 1000},  // 少800
+		{Token: "C", Balance: 1, PriceUSD: 1050, TargetUSD: 1000}, // 偏离不到阈值
+	}
+	rebalances, sweeps := monitor.PlanInventory(holdings, 0.2)
+	if len(rebalances) != 1 || rebalances[0].From != "A" || rebalances[0].To != "B" || rebalances[0].AmountUSD != 500 {
+		t.Fatalf("rebalances: %+v", rebalances)
+	}
+	if len(sweeps) != 0 {
+		t.Fatalf("sweeps: %+v", sweeps)
+	}
+
+	// 没有低于目标的token时提取超出的部分
+	holdings[1].Balance = 1000
+	rebalances, sweeps = monitor.PlanInventory(holdings, 0.2)
+	if len(rebalances) != 0 || len(sweeps) != 1 || sweeps[0].Token != "A" || sweeps[0].AmountUSD != 500 {
+		t.Fatalf("rebalances: %+v, sweeps: %+v", rebalances, sweeps)
+	}
+}
+
+// go test -v -run ^TestBacktestReport$ github.com/xiangxn/listener/test
+func TestBacktestReport(t *testing.T) {
+	a := &dt.Arbitrage{BuyPool: dt.Pair{Pool: "P1"}, SellPool: dt.Pair{Pool: "P2"}, ProfitUSD: 10, Gas: 100000, GasPrice: 1e-8, Strategy: strategies.STRATEGY_MOVING_BRICK}
+	b := &dt.Arbitrage{BuyPool: dt.Pair{Pool: "P2"}, SellPool: dt.Pair{Pool: "P3"}, ProfitUSD: 5, Gas: 100000, GasPrice: 1e-8, Strategy: strategies.STRATEGY_MOVING_BRICK}
+	c := &dt.Arbitrage{Legs: []dt.Pair{{Pool: "P4"}, {Pool: "P5"}, {Pool: "P6"}}, ProfitUSD: 2, Gas: 200000, GasPrice: 1e-8, Strategy: strategies.STRATEGY_MULTI_HOP}
+
+	r := monitor.NewBacktestReport(100, 200)
+	selected, dropped := monitor.Schedule([]*dt.Arbitrage{a, b}, 0)
+	r.AddBlock(101, 3, selected, dropped, nil, 2000)
+	r.AddBlock(105, 1, []*dt.Arbitrage{c}, nil, []string{"E"}, 2000)
+
+	if r.Blocks != 2 || r.Events != 4 || r.Opportunities != 3 || r.Dropped != 1 || len(r.Fills) != 2 || r.Failed != 1 {
+		t.Fatalf("report: %+v", r)
+	}
+	// 失败的多跳交易只计算gas成本
+	if math.Abs(r.GasUSD-6) > 1e-9 || math.Abs(r.ProfitUSD-6) > 1e-9 || r.FailureRate() != 0.5 {
+		t.Fatalf("gas: %f, profit: %f", r.GasUSD, r.ProfitUSD)
+	}
+	mb := r.Strategies[strategies.STRATEGY_MOVING_BRICK]
+	if mb.Opportunities != 2 || mb.Fills != 1 || mb.ProfitUSD != 10 {
+		t.Fatalf("moving brick: %+v", mb)
+	}
+	if len(r.Fills[1].Path) != 3 || r.Fills[1].BlockNumber != 105 || r.Fills[1].Error != "E" {
+		t.Fatalf("fill: %+v", r.Fills[1])
+	}
+	t.Log(r)
+}
+
+// go test -v -run ^TestTuneParams$ github.com/xiangxn/listener/test
+func TestTuneParams(t *testing.T) {
+	profit, err := monitor.ParseTuneParam("min_profit_usd=1,2,5")
+	if err != nil || len(profit.Values) != 3 {
+		t.Fatal(profit, err)
+	}
+	gas, err := monitor.ParseTuneParam("gas_times=1:1.5")
+	if err != nil || gas.Min != 1 || gas.Max != 1.5 || len(gas.Values) != 0 {
+		t.Fatal(gas, err)
+	}
+	for _, bad := range []string{"delta_coefficient=0.4", "unknown=1", "gas_times", "gas_times=2:1", "base_min_reserve=-1"} {
+		if _, err := monitor.ParseTuneParam(bad); err == nil {
+			t.Fatalf("%s should fail", bad)
+		}
+	}
+
+	reserve, _ := monitor.ParseTuneParam("base_min_reserve=1,10")
+	sets, err := monitor.TuneGrid([]monitor.TuneParam{profit, reserve})
+	if err != nil || len(sets) != 6 || sets[5][0] != 5 || sets[5][1] != 10 {
+		t.Fatal(sets, err)
+	}
+	if _, err := monitor.TuneGrid([]monitor.TuneParam{profit, gas}); err == nil {
+		t.Fatal("range should not be allowed in a grid")
+	}
+	params := []monitor.TuneParam{profit, gas}
+	sets = monitor.TuneRandom(params, 20, rand.New(rand.NewSource(1)))
+	for _, set := range sets {
+		if !slices.Contains(profit.Values, set[0]) || set[1] < 1 || set[1] > 1.5 {
+			t.Fatal(set)
+		}
+	}
+
+	cfg := config.Configuration{MinProfitUSD: 1}
+	cfg.Strategies.MovingBrick.MinProfitUSD = 3
+	tuned := monitor.ApplyTuneParams(cfg, params, []float64{5, 1.2})
+	if tuned.MinProfitUSD != 5 || tuned.Strategies.MovingBrick.MinProfitUSD != 0 || tuned.GasTimes != 1.2 || cfg.MinProfitUSD != 1 {
+		t.Fatalf("%+v", tuned)
+	}
+
+	results := []monitor.TuneResult{
+		monitor.NewTuneResult(params, []float64{1, 1}, &monitor.BacktestReport{ProfitUSD: 3, Verified: true, Failed: 1, Fills: make([]monitor.BacktestFill, 2)}),
+		monitor.NewTuneResult(params, []float64{2, 1}, &monitor.BacktestReport{ProfitUSD: 8, Verified: true, Fills: make([]monitor.BacktestFill, 4)}),
+		monitor.NewTuneResult(params, []float64{5, 1}, &monitor.BacktestReport{ProfitUSD: 3, Verified: true, Fills: make([]monitor.BacktestFill, 1)}),
+	}
+	monitor.RankTuneResults(results)
+	if results[0].Params["min_profit_usd"] != 2 || results[1].Params["min_profit_usd"] != 5 || results[2].Rank != 3 {
+		t.Fatalf("%+v", results)
+	}
+	var buf bytes.Buffer
+	if err := monitor.WriteTuneCSV(&buf, params, results); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || lines[0] != "rank,min_profit_usd,gas_times,net_profit_usd,gas_usd,trades,failed,failure_rate,opportunities,missed" ||
+		lines[3] != "3,1,1,3,0,2,1,0.5,0,0" {
+		t.Fatal(buf.String())
+	}
+}
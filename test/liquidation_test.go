@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/xiangxn/listener/monitor"
+	"github.com/xiangxn/listener/strategies"
+	dt "github.com/xiangxn/listener/types"
+)
+
+func TestLiquidationAmounts(t *testing.T) {
+	debt := strategies.AaveReserve{Asset: "USDC", Price: 1, Debt: 7000}
+	collateral := strategies.AaveReserve{Asset: "WETH", Price: 2000, Bonus: 1.05, ProtocolFee: 0.1, Collateral: 10}
+
+	// 健康因子不低于0.95时只能偿还一半债务
+	debtToCover, seized := strategies.LiquidationAmounts(0.97, debt, collateral)
+	if debtToCover != 3500 {
+		t.Fatalf("debtToCover: %f", debtToCover)
+	}
+	// 1.75 ETH加5%奖励, 协议收取奖励的10%
+	if want := 1.75*1.05 - 1.75*0.05*0.1; math.Abs(seized-want) > 1e-9 {
+		t.Fatalf("seized: %f, want: %f", seized, want)
+	}
+
+	// 低于0.95时可以偿还全部债务
+	if debtToCover, _ = strategies.LiquidationAmounts(0.9, debt, collateral); debtToCover != 7000 {
+		t.Fatalf("full debtToCover: %f", debtToCover)
+	}
+
+	// 抵押品不足时按抵押品减少偿还的债务
+	collateral.Collateral = 2
+	collateral.ProtocolFee = 0
+	debtToCover, seized = strategies.LiquidationAmounts(0.9, debt, collateral)
+	if seized != 2 || math.Abs(debtToCover-2/1.05*2000) > 1e-9 {
+		t.Fatalf("capped debtToCover: %f, seized: %f", debtToCover, seized)
+	}
+
+	collateral.Price = 0
+	if debtToCover, _ = strategies.LiquidationAmounts(0.9, debt, collateral); debtToCover != 0 {
+		t.Fatal("no price should not liquidate")
+	}
+}
+
+func TestParseAaveLog(t *testing.T) {
+	user := common.HexToAddress("0x36F18e8B735592dE9A32A417e482e106eAa0C77A")
+	// indexed地址参数左补零为32字节
+	reserve := common.HexToHash("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48")
+	userTopic := common.BytesToHash(user.Bytes())
+	other := common.HexToHash("0x0B0B")
+	cases := []struct {
+		topics []common.Hash
+		user   string
+		ok     bool
+	}{
+		// Supply/Borrow的第二个indexed参数是onBehalfOf
+		{[]common.Hash{strategies.AaveSupplyTopic, reserve, userTopic, {}}, user.Hex(), true},
+		{[]common.Hash{strategies.AaveBorrowTopic, reserve, userTopic, {}}, user.Hex(), true},
+		{[]common.Hash{strategies.AaveRepayTopic, reserve, userTopic, other}, user.Hex(), true},
+		{[]common.Hash{strategies.AaveWithdrawTopic, reserve, userTopic, other}, user.Hex(), true},
+		{[]common.Hash{strategies.AaveLiquidationTopic, reserve, other, userTopic}, user.Hex(), true},
+		{[]common.Hash{common.HexToHash("0x01"), reserve, userTopic}, "", false},
+		{[]common.Hash{strategies.AaveRepayTopic}, "", false},
+	}
+	for i, c := range cases {
+		got, ok := strategies.ParseAaveLog(types.Log{Topics: c.topics})
+		if ok != c.ok || got != c.user {
+			t.Fatalf("case %d: %s %v", i, got, ok)
+		}
+	}
+
+	p := strategies.AavePosition{}
+	if !p.Due(100, 1.05, 20) {
+		t.Fatal("unchecked position should be due")
+	}
+	p = strategies.AavePosition{HealthFactor: 1.5, HasDebt: true, CheckedBlock: 90}
+	if p.Due(100, 1.05, 20) || !p.Due(110, 1.05, 20) {
+		t.Fatal("healthy position should be refreshed every 20 blocks")
+	}
+	p.HealthFactor = 1.01
+	if !p.Due(91, 1.05, 20) {
+		t.Fatal("position near liquidation should be due")
+	}
+	p = strategies.AavePosition{HealthFactor: 1e50, CheckedBlock: 1}
+	if p.Due(1000, 1.05, 20) {
+		t.Fatal("position without debt should wait for events")
+	}
+}
+
+func TestPackLiquidate(t *testing.T) {
+	params := dt.SwapParams{
+		SellPool:  "0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc",
+		SellType:  1,
+		SellFee:   30,
+		BaseToken: "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48",
+		Borrow:    "0x88e6A0c2dDD26FEEb64F039a2c41296FcB3f5640",
+		Deadline:  20332763,
+		Liquidation: &dt.LiquidationParams{
+			AavePool:   "0x87870Bca3F3fD6335C3F4ce8392D69350B4fA4E2",
+			User:       "0x36F18e8B735592dE9A32A417e482e106eAa0C77A",
+			Collateral: "0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2",
+		},
+	}
+	minProfit := big.NewInt(1500000)
+	data := monitor.PackLiquidate(params, big.NewInt(10000000), minProfit)
+	if len(data) != 260 {
+		t.Fatalf("calldata length: %d", len(data))
+	}
+	if got := common.BytesToAddress(data[100:132]).Hex(); got != params.BaseToken {
+		t.Fatalf("debt: %s", got)
+	}
+	// 与合约相同的方式解出卖出池
+	leg := new(big.Int).SetBytes(data[196:228])
+	if got := common.BigToAddress(leg).Hex(); got != params.SellPool {
+		t.Fatalf("sell pool: %s", got)
+	}
+	if got := new(big.Int).And(new(big.Int).Rsh(leg, 160), big.NewInt(0xFFFF)); got.Int64() != 1 {
+		t.Fatalf("sell type: %s", got)
+	}
+	if got := new(big.Int).And(new(big.Int).Rsh(leg, 176), big.NewInt(0xFFFF)); got.Int64() != 30 {
+		t.Fatalf("sell fee: %s", got)
+	}
+	tmp := new(big.Int).SetBytes(data[228:260])
+	if got := new(big.Int).Rsh(tmp, 136); got.Cmp(minProfit) != 0 {
+		t.Fatalf("minProfit: %s", got)
+	}
+	if got := new(big.Int).And(new(big.Int).Rsh(tmp, 72), new(big.Int).SetUint64(0xFFFFFFFFFFFFFFFF)); got.Uint64() != params.Deadline {
+		t.Fatalf("deadline: %s", got)
+	}
+}
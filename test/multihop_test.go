@@ -0,0 +1,278 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/xiangxn/listener/config"
+	"github.com/xiangxn/listener/dex"
+	"github.com/xiangxn/listener/strategies"
+	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
+)
+
+func newV2Pair(pool, token0, token1 string, reserve0, reserve1 float64) *dt.Pair {
+	return &dt.Pair{
+		Pool:     pool,
+		Symbol:   token0 + "/" + token1,
+		Token0:   token0,
+		Token1:   token1,
+		Price:    reserve1 / reserve0,
+		Reserve0: reserve0,
+		Reserve1: reserve1,
+		Fee:      0.003,
+		Depth0:   dex.CalcDepthV2(reserve0, 0.01),
+		Depth1:   dex.CalcDepthV2(reserve1, 0.01),
+	}
+}
+
+func TestBestCycle(t *testing.T) {
+	// B->X->Y->B的汇率乘积为2*3*0.2=1.2
+	pairs := dt.Pairs{
+		newV2Pair("P1", "B", "X", 1000, 2000),
+		newV2Pair("P2", "X", "Y", 2000, 6000),
+		newV2Pair("P3", "B", "Y", 1200, 6000),
+		newV2Pair("P4", "X", "Z", 100, 100),
+	}
+	event := dt.SimplePool{Address: "P2", Token0: "X", Token1: "Y"}
+	cycle := strategies.BestCycle(pairs, event, "B", 3)
+	if cycle == nil {
+		t.Fatal("cycle not found")
+	}
+	var path []string
+	for _, leg := range cycle.Legs {
+		path = append(path, leg.Pool)
+	}
+	if len(path) != 3 || path[0] != "P1" || path[1] != "P2" || path[2] != "P3" {
+		t.Fatalf("path=%v", path)
+	}
+	if cycle.Legs[2].Token0 != "Y" || cycle.Legs[2].Token1 != "B" {
+		t.Errorf("last leg not aligned: %s->%s", cycle.Legs[2].Token0, cycle.Legs[2].Token1)
+	}
+
+	amount, profit := strategies.OptimalAmount(cycle.Legs, 0.01, math.Inf(1))
+	if amount <= 0 || profit <= 0 {
+		t.Fatalf("amount=%f, profit=%f", amount, profit)
+	}
+	for _, a := range []float64{amount * 0.9, amount * 1.1} {
+		if p := strategies.QuoteRoute(cycle.Legs, a, 0.01) - a; p > profit {
+			t.Errorf("profit at %f is %f, more than %f", a, p, profit)
+		}
+	}
+
+	// 两个池的环不是多跳套利
+	if c := strategies.BestCycle(pairs, dt.SimplePool{Address: "P3", Token0: "B", Token1: "Y"}, "B", 2); c != nil {
+		t.Errorf("unexpected cycle of %d legs", len(c.Legs))
+	}
+}
+
+func TestOptimalAmount(t *testing.T) {
+	marginal := func(legs []dt.Pair, amount float64) float64 {
+		h := amount * 1e-6
+		return (strategies.QuoteRoute(legs, amount+h, 0.01) - strategies.QuoteRoute(legs, amount-h, 0.01)) / (2 * h)
+	}
+	// 在A池卖出B, 在B池买回B, 恒定乘积用闭式解, 最优点的边际利润为0
+	legs := []dt.Pair{*newV2Pair("A", "B", "Q", 1000, 3100000), *newV2Pair("B", "Q", "B", 3000000, 1000)}
+	amount, profit := strategies.OptimalAmount(legs, 0.01, math.Inf(1))
+	if amount <= 0 || profit <= 0 {
+		t.Fatalf("amount=%f, profit=%f", amount, profit)
+	}
+	if m := marginal(legs, amount); math.Abs(m-1) > 1e-6 {
+		t.Errorf("marginal=%f at %f", m, amount)
+	}
+	if capped, _ := strategies.OptimalAmount(legs, 0.01, amount/2); capped != amount/2 {
+		t.Errorf("capped=%f, want %f", capped, amount/2)
+	}
+
+	// 包含stable池时用黄金分割搜索
+	stable := dt.Pair{Pool: "S", Token0: "B", Token1: "Q", Price: 1, Reserve0: 1e6, Reserve1: 1e6, Fee: 0.0001, Curve: dt.CURVE_STABLE}
+	legs = []dt.Pair{stable, *newV2Pair("C", "Q", "B", 100000, 102000)}
+	amount, profit = strategies.OptimalAmount(legs, 0.01, math.Inf(1))
+	if amount <= 0 || profit <= 0 {
+		t.Fatalf("stable amount=%f, profit=%f", amount, profit)
+	}
+	if m := marginal(legs, amount); math.Abs(m-1) > 1e-4 {
+		t.Errorf("stable marginal=%f at %f", m, amount)
+	}
+
+	// 有tick数据的集中流动性池按tick报价搜索, 上限是已知tick范围
+	state := &dt.ConcentratedState{SqrtPriceX96: dex.Q96, Liquidity: tools.ParseBigInt("1000000000000000000000000", 10), Decimals0: 18, Decimals1: 18}
+	net := tools.ParseBigInt("400000000000000000000000", 10)
+	v3 := dt.Pair{Pool: "V3", Token0: "B", Token1: "Q", Price: 1, Fee: 0.0005, Curve: dt.CURVE_CONCENTRATED,
+		Ticks: dex.NewTickCurve(state, map[int32]*big.Int{-10: net, 10: new(big.Int).Neg(net)}, -200, 200)}
+	maxAmount := strategies.RouteMaxAmount([]dt.Pair{v3})
+	if full := strategies.QuoteLeg(&v3, maxAmount, 0.01); math.Abs(strategies.QuoteLeg(&v3, maxAmount*2, 0.01)-full) > 1e-9*full {
+		t.Errorf("quote beyond max amount %f should not fill", maxAmount)
+	}
+	legs = []dt.Pair{v3, *newV2Pair("C", "Q", "B", 100000, 102000)}
+	amount, profit = strategies.OptimalAmount(legs, 0.01, math.Inf(1))
+	if amount <= 0 || profit <= 0 || amount >= maxAmount {
+		t.Fatalf("concentrated amount=%f, profit=%f, max=%f", amount, profit, maxAmount)
+	}
+	if m := marginal(legs, amount); math.Abs(m-1) > 1e-4 {
+		t.Errorf("concentrated marginal=%f at %f", m, amount)
+	}
+}
+
+// go test -v -run ^TestQuotePMM$ github.com/xiangxn/listener/test
+func TestQuotePMM(t *testing.T) {
+	lpFee := tools.Float64ToBigInt(0.003, 18)
+	for _, c := range []struct {
+		r          int64
+		b, q       float64
+		amounts    []float64
+		name       string
+		b0, q0     float64
+		price      float64
+		sellQuotes []float64
+	}{
+		{name: "one", r: dex.DODO_R_ONE, b: 1000, q: 2000, b0: 1000, q0: 2000, amounts: []float64{1, 100}, sellQuotes: []float64{2, 200}},
+		{name: "above", r: dex.DODO_R_ABOVE_ONE, b: 900, q: 2210, b0: 1000, q0: 2000, amounts: []float64{10, 300}, sellQuotes: []float64{20, 600}},
+		{name: "below", r: dex.DODO_R_BELOW_ONE, b: 1100, q: 1800, b0: 1000, q0: 2000, amounts: []float64{10, 300}, sellQuotes: []float64{20, 600}},
+	} {
+		state := &dex.PMMState{
+			I:  tools.Float64ToBigInt(2, 18),
+			K:  tools.Float64ToBigInt(0.5, 18),
+			B:  tools.Float64ToBigInt(c.b, 18),
+			Q:  tools.Float64ToBigInt(c.q, 18),
+			B0: tools.Float64ToBigInt(c.b0, 18),
+			Q0: tools.Float64ToBigInt(c.q0, 18),
+			R:  big.NewInt(c.r),
+		}
+		pair := dt.Pair{Pool: "D", Token0: "B", Token1: "Q", Price: 2, Fee: 0.003, Curve: dt.CURVE_PMM, PMM: dex.NewPMMCurve(state, 18, 18)}
+		// 交换币种后卖出Token0即卖出quote
+		reversed := pair
+		pmm := *pair.PMM
+		pmm.Reversed = true
+		reversed.Token0, reversed.Token1, reversed.Price, reversed.PMM = "Q", "B", 0.5, &pmm
+		for i := range c.amounts {
+			want := tools.BigIntToFloat64(dex.QuerySellBase(state, tools.Float64ToBigInt(c.amounts[i], 18), lpFee, big.NewInt(0)), 18)
+			if got := strategies.QuoteLeg(&pair, c.amounts[i], 0.01); math.Abs(got-want) > 1e-9*want {
+				t.Errorf("%s sellBase(%f)=%f, want=%f", c.name, c.amounts[i], got, want)
+			}
+			want = tools.BigIntToFloat64(dex.QuerySellQuote(state, tools.Float64ToBigInt(c.sellQuotes[i], 18), lpFee, big.NewInt(0)), 18)
+			if got := strategies.QuoteLeg(&reversed, c.sellQuotes[i], 0.01); math.Abs(got-want) > 1e-9*want {
+				t.Errorf("%s sellQuote(%f)=%f, want=%f", c.name, c.sellQuotes[i], got, want)
+			}
+		}
+	}
+}
+
+// go test -v -run ^TestQuoteTicks$ github.com/xiangxn/listener/test
+func TestQuoteTicks(t *testing.T) {
+	liquidity := tools.ParseBigInt("1000000000000000000000000", 10)
+	net := tools.ParseBigInt("400000000000000000000000", 10)
+	// 向下跨过tick -100和向上跨过tick 100后流动性都变为0.6倍
+	state := &dt.ConcentratedState{SqrtPriceX96: dex.Q96, Tick: 0, Liquidity: liquidity, Decimals0: 18, Decimals1: 18}
+	ticks := map[int32]*big.Int{-100: net, 100: new(big.Int).Neg(net), 300: net}
+	curve := dex.NewTickCurve(state, ticks, -200, 200)
+	if len(curve.Ticks) != 2 {
+		t.Fatalf("ticks out of range: %+v", curve.Ticks)
+	}
+	pair := dt.Pair{Pool: "V3", Token0: "A", Token1: "B", Price: 1, Curve: dt.CURVE_CONCENTRATED, Ticks: curve}
+	reversed := pair
+	rc := *curve
+	rc.Reversed = true
+	reversed.Token0, reversed.Token1, reversed.Ticks = "B", "A", &rc
+
+	l2 := new(big.Int).Sub(liquidity, net)
+	p := func(tick int64) *big.Int { return dex.TickToSqrtPriceQ96(tick) }
+	f := func(x *big.Int) float64 { return tools.BigIntToFloat64(x, 18) }
+	for _, c := range []struct {
+		name       string
+		pair       *dt.Pair
+		in1, out1  float64
+		in2, out2  float64
+		virtualIn  float64
+		virtualOut float64
+	}{
+		{
+			name: "sell0", pair: &pair,
+			in1: f(dex.CalcAmount0Delta(liquidity, p(-100), p(0), false)), out1: f(dex.CalcAmount1Delta(liquidity, p(-100), p(0), false)),
+			in2: f(dex.CalcAmount0Delta(l2, p(-200), p(-100), false)), out2: f(dex.CalcAmount1Delta(l2, p(-200), p(-100), false)),
+			virtualIn: f(liquidity), virtualOut: f(liquidity),
+		},
+		{
+			name: "sell1", pair: &reversed,
+			in1: f(dex.CalcAmount1Delta(liquidity, p(0), p(100), false)), out1: f(dex.CalcAmount0Delta(liquidity, p(0), p(100), false)),
+			in2: f(dex.CalcAmount1Delta(l2, p(100), p(200), false)), out2: f(dex.CalcAmount0Delta(l2, p(100), p(200), false)),
+			virtualIn: f(liquidity), virtualOut: f(liquidity),
+		},
+	} {
+		check := func(amount, want float64) {
+			if got := strategies.QuoteLeg(c.pair, amount, 0.01); math.Abs(got-want) > 1e-9*want {
+				t.Errorf("%s(%f)=%f, want=%f", c.name, amount, got, want)
+			}
+		}
+		// 段内与虚拟储备量的恒定乘积一致
+		check(c.in1/2, c.virtualOut*c.in1/2/(c.virtualIn+c.in1/2))
+		// 跨过tick后按新的流动性继续报价
+		check(c.in1, c.out1)
+		check(c.in1+c.in2, c.out1+c.out2)
+		// 超出已知tick范围的部分不成交
+		check(c.in1+c.in2+100, c.out1+c.out2)
+	}
+
+	// 手续费从输入中扣除
+	withFee := pair
+	withFee.Fee = 0.003
+	if got, want := strategies.QuoteLeg(&withFee, 1000, 0.01), strategies.QuoteLeg(&pair, 997, 0.01); math.Abs(got-want) > 1e-9*want {
+		t.Errorf("fee quote=%f, want=%f", got, want)
+	}
+}
+
+// go test -v -run ^TestSelectBorrowPool$ github.com/xiangxn/listener/test
+func TestSelectBorrowPool(t *testing.T) {
+	// 已按手续费从低到高、流动性从高到低排序
+	candidates := []strategies.BorrowCandidate{
+		{Pool: "P1", Fee: 0.0001, Liquidity: 10},
+		{Pool: "P2", Fee: 0.0005, Liquidity: 1000},
+		{Pool: "P3", Fee: 0.003, Liquidity: 5000},
+		{Pool: "P4", Liquidity: -1},
+	}
+	for _, c := range []struct {
+		amount float64
+		pool   string
+	}{{5, "P1"}, {100, "P2"}, {2000, "P3"}, {10000, "P4"}} {
+		got, ok := strategies.SelectBorrowPool(candidates, c.amount)
+		if !ok || got.Pool != c.pool {
+			t.Fatalf("amount %f: got %s, want %s", c.amount, got.Pool, c.pool)
+		}
+	}
+	if _, ok := strategies.SelectBorrowPool(candidates[:3], 10000); ok {
+		t.Fatal("no pool can lend 10000")
+	}
+}
+
+// go test -v -run ^TestBorrowPoolFee$ github.com/xiangxn/listener/test
+func TestBorrowPoolFee(t *testing.T) {
+	dexs := []config.DexConfig{{Factory: "V2", Fee: 0.003}, {Factory: "SOLIDLY", Fee: 0.002, StableFee: 0.0001}}
+	for _, c := range []struct {
+		pool dt.SimplePool
+		fee  float64
+	}{
+		{dt.SimplePool{Factory: "V3", Params: &dt.PoolParams{Fee: 0.0005}}, 0.0005},
+		{dt.SimplePool{Factory: "V2", Params: &dt.PoolParams{}}, 0.003},
+		{dt.SimplePool{Factory: "V2"}, 0.003},
+		{dt.SimplePool{Factory: "SOLIDLY", Params: &dt.PoolParams{Stable: true}}, 0.0001},
+		{dt.SimplePool{Factory: "UNKNOWN"}, 0},
+	} {
+		if fee := strategies.BorrowPoolFee(c.pool, dexs); fee != c.fee {
+			t.Fatalf("%s: fee %f, want %f", c.pool.Factory, fee, c.fee)
+		}
+	}
+}
+
+// go test -v -run ^TestReverseFee$ github.com/xiangxn/listener/test
+func TestReverseFee(t *testing.T) {
+	// 按方向收费的池反向手续费可以为0
+	directional := dt.Pair{Fee: 0.003, Directional: true}
+	if fee := directional.ReverseFee(); fee != 0 {
+		t.Fatalf("directional reverse fee=%f, want 0", fee)
+	}
+	plain := dt.Pair{Fee: 0.003}
+	if fee := plain.ReverseFee(); fee != 0.003 {
+		t.Fatalf("plain reverse fee=%f, want 0.003", fee)
+	}
+}
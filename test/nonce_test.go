@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/xiangxn/listener/monitor"
+)
+
+// go test -v -run ^TestNonceManager$ github.com/xiangxn/listener/test
+func TestNonceManager(t *testing.T) {
+	account := common.HexToAddress("0x36F18e8B735592dE9A32A417e482e106eAa0C77A")
+	chainNonce, fetches := uint64(10), 0
+	n := monitor.NewNonceManager(func(ctx context.Context, a common.Address) (uint64, error) {
+		fetches++
+		return chainNonce, nil
+	})
+	ctx := context.Background()
+
+	// 并发分配的nonce不重复并且连续
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nonce, err := n.Next(ctx, account)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			seen[nonce] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	for nonce := uint64(10); nonce < 30; nonce++ {
+		if !seen[nonce] {
+			t.Fatalf("nonce %d not allocated", nonce)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("fetches: %d", fetches)
+	}
+
+	// 发送失败的nonce留下空缺, 下一次分配时复用
+	sendErr := errors.New("connection refused")
+	n.Done(account, 12, sendErr)
+	n.Done(account, 15, sendErr)
+	n.Done(account, 20, nil)
+	for _, want := range []uint64{12, 15, 30} {
+		if nonce, _ := n.Next(ctx, account); nonce != want {
+			t.Fatalf("nonce: %d, want: %d", nonce, want)
+		}
+	}
+	// 最后分配的nonce失败时直接回退
+	n.Done(account, 30, sendErr)
+	if nonce, _ := n.Next(ctx, account); nonce != 30 {
+		t.Fatalf("rollback nonce: %d", nonce)
+	}
+
+	// nonce错误时重新从链上同步
+	chainNonce = 40
+	n.Done(account, 30, errors.New("nonce too low: next nonce 40, tx nonce 30"))
+	if nonce, _ := n.Next(ctx, account); nonce != 40 || fetches != 2 {
+		t.Fatalf("resync nonce: %d, fetches: %d", nonce, fetches)
+	}
+	chainNonce = 45
+	n.Resync(account)
+	if nonce, _ := n.Next(ctx, account); nonce != 45 {
+		t.Fatalf("manual resync nonce: %d", nonce)
+	}
+
+	if !monitor.IsNonceError(errors.New("Replacement transaction underpriced")) || monitor.IsNonceError(sendErr) {
+		t.Fatal("IsNonceError")
+	}
+}
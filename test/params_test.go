@@ -8,6 +8,8 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/xiangxn/listener/monitor"
+	dt "github.com/xiangxn/listener/types"
 )
 
 // go test -v -run ^TestParams$ github.com/xiangxn/listener/test
@@ -41,3 +43,35 @@ func TestParams(t *testing.T) {
 	fmt.Println(hexutil.Encode(data))
 
 }
+
+// go test -v -run ^TestPackSwapMinProfit$ github.com/xiangxn/listener/test
+func TestPackSwapMinProfit(t *testing.T) {
+	params := dt.SwapParams{Deadline: 20254401, Position: 1, BuyType: 1, SellType: 2, BuyFee: 30, SellFee: 25}
+	minProfit, _ := new(big.Int).SetString("1500000000000000", 10)
+	data := monitor.PackSwap(params, big.NewInt(10000000), minProfit)
+	if len(data) != 196 {
+		t.Fatalf("calldata length: %d", len(data))
+	}
+	// 与合约相同的方式解出参数字
+	tmp := new(big.Int).SetBytes(data[164:196])
+	mask64 := new(big.Int).SetUint64(0xFFFFFFFFFFFFFFFF)
+	if got := new(big.Int).Rsh(tmp, 136); got.Cmp(minProfit) != 0 {
+		t.Fatalf("minProfit: %s", got)
+	}
+	if got := new(big.Int).And(new(big.Int).Rsh(tmp, 72), mask64); got.Uint64() != params.Deadline {
+		t.Fatalf("deadline: %s", got)
+	}
+	if got := new(big.Int).And(tmp, big.NewInt(0xFFFF)); got.Int64() != int64(params.SellFee) {
+		t.Fatalf("sellFee: %s", got)
+	}
+
+	params.Path = []dt.SwapLeg{{Pool: "0x11b815efB8f581194ae79006d24E0d814B7697F6", Type: 2, Fee: 5}}
+	data = monitor.PackSwapPath(params, big.NewInt(10000000), minProfit)
+	tmp = new(big.Int).SetBytes(data[100:132])
+	if got := new(big.Int).Rsh(tmp, 136); got.Cmp(minProfit) != 0 {
+		t.Fatalf("path minProfit: %s", got)
+	}
+	if got := new(big.Int).And(new(big.Int).Rsh(tmp, 72), mask64); got.Uint64() != params.Deadline {
+		t.Fatalf("path deadline: %s", got)
+	}
+}
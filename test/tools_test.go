@@ -1,11 +1,16 @@
 package main
 
 import (
+	"math"
 	"math/big"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/xiangxn/go-multicall"
 	"github.com/xiangxn/listener/dex"
 	"github.com/xiangxn/listener/tools"
+	dt "github.com/xiangxn/listener/types"
 )
 
 func TestTickToSqrtPriceQ96(t *testing.T) {
@@ -39,3 +44,314 @@ func TestCalcReserves(t *testing.T) {
 		t.Errorf("token1Reserve=%s, want=%s", token1Reserve, want1Reserve)
 	}
 }
+
+// go test -v -run ^TestGetAmountOutSolidly$ github.com/xiangxn/listener/test
+func TestGetAmountOutSolidly(t *testing.T) {
+	dec0 := tools.ParseBigInt("1000000", 10)
+	dec1 := tools.ParseBigInt("1000000000000000000", 10)
+	reserve0 := tools.Float64ToBigInt(1000000, 6)
+	reserve1 := tools.Float64ToBigInt(1000000, 18)
+	amountIn := tools.Float64ToBigInt(1000, 6)
+
+	// stable池在储备平衡时接近1:1兑换(扣除0.05%手续费)
+	out := dex.GetAmountOutSolidly(amountIn, reserve0, reserve1, dec0, dec1, true, true, 0.0005)
+	got := tools.BigIntToFloat64(out, 18)
+	if got < 999.4 || got > 999.5 {
+		t.Errorf("stable amountOut=%f, want≈999.5", got)
+	}
+	// volatile池与恒定乘积一致
+	out = dex.GetAmountOutSolidly(amountIn, reserve0, reserve1, dec0, dec1, true, false, 0.003)
+	want := tools.ParseBigInt("996006981039903216493", 10)
+	if out.Cmp(want) != 0 {
+		t.Errorf("volatile amountOut=%s, want=%s", out, want)
+	}
+}
+
+func TestDecodeAlgebraSwap(t *testing.T) {
+	integralAbi := tools.ReadABI("AlgebraIntegral")
+	v1Abi, _ := multicall.ParseABI(dex.ALGEBRA_SWAP_V1_ABI)
+	d := &dex.AlgebraIntegral{Dex: dex.Dex{Abi: integralAbi}}
+	sender := common.BytesToHash(common.HexToAddress("0x01").Bytes())
+	recipient := common.BytesToHash(common.HexToAddress("0x02").Bytes())
+	amount0, amount1 := big.NewInt(1000), big.NewInt(-990)
+	price, liquidity, tick := tools.ParseBigInt("79228162514264337593543950336", 10), big.NewInt(1e18), big.NewInt(-5)
+
+	// Integral v1.2+的事件带有手续费字段
+	data, err := integralAbi.Events["Swap"].Inputs.NonIndexed().Pack(amount0, amount1, price, liquidity, tick, big.NewInt(500), big.NewInt(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vLog := types.Log{Topics: []common.Hash{integralAbi.Events["Swap"].ID, sender, recipient}, Data: data}
+	event, err := dex.DecodeAlgebraSwap(vLog, *integralAbi)
+	if err != nil || event.Amount1.Cmp(amount1) != 0 || event.OverrideFee.Int64() != 500 || event.PluginFee.Int64() != 100 || event.Recipient != common.HexToAddress("0x02") {
+		t.Fatalf("integral event: %+v %v", event, err)
+	}
+	if !d.AcceptSwapLog(vLog) {
+		t.Fatal("integral swap should be accepted")
+	}
+
+	// V1/Integral v1.0的事件没有手续费字段
+	data, _ = v1Abi.Events["Swap"].Inputs.NonIndexed().Pack(amount0, amount1, price, liquidity, tick)
+	vLog = types.Log{Topics: []common.Hash{v1Abi.Events["Swap"].ID, sender, recipient}, Data: data}
+	event, err = dex.DecodeAlgebraSwap(vLog, *integralAbi)
+	if err != nil || event.Amount0.Cmp(amount0) != 0 || event.Tick.Cmp(tick) != 0 || event.OverrideFee.Sign() != 0 {
+		t.Fatalf("v1 event: %+v %v", event, err)
+	}
+	if topics := d.SwapTopics(); len(topics) != 2 || topics[1] != v1Abi.Events["Swap"].ID {
+		t.Fatalf("swap topics: %v", topics)
+	}
+
+	// 数据不完整或不是Swap事件时不接受
+	vLog.Data = vLog.Data[:64]
+	if d.AcceptSwapLog(vLog) {
+		t.Fatal("truncated event should be rejected")
+	}
+	if d.AcceptSwapLog(types.Log{Topics: []common.Hash{common.HexToHash("0x01")}}) {
+		t.Fatal("unknown topic should be rejected")
+	}
+}
+
+func TestGetAmountOutLB(t *testing.T) {
+	// id为2^23时价格为1
+	price, _ := dex.CalcPriceLB(dex.LB_REAL_ID_SHIFT, 25, 18, 18).Float64()
+	if price != 1 {
+		t.Errorf("price=%f, want=1", price)
+	}
+	state := &dex.LBState{
+		ActiveId: dex.LB_REAL_ID_SHIFT,
+		BinStep:  25,
+		Static:   dex.LBStaticFeeParameters{BaseFactor: 5000, FilterPeriod: 30, DecayPeriod: 600, ReductionFactor: 5000, VariableFeeControl: big.NewInt(0), MaxVolatilityAccumulator: big.NewInt(350000)},
+		Variable: dex.LBVariableFeeParameters{VolatilityAccumulator: big.NewInt(0), VolatilityReference: big.NewInt(0), IdReference: big.NewInt(dex.LB_REAL_ID_SHIFT), TimeOfLastUpdate: big.NewInt(100)},
+		Bins: map[uint32]dex.LBBin{
+			dex.LB_REAL_ID_SHIFT: {ReserveX: big.NewInt(0), ReserveY: tools.Float64ToBigInt(1000, 18)},
+		},
+		Timestamp: 100,
+	}
+	// 单个bin内成交, 扣除0.125%的基础手续费
+	out, left := dex.GetAmountOutLB(state, tools.Float64ToBigInt(1, 18), true)
+	want := tools.ParseBigInt("998750000000000000", 10)
+	if out.Cmp(want) != 0 || left.Sign() != 0 {
+		t.Errorf("amountOut=%s left=%s, want=%s", out, left, want)
+	}
+}
+
+func TestQuoteLB(t *testing.T) {
+	active := uint32(dex.LB_REAL_ID_SHIFT)
+	static := dex.LBStaticFeeParameters{BaseFactor: 5000, FilterPeriod: 30, DecayPeriod: 600, ReductionFactor: 5000, VariableFeeControl: big.NewInt(40000), MaxVolatilityAccumulator: big.NewInt(350000)}
+	variable := dex.LBVariableFeeParameters{VolatilityAccumulator: big.NewInt(20000), VolatilityReference: big.NewInt(10000), IdReference: big.NewInt(int64(active)), TimeOfLastUpdate: big.NewInt(100)}
+	curve := dex.NewLBCurve(active, 25, &static, &variable, 18, 18)
+	state := &dex.LBState{ActiveId: active, BinStep: 25, Static: static, Variable: variable, Timestamp: 100, Bins: make(map[uint32]dex.LBBin)}
+	for i := uint32(0); i <= 3; i++ {
+		curve.Bins = append(curve.Bins, dt.LBCurveBin{Id: active - i, ReserveY: 100}, dt.LBCurveBin{Id: active + i + 1, ReserveX: 100})
+		state.Bins[active-i] = dex.LBBin{ReserveX: big.NewInt(0), ReserveY: tools.Float64ToBigInt(100, 18)}
+		state.Bins[active+i+1] = dex.LBBin{ReserveX: tools.Float64ToBigInt(100, 18), ReserveY: big.NewInt(0)}
+	}
+	reversed := *curve
+	reversed.Reversed = true
+	for _, amount := range []float64{1, 150, 1000} {
+		// 跨过多个bin时与GetAmountOutLB一致, 超出已获取的bin的部分不成交
+		out, _ := dex.GetAmountOutLB(state, tools.Float64ToBigInt(amount, 18), true)
+		if got, want := dex.QuoteLB(curve, amount), tools.BigIntToFloat64(out, 18); math.Abs(got-want) > 1e-9 {
+			t.Errorf("sellX(%f)=%f, want=%f", amount, got, want)
+		}
+		out, _ = dex.GetAmountOutLB(state, tools.Float64ToBigInt(amount, 18), false)
+		if got, want := dex.QuoteLB(&reversed, amount), tools.BigIntToFloat64(out, 18); math.Abs(got-want) > 1e-9 {
+			t.Errorf("sellY(%f)=%f, want=%f", amount, got, want)
+		}
+	}
+}
+
+func TestLBSwapLog(t *testing.T) {
+	lbAbi := tools.ReadABI("LiquidityBook")
+	d := &dex.LiquidityBook{Dex: dex.Dex{Abi: lbAbi}}
+	pack := func(x, y int64) (packed [32]byte) {
+		big.NewInt(y).FillBytes(packed[:16])
+		big.NewInt(x).FillBytes(packed[16:])
+		return
+	}
+	if x, y := dex.DecodeLBAmounts(pack(5, 7)); x.Int64() != 5 || y.Int64() != 7 {
+		t.Fatalf("amounts: %s %s", x, y)
+	}
+	sender := common.BytesToHash(common.HexToAddress("0x01").Bytes())
+	to := common.BytesToHash(common.HexToAddress("0x02").Bytes())
+	swapLog := func(in, out [32]byte) types.Log {
+		data, err := lbAbi.Events["Swap"].Inputs.NonIndexed().Pack(big.NewInt(dex.LB_REAL_ID_SHIFT), in, out, big.NewInt(0), pack(1, 0), pack(0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return types.Log{Topics: []common.Hash{lbAbi.Events["Swap"].ID, sender, to}, Data: data}
+	}
+	if !d.AcceptSwapLog(swapLog(pack(1000, 0), pack(0, 990))) {
+		t.Fatal("swap should be accepted")
+	}
+	if d.AcceptSwapLog(swapLog(pack(1000, 0), pack(0, 0))) {
+		t.Fatal("swap without output should be rejected")
+	}
+	if d.AcceptSwapLog(types.Log{Topics: []common.Hash{common.HexToHash("0x01")}}) {
+		t.Fatal("unknown topic should be rejected")
+	}
+}
+
+func TestLBPairInformation(t *testing.T) {
+	factoryAbi, err := multicall.ParseABI(dex.LB_FACTORY_ABI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := common.HexToAddress("0xD446eb1660F766d533BeCeEf890Df7A69d26f7d1")
+	data, err := factoryAbi.Methods["getLBPairInformation"].Outputs.Pack(uint16(25), pair, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := multicall.Contract{ABI: factoryAbi, Address: common.HexToAddress("0x8e42f2F4101563bF679975178e880FD87d3eFd4e")}
+	call := contract.NewCall(new(dex.LBPairInformation), "getLBPairInformation", common.Address{}, common.Address{}, big.NewInt(25))
+	if err = call.Unpack(data); err != nil {
+		t.Fatal(err)
+	}
+	if info := call.Outputs.(*dex.LBPairInformation); info.BinStep != 25 || info.LBPair != pair {
+		t.Fatalf("pair information: %+v", info)
+	}
+}
+
+func TestQuerySellDODO(t *testing.T) {
+	state := &dex.PMMState{
+		I:  tools.Float64ToBigInt(2, 18),
+		K:  big.NewInt(0),
+		B:  tools.Float64ToBigInt(1000, 18),
+		Q:  tools.Float64ToBigInt(2000, 18),
+		B0: tools.Float64ToBigInt(1000, 18),
+		Q0: tools.Float64ToBigInt(2000, 18),
+		R:  big.NewInt(dex.DODO_R_ONE),
+	}
+	price, _ := dex.CalcPriceDODO(state, 18, 18).Float64()
+	if price != 2 {
+		t.Errorf("price=%f, want=2", price)
+	}
+	lpFee := tools.Float64ToBigInt(0.003, 18)
+	// k为0时按预言机价格成交
+	out := dex.QuerySellBase(state, tools.Float64ToBigInt(1, 18), lpFee, big.NewInt(0))
+	want := tools.ParseBigInt("1994000000000000000", 10)
+	if out.Cmp(want) != 0 {
+		t.Errorf("sellBase amountOut=%s, want=%s", out, want)
+	}
+	// k大于0时有滑点, 卖出quote得到的base少于按预言机价格计算的数量
+	state.K = tools.Float64ToBigInt(0.5, 18)
+	out = dex.QuerySellQuote(state, tools.Float64ToBigInt(20, 18), big.NewInt(0), big.NewInt(0))
+	got := tools.BigIntToFloat64(out, 18)
+	if got >= 10 || got < 9.9 {
+		t.Errorf("sellQuote amountOut=%f, want<10", got)
+	}
+}
+
+func TestDODOSwapLog(t *testing.T) {
+	dodoAbi := tools.ReadABI("DODO")
+	d := &dex.DODO{Dex: dex.Dex{Abi: dodoAbi}}
+	if topics := d.SwapTopics(); len(topics) != 1 || topics[0] != common.HexToHash("0xc2c0245e056d5fb095f04cd6373bc770802ebd1e6c918eb78fdef843cdb37b0f") {
+		t.Fatalf("swap topics: %v", topics)
+	}
+	base, quote := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	swapLog := func(from, to int64) types.Log {
+		data, err := dodoAbi.Events[dex.DODO_SWAP_NAME].Inputs.Pack(base, quote, big.NewInt(from), big.NewInt(to), common.HexToAddress("0x03"), common.HexToAddress("0x04"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return types.Log{Topics: []common.Hash{dodoAbi.Events[dex.DODO_SWAP_NAME].ID}, Data: data}
+	}
+	if !d.AcceptSwapLog(swapLog(1000, 1990)) {
+		t.Fatal("swap should be accepted")
+	}
+	if d.AcceptSwapLog(swapLog(1000, 0)) {
+		t.Fatal("swap without output should be rejected")
+	}
+	vLog := swapLog(1000, 1990)
+	vLog.Data = vLog.Data[:64]
+	if d.AcceptSwapLog(vLog) {
+		t.Fatal("truncated event should be rejected")
+	}
+}
+
+func TestCalcDepthDODO(t *testing.T) {
+	// k为1并且处于平衡状态时PMM曲线与储备量为B0/Q0的恒定乘积一致
+	state := &dex.PMMState{
+		I:  tools.Float64ToBigInt(2, 18),
+		K:  tools.Float64ToBigInt(1, 18),
+		B:  tools.Float64ToBigInt(1000, 18),
+		Q:  tools.Float64ToBigInt(2000, 18),
+		B0: tools.Float64ToBigInt(1000, 18),
+		Q0: tools.Float64ToBigInt(2000, 18),
+		R:  big.NewInt(dex.DODO_R_ONE),
+	}
+	depth0, depth1 := dex.CalcDepthDODO(state, 0.01)
+	for i, c := range []struct {
+		depth *big.Int
+		want  float64
+	}{{depth0, dex.CalcDepthV2(1000, 0.01)}, {depth1, dex.CalcDepthV2(2000, 0.01)}} {
+		if got := tools.BigIntToFloat64(c.depth, 18); math.Abs(got-c.want) > 1e-5*c.want {
+			t.Errorf("depth%d=%f, want=%f", i, got, c.want)
+		}
+	}
+}
+
+func TestCalcDepthV3(t *testing.T) {
+	liquidity := tools.Float64ToBigInt(1000, 18)
+	state := &dt.ConcentratedState{SqrtPriceX96: dex.Q96, Tick: 0, Liquidity: liquidity, TickSpacing: 10}
+	// 价格为1且没有跨tick时与相同储备量的恒定乘积池一致
+	depth0, depth1 := dex.CalcDepthV3(state, nil, 0.01)
+	want := dex.CalcDepthV2(1000, 0.01)
+	for _, d := range []*big.Int{depth0, depth1} {
+		got := tools.BigIntToFloat64(d, 18)
+		if math.Abs(got-want) > 1e-6 {
+			t.Errorf("depth=%f, want=%f", got, want)
+		}
+	}
+	// 在tick -50处移除全部流动性后, 卖出token0的深度只到tick -50
+	depth0, _ = dex.CalcDepthV3(state, map[int32]*big.Int{-50: liquidity}, 0.01)
+	limit := tools.BigIntToFloat64(dex.CalcAmount0Delta(liquidity, dex.TickToSqrtPriceQ96(-50), dex.Q96, false), 18)
+	if got := tools.BigIntToFloat64(depth0, 18); math.Abs(got-limit) > 1e-9 || got >= want {
+		t.Errorf("depth0=%f, want=%f", got, limit)
+	}
+	pair := dt.Pair{Price: 2, Depth0: dex.CalcDepthV2(100, 0.01), Depth1: dex.CalcDepthV2(200, 0.01)}
+	if r := pair.DepthReserve0(0.01); math.Abs(r-100) > 1e-9 {
+		t.Errorf("DepthReserve0=%f, want=100", r)
+	}
+}
+
+func TestCalcDepthLB(t *testing.T) {
+	// binStep为25时1%的价格影响可以跨过4个bin, 第5个bin不计入深度
+	active := uint32(dex.LB_REAL_ID_SHIFT)
+	bins := map[uint32]dex.LBBin{active: {ReserveX: tools.Float64ToBigInt(100, 18), ReserveY: tools.Float64ToBigInt(100, 18)}}
+	for i := uint32(1); i <= 5; i++ {
+		bins[active-i] = dex.LBBin{ReserveX: big.NewInt(0), ReserveY: tools.Float64ToBigInt(100, 18)}
+		bins[active+i] = dex.LBBin{ReserveX: tools.Float64ToBigInt(100, 18), ReserveY: big.NewInt(0)}
+	}
+	depth0, depth1 := dex.CalcDepthLB(active, 25, bins, 0.01)
+	want := 100 * (math.Pow(1.0025, 5) - 1) / 0.0025
+	for _, depth := range []*big.Int{depth0, depth1} {
+		if got := tools.BigIntToFloat64(depth, 18); math.Abs(got-want) > 1e-9*want {
+			t.Errorf("depth=%f, want=%f", got, want)
+		}
+	}
+}
+
+func TestComputePoolAddress(t *testing.T) {
+	usdc := "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"
+	weth := "0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2"
+	// Uniswap V2 USDC/WETH
+	pool := dt.SimplePool{Token0: usdc, Token1: weth}
+	salt, _ := (&dex.UniswapV2{}).PoolSalt(&pool)
+	got := dex.ComputePoolAddress(common.HexToAddress("0x5C69bEe701ef814a2B6a3EDD4B1652CB9cc5aA6f"), salt,
+		common.HexToHash("0x96e8ac4277198ff8b6f785478aa9a39f403cb768dd02cbee326c3e7da348845f"))
+	if got != common.HexToAddress("0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc") {
+		t.Errorf("UniswapV2 pool=%s", got.Hex())
+	}
+	// Uniswap V3 USDC/WETH 0.05%
+	pool.Params = &dt.PoolParams{Fee: 0.0005, TickSpacing: 10}
+	salt, ok := (&dex.UniswapV3{}).PoolSalt(&pool)
+	if !ok {
+		t.Fatal("UniswapV3 PoolSalt failed")
+	}
+	got = dex.ComputePoolAddress(common.HexToAddress("0x1F98431c8aD98523631AE4a59f267346ea31F984"), salt,
+		common.HexToHash("0xe34f199b19b2b4f47f68442619d555527d244f78a3297ea89325f843f87b8b54"))
+	if got != common.HexToAddress("0x88e6A0c2dDD26FEEb64F039a2c41296FcB3f5640") {
+		t.Errorf("UniswapV3 pool=%s", got.Hex())
+	}
+}
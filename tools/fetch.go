@@ -5,10 +5,12 @@ import (
 	"sync"
 
 	"github.com/elliotchance/pie/v2"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/xiangxn/go-multicall"
 )
 
-func ConcurrentMulticall(mc *multicall.Caller, calls []*multicall.Call, chunkLength int, maxConcurrent int) (results []*multicall.Call, err error) {
+// 分组并发执行multicall, opts为nil时读取最新区块
+func ConcurrentMulticall(mc *multicall.Caller, opts *bind.CallOpts, calls []*multicall.Call, chunkLength int, maxConcurrent int) (results []*multicall.Call, err error) {
 	type task struct {
 		Index int
 		Mcs   []*multicall.Call
@@ -23,7 +25,7 @@ func ConcurrentMulticall(mc *multicall.Caller, calls []*multicall.Call, chunkLen
 		wg.Add(1)
 		go func(muc *multicall.Caller, cs []*multicall.Call, index int) {
 			defer wg.Done()
-			result, err := muc.Call(nil, cs...)
+			result, err := muc.Call(opts, cs...)
 			t := task{Index: index, Mcs: result, Err: err}
 			if err != nil {
 				fmt.Printf("ConcurrentMulticall [%d] error: %s \n", index, err.Error())
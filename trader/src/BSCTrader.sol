@@ -13,6 +13,10 @@ import "pancake-v3-contracts/v3-core/contracts/interfaces/callback/IPancakeV3Fla
 import "pancake-v3-contracts/v3-core/contracts/interfaces/callback/IPancakeV3SwapCallback.sol";
 import "pancake-v3-contracts/v3-core/contracts/interfaces/IPancakeV3Pool.sol";
 import "./interfaces/IAlgebraSwapCallback.sol";
+import "./interfaces/ISolidlyV2Pair.sol";
+import "./interfaces/ILBPair.sol";
+import "./interfaces/IDODOV2.sol";
+import "./interfaces/IAavePool.sol";
 
 contract BSCTrader is
     Ownable,
@@ -31,10 +35,34 @@ contract BSCTrader is
         address baseToken;
         address borrowPool;
         uint256 amount;
-        uint16 buyPoolType; //池类型：1是UniswapV2,2是UniswapV3,3是PancakeV3,4是Algebra,5是SolidlyV3
+        uint16 buyPoolType; //池类型：1是UniswapV2,2是UniswapV3,3是PancakeV3,4是Algebra,5是SolidlyV3,6是SolidlyV2,7是LiquidityBook,8是DODO
         uint16 sellPoolType;
         uint16 buyPoolFee; //1e4
         uint16 sellPoolFee; //1e4
+        uint256 minProfit; // 最小利润(base token)
+    }
+
+    // 多跳交易的参数
+    struct SwapPathData {
+        address baseToken;
+        address borrowPool;
+        uint256 amount;
+        uint256 minProfit; // 最小利润(base token)
+        // 每一步: 低160位为池地址, 160位起16位为池类型, 176位起16位为手续费(1e4)
+        uint256[] legs;
+    }
+
+    // 清算的参数
+    struct LiquidationData {
+        address aavePool;
+        address user; // 被清算的借款人
+        address collateral;
+        address debt; // 偿还的债务token, 也是利润的token
+        address borrowPool;
+        uint256 amount; // 偿还的债务数量
+        // 卖出抵押品的池: 低160位为池地址, 160位起16位为池类型, 176位起16位为手续费(1e4)
+        uint256 sellLeg;
+        uint256 minProfit; // 最小利润(debt token)
     }
 
     struct SwapCallbackData {
@@ -52,6 +80,10 @@ contract BSCTrader is
 
     bool private hasBorrow = false;
 
+    bool private pathBorrow = false;
+
+    bool private liquidationBorrow = false;
+
     constructor() Ownable(msg.sender) {}
 
     function withdraw(address token) external onlyOwner {
@@ -62,6 +94,21 @@ contract BSCTrader is
         }
     }
 
+    // 从合约中转出指定数量的token到to, 用于提取利润
+    function withdraw(address token, address to, uint256 amount) external onlyOwner {
+        require(token != address(0) && to != address(0), "W");
+        TransferHelper.safeTransfer(token, to, amount);
+    }
+
+    // 调整库存: 在指定池中卖出tokenIn, 得到的数量不能少于minOut
+    function rebalance(address pool, uint16 poolType, uint16 fee, address tokenIn, uint256 amount, uint256 minOut)
+        external
+        onlyOwner
+    {
+        (uint256 amountOut,) = _swapLeg(pool, poolType, fee, tokenIn, amount);
+        require(amountOut >= minOut, "R");
+    }
+
     function balances(address token) private view returns (uint256) {
         (bool success, bytes memory data) =
             token.staticcall(abi.encodeWithSelector(IERC20Minimal.balanceOf.selector, address(this)));
@@ -106,6 +153,7 @@ contract BSCTrader is
             mstore(add(data, 0xc0), and(shr(32, tmp), 0xFFFF))
             mstore(add(data, 0xe0), and(shr(16, tmp), 0xFFFF))
             mstore(add(data, 0x100), and(tmp, 0xFFFF))
+            mstore(add(data, 0x120), shr(136, tmp))
         }
 
         require(block.number <= deadline, "D");
@@ -120,7 +168,82 @@ contract BSCTrader is
         } else {
             _swap(data);
             uint256 balanceAfter = balances(data.baseToken);
-            require(balanceAfter >= balanceBefore, "E");
+            require(balanceAfter >= balanceBefore.add(data.minProfit), "E");
+        }
+    }
+
+    // 多跳路径中的池与数量都由调用者指定, 只能由owner调用
+    function swapPath() external onlyOwner {
+        SwapPathData memory data;
+        uint256 deadline; //过期块号
+        uint8 borrow; //如果需要借贷，false表示借token0,true表示借token1
+        uint256 count; //交易步数
+        assembly {
+            let tmp := calldataload(100)
+            count := and(tmp, 0xFF)
+            if iszero(eq(calldatasize(), add(132, mul(count, 32)))) { revert(0, 0) }
+            mstore(data, calldataload(4))
+            mstore(add(data, 0x20), calldataload(36))
+            mstore(add(data, 0x40), calldataload(68))
+            mstore(add(data, 0x60), shr(136, tmp))
+            deadline := and(shr(72, tmp), 0xFFFFFFFFFFFFFFFF)
+            borrow := and(shr(64, tmp), 0xFF)
+        }
+        data.legs = new uint256[](count);
+        for (uint256 i = 0; i < count; i++) {
+            data.legs[i] = uint256(bytes32(msg.data[132 + i * 32:164 + i * 32]));
+        }
+
+        require(block.number <= deadline, "D");
+
+        uint256 balanceBefore = balances(data.baseToken);
+        // 如果余额太少,就借入token完成交易
+        if (data.amount > balanceBefore) {
+            hasBorrow = true;
+            pathBorrow = true;
+            (uint256 a0, uint256 a1) = borrow == 0 ? (data.amount, uint256(0)) : (uint256(0), data.amount);
+            IPancakeV3Pool(data.borrowPool).flash(address(this), a0, a1, abi.encode(data));
+        } else {
+            _swapPath(data);
+            uint256 balanceAfter = balances(data.baseToken);
+            require(balanceAfter >= balanceBefore.add(data.minProfit), "E");
+        }
+    }
+
+    // 清算Aave V3的借款人: 偿还债务得到抵押品, 再在指定池中把抵押品卖回债务token
+    // 会授权aavePool使用合约的资金, 所以只能由owner调用
+    function liquidate() external onlyOwner {
+        LiquidationData memory data;
+        uint256 deadline; //过期块号
+        uint8 borrow; //如果需要借贷，false表示借token0,true表示借token1
+        assembly {
+            if iszero(eq(calldatasize(), 260)) { revert(0, 0) }
+            mstore(data, calldataload(4))
+            mstore(add(data, 0x20), calldataload(36))
+            mstore(add(data, 0x40), calldataload(68))
+            mstore(add(data, 0x60), calldataload(100))
+            mstore(add(data, 0x80), calldataload(132))
+            mstore(add(data, 0xa0), calldataload(164))
+            mstore(add(data, 0xc0), calldataload(196))
+            let tmp := calldataload(228)
+            mstore(add(data, 0xe0), shr(136, tmp))
+            deadline := and(shr(72, tmp), 0xFFFFFFFFFFFFFFFF)
+            borrow := and(shr(64, tmp), 0xFF)
+        }
+
+        require(block.number <= deadline, "D");
+
+        uint256 balanceBefore = balances(data.debt);
+        // 如果余额太少,就借入债务token完成清算
+        if (data.amount > balanceBefore) {
+            hasBorrow = true;
+            liquidationBorrow = true;
+            (uint256 a0, uint256 a1) = borrow == 0 ? (data.amount, uint256(0)) : (uint256(0), data.amount);
+            IPancakeV3Pool(data.borrowPool).flash(address(this), a0, a1, abi.encode(data));
+        } else {
+            _liquidate(data);
+            uint256 balanceAfter = balances(data.debt);
+            require(balanceAfter >= balanceBefore.add(data.minProfit), "E");
         }
     }
 
@@ -156,6 +279,96 @@ contract BSCTrader is
         pool.swap(amount0Out, amount1Out, address(this), new bytes(0));
     }
 
+    function swapSolidlyV2(ISolidlyV2Pair pool, uint256 amount, address token, address token0)
+        private
+        returns (uint256 amountOut)
+    {
+        amountOut = pool.getAmountOut(amount, token);
+        (uint256 amount0Out, uint256 amount1Out) = token == token0 ? (uint256(0), amountOut) : (amountOut, uint256(0));
+        TransferHelper.safeTransfer(token, address(pool), amount);
+        pool.swap(amount0Out, amount1Out, address(this), new bytes(0));
+    }
+
+    function swapLiquidityBook(ILBPair pool, uint256 amount, address token, address tokenX)
+        private
+        returns (uint256 amountOut)
+    {
+        bool swapForY = token == tokenX;
+        TransferHelper.safeTransfer(token, address(pool), amount);
+        bytes32 amountsOut = pool.swap(swapForY, address(this));
+        amountOut = swapForY ? uint256(amountsOut) >> 128 : uint256(uint128(uint256(amountsOut)));
+    }
+
+    function swapDODO(IDODOV2 pool, uint256 amount, address token, address baseToken)
+        private
+        returns (uint256 amountOut)
+    {
+        TransferHelper.safeTransfer(token, address(pool), amount);
+        amountOut = token == baseToken ? pool.sellBase(address(this)) : pool.sellQuote(address(this));
+    }
+
+    // 在pool中卖出amount个tokenIn, 返回得到的token和数量
+    function _swapLeg(address pool, uint16 poolType, uint16 fee, address tokenIn, uint256 amount)
+        private
+        returns (uint256 amountOut, address tokenOut)
+    {
+        if (poolType == 7) {
+            ILBPair lb = ILBPair(pool);
+            address tokenX = lb.getTokenX();
+            tokenOut = tokenIn == tokenX ? lb.getTokenY() : tokenX;
+            amountOut = swapLiquidityBook(lb, amount, tokenIn, tokenX);
+        } else if (poolType == 8) {
+            IDODOV2 dodo = IDODOV2(pool);
+            address baseToken = dodo._BASE_TOKEN_();
+            tokenOut = tokenIn == baseToken ? dodo._QUOTE_TOKEN_() : baseToken;
+            amountOut = swapDODO(dodo, amount, tokenIn, baseToken);
+        } else {
+            address token0 = IUniswapV2Pair(pool).token0();
+            address token1 = IUniswapV2Pair(pool).token1();
+            tokenOut = tokenIn == token0 ? token1 : token0;
+            if (poolType == 1) {
+                amountOut = swapUniswapV2(IUniswapV2Pair(pool), amount, tokenIn, token0, fee);
+            } else if (poolType == 6) {
+                amountOut = swapSolidlyV2(ISolidlyV2Pair(pool), amount, tokenIn, token0);
+            } else {
+                amountOut = swapUniswapV3(IUniswapV3Pool(pool), amount.toInt256(), tokenIn, token0, token1, poolType);
+            }
+        }
+    }
+
+    // 从baseToken开始依次完成每一步交易, 最后必须回到baseToken
+    function _swapPath(SwapPathData memory data) private {
+        address token = data.baseToken;
+        uint256 amount = data.amount;
+        for (uint256 i = 0; i < data.legs.length; i++) {
+            uint256 leg = data.legs[i];
+            (amount, token) = _swapLeg(address(uint160(leg)), uint16(leg >> 160), uint16(leg >> 176), token, amount);
+        }
+        require(token == data.baseToken, "P");
+    }
+
+    // 偿还债务并卖出得到的抵押品(只卖出本次得到的数量)
+    function _liquidate(LiquidationData memory data) private {
+        uint256 collateralBefore = balances(data.collateral);
+        approve(data.debt, data.aavePool, data.amount);
+        IAavePool(data.aavePool).liquidationCall(data.collateral, data.debt, data.user, data.amount, false);
+        // 清算池可能只使用了部分授权
+        approve(data.debt, data.aavePool, 0);
+        uint256 seized = balances(data.collateral).sub(collateralBefore);
+        require(seized > 0, "L");
+        (, address tokenOut) = _swapLeg(
+            address(uint160(data.sellLeg)), uint16(data.sellLeg >> 160), uint16(data.sellLeg >> 176), data.collateral, seized
+        );
+        require(tokenOut == data.debt, "P");
+    }
+
+    // 兼容approve没有返回值的token(如USDT)
+    function approve(address token, address spender, uint256 amount) private {
+        (bool success, bytes memory ret) =
+            token.call(abi.encodeWithSelector(IERC20Minimal.approve.selector, spender, amount));
+        require(success && (ret.length == 0 || abi.decode(ret, (bool))), "SA");
+    }
+
     function _swap(SwapParamsData memory data) private {
         // 先在sellPool卖出baseTokena
         uint256 amountOut;
@@ -163,6 +376,18 @@ contract BSCTrader is
             IUniswapV2Pair pool = IUniswapV2Pair(data.sellPool);
             address token0 = pool.token0();
             amountOut = swapUniswapV2(pool, data.amount, data.baseToken, token0, data.sellPoolFee);
+        } else if (data.sellPoolType == 6) {
+            ISolidlyV2Pair pool = ISolidlyV2Pair(data.sellPool);
+            address token0 = pool.token0();
+            amountOut = swapSolidlyV2(pool, data.amount, data.baseToken, token0);
+        } else if (data.sellPoolType == 7) {
+            ILBPair pool = ILBPair(data.sellPool);
+            address tokenX = pool.getTokenX();
+            amountOut = swapLiquidityBook(pool, data.amount, data.baseToken, tokenX);
+        } else if (data.sellPoolType == 8) {
+            IDODOV2 pool = IDODOV2(data.sellPool);
+            address baseToken = pool._BASE_TOKEN_();
+            amountOut = swapDODO(pool, data.amount, data.baseToken, baseToken);
         } else {
             IUniswapV3Pool pool = IUniswapV3Pool(data.sellPool);
             address token0 = pool.token0();
@@ -176,6 +401,21 @@ contract BSCTrader is
             address token0 = pool.token0();
             address token1 = pool.token1();
             swapUniswapV2(pool, amountOut, data.baseToken == token0 ? token1 : token0, token0, data.buyPoolFee);
+        } else if (data.buyPoolType == 6) {
+            ISolidlyV2Pair pool = ISolidlyV2Pair(data.buyPool);
+            address token0 = pool.token0();
+            address token1 = pool.token1();
+            swapSolidlyV2(pool, amountOut, data.baseToken == token0 ? token1 : token0, token0);
+        } else if (data.buyPoolType == 7) {
+            ILBPair pool = ILBPair(data.buyPool);
+            address tokenX = pool.getTokenX();
+            address tokenY = pool.getTokenY();
+            swapLiquidityBook(pool, amountOut, data.baseToken == tokenX ? tokenY : tokenX, tokenX);
+        } else if (data.buyPoolType == 8) {
+            IDODOV2 pool = IDODOV2(data.buyPool);
+            address baseToken = pool._BASE_TOKEN_();
+            address quoteToken = pool._QUOTE_TOKEN_();
+            swapDODO(pool, amountOut, data.baseToken == baseToken ? quoteToken : baseToken, baseToken);
         } else {
             IUniswapV3Pool pool = IUniswapV3Pool(data.buyPool);
             address token0 = pool.token0();
@@ -187,12 +427,20 @@ contract BSCTrader is
     }
 
     function pancakeV3FlashCallback(uint256 fee0, uint256 fee1, bytes calldata data) external override {
+        if (pathBorrow) {
+            flashPath(fee0 > 0 ? fee0 : fee1, data);
+            return;
+        }
+        if (liquidationBorrow) {
+            flashLiquidation(fee0 > 0 ? fee0 : fee1, data);
+            return;
+        }
         SwapParamsData memory decoded = abi.decode(data, (SwapParamsData));
         require(hasBorrow && msg.sender == decoded.borrowPool, "EP");
         uint256 balanceBefore = balances(decoded.baseToken);
         _swap(decoded);
         uint256 balanceAfter = balances(decoded.baseToken);
-        require(balanceAfter >= balanceBefore, "E");
+        require(balanceAfter >= balanceBefore.add(decoded.minProfit), "E");
         uint256 amountMin = LowGasSafeMath.add(decoded.amount, fee0 > 0 ? fee0 : fee1);
         if (amountMin > 0) {
             TransferHelper.safeTransfer(decoded.baseToken, msg.sender, amountMin);
@@ -200,6 +448,38 @@ contract BSCTrader is
         hasBorrow = false;
     }
 
+    // 多跳交易的闪电贷回调
+    function flashPath(uint256 fee, bytes calldata data) private {
+        SwapPathData memory decoded = abi.decode(data, (SwapPathData));
+        require(hasBorrow && msg.sender == decoded.borrowPool, "EP");
+        uint256 balanceBefore = balances(decoded.baseToken);
+        _swapPath(decoded);
+        uint256 balanceAfter = balances(decoded.baseToken);
+        require(balanceAfter >= balanceBefore.add(decoded.minProfit), "E");
+        uint256 amountMin = LowGasSafeMath.add(decoded.amount, fee);
+        if (amountMin > 0) {
+            TransferHelper.safeTransfer(decoded.baseToken, msg.sender, amountMin);
+        }
+        hasBorrow = false;
+        pathBorrow = false;
+    }
+
+    // 清算的闪电贷回调
+    function flashLiquidation(uint256 fee, bytes calldata data) private {
+        LiquidationData memory decoded = abi.decode(data, (LiquidationData));
+        require(hasBorrow && msg.sender == decoded.borrowPool, "EP");
+        uint256 balanceBefore = balances(decoded.debt);
+        _liquidate(decoded);
+        uint256 balanceAfter = balances(decoded.debt);
+        require(balanceAfter >= balanceBefore.add(decoded.minProfit), "E");
+        uint256 amountMin = LowGasSafeMath.add(decoded.amount, fee);
+        if (amountMin > 0) {
+            TransferHelper.safeTransfer(decoded.debt, msg.sender, amountMin);
+        }
+        hasBorrow = false;
+        liquidationBorrow = false;
+    }
+
     function uniswapV3SwapCallback(int256 amount0Delta, int256 amount1Delta, bytes calldata data) external override {
         v3SwapCallback(amount0Delta, amount1Delta, data);
     }
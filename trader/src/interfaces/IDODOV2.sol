@@ -0,0 +1,11 @@
+// SPDX-License-Identifier: MIT
+pragma solidity >=0.5.0;
+
+/// @title DODO V2 PMM pool (DVM / DSP / DPP)
+/// @notice Tokens must be sent to the pool before calling sellBase/sellQuote
+interface IDODOV2 {
+    function _BASE_TOKEN_() external view returns (address);
+    function _QUOTE_TOKEN_() external view returns (address);
+    function sellBase(address to) external returns (uint256 receiveQuoteAmount);
+    function sellQuote(address to) external returns (uint256 receiveBaseAmount);
+}
@@ -0,0 +1,10 @@
+// SPDX-License-Identifier: MIT
+pragma solidity >=0.5.0;
+
+/// @title Trader Joe Liquidity Book v2.1 pair
+/// @notice Tokens must be sent to the pair before calling swap, amounts are packed as (y << 128) | x
+interface ILBPair {
+    function getTokenX() external view returns (address);
+    function getTokenY() external view returns (address);
+    function swap(bool swapForY, address to) external returns (bytes32 amountsOut);
+}
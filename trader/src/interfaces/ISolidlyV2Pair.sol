@@ -0,0 +1,11 @@
+// SPDX-License-Identifier: MIT
+pragma solidity >=0.5.0;
+
+/// @title Solidly V2 style pair (Velodrome V2 / Aerodrome V2 / Thena V1)
+/// @notice Stable pairs use the x3y+y3x curve, so the output amount must be quoted by the pair itself
+interface ISolidlyV2Pair {
+    function token0() external view returns (address);
+    function token1() external view returns (address);
+    function getAmountOut(uint256 amountIn, address tokenIn) external view returns (uint256);
+    function swap(uint256 amount0Out, uint256 amount1Out, address to, bytes calldata data) external;
+}
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: UNLICENSED
+pragma solidity ^0.8.13;
+
+import {Test, console2} from "forge-std/Test.sol";
+import {Trader} from "../src/Trader.sol";
+import {IERC20} from "forge-std/interfaces/IERC20.sol";
+
+interface IAaveV3Pool {
+    function supply(address asset, uint256 amount, address onBehalfOf, uint16 referralCode) external;
+    function borrow(address asset, uint256 amount, uint256 interestRateMode, uint16 referralCode, address onBehalfOf)
+        external;
+    function getUserAccountData(address user)
+        external
+        view
+        returns (uint256, uint256, uint256, uint256, uint256, uint256 healthFactor);
+}
+
+interface IAaveOracle {
+    function getAssetPrice(address asset) external view returns (uint256);
+}
+
+contract LiquidationTest is Test {
+    string MAINNET_RPC_URL = vm.rpcUrl("mainnet");
+
+    uint256 mainnetFork;
+
+    address testAddress = address(0x36F18e8B735592dE9A32A417e482e106eAa0C77A);
+    address borrower = address(0xB0B);
+    address wethAddress = address(0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2);
+    address usdcAddress = address(0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48);
+    address aavePool = address(0x87870Bca3F3fD6335C3F4ce8392D69350B4fA4E2);
+    address aaveOracle = address(0x54586bE62E3c3580375aE3723C145253060Ca0C2);
+    // 借入USDC的池(USDC/ETH 0.05%), 卖出WETH的池(UniswapV2 USDC/WETH)
+    address borrowPool = address(0x88e6A0c2dDD26FEEb64F039a2c41296FcB3f5640);
+    address sellPool = address(0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc);
+
+    function setUp() public {
+        mainnetFork = vm.createFork(MAINNET_RPC_URL, 20332763);
+    }
+
+    // forge test --match-test test_Liquidate -vvvv
+    function test_Liquidate() public {
+        vm.selectFork(mainnetFork);
+        vm.deal(testAddress, 1 ether);
+        vm.startPrank(testAddress);
+        Trader trader = new Trader();
+        vm.stopPrank();
+
+        // 借款人存入10 WETH并借出USDC
+        uint256 ethPrice = IAaveOracle(aaveOracle).getAssetPrice(wethAddress);
+        deal(wethAddress, borrower, 10 ether);
+        vm.startPrank(borrower);
+        IERC20(wethAddress).approve(aavePool, 10 ether);
+        IAaveV3Pool(aavePool).supply(wethAddress, 10 ether, borrower, 0);
+        uint256 debt = ethPrice * 10 * 70 / 100 / 100; // 8位价格换算成6位USDC, 借出价值的70%
+        IAaveV3Pool(aavePool).borrow(usdcAddress, debt, 2, 0, borrower);
+        vm.stopPrank();
+
+        // 把预言机中的ETH价格下调20%, 使仓位可以清算
+        vm.mockCall(
+            aaveOracle,
+            abi.encodeWithSelector(IAaveOracle.getAssetPrice.selector, wethAddress),
+            abi.encode(ethPrice * 80 / 100)
+        );
+        (,,,,, uint256 healthFactor) = IAaveV3Pool(aavePool).getUserAccountData(borrower);
+        assertLt(healthFactor, 1e18, "position is not liquidatable");
+
+        // 合约没有USDC, 偿还一半债务需要闪电贷(USDC是token0)
+        uint256 amount = debt / 2;
+        uint256 deadline = block.number;
+        uint256 sellLeg = uint256(uint160(sellPool)) | (1 << 160) | (30 << 176);
+        uint256 tmp = (deadline << 72) | (uint256(0) << 64);
+        bytes memory data = abi.encodePacked(
+            bytes4(keccak256("liquidate()")),
+            abi.encode(aavePool, borrower, wethAddress, usdcAddress, borrowPool, amount, sellLeg, tmp)
+        );
+        assertEq(data.length, 260);
+
+        vm.startPrank(testAddress);
+        (bool success,) = address(trader).call(data);
+        assertTrue(success, "Call to liquidate failed");
+        vm.stopPrank();
+
+        uint256 balance = IERC20(usdcAddress).balanceOf(address(trader));
+        console2.log(balance);
+        assertGt(balance, 0, "no profit");
+    }
+}
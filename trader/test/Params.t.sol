@@ -28,6 +28,7 @@ contract CallDataC {
             mstore(add(data, 0xc0), and(shr(32, tmp), 0xFFFF))
             mstore(add(data, 0xe0), and(shr(16, tmp), 0xFFFF))
             mstore(add(data, 0x100), and(tmp, 0xFFFF))
+            mstore(add(data, 0x120), shr(136, tmp))
         }
     }
 }
@@ -41,8 +42,8 @@ contract ParamsTest is Test {
 
     // forge test --match-test test_swapParams -vvvv
     function test_swapParams() public {
-        uint256 a = 40725374; //deadline
-        a = a << 72;
+        uint256 a = uint256(1e15) << 136; //minProfit
+        a = a | (uint256(40725374) << 72); //deadline
         a = a | (1 << 64); // 借token1
         a = a | (1 << 48); //buyPoolType
         a = a | (3 << 32); //sellPoolType
@@ -71,6 +72,7 @@ contract ParamsTest is Test {
         assertEq(data.buyPoolFee, 25);
         assertEq(data.sellPoolFee, 30);
         assertEq(borrow, 1);
+        assertEq(data.minProfit, 1e15);
     }
 }
 
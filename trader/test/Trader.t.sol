@@ -108,6 +108,30 @@ contract TraderTest is Test {
         trader.withdraw(address(0));
     }
 
+    // forge test --match-test test_WithdrawTo -vvvv
+    function test_WithdrawTo() public {
+        vm.selectFork(mainnetFork);
+        vm.startPrank(testAddress);
+        Trader trader = new Trader(); // 部署新合约
+        vm.stopPrank();
+
+        IERC20 token = IERC20(baseAddress);
+        vm.startPrank(richAddress);
+        token.transfer(address(trader), 1 ether);
+        vm.stopPrank();
+
+        // 只转出指定数量, 剩余的留在合约中
+        address treasury = address(0xBEEF);
+        vm.prank(testAddress);
+        trader.withdraw(baseAddress, treasury, 0.4 ether);
+        assertEq(token.balanceOf(treasury), 0.4 ether, "Treasury balance is incorrect");
+        assertEq(token.balanceOf(address(trader)), 0.6 ether, "Trader balance is incorrect");
+
+        // 不是owner时不能提取
+        vm.expectRevert();
+        trader.withdraw(baseAddress, treasury, 0.1 ether);
+    }
+
     // forge test --match-test test_Swap -vvvv
     function test_Swap() public {
         vm.selectFork(mainnetFork2);
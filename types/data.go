@@ -1,19 +1,34 @@
 package types
 
-import "time"
+import (
+	"math"
+	"math/big"
+	"time"
+)
 
 type Pool struct {
-	Factory string `bson:"factory"`
-	Token0  Token  `bson:"token0"`
-	Token1  Token  `bson:"token1"`
-	Address string `bson:"address"`
+	Factory string      `bson:"factory"`
+	Token0  Token       `bson:"token0"`
+	Token1  Token       `bson:"token1"`
+	Address string      `bson:"address"`
+	Params  *PoolParams `bson:"params,omitempty"`
 }
 
 type SimplePool struct {
-	Factory string `bson:"factory"`
-	Token0  string `bson:"token0"`
-	Token1  string `bson:"token1"`
-	Address string `bson:"address"`
+	Factory string      `bson:"factory"`
+	Token0  string      `bson:"token0"`
+	Token1  string      `bson:"token1"`
+	Address string      `bson:"address"`
+	Params  *PoolParams `bson:"params,omitempty"`
+}
+
+// 池创建后不会改变的参数, 发现新池时获取一次并存入数据库
+// 为nil时表示还未获取
+type PoolParams struct {
+	// 固定的手续费档位(如UniswapV3的fee)
+	Fee         float64 `bson:"fee,omitempty"`
+	TickSpacing int32   `bson:"tickSpacing,omitempty"`
+	Stable      bool    `bson:"stable,omitempty"`
 }
 
 type Token struct {
@@ -35,7 +50,107 @@ type Pair struct {
 	Token1      string  `bson:"token1"`
 	DexName     string  `bson:"dexName"`
 	Fee         float64 `bson:"fee"`
+	// 按方向收费的池为true, 此时Fee是token0换token1方向的手续费, Fee1是token1换token0方向的手续费(可以为0)
+	Directional bool    `bson:"directional,omitempty"`
+	Fee1        float64 `bson:"fee1,omitempty"`
 	UpdateTimes int32   `bson:"updateTimes,omitempty"`
+	// 价格影响不超过DepthImpact时最多可卖入池中的token0/token1数量
+	Depth0 float64 `bson:"depth0"`
+	Depth1 float64 `bson:"depth1"`
+	// 报价使用的曲线类型
+	Curve uint8 `bson:"curve,omitempty"`
+	// 集中流动性池计算深度用的状态, 不存储
+	State *ConcentratedState `bson:"-"`
+	// DODO池的PMM曲线参数, 用于按PMM曲线报价
+	PMM *PMMCurve `bson:"pmm,omitempty"`
+	// LiquidityBook池的bin与手续费参数, 用于按bin报价
+	LB *LBCurve `bson:"lb,omitempty"`
+	// 集中流动性池的流动性与已初始化的tick, 用于按tick报价
+	Ticks *TickCurve `bson:"ticks,omitempty"`
+}
+
+const (
+	// 恒定乘积x*y=k, 按储备量报价
+	CURVE_CONSTANT_PRODUCT uint8 = iota
+	// 集中流动性, 按tick逐段报价, 没有tick数据时在深度范围内按虚拟储备量报价
+	CURVE_CONCENTRATED
+	// Solidly的stable池x³y+xy³=k
+	CURVE_STABLE
+	// DODO的PMM曲线, 按PMM参数报价
+	CURVE_PMM
+	// LiquidityBook, 按bin逐个报价
+	CURVE_LIQUIDITY_BOOK
+)
+
+// DODO PMM曲线参数, 数量已按小数位调整, I为以quote表示的base价格, R与合约中的R状态相同
+// 交易对交换币种后Reversed为true, 此时卖出Token0表示卖出quote
+type PMMCurve struct {
+	I        float64 `bson:"i"`
+	K        float64 `bson:"k"`
+	B        float64 `bson:"b"`
+	Q        float64 `bson:"q"`
+	B0       float64 `bson:"b0"`
+	Q0       float64 `bson:"q0"`
+	R        uint8   `bson:"r"`
+	Reversed bool    `bson:"-"`
+}
+
+// LiquidityBook池的报价状态, 数量已按小数位调整, 手续费参数与池合约的getStaticFeeParameters/getVariableFeeParameters相同
+// 交易对交换币种后Reversed为true, 此时卖出Token0表示卖出tokenY
+type LBCurve struct {
+	ActiveId                 uint32 `bson:"activeId"`
+	BinStep                  uint16 `bson:"binStep"`
+	Decimals0                uint64 `bson:"decimals0"`
+	Decimals1                uint64 `bson:"decimals1"`
+	BaseFactor               uint16 `bson:"baseFactor"`
+	FilterPeriod             uint16 `bson:"filterPeriod"`
+	DecayPeriod              uint16 `bson:"decayPeriod"`
+	ReductionFactor          uint16 `bson:"reductionFactor"`
+	VariableFeeControl       uint64 `bson:"variableFeeControl"`
+	MaxVolatilityAccumulator uint64 `bson:"maxVolatilityAccumulator"`
+	VolatilityAccumulator    uint64 `bson:"volatilityAccumulator"`
+	VolatilityReference      uint64 `bson:"volatilityReference"`
+	IdReference              uint64 `bson:"idReference"`
+	TimeOfLastUpdate         uint64 `bson:"timeOfLastUpdate"`
+	// 深度范围内的bin, 为空时还没有获取
+	Bins     []LBCurveBin `bson:"bins,omitempty"`
+	Reversed bool         `bson:"-"`
+}
+
+type LBCurveBin struct {
+	Id       uint32  `bson:"id"`
+	ReserveX float64 `bson:"reserveX"`
+	ReserveY float64 `bson:"reserveY"`
+}
+
+// 集中流动性池的报价状态, 价格与流动性已按小数位调整: SqrtPrice²为价格, 段内token0数量为Liquidity/SqrtPrice, token1数量为Liquidity*SqrtPrice
+// Ticks为Lower与Upper(sqrtPrice)之间已初始化的tick, 超出这个范围的流动性未知
+// 交易对交换币种后Reversed为true, 此时卖出Token0表示卖出token1
+type TickCurve struct {
+	Tick      int32           `bson:"tick"`
+	SqrtPrice float64         `bson:"sqrtPrice"`
+	Liquidity float64         `bson:"liquidity"`
+	Lower     float64         `bson:"lower"`
+	Upper     float64         `bson:"upper"`
+	Ticks     []TickCurveStep `bson:"ticks,omitempty"`
+	Reversed  bool            `bson:"-"`
+}
+
+type TickCurveStep struct {
+	Tick         int32   `bson:"tick"`
+	SqrtPrice    float64 `bson:"sqrtPrice"`
+	LiquidityNet float64 `bson:"liquidityNet"`
+}
+
+type ConcentratedState struct {
+	SqrtPriceX96 *big.Int
+	Tick         int32
+	Liquidity    *big.Int
+	TickSpacing  int32
+	// 是否使用Uniswap V3的tickBitmap记录已初始化的tick
+	TickBitmap bool
+	Decimals0  uint64
+	Decimals1  uint64
 }
 
 type Pairs []*Pair
@@ -50,6 +165,34 @@ type Arbitrage struct {
 	Borrow      string
 	Position    uint8
 	BaseToken   string
+	// 闪电贷手续费率
+	BorrowFee float64
+	// 多跳套利的每一步(已对齐为卖出Token0买入Token1), 为空时是BuyPool与SellPool两个池的套利
+	Legs []Pair
+	// 发现套利的策略名称
+	Strategy string
+	// 预估使用的gas
+	Gas int64
+	// 清算的参数, 不为nil时是清算: BaseToken为债务token, Amount为偿还的债务数量, 在SellPool中卖出抵押品
+	Liquidation *LiquidationParams
+}
+
+// token1换token0方向的手续费
+func (p *Pair) ReverseFee() float64 {
+	if p.Directional {
+		return p.Fee1
+	}
+	return p.Fee
+}
+
+// 由深度换算成等效的恒定乘积储备量(token0数量), 用于比较不同类型池的流动性
+// 对恒定乘积池结果约等于Reserve0
+func (p *Pair) DepthReserve0(impact float64) float64 {
+	if p.Price <= 0 || impact <= 0 || impact >= 1 {
+		return 0
+	}
+	depth := min(p.Depth0, p.Depth1/p.Price)
+	return depth / (1/math.Sqrt(1-impact) - 1)
 }
 
 func (p Pairs) Len() int           { return len(p) }
@@ -65,6 +208,76 @@ func (p Pool) Equal(y Pool) bool {
 	return p.Address == y.Address
 }
 
+// 工厂地址与CREATE2计算结果不一致的池
+type SpoofedPool struct {
+	Address   string    `bson:"address"`
+	Factory   string    `bson:"factory"`
+	Token0    string    `bson:"token0"`
+	Token1    string    `bson:"token1"`
+	Expected  string    `bson:"expected"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// 交易的gas出价, 价格单位与gas_price相同
+type GasBid struct {
+	BaseFee     float64 `bson:"base_fee"`
+	PriorityFee float64 `bson:"priority_fee"`
+	// 非EIP1559交易的gas price
+	GasPrice float64 `bson:"gas_price"`
+	// EIP1559交易的GasFeeCap
+	FeeCap float64 `bson:"fee_cap"`
+	Reason string  `bson:"reason"`
+	// 提高到最低优先费后gas成本超过毛利润, 不应发送交易
+	Unprofitable bool `bson:"unprofitable,omitempty"`
+}
+
+// 发送交易前eth_call预检的结果
+type Preflight struct {
+	BuyPool    string    `bson:"buy_pool"`
+	SellPool   string    `bson:"sell_pool"`
+	Path       []string  `bson:"path,omitempty"`
+	BaseToken  string    `bson:"base_token"`
+	Amount     float64   `bson:"amount"`
+	EventBlock uint64    `bson:"event_block"`
+	Decision   string    `bson:"decision"`
+	Gas        uint64    `bson:"gas,omitempty"`
+	Error      string    `bson:"error,omitempty"`
+	CreatedAt  time.Time `bson:"created_at"`
+}
+
+const (
+	PREFLIGHT_SEND   = "send"   // 预检通过
+	PREFLIGHT_RESIZE = "resize" // 减小数量后重新预检
+	PREFLIGHT_ABORT  = "abort"  // 放弃交易
+)
+
+// 与我们的交易竞争同一组池的其他套利交易
+type Competitor struct {
+	Tx          string `bson:"tx"`
+	BlockNumber uint64 `bson:"block_number"`
+	// 交易在区块中的位置
+	Position uint   `bson:"position"`
+	From     string `bson:"from"`
+	To       string `bson:"to"`
+	// 交易中发生swap的池
+	Pools []string `bson:"pools"`
+	// 我们交易的池组合(买入池/卖出池或多跳路径), 用于按池组合统计
+	PairKey string `bson:"pair_key"`
+	// 获得利润的token与数量
+	Token       string  `bson:"token"`
+	Profit      float64 `bson:"profit"`
+	ProfitUSD   float64 `bson:"profit_usd"`
+	GasPrice    uint64  `bson:"gas_price"`
+	PriorityFee uint64  `bson:"priority_fee"`
+	GasUsed     uint64  `bson:"gas_used"`
+	// 被竞争的我们的交易, 不在同一区块时OurPosition为-1
+	OurTx       string `bson:"our_tx"`
+	OurPosition int    `bson:"our_position"`
+	OurError    string `bson:"our_error,omitempty"`
+	// 我们的交易创建时间, 用于按时间查询
+	CreatedAt time.Time `bson:"created_at"`
+}
+
 type Transaction struct {
 	Tx         string    `bson:"tx"`
 	Ok         bool      `bson:"ok"`
@@ -78,6 +291,26 @@ type Transaction struct {
 	GasPrice   uint64    `bson:"gas_price"`
 	BaseToken  string    `bson:"base_token"`
 	EventBlock uint64    `bson:"event_block"`
+	Path       []string  `bson:"path,omitempty"`
+	Bid        *GasBid   `bson:"bid,omitempty"`
 	CreatedAt  time.Time `bson:"created_at"`
 	Error      string    `bson:"error"`
+	// 清算交易的借款人
+	Borrower string `bson:"borrower,omitempty"`
+	// 发送地址、nonce与截止区块, 用于处理超过截止区块仍未打包的交易
+	From     string `bson:"from,omitempty"`
+	Nonce    uint64 `bson:"nonce"`
+	Deadline uint64 `bson:"deadline,omitempty"`
+	// 没有被正常打包时的结果, 见TX_STATUS_*
+	Status string `bson:"status,omitempty"`
+	// 最后一次发送的取消交易
+	CancelTx       string  `bson:"cancel_tx,omitempty"`
+	CancelBid      *GasBid `bson:"cancel_bid,omitempty"`
+	CancelBlock    uint64  `bson:"cancel_block,omitempty"`
+	CancelAttempts int     `bson:"cancel_attempts,omitempty"`
 }
+
+const (
+	TX_STATUS_CANCELLED = "cancelled" // 被同nonce的取消交易替换
+	TX_STATUS_DROPPED   = "dropped"   // 没有被打包并且已不在交易池中
+)
@@ -5,7 +5,9 @@ import (
 	"math/big"
 	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/sirupsen/logrus"
 	"github.com/xiangxn/go-multicall"
@@ -23,11 +25,26 @@ type IActions interface {
 	GetPools(poolAddrs []string) (existingPool []string)
 	GetPoolsByTokens(tokens []string) (pools []Pool)
 	SavePools(pools []interface{}) error
+	UpdatePoolParams(addr string, params *PoolParams)
+	SaveSpoofedPool(pool SpoofedPool)
+	SavePreflight(preflight Preflight)
+	// 保存竞争者的套利交易, 同一笔交易对同一笔我们的交易只保存一次
+	SaveCompetitor(competitor Competitor)
+	// 获取我们的交易创建时间在[start, end)内的竞争者记录
+	GetCompetitors(start time.Time, end time.Time) []Competitor
 	SaveTokens(docs []interface{}) error
 	GetExistingTokens(tokens []string) (existingToken []string)
 	GetPairsByTokens(tokens []string) (pairs Pairs)
+	// 获取包含任意一个给定token的交易对
+	GetPairsWithTokens(tokens []string) (pairs Pairs)
+	// 获取指定池的交易对
+	GetPairs(pools []string) (pairs Pairs)
 	GetTransactions(ok bool, confirm bool) (txs []Transaction)
 	UpdateTransaction(hash string, confirm bool, gasUsed, gasPrice uint64, income float64, ok bool, err string)
+	// 记录为卡住的交易发送的取消交易
+	SetCancelTransaction(hash, cancelTx string, bid GasBid, blockNumber uint64)
+	// 把没有被打包的交易标记为已取消或已丢弃, gasUsed与gasPrice为取消交易的消耗
+	CloseTransaction(hash, status string, gasUsed, gasPrice uint64)
 	GetToken(addr string) Token
 	GetGas(buyPool, sellPool string) (min, max int64)
 	GetFailTransacttionCount(buyPool, sellPool string) int
@@ -35,8 +52,10 @@ type IActions interface {
 
 	//查询Transacttion
 	SearchTransacttion(simulation bool, start time.Time, end time.Time) (txs []Transaction)
-	//获取指定baseToken的平均价格(1base=Nquote)
+	//获取指定baseToken的价格(1base=Nquote)
 	GetBasePrice(baseToken, quoteToken string) (price float64)
+	// 设置价格预言机的当前区块
+	SetBlockNumber(blockNumber uint64)
 }
 
 type IMonitor interface {
@@ -51,6 +70,8 @@ type IMonitor interface {
 	Logger() logrus.FieldLogger
 	DB() IActions
 	Multicall() *multicall.Caller
+	// 读取价格等链上状态时使用的调用参数, 为nil时读取最新区块(回测时为历史区块)
+	CallOpts() *bind.CallOpts
 	Config() *config.Configuration
 	//添加新的token黑名单,并保存到json文件
 	AddTokenBlacklist(addr string)
@@ -64,11 +85,27 @@ type IMonitor interface {
 	SendToTG(msg string)
 	//更新指定池价格,并返回带价格的池信息
 	UpdatePrice(pools []Pool) (blockNumber uint64)
+	// 只查询指定池的价格, 不保存也不更新监控的状态, 策略中使用
+	QueryPairs(pools []Pool) (pairs []Pair)
 	// 调用合约发起套利,并保存交易hash后续验证结果
 	DoSwap(params SwapParams)
 	GetUseGas(buyPool, sellPool *Pair, amount float64) int64
+	// 套利合约中baseToken的余额
+	GetBaseBalance(baseToken string) float64
 
 	TestEvent(eventPool SimplePool, blockNumber uint64)
+	// 获取指定工厂对应交易所的池参数接口, 工厂不受支持时返回nil
+	GetPoolParams(factory string) IPoolParams
+}
+
+// 获取池创建后不会改变的参数
+type IPoolParams interface {
+	// 创建查询池参数的Call, 没有需要缓存的参数时返回nil
+	CreateParamsCall(pool *SimplePool) []*multicall.Call
+	// 根据链上数据设置pool.Params, 失败时返回false
+	SetParams(calls []*multicall.Call, pool *SimplePool) bool
+	// 计算CREATE2地址使用的salt(需要pool.Params), 不支持验证时返回false
+	PoolSalt(pool *SimplePool) ([]byte, bool)
 }
 
 // EventHandler 事件业务句柄
@@ -84,3 +121,17 @@ type EventHandler interface {
 	// Do 处理命中的事件
 	Do(monitor IMonitor, arbitrage *Arbitrage)
 }
+
+// 一个事件可以得到多个套利的策略(如同时运行多个策略), 所有套利交给调度统一去除冲突
+type ArbitragesHandler interface {
+	CalcArbitrages(monitor IMonitor, event SimplePool, blockNumber uint64, gasPrice float64) (arbitrages []*Arbitrage)
+}
+
+// 需要订阅交易池事件之外的事件的策略(如借贷协议的事件)
+type LogHandler interface {
+	// 额外订阅的合约地址与事件topic
+	LogFilter() (addresses []common.Address, topics []common.Hash)
+	// 每批事件处理时调用, logs为本批中匹配LogFilter的事件(可能为空), blockNumber为事件所在区块
+	// 返回的套利与交易池事件的套利一起调度
+	HandleLogs(monitor IMonitor, logs []ethtypes.Log, blockNumber uint64, gasPrice float64) (arbitrages []*Arbitrage)
+}
@@ -29,6 +29,30 @@ type SwapParams struct {
 	Borrow      string
 	Position    uint8
 	BaseToken   string
+	// 预估的USD净利润与gas, 用于gas出价
+	ProfitUSD float64
+	Gas       int64
+	// 合约要求的最小利润(baseToken数量), 低于该值时交易回滚
+	MinProfit float64
+	// 多跳交易的路径, 从BaseToken开始依次交易, 不为空时忽略BuyPool与SellPool的类型和手续费
+	Path []SwapLeg
+	// 清算交易的参数, 不为nil时调用liquidate(): BaseToken为债务token, Amount为偿还的债务数量,
+	// 在SellPool中卖出得到的抵押品, 不使用BuyPool
+	Liquidation *LiquidationParams
+	// 按新的数量重新报价, 返回预估的USD净利润与合约要求的最小利润, 预检减小数量时使用; 为nil时不能减小数量
+	Requote func(amount float64) (profitUSD, minProfit float64)
+}
+
+type LiquidationParams struct {
+	AavePool   string
+	User       string
+	Collateral string
+}
+
+type SwapLeg struct {
+	Pool string
+	Type uint8
+	Fee  uint16
 }
 
 type Options struct {
@@ -53,6 +77,10 @@ type ResBigInt struct {
 	*big.Int
 }
 
+type ResBool struct {
+	Value bool
+}
+
 type ResHash struct {
 	common.Hash
 }